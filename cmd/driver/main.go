@@ -1,30 +1,94 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"log/slog"
+	"math"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/go-logr/logr"
 	"github.com/ktsakalozos/my-csi-driver/pkg/metrics"
 	"github.com/ktsakalozos/my-csi-driver/pkg/rawfile"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	klog "k8s.io/klog/v2"
 )
 
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.gitCommit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
 var (
 	endpoint        = flag.String("endpoint", "unix:///var/lib/kubelet/plugins/my-csi-driver/csi.sock", "CSI endpoint")
 	nodeID          = flag.String("nodeid", "", "node id")
 	driverName      = flag.String("drivername", "my-csi-driver", "name of the driver")
-	workingMountDir = flag.String("working-mount-dir", "/var/lib/my-csi-driver", "directory for image files backing the volumes")
+	workingMountDir = flag.String("working-mount-dir", "/var/lib/my-csi-driver", "directory for image files backing the volumes; a comma separated list spreads new volumes over several disks by free space")
 	mode            = flag.String("mode", "both", "driver mode: controller | node | both")
 	metricsPort     = flag.Int("metrics-port", 9898, "port for prometheus metrics endpoint")
+	metricsAddress  = flag.String("metrics-bind-address", "", "host or IP the metrics endpoint listens on, e.g. 127.0.0.1 (default: all interfaces)")
+	metricsTLSCert  = flag.String("metrics-tls-cert", "", "PEM certificate file; with --metrics-tls-key, serves the metrics endpoint over HTTPS")
+	metricsTLSKey   = flag.String("metrics-tls-key", "", "PEM private key file for --metrics-tls-cert")
+	volumeIOStats   = flag.Bool("enable-volume-io-metrics", false, "export read/write byte and request counters per volume from /proc/diskstats of its loop device")
+	enablePprof     = flag.Bool("enable-pprof", false, "serve net/http/pprof profiles under /debug/pprof/ on the metrics port")
 	standaloneMode  = flag.Bool("standalone", false, "run without Kubernetes API (for testing only)")
+	registerDriver  = flag.Bool("register-csidriver", false, "create or update the CSIDriver object for --drivername on startup (no-op with --standalone)")
+	enableAttach    = flag.Bool("enable-attach", false, "advertise PUBLISH_UNPUBLISH_VOLUME and record attachments on PersistentVolumes, for clusters that expect the external-attacher and VolumeAttachment objects")
+	enableEphemeral = flag.Bool("enable-ephemeral", false, "advertise the Ephemeral lifecycle mode in the registered CSIDriver so pods can declare inline volumes")
+	volumeQoS       = flag.Bool("enable-volume-qos", false, "apply the iopsLimit and bandwidthLimit of VolumeAttributesClasses: the controller advertises MODIFY_VOLUME and the node throttles loop devices through cgroup v2 io.max")
+	qosCgroup       = flag.String("qos-cgroup", rawfile.DefaultQoSCgroup, "cgroup v2 directory containing the pods, whose io.max holds the limits of --enable-volume-qos")
+	minVolumeSize   = flag.String("min-volume-size", "", "minimum size of a provisioned volume, e.g. 1Mi (default: no minimum)")
+	maxVolumeSize   = flag.String("max-volume-size", "", "maximum size of a provisioned volume, e.g. 100Gi (default: no maximum)")
+	sizeRounding    = flag.String("size-rounding", rawfile.SizeRoundingExact, "size of new filesystem volumes: exact makes the backing file the requested size, up pads it by the estimated filesystem overhead so the usable space covers the request")
+	allowedTopos    = flag.String("allowed-topologies", "", "comma separated nodes new volumes may be placed on; CreateVolume fails with ResourceExhausted when a request permits none of them (default: every node)")
+	topologyPolicy  = flag.String("topology-policy", rawfile.TopologyPolicyFirst, "how CreateVolume picks among the permitted topologies: first keeps the provisioner's preference, random and least-loaded spread volumes of StorageClasses with Immediate binding")
+	reservedBytes   = flag.String("reserved-capacity-bytes", "", "free space kept on the backing filesystem, e.g. 10Gi; excluded from reported capacity and enforced when creating backing files (default: no reserve)")
+	gcGracePeriod   = flag.Duration("gc-grace-period", rawfile.DefaultGCGracePeriod, "minimum age of an orphaned backing file before the garbage collector deletes it")
+	gcMaxOrphans    = flag.Float64("gc-max-orphan-ratio", rawfile.DefaultGCMaxOrphanRatio, "largest fraction of the backing files one garbage collection pass may reclaim before it aborts (1 disables the check)")
+	gcInterval      = flag.Duration("gc-interval", rawfile.DefaultGCInterval, "how often the node garbage collector scans for orphaned backing files")
+	gcDisabled      = flag.Bool("gc-disabled", false, "disable the node garbage collector, e.g. when cleanup is managed externally")
+	gcOnce          = flag.Bool("gc-once", false, "run the garbage collector over the backing directories once, print the orphaned backing files it reclaimed and exit instead of serving CSI")
+	gcDryRun        = flag.Bool("gc-dry-run", false, "with --gc-once, only print the orphaned backing files that would be reclaimed")
+	loopReconcile   = flag.Duration("loop-device-reconcile-interval", rawfile.DefaultLoopDeviceReconcileInterval, "how often the node looks for loop devices left attached to deleted or unused backing files (0 disables it)")
+	detachLeaked    = flag.Bool("detach-leaked-loop-devices", false, "detach the leaked loop devices the reconciler finds instead of only reporting them")
+	checkNode       = flag.Bool("check-node", false, "check the node prerequisites (tools, loop devices, writable backing directories), print a pass/fail report and exit, non-zero on failure")
+	preflight       = flag.Bool("preflight", false, "check the node prerequisites at startup of the node plugin and exit if a required one is missing")
+	capacityReport  = flag.Duration("capacity-report-interval", 0, "how often the node plugin publishes the free space of its backing directories on its Node, for CreateVolume and GetCapacity to use (0 disables)")
+	capacityPublish = flag.Bool("enable-capacity-publishing", false, "have the controller maintain CSIStorageCapacity objects for every storage class of the driver and node with a current capacity report (see --capacity-report-interval)")
+	capacityNS      = flag.String("capacity-namespace", "", "namespace of the CSIStorageCapacity objects published with --enable-capacity-publishing")
+	onDeletePolicy  = flag.String("default-ondelete-policy", rawfile.OnDeletePolicyDelete, "what the garbage collector does with orphaned backing files: delete | retain")
+	maxVolumes      = flag.Int64("max-volumes-per-node", 0, "maximum number of volumes the scheduler may place on a node and of loop devices attached before staging fails (0 means the loop module's max_loop, or no limit when it is unset)")
+	fsckOnMount     = flag.Bool("fsck-on-mount", false, "check already formatted volumes with fsck -p (ext), xfs_repair -n or btrfs check before mounting them, failing on unrecoverable corruption")
+	defaultFsType   = flag.String("default-fstype", "ext4", "filesystem for volumes whose capability and storage class name no fsType: ext3 | ext4 | xfs | btrfs")
+	publishTimeout  = flag.Duration("node-publish-timeout", rawfile.DefaultNodePublishTimeout, "how long staging or publishing a volume may take before losetup, mkfs or mount is killed and the call fails with DeadlineExceeded (0 means no limit)")
+	mountPerms      = flag.String("mount-permissions", "0", "octal permission bits for staging/target directories and the mounted filesystem root, e.g. 0770 (0 keeps the default 0750)")
+	backingDirPerms = flag.String("backing-dir-permissions", "0", "octal permission bits applied to the backing directories at startup, e.g. 0770 (0 creates missing directories with 0750 and leaves existing ones alone)")
+	backingDirUID   = flag.Int("backing-dir-uid", -1, "user ID that owns the backing directories, set at startup (-1 keeps the current owner)")
+	backingDirGID   = flag.Int("backing-dir-gid", -1, "group ID of the backing directories, set at startup (-1 keeps the current group)")
+	removeArchived  = flag.Bool("remove-archived-volume-path", false, "with the retain policy, replace an existing archive of the same volume instead of skipping it")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 25*time.Second, "how long to wait for in-flight CSI calls to finish on SIGTERM/SIGINT before forcing the gRPC server to stop")
+	logFormat       = flag.String("log-format", "text", "log output format: text | json")
+	logOmitContext  = flag.Bool("log-omit-volume-context", false, "mask volume context values, such as backing file paths and secret names, in logged CSI requests and responses")
+	volStatsCache   = flag.Int("vol-stats-cache-expire-in-minutes", 1, "how long volume stats metrics are cached between scrapes, in minutes (0 disables caching)")
 )
 
 func main() {
 	klog.InitFlags(nil)
 	_ = flag.Set("logtostderr", "true")
 	flag.Parse()
+	setupLogging(*logFormat)
+	klog.Infof("my-csi-driver version %s (commit %s, built %s)", version, gitCommit, buildDate)
 	if *nodeID == "" {
 		// Backwards compatibility fallback: try NODE_NAME env (typical Downward API) then hostname
 		if envNode := os.Getenv("NODE_NAME"); envNode != "" {
@@ -70,27 +134,326 @@ func handle() {
 		}
 	}
 
+	// A comma separated list places new backing files on the directory with
+	// the most free space; the first one is where CreateVolume points
+	backingDirs := splitBackingDirs(backingDir)
+	backingDir = backingDirs[0]
+
+	if err := rawfile.ValidateDriverName(*driverName); err != nil {
+		klog.Fatalf("Invalid --drivername: %v", err)
+	}
+	if err := rawfile.ValidateEndpoint(*endpoint); err != nil {
+		klog.Fatalf("Invalid --endpoint: %v", err)
+	}
+	if *gcInterval <= 0 {
+		klog.Fatalf("Invalid --gc-interval %v: must be positive", *gcInterval)
+	}
+	if *gcMaxOrphans <= 0 || *gcMaxOrphans > 1 {
+		klog.Fatalf("Invalid --gc-max-orphan-ratio %v: must be above 0 and at most 1", *gcMaxOrphans)
+	}
+	if *capacityReport < 0 {
+		klog.Fatalf("Invalid --capacity-report-interval %v: must not be negative", *capacityReport)
+	}
+	if *capacityPublish && *capacityNS == "" {
+		klog.Fatalf("--enable-capacity-publishing requires --capacity-namespace")
+	}
+	if *publishTimeout < 0 {
+		klog.Fatalf("Invalid --node-publish-timeout %v: must not be negative", *publishTimeout)
+	}
+	if *loopReconcile < 0 {
+		klog.Fatalf("Invalid --loop-device-reconcile-interval %v: must not be negative", *loopReconcile)
+	}
+	if *maxVolumes < 0 {
+		klog.Fatalf("Invalid --max-volumes-per-node %d: must not be negative", *maxVolumes)
+	}
+	if *sizeRounding != rawfile.SizeRoundingExact && *sizeRounding != rawfile.SizeRoundingUp {
+		klog.Fatalf("Invalid --size-rounding %q: must be %q or %q", *sizeRounding, rawfile.SizeRoundingExact, rawfile.SizeRoundingUp)
+	}
+	switch *topologyPolicy {
+	case rawfile.TopologyPolicyFirst, rawfile.TopologyPolicyRandom, rawfile.TopologyPolicyLeastLoaded:
+	default:
+		klog.Fatalf("Invalid --topology-policy %q: must be %q, %q or %q", *topologyPolicy, rawfile.TopologyPolicyFirst, rawfile.TopologyPolicyRandom, rawfile.TopologyPolicyLeastLoaded)
+	}
+	if *onDeletePolicy != rawfile.OnDeletePolicyDelete && *onDeletePolicy != rawfile.OnDeletePolicyRetain {
+		klog.Fatalf("Invalid --default-ondelete-policy %q: must be %q or %q", *onDeletePolicy, rawfile.OnDeletePolicyDelete, rawfile.OnDeletePolicyRetain)
+	}
+	if err := rawfile.ValidateFsType(*defaultFsType); err != nil {
+		klog.Fatalf("Invalid --default-fstype: %v", err)
+	}
+	if *backingDirUID < -1 || *backingDirGID < -1 {
+		klog.Fatalf("Invalid backing directory owner %d:%d: IDs must not be negative, or -1 to keep the current one", *backingDirUID, *backingDirGID)
+	}
+	if (*metricsTLSCert == "") != (*metricsTLSKey == "") {
+		klog.Fatalf("Invalid metrics TLS configuration: --metrics-tls-cert and --metrics-tls-key must be set together")
+	}
+
+	driverOptions := rawfile.DriverOptions{
+		Version:                      version,
+		GitCommit:                    gitCommit,
+		BuildDate:                    buildDate,
+		NodeID:                       *nodeID,
+		DriverName:                   *driverName,
+		Endpoint:                     *endpoint,
+		BackingDir:                   backingDir,
+		ExtraBackingDirs:             backingDirs[1:],
+		Mode:                         *mode,
+		VolStatsCacheExpireInMinutes: *volStatsCache,
+		MinVolumeSize:                parseSize("min-volume-size", *minVolumeSize),
+		MaxVolumeSize:                parseSize("max-volume-size", *maxVolumeSize),
+		ReservedCapacity:             parseSize("reserved-capacity-bytes", *reservedBytes),
+		GCGracePeriod:                *gcGracePeriod,
+		GCMaxOrphanRatio:             *gcMaxOrphans,
+		EnableVolumeQoS:              *volumeQoS,
+		QoSCgroup:                    *qosCgroup,
+		GCInterval:                   *gcInterval,
+		GCDisabled:                   *gcDisabled,
+		LoopDeviceReconcileInterval:  *loopReconcile,
+		DetachLeakedLoopDevices:      *detachLeaked,
+		CapacityReportInterval:       *capacityReport,
+		EnableCapacityPublishing:     *capacityPublish,
+		CapacityNamespace:            *capacityNS,
+		EnableAttach:                 *enableAttach,
+		DefaultOnDeletePolicy:        *onDeletePolicy,
+		SizeRounding:                 *sizeRounding,
+		AllowedTopologies:            splitAllowedTopologies(*allowedTopos),
+		TopologyPolicy:               *topologyPolicy,
+		RemoveArchivedVolumePath:     *removeArchived,
+		MountPermissions:             parsePermissions("mount-permissions", *mountPerms),
+		BackingDirPermissions:        parsePermissions("backing-dir-permissions", *backingDirPerms),
+		BackingDirUID:                *backingDirUID,
+		BackingDirGID:                *backingDirGID,
+		MaxVolumesPerNode:            *maxVolumes,
+		FsckOnMount:                  *fsckOnMount,
+		DefaultFsType:                *defaultFsType,
+		NodePublishTimeout:           *publishTimeout,
+		LogOmitVolumeContext:         *logOmitContext,
+		Clientset:                    clientset,
+	}
+
+	if *gcOnce {
+		os.Exit(garbageCollectOnce(&driverOptions, *gcDryRun))
+	}
+	if *checkNode {
+		os.Exit(checkNodeOnce(&driverOptions))
+	}
+	if *registerDriver {
+		// Most CSIDriver fields are immutable on older clusters, so a drifted
+		// object may need deleting by hand; keep serving with it meanwhile
+		if err := rawfile.RegisterCSIDriver(context.Background(), clientset, *driverName, *enableAttach, *enableEphemeral); err != nil {
+			klog.Warningf("Failed to register CSIDriver: %v", err)
+		}
+	}
+	if *gcDryRun {
+		klog.Warningf("--gc-dry-run has no effect without --gc-once")
+	}
+
 	// Start metrics server
+	var metricsServer *metrics.Server
 	if *metricsPort > 0 {
-		metricsServer := metrics.NewServer(*metricsPort)
-		collector := metrics.NewVolumeStatsCollector(*nodeID, backingDir)
+		metricsServer = metrics.NewServer(*metricsPort)
+		metricsServer.SetBindAddress(*metricsAddress)
+		if *metricsTLSCert != "" {
+			metricsServer.SetTLS(*metricsTLSCert, *metricsTLSKey)
+		}
+		if *enablePprof {
+			metricsServer.EnablePprof()
+		}
+		cacheTTL := time.Duration(driverOptions.VolStatsCacheExpireInMinutes) * time.Minute
+		collector := metrics.NewVolumeStatsCollectorWithCache(*nodeID, backingDir, cacheTTL)
+		collector.SetReservedCapacity(driverOptions.ReservedCapacity)
+		collector.SetExtraBackingDirs(driverOptions.ExtraBackingDirs)
+		if *volumeIOStats {
+			collector.EnableVolumeIOStats()
+		}
+		operationMetrics := metrics.NewOperationMetrics()
+		gcMetrics := metrics.NewGCMetrics()
+		loopDeviceMetrics := metrics.NewLoopDeviceMetrics()
+		if err := metricsServer.RegisterCollector(metrics.NewBuildInfo(version, gitCommit, buildDate)); err != nil {
+			klog.Warningf("Failed to register build info metric: %v", err)
+		}
+		// A metric that fails to register is left out; the others are still served
 		if err := metricsServer.RegisterCollector(collector); err != nil {
 			klog.Warningf("Failed to register metrics collector: %v", err)
+		}
+		if err := metricsServer.RegisterCollector(operationMetrics); err != nil {
+			klog.Warningf("Failed to register operation metrics: %v", err)
 		} else {
-			if err := metricsServer.Start(); err != nil {
-				klog.Warningf("Failed to start metrics server: %v", err)
-			}
+			driverOptions.Interceptors = append(driverOptions.Interceptors, operationMetrics.UnaryServerInterceptor())
+		}
+		if err := metricsServer.RegisterCollector(gcMetrics); err != nil {
+			klog.Warningf("Failed to register garbage collection metrics: %v", err)
+		} else {
+			driverOptions.GCObserver = gcMetrics
+		}
+		if err := metricsServer.RegisterCollector(loopDeviceMetrics); err != nil {
+			klog.Warningf("Failed to register loop device metrics: %v", err)
+		} else {
+			driverOptions.LoopDeviceObserver = loopDeviceMetrics
+		}
+		if err := metricsServer.Start(); err != nil {
+			klog.Warningf("Failed to start metrics server: %v", err)
 		}
 	}
 
-	driverOptions := rawfile.DriverOptions{
-		NodeID:     *nodeID,
-		DriverName: *driverName,
-		Endpoint:   *endpoint,
-		BackingDir: backingDir,
-		Mode:       *mode,
-		Clientset:  clientset,
+	if *enablePprof && metricsServer == nil {
+		klog.Warningf("--enable-pprof has no effect without a metrics port")
 	}
+	if *volumeIOStats && metricsServer == nil {
+		klog.Warningf("--enable-volume-io-metrics has no effect without a metrics port")
+	}
+
 	d := rawfile.NewDriver(&driverOptions)
+	if err := d.PrepareBackingDirs(); err != nil {
+		klog.Fatalf("Failed to prepare backing directories: %v", err)
+	}
+	if *preflight && (*mode == "node" || *mode == "both") {
+		results := d.CheckNode(context.Background())
+		for _, r := range results {
+			if r.Err != nil && !r.Optional {
+				klog.Errorf("Preflight check %s failed: %v", r.Name, r.Err)
+			} else if r.Err != nil {
+				klog.Warningf("Preflight check %s failed: %v", r.Name, r.Err)
+			}
+		}
+		if rawfile.PreflightFailed(results) {
+			klog.Fatalf("Node prerequisites missing; run with --check-node for a full report")
+		}
+	}
+	if metricsServer != nil {
+		// Liveness only needs the process to answer; readiness needs the driver to serve
+		metricsServer.RegisterHealthChecks(nil, d.Ready)
+	}
+
+	// Shut down gracefully on termination so in-flight node operations are not
+	// cut off halfway through mounting or attaching loop devices
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigCh
+		klog.Infof("Received %v, shutting down", sig)
+		if metricsServer != nil {
+			if err := metricsServer.Stop(); err != nil {
+				klog.Warningf("Failed to stop metrics server: %v", err)
+			}
+		}
+		d.Stop(*shutdownTimeout)
+	}()
+
 	d.Run(false)
 }
+
+// garbageCollectOnce runs a single garbage collection pass for --gc-once,
+// printing each reclaimed file, and returns the process exit code
+func garbageCollectOnce(options *rawfile.DriverOptions, dryRun bool) int {
+	if options.Clientset == nil {
+		klog.Errorf("--gc-once needs the Kubernetes API to find orphaned backing files and cannot run with --standalone")
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	reclaimed, err := rawfile.NewDriver(options).GarbageCollectOnce(ctx, dryRun)
+	if err != nil {
+		klog.Errorf("Garbage collection failed: %v", err)
+		return 1
+	}
+	action := "deleted"
+	if options.DefaultOnDeletePolicy == rawfile.OnDeletePolicyRetain {
+		action = "archived"
+	}
+	if dryRun {
+		action = "would be " + action
+	}
+	for _, file := range reclaimed {
+		fmt.Printf("%s %s\n", action, file)
+	}
+	return 0
+}
+
+// checkNodeOnce checks the node prerequisites for --check-node, printing a
+// line per check, and returns the process exit code
+func checkNodeOnce(options *rawfile.DriverOptions) int {
+	results := rawfile.NewDriver(options).CheckNode(context.Background())
+	for _, r := range results {
+		switch {
+		case r.Err == nil:
+			fmt.Printf("PASS %s\n", r.Name)
+		case r.Optional:
+			fmt.Printf("WARN %s: %v\n", r.Name, r.Err)
+		default:
+			fmt.Printf("FAIL %s: %v\n", r.Name, r.Err)
+		}
+	}
+	if rawfile.PreflightFailed(results) {
+		fmt.Println("Node prerequisites missing")
+		return 1
+	}
+	fmt.Println("Node prerequisites met")
+	return 0
+}
+
+// setupLogging routes klog through a JSON handler for the json format; text
+// keeps klog's own output
+func setupLogging(format string) {
+	switch format {
+	case "text":
+	case "json":
+		// klog applies -v before handing messages over, so let every level through
+		handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.Level(math.MinInt)})
+		klog.SetLogger(logr.FromSlogHandler(handler))
+	default:
+		klog.Fatalf("Invalid --log-format %q: must be text or json", format)
+	}
+}
+
+// splitAllowedTopologies splits the comma separated nodes of
+// --allowed-topologies, dropping blanks
+func splitAllowedTopologies(value string) []string {
+	var nodes []string
+	for _, node := range strings.Split(value, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// splitBackingDirs splits a comma separated list of backing directories,
+// dropping blanks and duplicates
+func splitBackingDirs(value string) []string {
+	var dirs []string
+	seen := map[string]bool{}
+	for _, dir := range strings.Split(value, ",") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	if len(dirs) == 0 {
+		klog.Fatalf("Invalid backing directory %q: no directory given", value)
+	}
+	return dirs
+}
+
+// parsePermissions parses an octal permission flag value such as --mount-permissions
+func parsePermissions(name, value string) uint64 {
+	perms, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || perms > 0777 {
+		klog.Fatalf("Invalid --%s %q: must be octal permission bits such as 0770", name, value)
+	}
+	return perms
+}
+
+// parseSize parses a Kubernetes quantity flag value into bytes; empty means zero
+func parseSize(name, value string) int64 {
+	if value == "" {
+		return 0
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		klog.Fatalf("Invalid --%s %q: %v", name, value, err)
+	}
+	return q.Value()
+}
@@ -0,0 +1,19 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// NewBuildInfo returns a collector exposing the running build as the labels
+// of a constant rawfile_build_info gauge
+func NewBuildInfo(version, gitCommit, buildDate string) prometheus.Collector {
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rawfile_build_info",
+		Help: "Build information of the running driver; always 1.",
+		ConstLabels: prometheus.Labels{
+			"version":    version,
+			"git_commit": gitCommit,
+			"build_date": buildDate,
+		},
+	})
+	info.Set(1)
+	return info
+}
@@ -0,0 +1,19 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBuildInfo(t *testing.T) {
+	expected := `
+# HELP rawfile_build_info Build information of the running driver; always 1.
+# TYPE rawfile_build_info gauge
+rawfile_build_info{build_date="2026-01-02T03:04:05Z",git_commit="abc123",version="v1.2.3"} 1
+`
+	if err := testutil.CollectAndCompare(NewBuildInfo("v1.2.3", "abc123", "2026-01-02T03:04:05Z"), strings.NewReader(expected), "rawfile_build_info"); err != nil {
+		t.Errorf("unexpected build info metric: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GCMetrics records garbage collection passes of orphaned backing files, so
+// a pass that suddenly reclaims many volumes, e.g. because PVs went missing
+// from the API, can be alerted on
+type GCMetrics struct {
+	runs    prometheus.Counter
+	deleted prometheus.Counter
+	errors  prometheus.Counter
+	lastRun prometheus.Gauge
+}
+
+// NewGCMetrics creates the garbage collection metrics
+func NewGCMetrics() *GCMetrics {
+	return &GCMetrics{
+		runs: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rawfile_gc_runs_total",
+			Help: "Total number of garbage collection passes.",
+		}),
+		deleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rawfile_gc_deleted_files_total",
+			Help: "Total number of orphaned backing files deleted or archived by garbage collection.",
+		}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "rawfile_gc_errors_total",
+			Help: "Total number of garbage collection passes that failed.",
+		}),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "rawfile_gc_last_run_timestamp_seconds",
+			Help: "Unix time of the last garbage collection pass.",
+		}),
+	}
+}
+
+// Describe sends the descriptors of each metric to the provided channel
+func (m *GCMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.runs.Describe(ch)
+	m.deleted.Describe(ch)
+	m.errors.Describe(ch)
+	m.lastRun.Describe(ch)
+}
+
+// Collect sends the current value of each metric to the provided channel
+func (m *GCMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.runs.Collect(ch)
+	m.deleted.Collect(ch)
+	m.errors.Collect(ch)
+	m.lastRun.Collect(ch)
+}
+
+// ObserveGC records a finished garbage collection pass
+func (m *GCMetrics) ObserveGC(reclaimed int, err error) {
+	m.runs.Inc()
+	m.deleted.Add(float64(reclaimed))
+	if err != nil {
+		m.errors.Inc()
+	}
+	m.lastRun.SetToCurrentTime()
+}
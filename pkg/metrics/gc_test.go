@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGCMetrics(t *testing.T) {
+	m := NewGCMetrics()
+	if count := testutil.CollectAndCount(m); count != 4 {
+		t.Errorf("Expected 4 metrics, got %d", count)
+	}
+
+	before := time.Now().Unix()
+	m.ObserveGC(3, nil)
+	m.ObserveGC(0, errors.New("failed to list PersistentVolumes"))
+	m.ObserveGC(2, nil)
+
+	if got := testutil.ToFloat64(m.runs); got != 3 {
+		t.Errorf("Expected 3 runs, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.deleted); got != 5 {
+		t.Errorf("Expected 5 deleted files, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.errors); got != 1 {
+		t.Errorf("Expected 1 error, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.lastRun); got < float64(before) {
+		t.Errorf("Expected the last run timestamp to be at least %d, got %v", before, got)
+	}
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// OperationMetrics records latency and errors of CSI gRPC calls
+type OperationMetrics struct {
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+// NewOperationMetrics creates the CSI operation metrics
+func NewOperationMetrics() *OperationMetrics {
+	return &OperationMetrics{
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "rawfile_csi_operation_duration_seconds",
+				Help:    "Duration of CSI gRPC operations in seconds.",
+				Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+			},
+			[]string{"method", "code"},
+		),
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "rawfile_csi_operation_errors_total",
+				Help: "Total number of CSI gRPC operations that returned an error.",
+			},
+			[]string{"method", "code"},
+		),
+	}
+}
+
+// Describe sends the descriptors of each metric to the provided channel
+func (m *OperationMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.duration.Describe(ch)
+	m.errors.Describe(ch)
+}
+
+// Collect sends the current value of each metric to the provided channel
+func (m *OperationMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.duration.Collect(ch)
+	m.errors.Collect(ch)
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor that observes every call
+func (m *OperationMetrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.observe(info.FullMethod, time.Since(start), err)
+		return resp, err
+	}
+}
+
+// observe records a finished call; fullMethod is e.g. /csi.v1.Node/NodePublishVolume
+func (m *OperationMetrics) observe(fullMethod string, elapsed time.Duration, err error) {
+	method := path.Base(fullMethod)
+	code := status.Code(err).String()
+	m.duration.WithLabelValues(method, code).Observe(elapsed.Seconds())
+	if err != nil {
+		m.errors.WithLabelValues(method, code).Inc()
+	}
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOperationMetricsInterceptor(t *testing.T) {
+	m := NewOperationMetrics()
+	interceptor := m.UnaryServerInterceptor()
+
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	fail := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "missing")
+	}
+
+	publish := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodePublishVolume"}
+	for i := 0; i < 2; i++ {
+		if _, err := interceptor(context.Background(), nil, publish, ok); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	getVolume := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerGetVolume"}
+	if _, err := interceptor(context.Background(), nil, getVolume, fail); status.Code(err) != codes.NotFound {
+		t.Fatalf("interceptor should pass through handler errors, got %v", err)
+	}
+
+	// One histogram series per method and code
+	if count := testutil.CollectAndCount(m, "rawfile_csi_operation_duration_seconds"); count != 2 {
+		t.Errorf("Expected 2 duration series, got %d", count)
+	}
+
+	expected := `
+# HELP rawfile_csi_operation_errors_total Total number of CSI gRPC operations that returned an error.
+# TYPE rawfile_csi_operation_errors_total counter
+rawfile_csi_operation_errors_total{code="NotFound",method="ControllerGetVolume"} 1
+`
+	if err := testutil.CollectAndCompare(m, strings.NewReader(expected), "rawfile_csi_operation_errors_total"); err != nil {
+		t.Errorf("unexpected error metrics: %v", err)
+	}
+}
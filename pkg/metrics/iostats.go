@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	klog "k8s.io/klog/v2"
+)
+
+// diskStats are the I/O counters of a block device from /proc/diskstats
+type diskStats struct {
+	ReadOps    uint64
+	ReadBytes  uint64
+	WriteOps   uint64
+	WriteBytes uint64
+}
+
+// diskstatsSectorSize is the unit of the sector counts in /proc/diskstats,
+// whatever the logical block size of the device
+const diskstatsSectorSize = 512
+
+// ioStatsDescs describe the per-volume I/O counters
+type ioStatsDescs struct {
+	readBytes  *prometheus.Desc
+	writeBytes *prometheus.Desc
+	readOps    *prometheus.Desc
+	writeOps   *prometheus.Desc
+}
+
+func newIOStatsDescs() *ioStatsDescs {
+	labels := []string{"node", "volume"}
+	return &ioStatsDescs{
+		readBytes:  prometheus.NewDesc("rawfile_volume_read_bytes_total", "Bytes read from the volume's loop device", labels, nil),
+		writeBytes: prometheus.NewDesc("rawfile_volume_write_bytes_total", "Bytes written to the volume's loop device", labels, nil),
+		readOps:    prometheus.NewDesc("rawfile_volume_read_ops_total", "Read requests completed by the volume's loop device", labels, nil),
+		writeOps:   prometheus.NewDesc("rawfile_volume_write_ops_total", "Write requests completed by the volume's loop device", labels, nil),
+	}
+}
+
+// EnableVolumeIOStats has the collector export read and write counters for
+// each volume attached to a loop device. Call it before registering the
+// collector.
+func (c *VolumeStatsCollector) EnableVolumeIOStats() {
+	c.ioStats = newIOStatsDescs()
+}
+
+// collectVolumeIOStats sends the I/O counters of the attached volumes
+func (c *VolumeStatsCollector) collectVolumeIOStats(ch chan<- prometheus.Metric) {
+	devices, err := loopDeviceVolumes(c.sysBlockDir, c.backingDirs())
+	if err != nil {
+		klog.Errorf("Failed to map loop devices to volumes: %v", err)
+		return
+	}
+	if len(devices) == 0 {
+		return
+	}
+	stats, err := readDiskStats(c.diskstatsPath)
+	if err != nil {
+		klog.Errorf("Failed to read disk stats: %v", err)
+		return
+	}
+	for device, volumeID := range devices {
+		s, ok := stats[device]
+		if !ok {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.ioStats.readBytes, prometheus.CounterValue, float64(s.ReadBytes), c.nodeID, volumeID)
+		ch <- prometheus.MustNewConstMetric(c.ioStats.writeBytes, prometheus.CounterValue, float64(s.WriteBytes), c.nodeID, volumeID)
+		ch <- prometheus.MustNewConstMetric(c.ioStats.readOps, prometheus.CounterValue, float64(s.ReadOps), c.nodeID, volumeID)
+		ch <- prometheus.MustNewConstMetric(c.ioStats.writeOps, prometheus.CounterValue, float64(s.WriteOps), c.nodeID, volumeID)
+	}
+}
+
+// loopDeviceVolumes maps the loop devices bound to a volume backing file in
+// one of backingDirs, such as loop3, to the volume ID. The kernel keeps the
+// backing file of each attached loop device in sysfs.
+func loopDeviceVolumes(sysBlockDir string, backingDirs []string) (map[string]string, error) {
+	matches, err := filepath.Glob(filepath.Join(sysBlockDir, "loop*", "loop", "backing_file"))
+	if err != nil {
+		return nil, err
+	}
+	devices := make(map[string]string)
+	for _, match := range matches {
+		data, err := os.ReadFile(match)
+		if err != nil {
+			// Detached between the glob and the read
+			continue
+		}
+		backingFile := strings.TrimSuffix(strings.TrimSpace(string(data)), " (deleted)")
+		name := filepath.Base(backingFile)
+		if !strings.HasSuffix(name, ".img") || strings.HasPrefix(name, snapshotPrefix) {
+			continue
+		}
+		for _, dir := range backingDirs {
+			if filepath.Dir(backingFile) == filepath.Clean(dir) {
+				device := filepath.Base(filepath.Dir(filepath.Dir(match)))
+				devices[device] = strings.TrimSuffix(name, ".img")
+				break
+			}
+		}
+	}
+	return devices, nil
+}
+
+// readDiskStats parses /proc/diskstats into the counters of each device
+func readDiskStats(path string) (map[string]diskStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stats := make(map[string]diskStats)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// major minor name reads merged sectors ms writes merged sectors ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		var counters [4]uint64
+		valid := true
+		for i, field := range []string{fields[3], fields[5], fields[7], fields[9]} {
+			if counters[i], err = strconv.ParseUint(field, 10, 64); err != nil {
+				valid = false
+				break
+			}
+		}
+		if !valid {
+			continue
+		}
+		stats[fields[2]] = diskStats{
+			ReadOps:    counters[0],
+			ReadBytes:  counters[1] * diskstatsSectorSize,
+			WriteOps:   counters[2],
+			WriteBytes: counters[3] * diskstatsSectorSize,
+		}
+	}
+	return stats, scanner.Err()
+}
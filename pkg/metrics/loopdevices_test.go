@@ -0,0 +1,24 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoopDeviceMetrics(t *testing.T) {
+	m := NewLoopDeviceMetrics()
+	if count := testutil.CollectAndCount(m); count != 2 {
+		t.Errorf("Expected 2 metrics, got %d", count)
+	}
+
+	m.ObserveLeakedLoopDevices(2, 0)
+	m.ObserveLeakedLoopDevices(1, 3)
+
+	if got := testutil.ToFloat64(m.leaked); got != 3 {
+		t.Errorf("Expected 3 leaked loop devices, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.detached); got != 3 {
+		t.Errorf("Expected 3 detached loop devices, got %v", got)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	klog "k8s.io/klog/v2"
@@ -14,17 +16,50 @@ import (
 type VolumeStatsCollector struct {
 	nodeID     string
 	backingDir string
+	// extraBackingDirs are scanned alongside backingDir on nodes with several data disks
+	extraBackingDirs []string
+	// reserved is subtracted from the remaining capacity of each backing directory
+	reserved int64
+
+	// cacheTTL is how long per-volume stats are served from cache; zero disables caching
+	cacheTTL    time.Duration
+	cacheMu     sync.Mutex
+	cachedStats map[string]VolumeStats
+	cachedAt    time.Time
+	now         func() time.Time
+
+	// ioStats describes the per-volume I/O counters; nil unless enabled
+	ioStats       *ioStatsDescs
+	sysBlockDir   string
+	diskstatsPath string
 
 	remainingCapacity *prometheus.Desc
 	volumeUsed        *prometheus.Desc
 	volumeTotal       *prometheus.Desc
+	volumeSparse      *prometheus.Desc
+	snapshotCount     *prometheus.Desc
 }
 
+// snapshotPrefix marks snapshot images in the backing directory; they are
+// counted separately rather than reported as volumes
+const snapshotPrefix = "snap-"
+
 // NewVolumeStatsCollector creates a new volume stats collector
 func NewVolumeStatsCollector(nodeID, backingDir string) *VolumeStatsCollector {
+	return NewVolumeStatsCollectorWithCache(nodeID, backingDir, 0)
+}
+
+// NewVolumeStatsCollectorWithCache creates a volume stats collector that
+// memoizes the per-volume stats for cacheTTL between scrapes.
+func NewVolumeStatsCollectorWithCache(nodeID, backingDir string, cacheTTL time.Duration) *VolumeStatsCollector {
 	return &VolumeStatsCollector{
 		nodeID:     nodeID,
 		backingDir: backingDir,
+		cacheTTL:   cacheTTL,
+		now:        time.Now,
+
+		sysBlockDir:   "/sys/block",
+		diskstatsPath: "/proc/diskstats",
 		remainingCapacity: prometheus.NewDesc(
 			"rawfile_remaining_capacity",
 			"Free capacity for new volumes on this node (excluding reserved storage).",
@@ -43,6 +78,18 @@ func NewVolumeStatsCollector(nodeID, backingDir string) *VolumeStatsCollector {
 			[]string{"node", "volume"},
 			nil,
 		),
+		volumeSparse: prometheus.NewDesc(
+			"rawfile_volume_sparse_bytes",
+			"Bytes of the volume's apparent size not backed by allocated blocks (thin-provisioning savings)",
+			[]string{"node", "volume"},
+			nil,
+		),
+		snapshotCount: prometheus.NewDesc(
+			"rawfile_snapshot_count",
+			"Number of snapshot images in the backing directory",
+			[]string{"node"},
+			nil,
+		),
 	}
 }
 
@@ -51,6 +98,14 @@ func (c *VolumeStatsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.remainingCapacity
 	ch <- c.volumeUsed
 	ch <- c.volumeTotal
+	ch <- c.volumeSparse
+	ch <- c.snapshotCount
+	if c.ioStats != nil {
+		ch <- c.ioStats.readBytes
+		ch <- c.ioStats.writeBytes
+		ch <- c.ioStats.readOps
+		ch <- c.ioStats.writeOps
+	}
 }
 
 // Collect fetches the stats from the backing directory and sends them to the provided channel
@@ -68,8 +123,24 @@ func (c *VolumeStatsCollector) Collect(ch chan<- prometheus.Metric) {
 		)
 	}
 
+	snapshots, err := c.countSnapshots()
+	if err != nil {
+		klog.Errorf("Failed to count snapshots: %v", err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(
+			c.snapshotCount,
+			prometheus.GaugeValue,
+			float64(snapshots),
+			c.nodeID,
+		)
+	}
+
+	if c.ioStats != nil {
+		c.collectVolumeIOStats(ch)
+	}
+
 	// Get stats for each volume
-	volumeStats, err := c.getAllVolumeStats()
+	volumeStats, err := c.getCachedVolumeStats()
 	if err != nil {
 		klog.Errorf("Failed to get volume stats: %v", err)
 		return
@@ -90,6 +161,13 @@ func (c *VolumeStatsCollector) Collect(ch chan<- prometheus.Metric) {
 			c.nodeID,
 			volumeID,
 		)
+		ch <- prometheus.MustNewConstMetric(
+			c.volumeSparse,
+			prometheus.GaugeValue,
+			float64(stats.Sparse()),
+			c.nodeID,
+			volumeID,
+		)
 	}
 }
 
@@ -99,64 +177,135 @@ type VolumeStats struct {
 	Total int64
 }
 
-// getRemainingCapacity returns the available capacity in the backing directory
+// Sparse returns the part of the apparent size without allocated blocks.
+// Filesystem metadata can push Used above Total, so it never goes below zero.
+func (s VolumeStats) Sparse() int64 {
+	if s.Used >= s.Total {
+		return 0
+	}
+	return s.Total - s.Used
+}
+
+// countSnapshots returns the number of snapshot images in the backing directories
+func (c *VolumeStatsCollector) countSnapshots() (int, error) {
+	count := 0
+	for _, dir := range c.backingDirs() {
+		matches, err := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*.img"))
+		if err != nil {
+			return 0, err
+		}
+		count += len(matches)
+	}
+	return count, nil
+}
+
+// SetReservedCapacity holds bytes of each backing filesystem back from the
+// reported remaining capacity. Call it before registering the collector.
+func (c *VolumeStatsCollector) SetReservedCapacity(bytes int64) {
+	c.reserved = bytes
+}
+
+// SetExtraBackingDirs adds backing directories to scan besides the one the
+// collector was created with. Call it before registering the collector.
+func (c *VolumeStatsCollector) SetExtraBackingDirs(dirs []string) {
+	c.extraBackingDirs = dirs
+}
+
+// backingDirs returns every backing directory, the primary one first
+func (c *VolumeStatsCollector) backingDirs() []string {
+	return append([]string{c.backingDir}, c.extraBackingDirs...)
+}
+
+// getRemainingCapacity returns the available capacity across the backing
+// directories, each minus the reserved capacity
 func (c *VolumeStatsCollector) getRemainingCapacity() (int64, error) {
-	var stat syscall.Statfs_t
-	if err := syscall.Statfs(c.backingDir, &stat); err != nil {
-		return 0, err
+	var total int64
+	for _, dir := range c.backingDirs() {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(dir, &stat); err != nil {
+			return 0, err
+		}
+
+		// Available capacity = available blocks * block size
+		availableBytes := int64(stat.Bavail) * int64(stat.Bsize)
+		if availableBytes > c.reserved {
+			total += availableBytes - c.reserved
+		}
+	}
+	return total, nil
+}
+
+// getCachedVolumeStats returns the cached volume stats while they are fresh,
+// walking the backing directory again once they expire
+func (c *VolumeStatsCollector) getCachedVolumeStats() (map[string]VolumeStats, error) {
+	if c.cacheTTL <= 0 {
+		return c.getAllVolumeStats()
 	}
 
-	// Available capacity = available blocks * block size
-	availableBytes := int64(stat.Bavail) * int64(stat.Bsize)
-	return availableBytes, nil
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	if c.cachedStats != nil && c.now().Sub(c.cachedAt) < c.cacheTTL {
+		return c.cachedStats, nil
+	}
+
+	stats, err := c.getAllVolumeStats()
+	if err != nil {
+		return nil, err
+	}
+	c.cachedStats = stats
+	c.cachedAt = c.now()
+	return stats, nil
 }
 
-// getAllVolumeStats returns stats for all volumes in the backing directory
+// getAllVolumeStats returns stats for all volumes in the backing directories
 func (c *VolumeStatsCollector) getAllVolumeStats() (map[string]VolumeStats, error) {
 	stats := make(map[string]VolumeStats)
-
-	// Check if backing directory exists
-	if _, err := os.Stat(c.backingDir); os.IsNotExist(err) {
-		return stats, nil // No volumes yet
+	for _, dir := range c.backingDirs() {
+		if err := addVolumeStats(dir, stats); err != nil {
+			return nil, err
+		}
 	}
+	return stats, nil
+}
 
-	// Walk through backing directory to find .img files
-	err := filepath.Walk(c.backingDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+// addVolumeStats adds the stats of the volumes in one backing directory to stats.
+// Backing files sit at its top level; subdirectories, such as btrfs subvolumes
+// and the archive of retained backing files, are not descended into.
+func addVolumeStats(dir string, stats map[string]VolumeStats) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil // No volumes yet
+	}
+	if err != nil {
+		return err
+	}
 
-		// Skip directories and non-.img files
-		if info.IsDir() || !strings.HasSuffix(info.Name(), ".img") {
-			return nil
+	for _, entry := range entries {
+		// Skip directories, non-.img files and snapshot images
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".img") || strings.HasPrefix(name, snapshotPrefix) {
+			continue
 		}
+		path := filepath.Join(dir, name)
 
 		// Extract volume ID from filename (vol-xxx.img -> vol-xxx)
-		volumeID := strings.TrimSuffix(info.Name(), ".img")
+		volumeID := strings.TrimSuffix(name, ".img")
 
 		// Get actual disk usage (blocks allocated)
 		var stat syscall.Stat_t
 		if err := syscall.Stat(path, &stat); err != nil {
 			klog.Warningf("Failed to stat volume file %s: %v", path, err)
-			return nil
+			continue
 		}
 
-		// Used space is blocks * block size
-		// Note: stat.Blocks is typically in 512-byte units on most Unix-like systems,
-		// but we use stat.Blksize for better portability across platforms
-		usedBytes := stat.Blocks * stat.Blksize
+		// Used space is the allocated blocks; stat.Blocks counts 512-byte units
+		// regardless of the filesystem block size (Blksize is only the I/O hint)
+		usedBytes := stat.Blocks * 512
 
 		stats[volumeID] = VolumeStats{
 			Used:  usedBytes,
-			Total: info.Size(),
+			Total: stat.Size,
 		}
-
-		return nil
-	})
-
-	if err != nil {
-		return nil, err
 	}
-
-	return stats, nil
+	return nil
 }
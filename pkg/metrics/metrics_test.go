@@ -3,7 +3,9 @@ package metrics
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
@@ -99,6 +101,30 @@ func TestGetRemainingCapacity(t *testing.T) {
 	}
 }
 
+func TestGetRemainingCapacity_Reserved(t *testing.T) {
+	collector := NewVolumeStatsCollector("test-node", t.TempDir())
+
+	available, err := collector.getRemainingCapacity()
+	if err != nil {
+		t.Fatalf("Failed to get remaining capacity: %v", err)
+	}
+
+	// Free space can shift between calls, so only check the reserve lowers it
+	collector.SetReservedCapacity(available / 2)
+	capacity, err := collector.getRemainingCapacity()
+	if err != nil {
+		t.Fatalf("Failed to get remaining capacity: %v", err)
+	}
+	if capacity <= 0 || capacity >= available {
+		t.Errorf("Expected capacity between 0 and %d with a reserve, got %d", available, capacity)
+	}
+
+	collector.SetReservedCapacity(available * 2)
+	if capacity, err = collector.getRemainingCapacity(); err != nil || capacity != 0 {
+		t.Errorf("Expected zero capacity when the reserve exceeds free space, got %d, %v", capacity, err)
+	}
+}
+
 func TestGetAllVolumeStats(t *testing.T) {
 	// Create a temporary backing directory
 	tmpDir, err := os.MkdirTemp("", "volume-stats-test-*")
@@ -157,6 +183,110 @@ func TestGetAllVolumeStats(t *testing.T) {
 	}
 }
 
+func TestVolumeStatsCollector_SparseAndSnapshots(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// A fully sparse volume, a fully allocated one and two snapshots
+	if err := createTestFile(filepath.Join(tmpDir, "vol-sparse.img"), 1024*1024); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "vol-full.img"), make([]byte, 64*1024), 0600); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	for _, name := range []string{"snap-1.img", "snap-2.img"} {
+		if err := createTestFile(filepath.Join(tmpDir, name), 1024*1024); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	collector := NewVolumeStatsCollector("test-node", tmpDir)
+
+	stats, err := collector.getAllVolumeStats()
+	if err != nil {
+		t.Fatalf("Failed to get volume stats: %v", err)
+	}
+	if len(stats) != 2 {
+		t.Errorf("Expected snapshots to be excluded from 2 volumes, got %d", len(stats))
+	}
+	if sparse := stats["vol-sparse"].Sparse(); sparse <= 0 || sparse > 1024*1024 {
+		t.Errorf("Expected sparse volume to report sparse bytes up to 1048576, got %d", sparse)
+	}
+	if sparse := stats["vol-full"].Sparse(); sparse != 0 {
+		t.Errorf("Expected fully allocated volume to report 0 sparse bytes, got %d", sparse)
+	}
+
+	if count := testutil.CollectAndCount(collector, "rawfile_volume_sparse_bytes"); count != 2 {
+		t.Errorf("Expected 2 volume_sparse_bytes metrics, got %d", count)
+	}
+	expected := `
+# HELP rawfile_snapshot_count Number of snapshot images in the backing directory
+# TYPE rawfile_snapshot_count gauge
+rawfile_snapshot_count{node="test-node"} 2
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "rawfile_snapshot_count"); err != nil {
+		t.Errorf("Unexpected snapshot count metric: %v", err)
+	}
+}
+
+func TestGetAllVolumeStats_TopLevelOnly(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := createTestFile(filepath.Join(tmpDir, "vol-live.img"), 1024*1024); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	// Retained backing files of deleted volumes, and the files a pod wrote
+	// into a btrfs subvolume volume
+	for _, file := range []string{"archived/vol-deleted.img", "vol-sub.subvol/disk.img"} {
+		if err := os.MkdirAll(filepath.Join(tmpDir, filepath.Dir(file)), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := createTestFile(filepath.Join(tmpDir, file), 1024*1024); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	stats, err := NewVolumeStatsCollector("test-node", tmpDir).getAllVolumeStats()
+	if err != nil {
+		t.Fatalf("Failed to get volume stats: %v", err)
+	}
+	if _, ok := stats["vol-live"]; !ok || len(stats) != 1 {
+		t.Errorf("Expected only vol-live, got %v", stats)
+	}
+}
+
+func TestGetAllVolumeStats_ExtraBackingDirs(t *testing.T) {
+	primary, extra := t.TempDir(), t.TempDir()
+	if err := createTestFile(filepath.Join(primary, "vol-a.img"), 1024*1024); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	for _, name := range []string{"vol-b.img", "snap-1.img"} {
+		if err := createTestFile(filepath.Join(extra, name), 1024*1024); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	collector := NewVolumeStatsCollector("test-node", primary)
+	single, err := collector.getRemainingCapacity()
+	if err != nil {
+		t.Fatalf("Failed to get remaining capacity: %v", err)
+	}
+	collector.SetExtraBackingDirs([]string{extra})
+
+	stats, err := collector.getAllVolumeStats()
+	if err != nil {
+		t.Fatalf("Failed to get volume stats: %v", err)
+	}
+	if _, ok := stats["vol-b"]; !ok || len(stats) != 2 {
+		t.Errorf("Expected vol-a and vol-b across both directories, got %v", stats)
+	}
+	if count, err := collector.countSnapshots(); err != nil || count != 1 {
+		t.Errorf("Expected 1 snapshot in the extra directory, got %d, %v", count, err)
+	}
+	// Both temp directories share a filesystem, so its free space counts twice
+	if capacity, err := collector.getRemainingCapacity(); err != nil || capacity <= single {
+		t.Errorf("Expected remaining capacity above %d with two directories, got %d, %v", single, capacity, err)
+	}
+}
+
 func TestGetAllVolumeStats_EmptyDirectory(t *testing.T) {
 	// Create a temporary backing directory
 	tmpDir, err := os.MkdirTemp("", "empty-stats-test-*")
@@ -192,6 +322,40 @@ func TestGetAllVolumeStats_NonExistentDirectory(t *testing.T) {
 	}
 }
 
+func TestVolumeStatsCollector_CacheHit(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "metrics-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := createTestFile(filepath.Join(tmpDir, "vol-cache-1.img"), 1024*1024); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	collector := NewVolumeStatsCollectorWithCache("test-node", tmpDir, time.Minute)
+	now := time.Now()
+	collector.now = func() time.Time { return now }
+
+	if count := testutil.CollectAndCount(collector, "rawfile_volume_total"); count != 1 {
+		t.Fatalf("Expected 1 volume_total metric, got %d", count)
+	}
+
+	// A volume added between scrapes is not visible until the cache expires
+	if err := createTestFile(filepath.Join(tmpDir, "vol-cache-2.img"), 1024*1024); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	now = now.Add(30 * time.Second)
+	if count := testutil.CollectAndCount(collector, "rawfile_volume_total"); count != 1 {
+		t.Errorf("Expected cached 1 volume_total metric, got %d", count)
+	}
+
+	now = now.Add(time.Minute)
+	if count := testutil.CollectAndCount(collector, "rawfile_volume_total"); count != 2 {
+		t.Errorf("Expected 2 volume_total metrics after cache expiry, got %d", count)
+	}
+}
+
 // Helper function to create a test file with a specific size
 // Note: This creates a sparse file (no actual data written) for testing file size,
 // which is different from createTestFileWithData in server_test.go that writes actual data.
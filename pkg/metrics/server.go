@@ -2,8 +2,13 @@ package metrics
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,9 +18,20 @@ import (
 
 // Server manages the metrics HTTP server
 type Server struct {
-	port       int
-	registry   *prometheus.Registry
-	httpServer *http.Server
+	port int
+	// bindAddress is the host or IP to listen on; empty means all interfaces
+	bindAddress string
+	registry    *prometheus.Registry
+	httpServer  *http.Server
+	// pprof mounts the net/http/pprof handlers under /debug/pprof/
+	pprof bool
+	// tlsCertFile and tlsKeyFile switch the server to HTTPS when both are set
+	tlsCertFile string
+	tlsKeyFile  string
+
+	mu        sync.RWMutex
+	liveness  func() error
+	readiness func() error
 }
 
 // NewServer creates a new metrics server
@@ -26,24 +42,98 @@ func NewServer(port int) *Server {
 	}
 }
 
+// SetBindAddress restricts the server to listen on one host or IP, e.g.
+// 127.0.0.1, instead of all interfaces. Must be called before Start.
+func (s *Server) SetBindAddress(address string) {
+	s.bindAddress = address
+}
+
+// SetTLS serves the endpoints over HTTPS with the given PEM certificate and
+// key files instead of plain HTTP. Must be called before Start.
+func (s *Server) SetTLS(certFile, keyFile string) {
+	s.tlsCertFile = certFile
+	s.tlsKeyFile = keyFile
+}
+
 // RegisterCollector registers a prometheus collector
 func (s *Server) RegisterCollector(collector prometheus.Collector) error {
 	return s.registry.Register(collector)
 }
 
+// EnablePprof mounts the runtime profiling handlers under /debug/pprof/ on the
+// metrics port. Profiles expose internals, so this is off unless requested.
+// Must be called before Start.
+func (s *Server) EnablePprof() {
+	s.pprof = true
+}
+
+// RegisterHealthChecks sets the checks behind /healthz and /readyz. Each
+// endpoint returns 200 while its check returns nil and 503 otherwise; a nil
+// check always reports healthy. Checks may be registered after Start.
+func (s *Server) RegisterHealthChecks(liveness, readiness func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.liveness = liveness
+	s.readiness = readiness
+}
+
+// healthHandler serves the result of the check returned by get
+func (s *Server) healthHandler(get func() func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		check := get()
+		s.mu.RUnlock()
+		if check != nil {
+			if err := check(); err != nil {
+				klog.V(4).Infof("Health check %s failed: %v", r.URL.Path, err)
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	}
+}
+
 // Start starts the metrics HTTP server in a goroutine
 func (s *Server) Start() error {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	mux.Handle("/healthz", s.healthHandler(func() func() error { return s.liveness }))
+	mux.Handle("/readyz", s.healthHandler(func() func() error { return s.readiness }))
+	if s.pprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		klog.Warningf("pprof profiling enabled on metrics port %d", s.port)
+	}
+
+	// Load the key pair up front so a bad certificate fails Start rather than
+	// only being logged by the serving goroutine
+	useTLS := s.tlsCertFile != "" || s.tlsKeyFile != ""
+	if useTLS {
+		if _, err := tls.LoadX509KeyPair(s.tlsCertFile, s.tlsKeyFile); err != nil {
+			return fmt.Errorf("failed to load metrics TLS certificate: %v", err)
+		}
+	}
 
 	s.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", s.port),
+		Addr:    net.JoinHostPort(s.bindAddress, strconv.Itoa(s.port)),
 		Handler: mux,
 	}
 
 	go func() {
-		klog.Infof("Starting metrics server on port %d", s.port)
-		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if useTLS {
+			klog.Infof("Starting metrics server on %s (TLS)", s.httpServer.Addr)
+			err = s.httpServer.ListenAndServeTLS(s.tlsCertFile, s.tlsKeyFile)
+		} else {
+			klog.Infof("Starting metrics server on %s", s.httpServer.Addr)
+			err = s.httpServer.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			klog.Errorf("Metrics server failed: %v", err)
 		}
 	}()
@@ -1,8 +1,17 @@
 package metrics
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -86,6 +95,29 @@ func TestMetricsServerIntegration(t *testing.T) {
 	}
 }
 
+func TestMetricsServerBindAddress(t *testing.T) {
+	server := NewServer(19894)
+	server.SetBindAddress("127.0.0.1")
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if server.httpServer.Addr != "127.0.0.1:19894" {
+		t.Errorf("Expected server address 127.0.0.1:19894, got %s", server.httpServer.Addr)
+	}
+	resp, err := http.Get("http://127.0.0.1:19894/metrics")
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+}
+
 func TestMetricsServerStop(t *testing.T) {
 	// Test that the server can be started and stopped cleanly
 	server := NewServer(19899)
@@ -106,6 +138,179 @@ func TestMetricsServerStop(t *testing.T) {
 	}
 }
 
+func TestMetricsServerHealthChecks(t *testing.T) {
+	server := NewServer(19897)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	get := func(path string) int {
+		t.Helper()
+		resp, err := http.Get("http://localhost:19897" + path)
+		if err != nil {
+			t.Fatalf("Failed to fetch %s: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Without registered checks both endpoints report healthy
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("Expected /healthz status 200 without checks, got %d", code)
+	}
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Errorf("Expected /readyz status 200 without checks, got %d", code)
+	}
+
+	var readyErr error
+	server.RegisterHealthChecks(
+		func() error { return nil },
+		func() error { return readyErr },
+	)
+	readyErr = fmt.Errorf("socket not listening")
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("Expected /healthz status 200, got %d", code)
+	}
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected /readyz status 503 while not ready, got %d", code)
+	}
+
+	readyErr = nil
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Errorf("Expected /readyz status 200 once ready, got %d", code)
+	}
+
+	// The metrics handler is unaffected
+	if code := get("/metrics"); code != http.StatusOK {
+		t.Errorf("Expected /metrics status 200, got %d", code)
+	}
+}
+
+func TestMetricsServerPprof(t *testing.T) {
+	tests := []struct {
+		name   string
+		port   int
+		enable bool
+		want   int
+	}{
+		{"Disabled", 19896, false, http.StatusNotFound},
+		{"Enabled", 19895, true, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(tt.port)
+			if tt.enable {
+				server.EnablePprof()
+			}
+			if err := server.Start(); err != nil {
+				t.Fatalf("Failed to start server: %v", err)
+			}
+			defer server.Stop()
+
+			time.Sleep(100 * time.Millisecond)
+
+			resp, err := http.Get(fmt.Sprintf("http://localhost:%d/debug/pprof/goroutine?debug=1", tt.port))
+			if err != nil {
+				t.Fatalf("Failed to fetch pprof endpoint: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("Expected status %d, got %d", tt.want, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestMetricsServerTLS(t *testing.T) {
+	certFile, keyFile, pool := writeSelfSignedCert(t)
+
+	server := NewServer(19893)
+	server.SetTLS(certFile, keyFile)
+	if err := server.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://localhost:19893/metrics")
+	if err != nil {
+		t.Fatalf("Failed to fetch metrics over TLS: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	// Plain HTTP is refused
+	if resp, err := http.Get("http://localhost:19893/metrics"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("Expected plain HTTP to be rejected")
+		}
+	}
+}
+
+func TestMetricsServerTLSInvalidCert(t *testing.T) {
+	server := NewServer(19892)
+	server.SetTLS(filepath.Join(t.TempDir(), "missing.crt"), filepath.Join(t.TempDir(), "missing.key"))
+	if err := server.Start(); err == nil {
+		server.Stop()
+		t.Fatalf("Expected Start to fail with a missing certificate")
+	}
+}
+
+// writeSelfSignedCert writes a self-signed certificate for localhost and its
+// key to a temporary directory and returns their paths and a pool trusting it
+func writeSelfSignedCert(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
 // Helper function to create a test file with actual data (not sparse)
 // This ensures blocks are actually allocated on disk for accurate used space metrics.
 // Unlike createTestFile in metrics_test.go which creates sparse files for testing size.
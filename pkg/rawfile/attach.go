@@ -0,0 +1,114 @@
+package rawfile
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// attachedNodesAnnotation, prefixed with the driver name, lists the comma
+// separated nodes a PersistentVolume is attached to in attach mode
+const attachedNodesAnnotation = "/attached-nodes"
+
+// attachedNodes returns the nodes pv is recorded as attached to
+func (cs *ControllerServer) attachedNodes(pv *corev1.PersistentVolume) []string {
+	value := pv.Annotations[cs.name+attachedNodesAnnotation]
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// setAttachedNodes records nodes as the attachments of pv, removing the
+// annotation once the volume is attached nowhere
+func (cs *ControllerServer) setAttachedNodes(ctx context.Context, pv *corev1.PersistentVolume, nodes []string) error {
+	var value interface{}
+	if len(nodes) > 0 {
+		slices.Sort(nodes)
+		value = strings.Join(nodes, ",")
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{cs.name + attachedNodesAnnotation: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = cs.clientset.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// attachVolume records that the volume is attached to the node. Backing files
+// live on a single node, so a volume pinned elsewhere cannot be attached.
+func (cs *ControllerServer) attachVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) error {
+	if req.VolumeId == "" {
+		return status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if req.NodeId == "" {
+		return status.Error(codes.InvalidArgument, "node ID is required")
+	}
+	if err := validateVolumeCapability(req.VolumeCapability); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if cs.clientset == nil {
+		return status.Errorf(codes.FailedPrecondition, "Kubernetes clientset not configured - cannot record attachments")
+	}
+
+	pv, err := cs.findPersistentVolume(ctx, req.VolumeId)
+	if err != nil {
+		return err
+	}
+	if node := nodeFromAffinity(pv); node != "" && node != req.NodeId {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is on node %s and cannot be attached to node %s", req.VolumeId, node, req.NodeId)
+	}
+	nodes := cs.attachedNodes(pv)
+	if slices.Contains(nodes, req.NodeId) {
+		return nil
+	}
+	if err := cs.setAttachedNodes(ctx, pv, append(nodes, req.NodeId)); err != nil {
+		return status.Errorf(codes.Internal, "failed to record attachment of volume %s to node %s: %v", req.VolumeId, req.NodeId, err)
+	}
+	klog.Infof("ControllerPublishVolume: attached %s to node %s", req.VolumeId, req.NodeId)
+	return nil
+}
+
+// detachVolume forgets the attachment of the volume to the node, or to every
+// node when none is given. Volumes that are gone are already detached.
+func (cs *ControllerServer) detachVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) error {
+	if req.VolumeId == "" {
+		return status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if cs.clientset == nil {
+		return status.Errorf(codes.FailedPrecondition, "Kubernetes clientset not configured - cannot record attachments")
+	}
+
+	pv, err := cs.findPersistentVolume(ctx, req.VolumeId)
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	nodes := cs.attachedNodes(pv)
+	remaining := slices.DeleteFunc(slices.Clone(nodes), func(node string) bool {
+		return req.NodeId == "" || node == req.NodeId
+	})
+	if len(remaining) == len(nodes) {
+		return nil
+	}
+	if err := cs.setAttachedNodes(ctx, pv, remaining); err != nil {
+		return status.Errorf(codes.Internal, "failed to record detachment of volume %s from node %s: %v", req.VolumeId, req.NodeId, err)
+	}
+	klog.Infof("ControllerUnpublishVolume: detached %s from node %s", req.VolumeId, req.NodeId)
+	return nil
+}
@@ -0,0 +1,123 @@
+package rawfile
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestController_AttachMode(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(
+		newPinnedTestPV("vol-pinned", "/tmp/my-csi-driver", "node-1", 0),
+		newTestPV("vol-free", "test-driver", "1Mi"),
+	)
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", "/tmp/my-csi-driver", clientset)
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	publish := func(volumeID, nodeID string) error {
+		_, err := cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeID, NodeId: nodeID, VolumeCapability: capability})
+		return err
+	}
+	attached := func(name string) string {
+		pv, err := clientset.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get PV %s: %v", name, err)
+		}
+		value, ok := pv.Annotations["test-driver"+attachedNodesAnnotation]
+		if !ok {
+			return "<none>"
+		}
+		return value
+	}
+	hasPublishCap := func() bool {
+		resp, err := cs.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+		if err != nil {
+			t.Fatalf("ControllerGetCapabilities failed: %v", err)
+		}
+		for _, c := range resp.Capabilities {
+			if c.GetRpc().GetType() == csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Off by default: nothing is advertised or recorded
+	if hasPublishCap() {
+		t.Errorf("expected PUBLISH_UNPUBLISH_VOLUME to be off by default")
+	}
+	if err := publish("vol-pinned", "node-1"); err != nil {
+		t.Fatalf("ControllerPublishVolume failed: %v", err)
+	}
+	if got := attached("vol-pinned"); got != "<none>" {
+		t.Errorf("expected no attachment recorded without attach mode, got %q", got)
+	}
+
+	cs.attachEnabled = true
+	if !hasPublishCap() {
+		t.Errorf("expected PUBLISH_UNPUBLISH_VOLUME in attach mode")
+	}
+	if err := publish("vol-pinned", "node-1"); err != nil {
+		t.Fatalf("ControllerPublishVolume failed: %v", err)
+	}
+	// Publishing again is idempotent
+	if err := publish("vol-pinned", "node-1"); err != nil {
+		t.Fatalf("repeated ControllerPublishVolume failed: %v", err)
+	}
+	if got := attached("vol-pinned"); got != "node-1" {
+		t.Errorf("expected vol-pinned attached to node-1, got %q", got)
+	}
+	// The backing file only exists on the node the volume is pinned to
+	if err := publish("vol-pinned", "node-2"); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition attaching to another node, got %v", err)
+	}
+	if err := publish("vol-missing", "node-1"); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for an unknown volume, got %v", err)
+	}
+	if err := publish("vol-free", ""); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument without a node, got %v", err)
+	}
+
+	// Volumes not yet pinned may be attached to several nodes
+	for _, node := range []string{"node-b", "node-a"} {
+		if err := publish("vol-free", node); err != nil {
+			t.Fatalf("ControllerPublishVolume to %s failed: %v", node, err)
+		}
+	}
+	if got := attached("vol-free"); got != "node-a,node-b" {
+		t.Errorf("expected vol-free attached to node-a,node-b, got %q", got)
+	}
+
+	unpublish := func(volumeID, nodeID string) error {
+		_, err := cs.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: nodeID})
+		return err
+	}
+	if err := unpublish("vol-free", "node-b"); err != nil {
+		t.Fatalf("ControllerUnpublishVolume failed: %v", err)
+	}
+	if got := attached("vol-free"); got != "node-a" {
+		t.Errorf("expected vol-free attached to node-a only, got %q", got)
+	}
+	// Without a node the volume is detached everywhere and the annotation removed
+	if err := unpublish("vol-free", ""); err != nil {
+		t.Fatalf("ControllerUnpublishVolume failed: %v", err)
+	}
+	if got := attached("vol-free"); got != "<none>" {
+		t.Errorf("expected the annotation removed, got %q", got)
+	}
+	// Detaching what is already detached, or gone, succeeds
+	if err := unpublish("vol-free", "node-a"); err != nil {
+		t.Errorf("repeated ControllerUnpublishVolume failed: %v", err)
+	}
+	if err := unpublish("vol-missing", "node-1"); err != nil {
+		t.Errorf("expected ControllerUnpublishVolume of an unknown volume to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,328 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// VolumeBackend provides the storage of volumes on a node. The node server
+// validates requests, holds the volume lock and bounds the time taken; the
+// backend sets the volume up at the staging path and tears it down again.
+type VolumeBackend interface {
+	// Stage makes the volume available at the staging path of req, creating
+	// its storage just-in-time. Staging a staged volume does nothing.
+	Stage(ctx context.Context, req *csi.NodeStageVolumeRequest, volCtx VolumeContext) error
+	// Unstage undoes Stage. Unstaging a volume that isn't staged does nothing.
+	Unstage(ctx context.Context, req *csi.NodeUnstageVolumeRequest) error
+	// Remove deletes the storage of an orphaned volume at path
+	Remove(ctx context.Context, path string) error
+	// Stats reports the usage and condition of the volume published at
+	// volumePath, which is known to be mounted
+	Stats(ctx context.Context, volumeID, volumePath string) (*csi.NodeGetVolumeStatsResponse, error)
+}
+
+// newVolumeBackends returns the backends of a node server by backing mode
+func newVolumeBackends(ns *NodeServer) map[string]VolumeBackend {
+	return map[string]VolumeBackend{
+		backingModeFile:      &loopFileBackend{ns: ns},
+		backingModeSubvolume: &subvolumeBackend{ns: ns},
+		backingModeTmpfs:     &tmpfsBackend{ns: ns},
+	}
+}
+
+// backend returns the backend serving volumes with the given context
+func (ns *NodeServer) backend(volCtx VolumeContext) VolumeBackend {
+	return ns.backends[volCtx.BackingMode]
+}
+
+// stagedBackend returns the backend of a volume from what exists for it on
+// the node, for calls that don't carry the volume context. tmpfs volumes
+// leave nothing behind but the mount at path, its staging or target path.
+func (ns *NodeServer) stagedBackend(volumeID, path string) VolumeBackend {
+	if ns.isTmpfsMount(path) {
+		return ns.backends[backingModeTmpfs]
+	}
+	if _, ok := ns.findBackingFile(ns.subvolumePath(volumeID)); ok {
+		return ns.backends[backingModeSubvolume]
+	}
+	return ns.backends[backingModeFile]
+}
+
+// backendForPath returns the backend owning the backing file or subvolume at path
+func (ns *NodeServer) backendForPath(path string) VolumeBackend {
+	if strings.HasSuffix(path, subvolumeSuffix) {
+		return ns.backends[backingModeSubvolume]
+	}
+	return ns.backends[backingModeFile]
+}
+
+// loopFileBackend, the default backend, keeps each volume in a backing file
+// attached to a loop device, or to an nbd device for qcow2 images, with a
+// filesystem mounted at the staging path. Block volumes get the device
+// bind-mounted onto a file inside the staging directory instead.
+type loopFileBackend struct {
+	ns *NodeServer
+}
+
+func (b *loopFileBackend) Stage(ctx context.Context, req *csi.NodeStageVolumeRequest, volCtx VolumeContext) error {
+	ns := b.ns
+	var err error
+
+	block := req.VolumeCapability.GetBlock() != nil
+	stagingDevice := blockStagingDevice(req.StagingTargetPath)
+
+	// The capability takes precedence, then the storage class fsType recorded
+	// at CreateVolume, then the node's default. Checked before a loop device is
+	// attached.
+	fsType := req.VolumeCapability.GetMount().GetFsType()
+	if fsType == "" {
+		fsType = volCtx.FsType
+	}
+	if fsType == "" {
+		fsType = ns.defaultFsType
+	}
+	if !block && !supportedFsTypes[fsType] {
+		return status.Errorf(codes.InvalidArgument, "unsupported fsType %q", fsType)
+	}
+	mkfsOptions := volCtx.MkfsOptions
+	if volCtx.FsLabel != "" && !block {
+		if err := validateFsLabel(volCtx.FsLabel, fsType); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		mkfsOptions = append(mkfsOptions, "-L", volCtx.FsLabel)
+	}
+	if block && volCtx.Encrypted {
+		return status.Error(codes.InvalidArgument, "encryption is only supported for filesystem volumes")
+	}
+	if block && volCtx.Qcow2 {
+		return status.Error(codes.InvalidArgument, "qcow2 backing files are only supported for filesystem volumes")
+	}
+
+	// Already staged: nothing to do (idempotent)
+	if block {
+		if _, ok := findBlockLoopDevice(stagingDevice); ok {
+			return nil
+		}
+	} else if mounted, err := b.ns.isMountPoint(req.StagingTargetPath); err != nil {
+		return status.Errorf(codes.Internal, "failed to check staging path %s: %v", req.StagingTargetPath, err)
+	} else if mounted {
+		return nil
+	}
+
+	if err := ns.makeMountDir(req.StagingTargetPath); err != nil {
+		return toStatus(err)
+	}
+
+	backingFile := volCtx.BackingFile
+	if err := ns.validateBackingFile(backingFile); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if existing, ok := ns.findBackingFile(backingFile); ok {
+		backingFile = existing
+	} else {
+		backingFile = ns.placeBackingFile(backingFile)
+	}
+	klog.Infof("NodeStageVolume backingFile: %s", backingFile)
+
+	// Volumes from older controllers may lack a size
+	size := volumeSize(volCtx, backingFile)
+
+	// Clones start from a copy of the source volume's backing file
+	cloneSource := volCtx.CloneSourceFile
+	if cloneSource != "" {
+		if err := ns.validateBackingFile(cloneSource); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid clone source: %v", err)
+		}
+		cloneSource, _ = ns.findBackingFile(cloneSource)
+	}
+
+	// Resolve the encryption key before touching the node so a missing secret fails cleanly
+	var key []byte
+	if volCtx.Encrypted {
+		if key, err = encryptionKey(req.Secrets); err != nil {
+			return err
+		}
+	}
+
+	qcow2 := false
+	if volCtx.Qcow2 {
+		if qcow2, err = ns.useQcow2(ctx, backingFile); err != nil {
+			return toStatus(err)
+		}
+	}
+
+	// Refuse before creating anything when another loop device would exceed the node's limit
+	if !qcow2 {
+		if err := ns.checkLoopDeviceLimit(); err != nil {
+			return err
+		}
+	}
+
+	_, statErr := os.Stat(backingFile)
+	if err := ns.ensureBackingFile(ctx, backingFile, size, cloneSource, qcow2, volCtx.Preallocate); err != nil {
+		return toStatus(err)
+	}
+	if os.IsNotExist(statErr) {
+		ns.recordVolumeEvent(ctx, req.VolumeId, req.VolumeContext, corev1.EventTypeNormal, eventReasonBackingFileCreated, "Created backing file %s (%d bytes) on node %s", backingFile, size, ns.nodeID)
+	}
+
+	// Attach the backing file: qcow2 images through qemu-nbd, raw files as a loop device
+	var loopDev string
+	detach := ns.detachLoopDevice
+	if qcow2 {
+		loopDev, err = ns.attachNBD(ctx, backingFile)
+		detach = ns.detachNBD
+	} else {
+		loopDev, err = ns.setupLoopDevice(ctx, backingFile)
+	}
+	if err != nil {
+		return wrapStatus(err, "failed to set up loop device")
+	}
+
+	// Detach the device again if any later step fails, so failed attempts don't leak /dev/loopN or /dev/nbdN
+	staged := false
+	defer func() {
+		if !staged {
+			detach(context.WithoutCancel(ctx), loopDev)
+		}
+	}()
+
+	// Raw block: expose the loop device itself inside the staging directory
+	if block {
+		klog.Infof("NodeStageVolume bind-mounting block device %s", loopDev)
+		if err := createBlockTarget(stagingDevice); err != nil {
+			return toStatus(err)
+		}
+		if err := ns.bindMount(ctx, loopDev, stagingDevice, nil); err != nil {
+			return status.Errorf(codes.Internal, "failed to bind mount block device: %v", err)
+		}
+		staged = true
+		return nil
+	}
+
+	// Read-only volumes are never formatted; they must already carry a filesystem
+	readOnly := isReadOnlyAccessMode(req.VolumeCapability.GetAccessMode().GetMode())
+
+	// Encrypted volumes put the filesystem on the opened LUKS device instead of the loop device
+	device := loopDev
+	if volCtx.Encrypted {
+		if device, err = ns.openLUKS(ctx, loopDev, req.VolumeId, key, readOnly); err != nil {
+			return status.Errorf(codes.Internal, "failed to open encrypted device: %v", err)
+		}
+		// Runs before the loop device is detached
+		defer func() {
+			if !staged {
+				if err := ns.runCommand(context.WithoutCancel(ctx), "cryptsetup", "luksClose", luksMapperName(req.VolumeId)); err != nil {
+					klog.Errorf("Failed to close LUKS device for %s: %v", req.VolumeId, err)
+				}
+			}
+		}()
+	}
+
+	// Format if needed (only if not already formatted).
+	var options []string
+	if readOnly {
+		options = append(options, "ro")
+	}
+	options = mergeMountOptions(options, capabilityMountFlags(req.VolumeCapability))
+	if !readOnly {
+		klog.Infof("NodeStageVolume format: %s %s", device, fsType)
+		if err := ns.formatIfNeeded(ctx, device, fsType, mkfsOptions); err != nil {
+			return wrapStatus(err, "failed to format device")
+		}
+	}
+
+	// Mount device
+	if err := ns.mountDevice(ctx, device, req.StagingTargetPath, fsType, options); err != nil {
+		return wrapStatus(err, "failed to mount device")
+	}
+
+	if !readOnly {
+		if err := ns.applyMountPermissions(ctx, req.StagingTargetPath); err != nil {
+			return err
+		}
+	}
+
+	staged = true
+	return nil
+}
+
+func (b *loopFileBackend) Unstage(ctx context.Context, req *csi.NodeUnstageVolumeRequest) error {
+	ns := b.ns
+	// Raw block volumes: the staging device file is the bind-mounted loop device
+	stagingDevice := blockStagingDevice(req.StagingTargetPath)
+	if loopDev, ok := findBlockLoopDevice(stagingDevice); ok {
+		if err := ns.runCommand(ctx, "umount", stagingDevice); err != nil {
+			return status.Errorf(codes.Internal, "failed to unmount block device: %v", err)
+		}
+		ns.clearIOLimits(loopDev)
+		if err := ns.runCommand(ctx, "losetup", "-d", loopDev); err != nil {
+			return status.Errorf(codes.Internal, "failed to detach loop device: %v", err)
+		}
+		if err := os.Remove(stagingDevice); err != nil && !os.IsNotExist(err) {
+			return status.Errorf(codes.Internal, "failed to remove block staging device: %v", err)
+		}
+		return nil
+	}
+
+	// Unmount the staging path if it's still mounted
+	mounted, err := b.ns.isMountPoint(req.StagingTargetPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to check staging path %s: %v", req.StagingTargetPath, err)
+	}
+	if mounted {
+		if err := ns.runCommand(ctx, "umount", req.StagingTargetPath); err != nil {
+			return status.Errorf(codes.Internal, "failed to unmount: %v", err)
+		}
+	}
+
+	// Close the LUKS device of an encrypted volume before its loop device can be detached
+	if err := ns.closeLUKS(ctx, req.VolumeId); err != nil {
+		return status.Errorf(codes.Internal, "failed to close encrypted device: %v", err)
+	}
+
+	// Disconnect the nbd device of a qcow2 backing file
+	backingFile := ns.backingFilePath(req.VolumeId)
+	if device, ok := ns.findNBDDevice(backingFile); ok {
+		if err := ns.runCommand(ctx, "qemu-nbd", "--disconnect", device); err != nil {
+			return status.Errorf(codes.Internal, "failed to disconnect nbd device: %v", err)
+		}
+		return nil
+	}
+
+	// Detach the loop device backing this volume, if any
+	loopDev, err := findLoopDevice(ctx, ns.runner, backingFile)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to find loop device for %s: %v", backingFile, err)
+	}
+	if loopDev != "" {
+		ns.clearIOLimits(loopDev)
+		if err := ns.runCommand(ctx, "losetup", "-d", loopDev); err != nil {
+			return status.Errorf(codes.Internal, "failed to detach loop device: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func (b *loopFileBackend) Remove(ctx context.Context, path string) error {
+	return os.Remove(path)
+}
+
+func (b *loopFileBackend) Stats(ctx context.Context, volumeID, volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	usage, err := statfsUsage(volumePath)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: b.ns.volumeCondition(ctx, volumeID, volumePath),
+	}, nil
+}
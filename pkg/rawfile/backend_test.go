@@ -0,0 +1,72 @@
+package rawfile
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeBackend records the volumes the node server hands to it
+type fakeBackend struct {
+	calls []string
+}
+
+func (b *fakeBackend) Stage(ctx context.Context, req *csi.NodeStageVolumeRequest, volCtx VolumeContext) error {
+	b.calls = append(b.calls, "stage "+req.VolumeId+" "+volCtx.BackingFile)
+	return nil
+}
+
+func (b *fakeBackend) Unstage(ctx context.Context, req *csi.NodeUnstageVolumeRequest) error {
+	b.calls = append(b.calls, "unstage "+req.VolumeId)
+	return nil
+}
+
+func (b *fakeBackend) Remove(ctx context.Context, path string) error {
+	b.calls = append(b.calls, "remove "+path)
+	return nil
+}
+
+func (b *fakeBackend) Stats(ctx context.Context, volumeID, volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	b.calls = append(b.calls, "stats "+volumeID)
+	return &csi.NodeGetVolumeStatsResponse{}, nil
+}
+
+func TestNode_VolumeBackend(t *testing.T) {
+	testDir := t.TempDir()
+	runner := &fakeRunner{}
+	backend := &fakeBackend{}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+	ns.backends[backingModeFile] = backend
+
+	backingFile := filepath.Join(testDir, "vol-1.img")
+	if _, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+		VolumeContext:     map[string]string{"backingFile": backingFile},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	if _, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+	}); err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %v", err)
+	}
+
+	want := []string{"stage vol-1 " + backingFile, "unstage vol-1"}
+	if !reflect.DeepEqual(backend.calls, want) {
+		t.Errorf("expected %v, got %v", want, backend.calls)
+	}
+	if len(runner.calls) != 0 {
+		t.Errorf("expected the backend to run every command, got %v", runner.calls)
+	}
+}
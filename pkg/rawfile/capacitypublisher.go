@@ -0,0 +1,154 @@
+package rawfile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"time"
+
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// DefaultCapacityPublishInterval is how often the controller brings the
+// CSIStorageCapacity objects in line with the nodes' capacity reports.
+const DefaultCapacityPublishInterval = time.Minute
+
+// Labels on the CSIStorageCapacity objects the controller publishes; the
+// driver name label matches the external-provisioner's, the managed-by value
+// tells them apart
+const (
+	capacityDriverLabel    = "csi.storage.k8s.io/drivername"
+	capacityManagedByLabel = "csi.storage.k8s.io/managed-by"
+	capacityManagedBy      = "my-csi-driver-controller"
+)
+
+// RunCapacityPublisher periodically publishes a CSIStorageCapacity object in
+// namespace for every node with a current capacity report and every storage
+// class of the driver, so the scheduler only places pods with volumes of
+// that class on nodes with room for them. Objects of nodes that are gone or
+// stopped reporting, and of deleted storage classes, are removed.
+func (cs *ControllerServer) RunCapacityPublisher(ctx context.Context, namespace string, interval time.Duration) {
+	klog.Infof("Starting capacity publisher in namespace %s with interval %v", namespace, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := cs.publishCapacity(ctx, namespace); err != nil {
+			klog.Errorf("Failed to publish storage capacity: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			klog.Infof("Capacity publisher stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishCapacity creates, updates and deletes the driver's
+// CSIStorageCapacity objects in namespace to match the current node reports
+func (cs *ControllerServer) publishCapacity(ctx context.Context, namespace string) error {
+	if cs.clientset == nil {
+		klog.V(2).Infof("Skipping capacity publishing: Kubernetes clientset not configured")
+		return nil
+	}
+	classes, err := cs.clientset.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	nodes, err := cs.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	desired := make(map[string]*storagev1.CSIStorageCapacity)
+	for _, class := range classes.Items {
+		if class.Provisioner != cs.name {
+			continue
+		}
+		for i := range nodes.Items {
+			available, ok := cs.nodeCapacity(&nodes.Items[i])
+			if !ok {
+				continue
+			}
+			capacity := cs.storageCapacity(namespace, class.Name, nodes.Items[i].Name, available)
+			desired[capacity.Name] = capacity
+		}
+	}
+
+	client := cs.clientset.StorageV1().CSIStorageCapacities(namespace)
+	existing, err := client.List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(cs.capacityLabels()).String()})
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := range existing.Items {
+		current := &existing.Items[i]
+		want, ok := desired[current.Name]
+		if !ok {
+			if err := client.Delete(ctx, current.Name, metav1.DeleteOptions{}); err != nil {
+				errs = append(errs, err)
+			} else {
+				klog.V(2).Infof("Deleted CSIStorageCapacity %s/%s of storage class %s", namespace, current.Name, current.StorageClassName)
+			}
+			continue
+		}
+		delete(desired, current.Name)
+		if current.StorageClassName == want.StorageClassName &&
+			reflect.DeepEqual(current.NodeTopology, want.NodeTopology) &&
+			current.Capacity != nil && current.Capacity.Cmp(*want.Capacity) == 0 &&
+			current.MaximumVolumeSize != nil && current.MaximumVolumeSize.Cmp(*want.MaximumVolumeSize) == 0 {
+			continue
+		}
+		updated := current.DeepCopy()
+		updated.NodeTopology = want.NodeTopology
+		updated.Capacity = want.Capacity
+		updated.MaximumVolumeSize = want.MaximumVolumeSize
+		if _, err := client.Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, capacity := range desired {
+		if _, err := client.Create(ctx, capacity, metav1.CreateOptions{}); err != nil {
+			errs = append(errs, err)
+		} else {
+			klog.V(2).Infof("Created CSIStorageCapacity %s/%s of storage class %s", namespace, capacity.Name, capacity.StorageClassName)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// capacityLabels select the CSIStorageCapacity objects of this driver
+func (cs *ControllerServer) capacityLabels() map[string]string {
+	return map[string]string{
+		capacityDriverLabel:    cs.name,
+		capacityManagedByLabel: capacityManagedBy,
+	}
+}
+
+// storageCapacity returns the CSIStorageCapacity object for a storage class on
+// a node. Its name is derived from both, so each pair has exactly one object.
+func (cs *ControllerServer) storageCapacity(namespace, className, nodeName string, available int64) *storagev1.CSIStorageCapacity {
+	sum := sha256.Sum256([]byte(cs.name + "/" + className + "/" + nodeName))
+	return &storagev1.CSIStorageCapacity{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "csisc-" + hex.EncodeToString(sum[:8]),
+			Namespace: namespace,
+			Labels:    cs.capacityLabels(),
+		},
+		StorageClassName: className,
+		NodeTopology: &metav1.LabelSelector{
+			MatchLabels: map[string]string{topologyKey: nodeName},
+		},
+		Capacity: resource.NewQuantity(available, resource.BinarySI),
+		// Backing files can't span directories, so the largest volume is
+		// what the emptiest directory can hold
+		MaximumVolumeSize: resource.NewQuantity(available, resource.BinarySI),
+	}
+}
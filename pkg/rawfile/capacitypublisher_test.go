@@ -0,0 +1,72 @@
+package rawfile
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestController_PublishCapacity(t *testing.T) {
+	ctx := context.Background()
+	valid := time.Now().Add(time.Hour)
+	clientset := fake.NewSimpleClientset(
+		newCapacityReportedNode("node-1", "1048576", valid),
+		newCapacityReportedNode("node-2", "2097152", valid),
+		newCapacityReportedNode("node-stale", "1048576", time.Now().Add(-time.Minute)),
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "fast"}, Provisioner: "test-driver"},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "other"}, Provisioner: "other-driver"},
+	)
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", t.TempDir(), clientset)
+	published := func() map[string]int64 {
+		list, err := clientset.StorageV1().CSIStorageCapacities("kube-system").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("failed to list CSIStorageCapacities: %v", err)
+		}
+		capacities := make(map[string]int64)
+		for _, c := range list.Items {
+			capacities[c.StorageClassName+"/"+c.NodeTopology.MatchLabels[topologyKey]] = c.Capacity.Value()
+		}
+		return capacities
+	}
+	expect := func(want map[string]int64) {
+		t.Helper()
+		if err := cs.publishCapacity(ctx, "kube-system"); err != nil {
+			t.Fatalf("publishCapacity failed: %v", err)
+		}
+		got := published()
+		if len(got) != len(want) {
+			t.Errorf("expected %v published, got %v", want, got)
+			return
+		}
+		for key, capacity := range want {
+			if got[key] != capacity {
+				t.Errorf("expected %s to have capacity %d, got %v", key, capacity, got)
+			}
+		}
+	}
+
+	// Only current reports and the driver's own storage classes are published
+	expect(map[string]int64{"fast/node-1": 1048576, "fast/node-2": 2097152})
+	// Publishing again changes nothing
+	expect(map[string]int64{"fast/node-1": 1048576, "fast/node-2": 2097152})
+
+	// New reports update the objects
+	if _, err := clientset.CoreV1().Nodes().Update(ctx, newCapacityReportedNode("node-1", "4194304", valid), metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update node: %v", err)
+	}
+	expect(map[string]int64{"fast/node-1": 4194304, "fast/node-2": 2097152})
+
+	// Removed nodes and storage classes take their objects with them
+	if err := clientset.CoreV1().Nodes().Delete(ctx, "node-2", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete node: %v", err)
+	}
+	expect(map[string]int64{"fast/node-1": 4194304})
+	if err := clientset.StorageV1().StorageClasses().Delete(ctx, "fast", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete storage class: %v", err)
+	}
+	expect(map[string]int64{})
+}
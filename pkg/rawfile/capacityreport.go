@@ -0,0 +1,143 @@
+package rawfile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// Node annotations, prefixed with the driver name, carrying the capacity
+// report: the bytes free for a new backing file, and until when the value
+// may be trusted. The node sets the expiry from its own report interval so
+// the controller needs no knowledge of it.
+const (
+	availableCapacityAnnotation  = "/available-capacity"
+	capacityValidUntilAnnotation = "/available-capacity-valid-until"
+)
+
+// capacityReportsMissed is how many capacity reports may be missed before the
+// last one expires
+const capacityReportsMissed = 3
+
+// RunCapacityReporter periodically publishes the free space of the backing
+// directories on this node's Node object, so the controller can place and
+// size volumes by it. Updates the node plugin isn't allowed to make are
+// logged as warnings and retried.
+func (ns *NodeServer) RunCapacityReporter(ctx context.Context, interval time.Duration) {
+	klog.Infof("Starting capacity reporter with interval %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := ns.reportCapacity(ctx, interval); apierrors.IsForbidden(err) {
+			klog.Warningf("Not allowed to report capacity on node %s, check the node plugin's RBAC rules: %v", ns.nodeID, err)
+		} else if err != nil {
+			klog.Errorf("Failed to report capacity: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			klog.Infof("Capacity reporter stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportCapacity records the space available for a new volume on the Node,
+// valid for a few report intervals
+func (ns *NodeServer) reportCapacity(ctx context.Context, interval time.Duration) error {
+	if ns.clientset == nil {
+		klog.V(2).Infof("Skipping capacity report: Kubernetes clientset not configured")
+		return nil
+	}
+	available, err := ns.availableForNewVolume()
+	if err != nil {
+		return err
+	}
+
+	validUntil := time.Now().Add(capacityReportsMissed * interval)
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				ns.driverName + availableCapacityAnnotation:  strconv.FormatInt(available, 10),
+				ns.driverName + capacityValidUntilAnnotation: validUntil.UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := ns.clientset.CoreV1().Nodes().Patch(ctx, ns.nodeID, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	klog.V(4).Infof("Reported %d bytes available on node %s", available, ns.nodeID)
+	return nil
+}
+
+// availableForNewVolume returns the size of the largest backing file that
+// could be created: the most free space in any one backing directory, less
+// the reserved capacity
+func (ns *NodeServer) availableForNewVolume() (int64, error) {
+	var largest int64
+	for _, dir := range ns.backingDirs() {
+		available, err := availableCapacity(dir)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get capacity of %s: %v", dir, err)
+		}
+		if available = withoutReserve(available, ns.reservedCapacity); available > largest {
+			largest = available
+		}
+	}
+	return largest, nil
+}
+
+// reportedCapacity returns the capacity a node last reported, if the report
+// is still valid
+func (cs *ControllerServer) reportedCapacity(ctx context.Context, nodeName string) (int64, bool) {
+	if cs.clientset == nil || nodeName == "" {
+		return 0, false
+	}
+	node, err := cs.clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		klog.V(4).Infof("Capacity of node %s unknown: %v", nodeName, err)
+		return 0, false
+	}
+	return cs.nodeCapacity(node)
+}
+
+// nodeCapacity reads the capacity report from the annotations of node
+func (cs *ControllerServer) nodeCapacity(node *corev1.Node) (int64, bool) {
+	validUntil, err := time.Parse(time.RFC3339, node.Annotations[cs.name+capacityValidUntilAnnotation])
+	if err != nil || time.Now().After(validUntil) {
+		klog.V(4).Infof("Node %s has no current capacity report", node.Name)
+		return 0, false
+	}
+	available, err := strconv.ParseInt(node.Annotations[cs.name+availableCapacityAnnotation], 10, 64)
+	if err != nil {
+		klog.V(4).Infof("Node %s reported no usable capacity: %v", node.Name, err)
+		return 0, false
+	}
+	return available, true
+}
+
+// checkNodeCapacity fails with ResourceExhausted when the node a new volume
+// is placed on has reported less free space than the volume needs, so the pod
+// isn't scheduled there only to fail at staging. It is best effort: without a
+// current report from the node the volume is let through.
+func (cs *ControllerServer) checkNodeCapacity(ctx context.Context, nodeName string, size int64) error {
+	available, ok := cs.reportedCapacity(ctx, nodeName)
+	if ok && size > available {
+		return status.Errorf(codes.ResourceExhausted, "node %s has %d bytes available, not enough for a %d byte volume", nodeName, available, size)
+	}
+	return nil
+}
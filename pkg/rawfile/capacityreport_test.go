@@ -0,0 +1,117 @@
+package rawfile
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newCapacityReportedNode returns a Node carrying a test-driver capacity
+// report valid until validUntil
+func newCapacityReportedNode(name, available string, validUntil time.Time) *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name: name,
+		Annotations: map[string]string{
+			"test-driver" + availableCapacityAnnotation:  available,
+			"test-driver" + capacityValidUntilAnnotation: validUntil.UTC().Format(time.RFC3339),
+		},
+	}}
+}
+
+func TestNode_ReportCapacity(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "test-node"}})
+	ns := NewNodeServer("test-node", "test-driver", t.TempDir(), clientset)
+
+	if err := ns.reportCapacity(context.Background(), time.Minute); err != nil {
+		t.Fatalf("reportCapacity failed: %v", err)
+	}
+	node, err := clientset.CoreV1().Nodes().Get(context.Background(), "test-node", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get node: %v", err)
+	}
+	if available, err := strconv.ParseInt(node.Annotations["test-driver"+availableCapacityAnnotation], 10, 64); err != nil || available <= 0 {
+		t.Errorf("expected available capacity reported, got %q", node.Annotations["test-driver"+availableCapacityAnnotation])
+	}
+	validUntil, err := time.Parse(time.RFC3339, node.Annotations["test-driver"+capacityValidUntilAnnotation])
+	if err != nil {
+		t.Fatalf("expected a validity deadline, got %v", err)
+	}
+	if remaining := time.Until(validUntil); remaining < 2*time.Minute || remaining > 3*time.Minute {
+		t.Errorf("expected the report valid for about 3 intervals, got %v", remaining)
+	}
+
+	// A node plugin without RBAC for Nodes gets Forbidden back
+	clientset.PrependReactor("patch", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "nodes"}, "test-node", nil)
+	})
+	if err := ns.reportCapacity(context.Background(), time.Minute); !apierrors.IsForbidden(err) {
+		t.Errorf("expected Forbidden, got %v", err)
+	}
+}
+
+func TestController_CreateVolume_NodeCapacity(t *testing.T) {
+	valid := time.Now().Add(time.Hour)
+	clientset := fake.NewSimpleClientset(
+		newCapacityReportedNode("node-full", "1048576", valid),
+		newCapacityReportedNode("node-roomy", "1073741824", valid),
+		newCapacityReportedNode("node-stale", "1048576", time.Now().Add(-time.Minute)),
+		newCapacityReportedNode("node-unknown", "", valid),
+	)
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", t.TempDir(), clientset)
+
+	for node, want := range map[string]codes.Code{
+		"node-full":    codes.ResourceExhausted,
+		"node-roomy":   codes.OK,
+		"node-stale":   codes.OK,
+		"node-unknown": codes.OK,
+		"node-gone":    codes.OK,
+	} {
+		_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          "testvol-" + node,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 64 * 1048576},
+			AccessibilityRequirements: &csi.TopologyRequirement{
+				Preferred: []*csi.Topology{{Segments: map[string]string{topologyKey: node}}},
+			},
+		})
+		if status.Code(err) != want {
+			t.Errorf("%s: expected %v, got %v", node, want, err)
+		}
+	}
+}
+
+func TestController_GetCapacity_Topology(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		newCapacityReportedNode("node-1", "1048576", time.Now().Add(time.Hour)),
+		newCapacityReportedNode("node-stale", "1048576", time.Now().Add(-time.Minute)),
+	)
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", t.TempDir(), clientset)
+	capacity := func(node string) int64 {
+		resp, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+			AccessibleTopology: &csi.Topology{Segments: map[string]string{topologyKey: node}},
+		})
+		if err != nil {
+			t.Fatalf("GetCapacity for %s failed: %v", node, err)
+		}
+		return resp.AvailableCapacity
+	}
+
+	if got := capacity("node-1"); got != 1048576 {
+		t.Errorf("expected the capacity node-1 reported, got %d", got)
+	}
+	// Without a current report the controller's own backing directory is used
+	if got := capacity("node-stale"); got == 1048576 {
+		t.Errorf("expected the stale report of node-stale ignored")
+	}
+}
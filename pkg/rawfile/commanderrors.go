@@ -0,0 +1,69 @@
+package rawfile
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// commandFailure is a known way losetup, mkfs or mount fail, recognized by
+// their output, and the gRPC code telling kubelet whether retrying can help
+type commandFailure struct {
+	output string
+	code   codes.Code
+}
+
+// commandFailures are matched in order against the lowercased output of a
+// failed command. Unavailable marks transient failures worth retrying soon;
+// ResourceExhausted clears once space or devices are freed, matching
+// backingFileError; FailedPrecondition and InvalidArgument need the node or
+// the storage class fixed before a retry can succeed.
+var commandFailures = []commandFailure{
+	// Transient: another process holds the device or udev hasn't created its node yet
+	{"device or resource busy", codes.Unavailable},
+	{"resource temporarily unavailable", codes.Unavailable},
+	{"mount point busy", codes.Unavailable},
+	{"special device", codes.Unavailable},
+	// Out of space or loop devices
+	{"no space left on device", codes.ResourceExhausted},
+	{"could not find any free loop device", codes.ResourceExhausted},
+	// mount reports "wrong fs type, bad option, bad superblock" for bad options
+	// and damaged filesystems alike; neither clears on its own
+	{"wrong fs type", codes.FailedPrecondition},
+	// Bad options from the storage class or capability mount flags
+	{"invalid option", codes.InvalidArgument},
+	{"unrecognized option", codes.InvalidArgument},
+	{"bad option", codes.InvalidArgument},
+	// The node or the volume needs fixing first
+	{"unknown filesystem type", codes.FailedPrecondition},
+	{"permission denied", codes.FailedPrecondition},
+	{"operation not permitted", codes.FailedPrecondition},
+	{"read-only file system", codes.FailedPrecondition},
+	{"no such file or directory", codes.FailedPrecondition},
+	{"no such device", codes.FailedPrecondition},
+}
+
+// commandErrorCode classifies a failed command from its error and output;
+// failures it doesn't recognize are internal
+func commandErrorCode(err error, out []byte) codes.Code {
+	if errors.Is(err, exec.ErrNotFound) {
+		return codes.FailedPrecondition
+	}
+	text := strings.ToLower(string(out))
+	for _, failure := range commandFailures {
+		if strings.Contains(text, failure.output) {
+			return failure.code
+		}
+	}
+	return codes.Internal
+}
+
+// commandError reports a failed command as a gRPC status with the code of its
+// failure mode, folding the command's output into the message
+func commandError(err error, out []byte, format string, args ...interface{}) error {
+	return status.Errorf(commandErrorCode(err, out), "%s: %v: %s", fmt.Sprintf(format, args...), err, strings.TrimSpace(string(out)))
+}
@@ -0,0 +1,82 @@
+package rawfile
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNode_CommandErrorCodes(t *testing.T) {
+	setupLoop := func(ns *NodeServer) error {
+		_, err := ns.setupLoopDevice(context.Background(), "/var/lib/my-csi-driver/vol-x.img")
+		return err
+	}
+	format := func(ns *NodeServer) error {
+		return ns.formatIfNeeded(context.Background(), "/dev/loop0", "ext4", nil)
+	}
+	mount := func(ns *NodeServer) error {
+		return ns.mountDevice(context.Background(), "/dev/loop0", "/staging", "ext4", nil)
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		output  string
+		op      func(*NodeServer) error
+		want    codes.Code
+	}{
+		{"LosetupBusy", "losetup", "losetup: /var/lib/my-csi-driver/vol-x.img: failed to set up loop device: Device or resource busy", setupLoop, codes.Unavailable},
+		{"LosetupNoFreeDevice", "losetup", "losetup: cannot find an unused loop device: could not find any free loop device", setupLoop, codes.ResourceExhausted},
+		{"LosetupMissingFile", "losetup", "losetup: /var/lib/my-csi-driver/vol-x.img: failed to set up loop device: No such file or directory", setupLoop, codes.FailedPrecondition},
+		{"LosetupNotPermitted", "losetup", "losetup: /dev/loop-control: failed to open: Permission denied", setupLoop, codes.FailedPrecondition},
+		{"LosetupUnknown", "losetup", "losetup: something unexpected", setupLoop, codes.Internal},
+		{"MkfsNoSpace", "mkfs.ext4", "mkfs.ext4: No space left on device while writing out and closing file system", format, codes.ResourceExhausted},
+		{"MkfsBusy", "mkfs.ext4", "/dev/loop0 is apparently in use by the system; will not make a filesystem here!\nDevice or resource busy", format, codes.Unavailable},
+		{"MkfsInvalidOption", "mkfs.ext4", "mkfs.ext4: invalid option -- 'z'", format, codes.InvalidArgument},
+		{"MountWrongFsType", "mount", "mount: /staging: wrong fs type, bad option, bad superblock on /dev/loop0, missing codepage or helper program, or other error.", mount, codes.FailedPrecondition},
+		{"MountDeviceMissing", "mount", "mount: /staging: special device /dev/loop0 does not exist.", mount, codes.Unavailable},
+		{"MountBusy", "mount", "mount: /staging: /dev/loop0 already mounted or mount point busy.", mount, codes.Unavailable},
+		{"MountReadOnly", "mount", "mount: /staging: cannot mount /dev/loop0 read-only.\nRead-only file system", mount, codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := NewNodeServer("test-node", "test-driver", t.TempDir(), nil)
+			ns.runner = &fakeRunner{fail: map[string]bool{tt.command: true}, output: map[string]string{tt.command: tt.output}}
+			if err := tt.op(ns); status.Code(err) != tt.want {
+				t.Errorf("expected %v for %q, got %v", tt.want, tt.output, err)
+			}
+		})
+	}
+
+	if code := commandErrorCode(fmt.Errorf("exec: %w", exec.ErrNotFound), nil); code != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for a missing command, got %v", code)
+	}
+}
+
+func TestNode_StageVolume_TransientFailure(t *testing.T) {
+	testDir := t.TempDir()
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = &fakeRunner{
+		fail:   map[string]bool{"losetup": true},
+		output: map[string]string{"losetup": "losetup: failed to set up loop device: Device or resource busy"},
+	}
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-busy",
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+		VolumeContext:     map[string]string{"backingFile": filepath.Join(testDir, "vol-busy.img"), "size": "1048576"},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("expected NodeStageVolume to report a busy loop device as Unavailable, got %v", err)
+	}
+}
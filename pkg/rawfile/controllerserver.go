@@ -2,13 +2,20 @@ package rawfile
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -22,6 +29,30 @@ type ControllerServer struct {
 	version    string
 	backingDir string
 	clientset  kubernetes.Interface
+	// minVolumeSize and maxVolumeSize bound the size of new volumes in bytes; zero disables the bound
+	minVolumeSize int64
+	maxVolumeSize int64
+	// extraBackingDirs are the node's other data disks; they add to the reported capacity
+	extraBackingDirs []string
+	// reservedCapacity is held back from each backing filesystem and never reported as available
+	reservedCapacity int64
+	// attachEnabled has the controller advertise PUBLISH_UNPUBLISH_VOLUME and
+	// record attachments, for clusters that expect VolumeAttachment objects
+	attachEnabled bool
+	// sizeRounding pads filesystem volumes by their metadata overhead with
+	// SizeRoundingUp; SizeRoundingExact, or empty, keeps the requested size
+	sizeRounding string
+	// qosEnabled has the controller advertise MODIFY_VOLUME and accept the I/O
+	// limits of VolumeAttributesClasses
+	qosEnabled bool
+	// allowedNodes restricts new volumes to these nodes; empty allows every node
+	allowedNodes []string
+	// topologyPolicy chooses among the permitted topologies of a new volume,
+	// one of the TopologyPolicy constants; empty means TopologyPolicyFirst
+	topologyPolicy string
+	// volumes records the volumes created in standalone mode; with a clientset
+	// the PersistentVolumes are the record instead
+	volumes volumeStore
 	csi.UnimplementedControllerServer
 }
 
@@ -51,76 +82,770 @@ func NewControllerServerWithBackingDir(name, version, backingDir string, clients
 	return &ControllerServer{name: name, version: version, backingDir: dir, clientset: clientset}
 }
 
+// volumeStore returns the record of the driver's volumes, or nil when the
+// controller has neither a clientset nor a store of its own
+func (cs *ControllerServer) volumeStore() volumeStore {
+	if cs.volumes != nil {
+		return cs.volumes
+	}
+	if cs.clientset != nil {
+		return &pvVolumeStore{clientset: cs.clientset, driver: cs.name}
+	}
+	return nil
+}
+
+// standalone reports whether the controller runs without the Kubernetes API
+// and keeps its own record of volumes
+func (cs *ControllerServer) standalone() bool {
+	return cs.clientset == nil && cs.volumes != nil
+}
+
+// getStandaloneVolume answers ControllerGetVolume from the volume store
+func (cs *ControllerServer) getStandaloneVolume(ctx context.Context, volumeID string) (*csi.ControllerGetVolumeResponse, error) {
+	record, err := findVolumeRecord(ctx, cs.volumes, volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look up volume %s: %v", volumeID, err)
+	}
+	if record == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+	}
+	volumeContext := map[string]string{
+		"backingFile": record.Context["backingFile"],
+		"size":        strconv.FormatInt(record.Capacity, 10),
+	}
+	if size := record.Context["size"]; size != "" {
+		volumeContext["size"] = size
+	}
+	if created := record.Context[creationTimeParam]; created != "" {
+		volumeContext[creationTimeParam] = created
+	}
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID,
+			CapacityBytes: record.Capacity,
+			VolumeContext: volumeContext,
+		},
+	}, nil
+}
+
+// removeStandaloneVolume deletes the backing file or subvolume of a recorded
+// volume from whichever backing directory the node placed it in. Unknown
+// volumes and volumes the node never created are not an error.
+func (cs *ControllerServer) removeStandaloneVolume(ctx context.Context, volumeID string) error {
+	record, err := findVolumeRecord(ctx, cs.volumes, volumeID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to look up volume %s: %v", volumeID, err)
+	}
+	if record == nil || record.Context["backingFile"] == "" {
+		return nil
+	}
+	backingFile := record.Context["backingFile"]
+	if err := validateBackingFile(cs.backingDir, backingFile); err != nil {
+		return status.Errorf(codes.Internal, "refusing to remove volume %s: %v", volumeID, err)
+	}
+	for _, dir := range append([]string{cs.backingDir}, cs.extraBackingDirs...) {
+		path := filepath.Join(dir, filepath.Base(backingFile))
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return status.Errorf(codes.Internal, "failed to remove backing file %s: %v", path, err)
+		}
+		klog.Infof("DeleteVolume: removed backing file %s", path)
+	}
+	return nil
+}
+
 func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	validateOnly, err := isValidateOnly(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get volume size in bytes
+	size, err := cs.volumeSize(req.CapacityRange)
+	if err != nil {
+		return nil, err
+	}
+	size = cs.roundVolumeSize(size, req)
+
+	// A retried request gets back the volume already created under its name
+	store := cs.volumeStore()
+	if store != nil && !validateOnly && req.Name != "" {
+		existing, err := store.GetByName(ctx, req.Name)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to look up volume %s: %v", req.Name, err)
+		}
+		if existing != nil {
+			if existing.Capacity != size {
+				return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists as %s with capacity %d", req.Name, existing.ID, existing.Capacity)
+			}
+			klog.Infof("CreateVolume: %s already exists as %s", req.Name, existing.ID)
+			return &csi.CreateVolumeResponse{
+				Volume: &csi.Volume{
+					VolumeId:      existing.ID,
+					CapacityBytes: existing.Capacity,
+					VolumeContext: existing.Context,
+					ContentSource: req.VolumeContentSource,
+				},
+			}, nil
+		}
+	}
+
 	volID := "vol-" + uuid.New().String()
+	if validateOnly {
+		volID = validateOnlyVolumePrefix + uuid.New().String()
+	}
 	klog.Infof("CreateVolume: %s (logical creation)", volID)
 
-	// Get volume size in bytes
-	size := req.CapacityRange.GetRequiredBytes()
-	if size == 0 {
-		size = 1 << 30 // Default to 1GiB
+	// Backend providing the volume on the node: a backing file, a subvolume or tmpfs
+	backingMode, err := backingModeVolumeContext(req.Parameters, req.VolumeCapabilities)
+	if err != nil {
+		return nil, err
 	}
+	tmpfs := backingMode[backingModeParam] == backingModeTmpfs
 
-	// Define backing file path (will be created by NodeServer)
-	backingFile := cs.backingDir + "/" + volID + ".img"
-	klog.Infof("CreateVolume backingFile: %s (deferred to node)", backingFile)
+	volumeContext := map[string]string{
+		"size":            strconv.FormatInt(size, 10),
+		creationTimeParam: time.Now().UTC().Format(time.RFC3339),
+	}
+
+	// Define backing file path (will be created by NodeServer); tmpfs volumes live in memory
+	if !tmpfs {
+		backingFile := cs.backingDir + "/" + volID + ".img"
+		if backingMode[backingModeParam] == backingModeSubvolume {
+			backingFile = cs.backingDir + "/" + volID + subvolumeSuffix
+		}
+		if err := validateBackingFile(cs.backingDir, backingFile); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		klog.Infof("CreateVolume backingFile: %s (deferred to node)", backingFile)
+		volumeContext["backingFile"] = backingFile
+	}
+	for k, v := range backingMode {
+		volumeContext[k] = v
+	}
+
+	// Filesystem type requested by the storage class, applied by the node at format time
+	if fsType := req.Parameters["fsType"]; fsType != "" {
+		if !supportedFsTypes[fsType] {
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported fsType %q", fsType)
+		}
+		volumeContext["fsType"] = fsType
+	}
+
+	// Extra mkfs options requested by the storage class, passed by the node to mkfs
+	if mkfsOptions := req.Parameters["mkfsOptions"]; mkfsOptions != "" {
+		if _, err := parseMkfsOptions(mkfsOptions); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		volumeContext["mkfsOptions"] = mkfsOptions
+	}
+
+	// Stable filesystem label derived from the volume ID, applied by the node at format time
+	if value, ok := req.Parameters[fsLabelParam]; ok {
+		fsLabel, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q: must be true or false", fsLabelParam, value)
+		}
+		if fsLabel {
+			if options, _ := parseMkfsOptions(req.Parameters["mkfsOptions"]); slices.Contains(options, "-L") {
+				return nil, status.Errorf(codes.InvalidArgument, "%s conflicts with -L in mkfsOptions", fsLabelParam)
+			}
+			volumeContext[fsLabelParam] = fsLabelFor(volID)
+		}
+	}
+
+	// LUKS encryption, applied by the node when the backing file is staged
+	encryption, err := encryptionVolumeContext(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if encryption != nil && hasBlockCapability(req.VolumeCapabilities) {
+		return nil, status.Error(codes.InvalidArgument, "encryption is only supported for filesystem volumes")
+	}
+	for k, v := range encryption {
+		volumeContext[k] = v
+	}
+
+	// Backing file format, applied by the node when it creates the file
+	format, err := backingFormatVolumeContext(req.Parameters, req.VolumeCapabilities, req.VolumeContentSource)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range format {
+		volumeContext[k] = v
+	}
+
+	// Limits of the VolumeAttributesClass the claim was created with
+	if len(req.MutableParameters) > 0 {
+		if !cs.qosEnabled {
+			return nil, status.Error(codes.InvalidArgument, "mutable parameters are only supported with --enable-volume-qos")
+		}
+		if !hasLoopDevice(volumeContext) {
+			return nil, status.Error(codes.InvalidArgument, "only volumes attached through a loop device can be limited")
+		}
+		limits, err := parseIOLimits(req.MutableParameters)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if limits.iops > 0 {
+			volumeContext[iopsLimitParam] = strconv.FormatInt(limits.iops, 10)
+		}
+		if limits.bandwidth > 0 {
+			volumeContext[bandwidthLimitParam] = strconv.FormatInt(limits.bandwidth, 10)
+		}
+	}
+
+	// Propagation of the volume's published mounts, set by the node after bind-mounting
+	if value, ok := req.Parameters[mountPropagationParam]; ok {
+		if err := validateMountPropagation(value); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if value != "" {
+			volumeContext[mountPropagationParam] = value
+		}
+	}
+
+	// Fully allocated backing file, reserved by the node with fallocate when it creates the file
+	if value, ok := req.Parameters[preallocateParam]; ok {
+		preallocate, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q: must be true or false", preallocateParam, value)
+		}
+		if preallocate && isQcow2(volumeContext) {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is only supported for raw backing files", preallocateParam)
+		}
+		if preallocate {
+			volumeContext[preallocateParam] = "true"
+		}
+	}
+
+	// Cloning: the node copies the source backing file during JIT creation,
+	// so the clone must land on the node holding the source volume
+	var sourceTopology *csi.Topology
+	if srcVolume := req.GetVolumeContentSource().GetVolume(); srcVolume != nil {
+		if tmpfs {
+			return nil, status.Errorf(codes.InvalidArgument, "%s %s volumes can't be cloned", backingModeParam, backingModeTmpfs)
+		}
+		srcFile, srcNode, err := cs.resolveCloneSource(ctx, srcVolume.GetVolumeId(), size)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(srcFile, subvolumeSuffix) != (backingMode[backingModeParam] == backingModeSubvolume) {
+			return nil, status.Errorf(codes.InvalidArgument, "clone source %s has a different %s", srcVolume.GetVolumeId(), backingModeParam)
+		}
+		volumeContext["cloneFromVolume"] = srcVolume.GetVolumeId()
+		volumeContext["cloneSourceFile"] = srcFile
+		if srcNode != "" {
+			sourceTopology = &csi.Topology{Segments: map[string]string{topologyKey: srcNode}}
+		}
+		klog.Infof("CreateVolume: cloning %s from volume %s (%s)", volID, srcVolume.GetVolumeId(), srcFile)
+	}
+
+	// Every parameter has been checked and nothing has been recorded yet
+	if validateOnly {
+		klog.Infof("CreateVolume: parameters of %s are valid (validate only)", req.Name)
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:      volID,
+				CapacityBytes: size,
+				VolumeContext: volumeContext,
+			},
+		}, nil
+	}
 
 	// Prepare response
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      volID,
 			CapacityBytes: size,
-			VolumeContext: map[string]string{
-				"backingFile": backingFile,
-				"size":        strconv.FormatInt(size, 10),
-			},
+			VolumeContext: volumeContext,
+			ContentSource: req.VolumeContentSource,
 		},
 	}
 
-	// Handle topology: if the external-provisioner provides preferred topology,
-	// use the first preferred topology to indicate where the volume will be accessible.
-	// This works with the JIT file creation model because the file will be created
-	// on the node where the pod is scheduled, which matches the topology constraint.
-	if req.AccessibilityRequirements != nil && len(req.AccessibilityRequirements.Preferred) > 0 {
-		// Use the first preferred topology
-		resp.Volume.AccessibleTopology = []*csi.Topology{req.AccessibilityRequirements.Preferred[0]}
-		klog.Infof("CreateVolume: set AccessibleTopology from preferred: %+v", req.AccessibilityRequirements.Preferred[0])
-	} else if req.AccessibilityRequirements != nil && len(req.AccessibilityRequirements.Requisite) > 0 {
-		// Fall back to first requisite topology if no preferred
-		resp.Volume.AccessibleTopology = []*csi.Topology{req.AccessibilityRequirements.Requisite[0]}
-		klog.Infof("CreateVolume: set AccessibleTopology from requisite: %+v", req.AccessibilityRequirements.Requisite[0])
+	// Clones are only accessible where the source backing file lives; other
+	// volumes go where the topology policy picks among the permitted
+	// topologies. The backing file is created just in time on that node.
+	if sourceTopology != nil {
+		if !cs.topologyAllowed(sourceTopology) {
+			return nil, status.Errorf(codes.ResourceExhausted, "clone source node %s is not an allowed topology", sourceTopology.Segments[topologyKey])
+		}
+		resp.Volume.AccessibleTopology = []*csi.Topology{sourceTopology}
+		klog.Infof("CreateVolume: set AccessibleTopology from clone source: %+v", sourceTopology)
+	} else {
+		topology, err := cs.selectTopology(ctx, req.AccessibilityRequirements)
+		if err != nil {
+			return nil, err
+		}
+		if topology != nil {
+			resp.Volume.AccessibleTopology = []*csi.Topology{topology}
+			klog.Infof("CreateVolume: set AccessibleTopology (%s policy): %+v", cs.topologyPolicyName(), topology)
+		}
+	}
+
+	// Refuse volumes the chosen node has no room for; tmpfs volumes take memory, not disk
+	if len(resp.Volume.AccessibleTopology) > 0 && !tmpfs {
+		if err := cs.checkNodeCapacity(ctx, resp.Volume.AccessibleTopology[0].Segments[topologyKey], size); err != nil {
+			return nil, err
+		}
 	}
 
+	if store != nil {
+		record := volumeRecord{ID: volID, Name: req.Name, Capacity: size, Context: volumeContext}
+		if len(resp.Volume.AccessibleTopology) > 0 {
+			record.Node = resp.Volume.AccessibleTopology[0].Segments[topologyKey]
+		}
+		if err := store.Put(ctx, record); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to record volume %s: %v", volID, err)
+		}
+	}
 	return resp, nil
 }
 
+// creationTimeParam is the volume context key recording when CreateVolume
+// created a volume, in RFC 3339. Retries return the recorded context, so the
+// time stays that of the first call.
+const creationTimeParam = "creationTime"
+
+// validateOnlyVolumePrefix marks the synthetic volume ID returned when the
+// validateOnly parameter is set; no backing file is ever created for it
+const validateOnlyVolumePrefix = "validate-only-"
+
+// fsLabelParam is the storage class parameter asking for a filesystem label
+// derived from the volume ID; the volume context carries the label itself
+const fsLabelParam = "fsLabel"
+
+// fsLabelFor derives the filesystem label of a volume from the first twelve
+// hex digits of its UUID, short enough for every supported filesystem
+func fsLabelFor(volumeID string) string {
+	label := strings.ReplaceAll(strings.TrimPrefix(strings.TrimPrefix(volumeID, "vol-"), validateOnlyVolumePrefix), "-", "")
+	if len(label) > 12 {
+		label = label[:12]
+	}
+	return label
+}
+
+// preallocateParam is the storage class parameter, also recorded in the
+// volume context, asking for backing files with all blocks allocated
+const preallocateParam = "preallocate"
+
+// isValidateOnly reports whether the storage class asks CreateVolume to only
+// validate its parameters, so admins and CI can lint storage classes
+func isValidateOnly(params map[string]string) (bool, error) {
+	value, ok := params["validateOnly"]
+	if !ok {
+		return false, nil
+	}
+	validateOnly, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "invalid validateOnly parameter %q: must be true or false", value)
+	}
+	return validateOnly, nil
+}
+
+// resolveCloneSource looks up the PersistentVolume of a clone source and
+// returns its backing file and the node it lives on (empty if unknown).
+func (cs *ControllerServer) resolveCloneSource(ctx context.Context, srcVolumeID string, size int64) (string, string, error) {
+	if cs.clientset == nil {
+		return "", "", status.Errorf(codes.FailedPrecondition, "Kubernetes clientset not configured - cannot resolve clone source")
+	}
+	pv, err := cs.findPersistentVolume(ctx, srcVolumeID)
+	if err != nil {
+		return "", "", err
+	}
+
+	srcFile := pv.Spec.CSI.VolumeAttributes["backingFile"]
+	if err := validateBackingFile(cs.backingDir, srcFile); err != nil {
+		return "", "", status.Errorf(codes.InvalidArgument, "invalid clone source %s: %v", srcVolumeID, err)
+	}
+	if capacity, ok := pv.Spec.Capacity[corev1.ResourceStorage]; ok && capacity.Value() > size {
+		return "", "", status.Errorf(codes.OutOfRange, "requested size %d is smaller than source volume %s (%d bytes)", size, srcVolumeID, capacity.Value())
+	}
+	return srcFile, nodeFromAffinity(pv), nil
+}
+
+// findPersistentVolume returns the PersistentVolume of this driver with the given volume handle
+func (cs *ControllerServer) findPersistentVolume(ctx context.Context, volumeID string) (*corev1.PersistentVolume, error) {
+	pvList, err := cs.clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error listing volumes: %v", err)
+	}
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == cs.name && pv.Spec.CSI.VolumeHandle == volumeID {
+			return pv, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+}
+
+// nodeFromAffinity returns the node a PV is pinned to by its topology node affinity
+func nodeFromAffinity(pv *corev1.PersistentVolume) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == topologyKey && expr.Operator == corev1.NodeSelectorOpIn && len(expr.Values) > 0 {
+				return expr.Values[0]
+			}
+		}
+	}
+	return ""
+}
+
+// volumeSize resolves the size of a new volume from the requested capacity
+// range, applying the default size and the configured minimum and maximum.
+func (cs *ControllerServer) volumeSize(capRange *csi.CapacityRange) (int64, error) {
+	required := capRange.GetRequiredBytes()
+	limit := capRange.GetLimitBytes()
+	if required < 0 || limit < 0 {
+		return 0, status.Error(codes.InvalidArgument, "capacity range must not be negative")
+	}
+	if limit > 0 && required > limit {
+		return 0, status.Errorf(codes.InvalidArgument, "required bytes %d exceed limit bytes %d", required, limit)
+	}
+	if cs.maxVolumeSize > 0 && required > cs.maxVolumeSize {
+		return 0, status.Errorf(codes.OutOfRange, "required bytes %d exceed maximum volume size %d", required, cs.maxVolumeSize)
+	}
+	if cs.minVolumeSize > 0 && limit > 0 && limit < cs.minVolumeSize {
+		return 0, status.Errorf(codes.OutOfRange, "limit bytes %d are below minimum volume size %d", limit, cs.minVolumeSize)
+	}
+
+	size := required
+	if size == 0 {
+		size = defaultVolumeSize
+		if limit > 0 && size > limit {
+			size = limit
+		}
+		if cs.maxVolumeSize > 0 && size > cs.maxVolumeSize {
+			size = cs.maxVolumeSize
+		}
+	}
+	if size < cs.minVolumeSize {
+		size = cs.minVolumeSize
+	}
+	return size, nil
+}
+
+// Size rounding policies: exact backing files are the requested size, while
+// up pads them so the filesystem's usable space covers the request
+const (
+	SizeRoundingExact = "exact"
+	SizeRoundingUp    = "up"
+)
+
+// roundVolumeSize pads the size of a filesystem volume by the estimated
+// overhead of its filesystem under SizeRoundingUp. Block, subvolume and
+// tmpfs volumes have no filesystem of their own to pad for. The padding never
+// goes beyond the limit of the request or the maximum volume size.
+func (cs *ControllerServer) roundVolumeSize(size int64, req *csi.CreateVolumeRequest) int64 {
+	if cs.sizeRounding != SizeRoundingUp {
+		return size
+	}
+	switch req.Parameters[backingModeParam] {
+	case backingModeSubvolume, backingModeTmpfs:
+		return size
+	}
+	fsType := req.Parameters["fsType"]
+	for _, capability := range req.VolumeCapabilities {
+		if capability.GetBlock() != nil {
+			return size
+		}
+		if fsType == "" {
+			fsType = capability.GetMount().GetFsType()
+		}
+	}
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+
+	padded := paddedSize(size, fsType)
+	if limit := req.CapacityRange.GetLimitBytes(); limit > 0 && padded > limit {
+		padded = limit
+	}
+	if cs.maxVolumeSize > 0 && padded > cs.maxVolumeSize {
+		padded = cs.maxVolumeSize
+	}
+	if padded > size {
+		klog.V(2).Infof("CreateVolume: padding %d bytes to %d for %s overhead", size, padded, fsType)
+		return padded
+	}
+	return size
+}
+
+// fsOverhead estimates the space mkfs and the mounted filesystem keep from
+// users of a filesystem of size bytes: for ext3 and ext4, 5% reserved
+// blocks, inode tables and bitmaps and a journal of about 1/64 of the size up
+// to 1GiB; for xfs, its log and allocation group headers; for btrfs, its
+// metadata chunks.
+func fsOverhead(size int64, fsType string) int64 {
+	switch fsType {
+	case "ext3", "ext4":
+		return size*7/100 + min(size/64, 1<<30)
+	case "xfs":
+		return size*2/100 + 64<<20
+	case "btrfs":
+		return size*5/100 + 16<<20
+	default:
+		return 0
+	}
+}
+
+// paddedSize returns the smallest size, in whole MiB, whose filesystem
+// leaves at least size bytes usable. The overhead grows with the padded
+// size, so it is recomputed until the padding covers it.
+func paddedSize(size int64, fsType string) int64 {
+	padded := size
+	for i := 0; i < 10; i++ {
+		need := size + fsOverhead(padded, fsType)
+		if need <= padded {
+			break
+		}
+		padded = need
+	}
+	const mib = 1 << 20
+	if padded > size {
+		padded = (padded + mib - 1) / mib * mib
+	}
+	return padded
+}
+
 func (cs *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	klog.Infof("DeleteVolume: %s (logical deletion, physical cleanup handled by node garbage collector)", req.VolumeId)
+
+	// Standalone there is no garbage collector, but controller and node share the backing directory
+	if cs.standalone() {
+		if err := cs.removeStandaloneVolume(ctx, req.VolumeId); err != nil {
+			return nil, err
+		}
+	}
+	if store := cs.volumeStore(); store != nil {
+		if err := store.Delete(ctx, req.VolumeId); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to forget volume %s: %v", req.VolumeId, err)
+		}
+	}
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// ControllerPublishVolume records the attachment of a volume to a node in
+// attach mode. Otherwise there is nothing to attach: the node plugin sets up
+// the loop device when it stages the volume.
 func (cs *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if cs.attachEnabled {
+		if err := cs.attachVolume(ctx, req); err != nil {
+			return nil, err
+		}
+	}
 	return &csi.ControllerPublishVolumeResponse{}, nil
 }
 
 func (cs *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if cs.attachEnabled {
+		if err := cs.detachVolume(ctx, req); err != nil {
+			return nil, err
+		}
+	}
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
 func (cs *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if len(req.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
+	}
+
+	// Only confirm when every requested capability is supported
+	for _, capability := range req.VolumeCapabilities {
+		if err := validateVolumeCapability(capability); err != nil {
+			klog.Infof("ValidateVolumeCapabilities: %s: %v", req.VolumeId, err)
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+		}
+	}
+
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.VolumeContext,
 			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.Parameters,
 		},
 	}, nil
 }
 
+// topologyKey is the topology segment identifying the node that holds a volume's backing file
+const topologyKey = "kubernetes.io/hostname"
+
+// defaultVolumeSize is used when a request carries no capacity
+const defaultVolumeSize int64 = 1 << 30
+
+// defaultFsType is used when neither the volume capability nor the storage
+// class specify one, unless --default-fstype names another
+const defaultFsType = "ext4"
+
+// supportedFsTypes lists the filesystems the node plugin knows how to create
+var supportedFsTypes = map[string]bool{
+	"ext3":  true,
+	"ext4":  true,
+	"xfs":   true,
+	"btrfs": true,
+}
+
+// maxFsLabelLength is the longest label mkfs accepts for each supported filesystem
+var maxFsLabelLength = map[string]int{
+	"ext3":  16,
+	"ext4":  16,
+	"xfs":   12,
+	"btrfs": 255,
+}
+
+// ValidateFsType checks that fsType is one the driver can format volumes with
+func ValidateFsType(fsType string) error {
+	if !supportedFsTypes[fsType] {
+		types := make([]string, 0, len(supportedFsTypes))
+		for t := range supportedFsTypes {
+			types = append(types, t)
+		}
+		slices.Sort(types)
+		return fmt.Errorf("unsupported fsType %q: must be one of %s", fsType, strings.Join(types, ", "))
+	}
+	return nil
+}
+
+// supportedAccessModes lists the access modes a loop-mounted backing file can safely serve
+var supportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:   true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  true,
+}
+
+// validateVolumeCapability returns an error describing why capability is not supported
+func validateVolumeCapability(capability *csi.VolumeCapability) error {
+	if capability == nil {
+		return fmt.Errorf("volume capability is empty")
+	}
+	if capability.GetBlock() == nil && capability.GetMount() == nil {
+		return fmt.Errorf("volume capability must specify an access type")
+	}
+	mode := capability.GetAccessMode().GetMode()
+	if !supportedAccessModes[mode] {
+		return fmt.Errorf("access mode %s is not supported", mode)
+	}
+	return nil
+}
+
 func (cs *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return &csi.ListVolumesResponse{}, nil
+	klog.V(4).Infof("ListVolumes: max_entries=%d starting_token=%q", req.MaxEntries, req.StartingToken)
+
+	store := cs.volumeStore()
+	if store == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "Kubernetes clientset not configured - cannot list volumes")
+	}
+	if req.MaxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "max_entries must not be negative")
+	}
+
+	// Records come sorted by ID so that pagination tokens are stable across calls
+	records, err := store.List(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error listing volumes: %v", err)
+	}
+
+	// The starting token is the index of the first entry to return
+	start := 0
+	if req.StartingToken != "" {
+		start, err = strconv.Atoi(req.StartingToken)
+		if err != nil || start < 0 || start > len(records) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting_token %q", req.StartingToken)
+		}
+	}
+	end := len(records)
+	if req.MaxEntries > 0 && start+int(req.MaxEntries) < end {
+		end = start + int(req.MaxEntries)
+	}
+
+	// Volume health comes from the reports node plugins publish on their Node
+	health := &volumeHealthReports{cs: cs, now: time.Now(), nodes: map[string]*corev1.Node{}}
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, end-start)
+	for _, record := range records[start:end] {
+		entry := &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      record.ID,
+				CapacityBytes: record.Capacity,
+				VolumeContext: map[string]string{
+					"backingFile": record.Context["backingFile"],
+				},
+			},
+		}
+		if condition := health.condition(ctx, record.Node, record.ID); condition != nil {
+			entry.Status = &csi.ListVolumesResponse_VolumeStatus{VolumeCondition: condition}
+		}
+		entries = append(entries, entry)
+	}
+
+	resp := &csi.ListVolumesResponse{Entries: entries}
+	if end < len(records) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	return resp, nil
 }
 
+// GetCapacity reports the free space of the backing directories as seen by the
+// controller. The controller mounts the same host backing directories as the
+// node plugin, so this reflects the node the controller is running on. With
+// extra backing directories a single volume can only use the largest of them,
+// which is reported as the maximum volume size.
 func (cs *ControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return &csi.GetCapacityResponse{AvailableCapacity: 1 << 30}, nil
+	// The external-provisioner asks per node; prefer what that node reported
+	if node := req.GetAccessibleTopology().GetSegments()[topologyKey]; node != "" {
+		if available, ok := cs.reportedCapacity(ctx, node); ok {
+			return &csi.GetCapacityResponse{AvailableCapacity: available, MaximumVolumeSize: wrapperspb.Int64(available)}, nil
+		}
+	}
+
+	var total, largest int64
+	for _, dir := range append([]string{cs.backingDir}, cs.extraBackingDirs...) {
+		available, err := availableCapacity(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// No volumes have been created yet
+				klog.V(4).Infof("GetCapacity: backing directory %s does not exist yet", dir)
+				continue
+			}
+			return nil, status.Errorf(codes.Internal, "failed to get capacity of %s: %v", dir, err)
+		}
+		available = withoutReserve(available, cs.reservedCapacity)
+		total += available
+		if available > largest {
+			largest = available
+		}
+	}
+	resp := &csi.GetCapacityResponse{AvailableCapacity: total}
+	if len(cs.extraBackingDirs) > 0 {
+		resp.MaximumVolumeSize = wrapperspb.Int64(largest)
+	}
+	return resp, nil
+}
+
+// withoutReserve subtracts the reserved bytes from available, never going below zero
+func withoutReserve(available, reserved int64) int64 {
+	if available <= reserved {
+		return 0
+	}
+	return available - reserved
+}
+
+// availableCapacity returns the bytes available to unprivileged users in dir
+func availableCapacity(dir string) (int64, error) {
+	var stats unix.Statfs_t
+	if err := unix.Statfs(dir, &stats); err != nil {
+		return 0, &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+	return int64(stats.Bavail) * int64(stats.Bsize), nil
 }
 
 func (cs *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
@@ -133,10 +858,74 @@ func (cs *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *
 			},
 		},
 	})
+	// Indicate support for cloning volumes
+	ctrlCaps = append(ctrlCaps, &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{
+				Type: csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+			},
+		},
+	})
+	// Indicate support for listing volumes
+	ctrlCaps = append(ctrlCaps, &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{
+				Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			},
+		},
+	})
+	// Indicate that listed volumes carry their condition
+	ctrlCaps = append(ctrlCaps, &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{
+				Type: csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+			},
+		},
+	})
+	// Indicate support for the SINGLE_NODE_SINGLE_WRITER (ReadWriteOncePod) and
+	// SINGLE_NODE_MULTI_WRITER access modes
+	ctrlCaps = append(ctrlCaps, &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{
+				Type: csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+			},
+		},
+	})
+	// In attach mode, have the external-attacher call ControllerPublishVolume
+	if cs.attachEnabled {
+		ctrlCaps = append(ctrlCaps, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+				},
+			},
+		})
+	}
+	// With volume QoS, have the external-resizer call ControllerModifyVolume
+	// for VolumeAttributesClass changes
+	if cs.qosEnabled {
+		ctrlCaps = append(ctrlCaps, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+				},
+			},
+		})
+	}
 	return &csi.ControllerGetCapabilitiesResponse{Capabilities: ctrlCaps}, nil
 }
 
-func (cs *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+func (cs *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (_ *csi.ControllerGetVolumeResponse, err error) {
+	// A lookup cut short by the caller's deadline or cancellation is not an internal error
+	defer func() {
+		err = deadlineExceeded(ctx, err)
+	}()
+
+	// Standalone controllers answer from their own record of volumes
+	if cs.standalone() {
+		return cs.getStandaloneVolume(ctx, req.VolumeId)
+	}
+
 	klog.Infof("ControllerGetVolume: %s (fetching from Kubernetes API)", req.VolumeId)
 
 	// Check if clientset is available
@@ -182,14 +971,27 @@ func (cs *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.Co
 	} else if capacityBytes > 0 {
 		volumeContext["size"] = strconv.FormatInt(capacityBytes, 10)
 	}
+	// Volumes of older controllers carry no creation time; their PV's is close enough
+	if created := pv.Spec.CSI.VolumeAttributes[creationTimeParam]; created != "" {
+		volumeContext[creationTimeParam] = created
+	} else if !pv.CreationTimestamp.IsZero() {
+		volumeContext[creationTimeParam] = pv.CreationTimestamp.UTC().Format(time.RFC3339)
+	}
 
-	return &csi.ControllerGetVolumeResponse{
+	resp := &csi.ControllerGetVolumeResponse{
 		Volume: &csi.Volume{
 			VolumeId:      req.VolumeId,
 			CapacityBytes: capacityBytes,
 			VolumeContext: volumeContext,
 		},
-	}, nil
+	}
+	// Best effort: the health its node last reported, e.g. a backing file that
+	// was never created or is not the size of the volume
+	health := &volumeHealthReports{cs: cs, now: time.Now(), nodes: map[string]*corev1.Node{}}
+	if condition := health.condition(ctx, nodeFromAffinity(pv), req.VolumeId); condition != nil {
+		resp.Status = &csi.ControllerGetVolumeResponse_VolumeStatus{VolumeCondition: condition}
+	}
+	return resp, nil
 }
 
 func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
@@ -199,8 +1001,16 @@ func (cs *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 	}, nil
 }
 
+// ControllerModifyVolume records the I/O limits of a VolumeAttributesClass on
+// the volume's PersistentVolume; the node applies them to its loop device.
 func (cs *ControllerServer) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "ControllerModifyVolume not implemented")
+	if !cs.qosEnabled {
+		return nil, status.Errorf(codes.Unimplemented, "ControllerModifyVolume not implemented")
+	}
+	if err := cs.modifyVolume(ctx, req); err != nil {
+		return nil, err
+	}
+	return &csi.ControllerModifyVolumeResponse{}, nil
 }
 
 // Snapshot RPCs
@@ -3,13 +3,21 @@ package rawfile
 import (
 	"context"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestController_GetCapabilities_CreateDeleteVolume(t *testing.T) {
@@ -104,11 +112,62 @@ func TestController_DeleteVolume(t *testing.T) {
 	os.Remove(backingFile)
 }
 
+func TestController_GetVolume_Cancelled(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	// The API call notices the cancellation mid-flight
+	clientset.PrependReactor("get", "persistentvolumes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		cancel()
+		return true, nil, ctx.Err()
+	})
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", "/tmp/my-csi-driver", clientset)
+
+	_, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "vol-cancelled"})
+	if status.Code(err) != codes.Canceled {
+		t.Errorf("expected Canceled, got %v", err)
+	}
+}
+
+func TestController_CreateVolume_CreationTime(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", dir, nil)
+	cs.volumes = newFileVolumeStore(dir)
+
+	req := &csi.CreateVolumeRequest{Name: "pvc-created", CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 20}}
+	first, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	created := first.Volume.VolumeContext[creationTimeParam]
+	if _, err := time.Parse(time.RFC3339, created); err != nil {
+		t.Fatalf("expected an RFC 3339 creation time, got %q: %v", created, err)
+	}
+
+	// Retries and later lookups report the time of the first call
+	time.Sleep(1100 * time.Millisecond)
+	second, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("repeated CreateVolume failed: %v", err)
+	}
+	if got := second.Volume.VolumeContext[creationTimeParam]; got != created {
+		t.Errorf("expected creation time %s on retry, got %s", created, got)
+	}
+	got, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: first.Volume.VolumeId})
+	if err != nil {
+		t.Fatalf("ControllerGetVolume failed: %v", err)
+	}
+	if got.Volume.VolumeContext[creationTimeParam] != created {
+		t.Errorf("expected creation time %s, got %v", created, got.Volume.VolumeContext)
+	}
+}
+
 func TestController_GetVolume(t *testing.T) {
 	// Create a fake PV
 	pv := &corev1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "vol-test-getvolume",
+			Name:              "vol-test-getvolume",
+			CreationTimestamp: metav1.NewTime(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)),
 		},
 		Spec: corev1.PersistentVolumeSpec{
 			Capacity: corev1.ResourceList{
@@ -140,6 +199,10 @@ func TestController_GetVolume(t *testing.T) {
 	if resp.Volume.CapacityBytes != 123456 {
 		t.Errorf("expected size %d, got %d", 123456, resp.Volume.CapacityBytes)
 	}
+	// Without a recorded creation time the PV's is reported
+	if got := resp.Volume.VolumeContext[creationTimeParam]; got != "2024-05-01T12:00:00Z" {
+		t.Errorf("expected the PV creation time, got %q", got)
+	}
 
 	// Test non-existent volume
 	if _, err = cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "vol-does-not-exist"}); err == nil {
@@ -259,3 +322,551 @@ func TestController_CreateVolume_WithoutTopology(t *testing.T) {
 		t.Errorf("AccessibleTopology should not be set when no requirements provided")
 	}
 }
+
+func newTestPV(name, driver string, capacity string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceStorage: resource.MustParse(capacity),
+			},
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       driver,
+					VolumeHandle: name,
+					VolumeAttributes: map[string]string{
+						"backingFile": "/tmp/my-csi-driver/" + name + ".img",
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestController_ListVolumes(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		newTestPV("vol-a", "test-driver", "1Mi"),
+		newTestPV("vol-b", "test-driver", "2Mi"),
+		newTestPV("vol-c", "test-driver", "3Mi"),
+		newTestPV("vol-other", "other-driver", "1Mi"),
+	)
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", "/tmp/my-csi-driver", clientset)
+
+	// List everything in one page
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	if len(resp.Entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(resp.Entries))
+	}
+	if resp.NextToken != "" {
+		t.Errorf("expected empty next token, got %q", resp.NextToken)
+	}
+	if got := resp.Entries[1].Volume.CapacityBytes; got != 2*1024*1024 {
+		t.Errorf("expected capacity %d, got %d", 2*1024*1024, got)
+	}
+	if got := resp.Entries[0].Volume.VolumeContext["backingFile"]; got != "/tmp/my-csi-driver/vol-a.img" {
+		t.Errorf("unexpected backingFile %q", got)
+	}
+
+	// Paginate two at a time
+	resp, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	if len(resp.Entries) != 2 || resp.NextToken == "" {
+		t.Fatalf("expected 2 entries and a next token, got %d entries and token %q", len(resp.Entries), resp.NextToken)
+	}
+	resp, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: resp.NextToken})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	if len(resp.Entries) != 1 || resp.Entries[0].Volume.VolumeId != "vol-c" {
+		t.Errorf("unexpected second page: %+v", resp.Entries)
+	}
+	if resp.NextToken != "" {
+		t.Errorf("expected empty next token on last page, got %q", resp.NextToken)
+	}
+
+	// Invalid token
+	if _, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "bogus"}); status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted for invalid token, got %v", err)
+	}
+
+	// Missing clientset
+	cs = NewControllerServerWithBackingDir("test-driver", "0.1.0", "/tmp/my-csi-driver", nil)
+	if _, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition without clientset, got %v", err)
+	}
+}
+
+func TestController_GetCapacity(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", t.TempDir(), nil)
+	resp, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	if err != nil {
+		t.Fatalf("GetCapacity failed: %v", err)
+	}
+	if resp.AvailableCapacity <= 0 {
+		t.Errorf("expected positive capacity, got %d", resp.AvailableCapacity)
+	}
+
+	// The reserve is subtracted from the reported capacity, bottoming out at zero
+	cs.reservedCapacity = 1048576
+	reserved, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	if err != nil {
+		t.Fatalf("GetCapacity with reserve failed: %v", err)
+	}
+	if reserved.AvailableCapacity >= resp.AvailableCapacity {
+		t.Errorf("expected reserve to lower capacity below %d, got %d", resp.AvailableCapacity, reserved.AvailableCapacity)
+	}
+	cs.reservedCapacity = resp.AvailableCapacity * 2
+	if reserved, err = cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{}); err != nil || reserved.AvailableCapacity != 0 {
+		t.Errorf("expected zero capacity when the reserve exceeds free space, got %v, %v", reserved, err)
+	}
+
+	// Extra backing directories add up, and the largest bounds a single volume
+	cs.reservedCapacity = 0
+	cs.extraBackingDirs = []string{t.TempDir(), filepath.Join(t.TempDir(), "missing")}
+	multi, err := cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	if err != nil {
+		t.Fatalf("GetCapacity with extra directories failed: %v", err)
+	}
+	if multi.MaximumVolumeSize == nil || multi.MaximumVolumeSize.Value <= 0 || multi.AvailableCapacity < 2*multi.MaximumVolumeSize.Value-1048576 {
+		t.Errorf("expected capacity summed over two directories and a maximum volume size, got %v", multi)
+	}
+	cs.extraBackingDirs = nil
+
+	// A backing directory that does not exist yet reports zero capacity
+	cs = NewControllerServerWithBackingDir("test-driver", "0.1.0", filepath.Join(t.TempDir(), "missing"), nil)
+	resp, err = cs.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	if err != nil {
+		t.Fatalf("GetCapacity failed for missing dir: %v", err)
+	}
+	if resp.AvailableCapacity != 0 {
+		t.Errorf("expected zero capacity for missing dir, got %d", resp.AvailableCapacity)
+	}
+}
+
+func TestController_ValidateVolumeCapabilities(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", "/tmp/my-csi-driver", nil)
+
+	mountCap := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		caps      []*csi.VolumeCapability
+		confirmed bool
+	}{
+		{"SingleNodeWriter", []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}, true},
+		{"SingleNodeReaderOnly", []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)}, true},
+		{"SingleNodeSingleWriter", []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER)}, true},
+		{"SingleNodeMultiWriter", []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER)}, true},
+		{"MultiNodeMultiWriter", []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}, false},
+		{"MixedModes", []*csi.VolumeCapability{
+			mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			mountCap(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+		}, false},
+		{"Block", []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}}, true},
+		{"NoAccessType", []*csi.VolumeCapability{{
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           "vol-validate",
+				VolumeCapabilities: tt.caps,
+			})
+			if err != nil {
+				t.Fatalf("ValidateVolumeCapabilities failed: %v", err)
+			}
+			if tt.confirmed && resp.Confirmed == nil {
+				t.Errorf("expected capabilities to be confirmed, message: %s", resp.Message)
+			}
+			if !tt.confirmed && (resp.Confirmed != nil || resp.Message == "") {
+				t.Errorf("expected rejection with message, got %+v", resp)
+			}
+		})
+	}
+
+	// Missing capabilities is an invalid argument
+	if _, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "vol-validate"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for missing capabilities, got %v", err)
+	}
+}
+
+func TestController_CreateVolume_FsType(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test.csi", "0.1.0", "/tmp/my-csi-driver", nil)
+
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "testvol-xfs",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		Parameters:    map[string]string{"fsType": "xfs"},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if got := resp.Volume.VolumeContext["fsType"]; got != "xfs" {
+		t.Errorf("expected fsType xfs in volume context, got %q", got)
+	}
+
+	// No fsType parameter leaves the choice to the node
+	resp, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "testvol-nofs",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if _, ok := resp.Volume.VolumeContext["fsType"]; ok {
+		t.Errorf("fsType should not be set without a storage class parameter")
+	}
+
+	// Unknown filesystems are rejected
+	_, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "testvol-badfs",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		Parameters:    map[string]string{"fsType": "ntfs"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for unsupported fsType, got %v", err)
+	}
+}
+
+func TestController_CreateVolume_MkfsOptions(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test.csi", "0.1.0", "/tmp/my-csi-driver", nil)
+
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "testvol-mkfs",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		Parameters:    map[string]string{"mkfsOptions": "-b 4096 -m 0"},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if got := resp.Volume.VolumeContext["mkfsOptions"]; got != "-b 4096 -m 0" {
+		t.Errorf("expected mkfsOptions in volume context, got %q", got)
+	}
+
+	// Shell metacharacters are rejected
+	_, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "testvol-badmkfs",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		Parameters:    map[string]string{"mkfsOptions": "-b 4096; reboot"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for mkfsOptions with metacharacters, got %v", err)
+	}
+}
+
+func TestController_CreateVolume_FsLabel(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test.csi", "0.1.0", "/tmp/my-csi-driver", nil)
+
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "testvol-label",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		Parameters:    map[string]string{"fsLabel": "true"},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	label := resp.Volume.VolumeContext["fsLabel"]
+	if len(label) != 12 || !strings.HasPrefix(strings.ReplaceAll(resp.Volume.VolumeId, "-", ""), "vol"+label) {
+		t.Errorf("expected a 12 character label from volume %s, got %q", resp.Volume.VolumeId, label)
+	}
+	if got := fsLabelFor("vol-1b4e28ba-2fa1-11d2-883f-0016d3cca427"); got != "1b4e28ba2fa1" {
+		t.Errorf("unexpected label %q", got)
+	}
+
+	for name, params := range map[string]map[string]string{
+		"BadValue":   {"fsLabel": "yes please"},
+		"LabelTwice": {"fsLabel": "true", "mkfsOptions": "-L data"},
+	} {
+		if _, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          "testvol-badlabel",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+			Parameters:    params,
+		}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: expected InvalidArgument, got %v", name, err)
+		}
+	}
+}
+
+func TestController_CreateVolume_Preallocate(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test.csi", "0.1.0", "/tmp/my-csi-driver", nil)
+
+	tests := []struct {
+		name     string
+		params   map[string]string
+		wantCode codes.Code
+		want     string
+	}{
+		{"Preallocated", map[string]string{"preallocate": "true"}, codes.OK, "true"},
+		{"Sparse", map[string]string{"preallocate": "false"}, codes.OK, ""},
+		{"Default", nil, codes.OK, ""},
+		{"BadValue", map[string]string{"preallocate": "always"}, codes.InvalidArgument, ""},
+		{"Qcow2", map[string]string{"preallocate": "true", "backingFormat": "qcow2"}, codes.InvalidArgument, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:          "testvol-prealloc",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+				Parameters:    tt.params,
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("expected %v, got %v", tt.wantCode, err)
+			}
+			if err == nil && resp.Volume.VolumeContext["preallocate"] != tt.want {
+				t.Errorf("expected preallocate %q in volume context, got %q", tt.want, resp.Volume.VolumeContext["preallocate"])
+			}
+		})
+	}
+}
+
+func TestController_CreateVolume_ValidateOnly(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test.csi", "0.1.0", "/tmp/my-csi-driver", nil)
+
+	tests := []struct {
+		name     string
+		params   map[string]string
+		wantCode codes.Code
+	}{
+		{"Valid", map[string]string{"validateOnly": "true", "fsType": "xfs", "mkfsOptions": "-m reflink=1", "backingFormat": "qcow2"}, codes.OK},
+		{"BadFsType", map[string]string{"validateOnly": "true", "fsType": "ntfs"}, codes.InvalidArgument},
+		{"BadMkfsOptions", map[string]string{"validateOnly": "true", "mkfsOptions": "-b 4096 && reboot"}, codes.InvalidArgument},
+		{"BadEncrypted", map[string]string{"validateOnly": "true", "encrypted": "maybe"}, codes.InvalidArgument},
+		{"BadBackingFormat", map[string]string{"validateOnly": "true", "backingFormat": "vmdk"}, codes.InvalidArgument},
+		{"BadFlag", map[string]string{"validateOnly": "yes please"}, codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:          "testvol-validate",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+				Parameters:    tt.params,
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("expected %v, got %v", tt.wantCode, err)
+			}
+			if err == nil && !strings.HasPrefix(resp.Volume.VolumeId, validateOnlyVolumePrefix) {
+				t.Errorf("expected a synthetic volume ID, got %q", resp.Volume.VolumeId)
+			}
+		})
+	}
+
+	// validateOnly=false provisions normally
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "testvol-novalidate",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		Parameters:    map[string]string{"validateOnly": "false"},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if !strings.HasPrefix(resp.Volume.VolumeId, "vol-") {
+		t.Errorf("expected a real volume ID, got %q", resp.Volume.VolumeId)
+	}
+}
+
+func TestController_CreateVolume_SizeBounds(t *testing.T) {
+	const mib = 1024 * 1024
+	cs := NewControllerServerWithBackingDir("test.csi", "0.1.0", "/tmp/my-csi-driver", nil)
+	cs.minVolumeSize = mib
+	cs.maxVolumeSize = 10 * mib
+
+	tests := []struct {
+		name     string
+		required int64
+		limit    int64
+		wantSize int64
+		wantCode codes.Code
+	}{
+		{"AtMinimum", mib, 0, mib, codes.OK},
+		{"BelowMinimumRoundsUp", 1, 0, mib, codes.OK},
+		{"AtMaximum", 10 * mib, 0, 10 * mib, codes.OK},
+		{"AboveMaximum", 10*mib + 1, 0, 0, codes.OutOfRange},
+		{"LimitBelowMinimum", 0, mib - 1, 0, codes.OutOfRange},
+		{"LimitAtMinimum", 0, mib, mib, codes.OK},
+		{"DefaultClampedToMaximum", 0, 0, 10 * mib, codes.OK},
+		{"RequiredAboveLimit", 2 * mib, mib, 0, codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name:          "testvol-bounds",
+				CapacityRange: &csi.CapacityRange{RequiredBytes: tt.required, LimitBytes: tt.limit},
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("expected code %v, got %v", tt.wantCode, err)
+			}
+			if err == nil && resp.Volume.CapacityBytes != tt.wantSize {
+				t.Errorf("expected size %d, got %d", tt.wantSize, resp.Volume.CapacityBytes)
+			}
+		})
+	}
+
+	// Without bounds the default size is unchanged
+	cs = NewControllerServerWithBackingDir("test.csi", "0.1.0", "/tmp/my-csi-driver", nil)
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "testvol-default"})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if resp.Volume.CapacityBytes != 1<<30 {
+		t.Errorf("expected default size 1GiB, got %d", resp.Volume.CapacityBytes)
+	}
+}
+
+func TestPaddedSize(t *testing.T) {
+	const gib = 1 << 30
+	for _, fsType := range []string{"ext3", "ext4", "xfs", "btrfs"} {
+		for _, size := range []int64{1 << 20, gib, 100 * gib} {
+			padded := paddedSize(size, fsType)
+			if usable := padded - fsOverhead(padded, fsType); usable < size {
+				t.Errorf("paddedSize(%d, %s) = %d leaves only %d bytes usable", size, fsType, padded, usable)
+			}
+			if padded%(1<<20) != 0 {
+				t.Errorf("paddedSize(%d, %s) = %d is not a whole number of MiB", size, fsType, padded)
+			}
+		}
+	}
+	// ext4 takes about 7% plus a journal of 1/64; a GiB needs a little under 1.1GiB
+	if got := paddedSize(gib, "ext4"); got < gib*109/100 || got > gib*110/100 {
+		t.Errorf("paddedSize(1GiB, ext4) = %d, expected about 1.094GiB", got)
+	}
+	// Unknown filesystems get no padding
+	if got := paddedSize(gib, "vfat"); got != gib {
+		t.Errorf("paddedSize(1GiB, vfat) = %d, expected %d", got, gib)
+	}
+}
+
+func TestController_CreateVolume_SizeRounding(t *testing.T) {
+	const gib = 1 << 30
+	cs := NewControllerServerWithBackingDir("test.csi", "0.1.0", "/tmp/my-csi-driver", nil)
+	create := func(req *csi.CreateVolumeRequest) int64 {
+		t.Helper()
+		req.Name = "testvol-rounding"
+		resp, err := cs.CreateVolume(context.Background(), req)
+		if err != nil {
+			t.Fatalf("CreateVolume failed: %v", err)
+		}
+		if size := resp.Volume.VolumeContext["size"]; size != strconv.FormatInt(resp.Volume.CapacityBytes, 10) {
+			t.Errorf("expected the backing file size %s to match the capacity %d", size, resp.Volume.CapacityBytes)
+		}
+		return resp.Volume.CapacityBytes
+	}
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	// exact, the default, keeps the requested size
+	if got := create(&csi.CreateVolumeRequest{CapacityRange: &csi.CapacityRange{RequiredBytes: gib}}); got != gib {
+		t.Errorf("expected exact size %d, got %d", gib, got)
+	}
+
+	cs.sizeRounding = SizeRoundingUp
+	if got, want := create(&csi.CreateVolumeRequest{CapacityRange: &csi.CapacityRange{RequiredBytes: gib}}), paddedSize(gib, "ext4"); got != want {
+		t.Errorf("expected ext4 padded size %d, got %d", want, got)
+	}
+	if got, want := create(&csi.CreateVolumeRequest{
+		CapacityRange: &csi.CapacityRange{RequiredBytes: gib},
+		Parameters:    map[string]string{"fsType": "xfs"},
+	}), paddedSize(gib, "xfs"); got != want {
+		t.Errorf("expected xfs padded size %d, got %d", want, got)
+	}
+	if got := create(&csi.CreateVolumeRequest{
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: gib},
+		VolumeCapabilities: []*csi.VolumeCapability{block},
+	}); got != gib {
+		t.Errorf("expected block volumes to keep their size %d, got %d", gib, got)
+	}
+	// The padding stops at the limit of the request
+	if got := create(&csi.CreateVolumeRequest{CapacityRange: &csi.CapacityRange{RequiredBytes: gib, LimitBytes: gib + 1<<20}}); got != gib+1<<20 {
+		t.Errorf("expected the padding to stop at the limit %d, got %d", gib+1<<20, got)
+	}
+}
+
+func TestController_CreateVolume_Clone(t *testing.T) {
+	srcPV := newTestPV("vol-source", "test-driver", "1Mi")
+	srcPV.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{
+		Required: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{
+					Key:      "kubernetes.io/hostname",
+					Operator: corev1.NodeSelectorOpIn,
+					Values:   []string{"node-a"},
+				}},
+			}},
+		},
+	}
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", "/tmp/my-csi-driver", fake.NewSimpleClientset(srcPV))
+
+	cloneReq := func(volumeID string, size int64) *csi.CreateVolumeRequest {
+		return &csi.CreateVolumeRequest{
+			Name:          "testvol-clone",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+			VolumeContentSource: &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volumeID}},
+			},
+			AccessibilityRequirements: &csi.TopologyRequirement{
+				Preferred: []*csi.Topology{{Segments: map[string]string{"kubernetes.io/hostname": "node-b"}}},
+			},
+		}
+	}
+
+	resp, err := cs.CreateVolume(context.Background(), cloneReq("vol-source", 2*1024*1024))
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	ctx := resp.Volume.VolumeContext
+	if ctx["cloneFromVolume"] != "vol-source" {
+		t.Errorf("expected cloneFromVolume vol-source, got %q", ctx["cloneFromVolume"])
+	}
+	if ctx["cloneSourceFile"] != "/tmp/my-csi-driver/vol-source.img" {
+		t.Errorf("unexpected cloneSourceFile %q", ctx["cloneSourceFile"])
+	}
+	if resp.Volume.ContentSource.GetVolume().GetVolumeId() != "vol-source" {
+		t.Errorf("expected content source to be echoed in the response")
+	}
+	// The clone must be placed on the source node, not the preferred one
+	if got := resp.Volume.AccessibleTopology[0].Segments["kubernetes.io/hostname"]; got != "node-a" {
+		t.Errorf("expected clone topology node-a, got %q", got)
+	}
+
+	// Clones can't be smaller than their source
+	if _, err := cs.CreateVolume(context.Background(), cloneReq("vol-source", 1024)); status.Code(err) != codes.OutOfRange {
+		t.Errorf("expected OutOfRange for undersized clone, got %v", err)
+	}
+	// Unknown source volume
+	if _, err := cs.CreateVolume(context.Background(), cloneReq("vol-missing", 2*1024*1024)); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for missing source, got %v", err)
+	}
+}
+
+func TestValidateFsType(t *testing.T) {
+	for _, fsType := range []string{"ext3", "ext4", "xfs", "btrfs"} {
+		if err := ValidateFsType(fsType); err != nil {
+			t.Errorf("expected %s to be valid, got %v", fsType, err)
+		}
+	}
+	for _, fsType := range []string{"", "ntfs", "EXT4"} {
+		if err := ValidateFsType(fsType); err == nil {
+			t.Errorf("expected %q to be rejected", fsType)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package rawfile
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// maxDriverNameLength is the longest driver name the CSI spec allows
+const maxDriverNameLength = 63
+
+// ValidateDriverName checks that name is usable as a CSI driver name and as
+// the name of its CSIDriver object: at most 63 characters of a DNS subdomain.
+func ValidateDriverName(name string) error {
+	if len(name) > maxDriverNameLength {
+		return fmt.Errorf("driver name %q is longer than %d characters", name, maxDriverNameLength)
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return fmt.Errorf("invalid driver name %q: %s", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// fsGroupPolicy has kubelet apply a pod's fsGroup to every volume of this
+// driver, chowning the mounted filesystem to the group and making it group
+// writable, so non-root containers can write to their volumes
+const fsGroupPolicy = storagev1.FileFSGroupPolicy
+
+// csiDriverSpec describes how Kubernetes should call the driver. It matches
+// the CSIDriver object shipped with the Helm chart. attachRequired is set in
+// attach mode, when the controller handles ControllerPublishVolume, and
+// ephemeral adds the Ephemeral lifecycle mode for inline volumes.
+func csiDriverSpec(attachRequired, ephemeral bool) storagev1.CSIDriverSpec {
+	podInfoOnMount := true
+	storageCapacity := true
+	policy := fsGroupPolicy
+	modes := []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecyclePersistent}
+	if ephemeral {
+		modes = append(modes, storagev1.VolumeLifecycleEphemeral)
+	}
+	return storagev1.CSIDriverSpec{
+		AttachRequired:       &attachRequired,
+		PodInfoOnMount:       &podInfoOnMount,
+		StorageCapacity:      &storageCapacity,
+		FSGroupPolicy:        &policy,
+		VolumeLifecycleModes: modes,
+	}
+}
+
+// RegisterCSIDriver creates the CSIDriver object for name, or updates an
+// existing one whose spec has drifted. attachRequired matches --enable-attach
+// and ephemeral --enable-ephemeral. It does nothing without a clientset.
+func RegisterCSIDriver(ctx context.Context, clientset kubernetes.Interface, name string, attachRequired, ephemeral bool) error {
+	if clientset == nil {
+		klog.Infof("Not registering CSIDriver %s: Kubernetes clientset not configured", name)
+		return nil
+	}
+	if err := ValidateDriverName(name); err != nil {
+		return err
+	}
+	spec := csiDriverSpec(attachRequired, ephemeral)
+
+	drivers := clientset.StorageV1().CSIDrivers()
+	existing, err := drivers.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = drivers.Create(ctx, &storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to create CSIDriver %s: %v", name, err)
+		}
+		klog.Infof("Registered CSIDriver %s", name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get CSIDriver %s: %v", name, err)
+	}
+
+	// Leave fields the driver doesn't manage, such as seLinuxMount, as they are
+	want := existing.Spec
+	want.AttachRequired = spec.AttachRequired
+	want.PodInfoOnMount = spec.PodInfoOnMount
+	want.StorageCapacity = spec.StorageCapacity
+	want.FSGroupPolicy = spec.FSGroupPolicy
+	want.VolumeLifecycleModes = spec.VolumeLifecycleModes
+	if reflect.DeepEqual(existing.Spec, want) {
+		klog.V(2).Infof("CSIDriver %s is up to date", name)
+		return nil
+	}
+	existing.Spec = want
+	if _, err := drivers.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update CSIDriver %s: %v", name, err)
+	}
+	klog.Infof("Updated CSIDriver %s", name)
+	return nil
+}
@@ -0,0 +1,111 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestValidateDriverName(t *testing.T) {
+	for name, wantErr := range map[string]bool{
+		"my-csi-driver":         false,
+		"fast.rawfile.example":  false,
+		"":                      true,
+		"My_Driver":             true,
+		strings.Repeat("a", 64): true,
+	} {
+		if err := ValidateDriverName(name); (err != nil) != wantErr {
+			t.Errorf("ValidateDriverName(%q): expected error %v, got %v", name, wantErr, err)
+		}
+	}
+}
+
+func TestRegisterCSIDriver(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	ctx := context.Background()
+
+	if err := RegisterCSIDriver(ctx, clientset, "my-csi-driver", false, false); err != nil {
+		t.Fatalf("RegisterCSIDriver failed: %v", err)
+	}
+	driver, err := clientset.StorageV1().CSIDrivers().Get(ctx, "my-csi-driver", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("CSIDriver not created: %v", err)
+	}
+	if *driver.Spec.AttachRequired || !*driver.Spec.PodInfoOnMount || *driver.Spec.FSGroupPolicy != storagev1.FileFSGroupPolicy {
+		t.Errorf("unexpected CSIDriver spec %+v", driver.Spec)
+	}
+	if want := []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecyclePersistent}; !reflect.DeepEqual(driver.Spec.VolumeLifecycleModes, want) {
+		t.Errorf("expected %v lifecycle modes, got %v", want, driver.Spec.VolumeLifecycleModes)
+	}
+
+	// A drifted spec is corrected, keeping fields the driver doesn't manage
+	attachRequired, seLinuxMount := true, true
+	driver.Spec.AttachRequired = &attachRequired
+	driver.Spec.SELinuxMount = &seLinuxMount
+	if _, err := clientset.StorageV1().CSIDrivers().Update(ctx, driver, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update CSIDriver: %v", err)
+	}
+	if err := RegisterCSIDriver(ctx, clientset, "my-csi-driver", false, false); err != nil {
+		t.Fatalf("RegisterCSIDriver failed: %v", err)
+	}
+	driver, _ = clientset.StorageV1().CSIDrivers().Get(ctx, "my-csi-driver", metav1.GetOptions{})
+	if *driver.Spec.AttachRequired || !*driver.Spec.SELinuxMount {
+		t.Errorf("expected attachRequired reset and seLinuxMount kept, got %+v", driver.Spec)
+	}
+
+	// Registering again changes nothing
+	before := len(clientset.Actions())
+	if err := RegisterCSIDriver(ctx, clientset, "my-csi-driver", false, false); err != nil {
+		t.Fatalf("RegisterCSIDriver failed: %v", err)
+	}
+	if actions := clientset.Actions()[before:]; len(actions) != 1 || actions[0].GetVerb() != "get" {
+		t.Errorf("expected only a get for an up to date CSIDriver, got %v", actions)
+	}
+
+	// Attach mode turns attachRequired on
+	if err := RegisterCSIDriver(ctx, clientset, "my-csi-driver", true, false); err != nil {
+		t.Fatalf("RegisterCSIDriver failed: %v", err)
+	}
+	driver, _ = clientset.StorageV1().CSIDrivers().Get(ctx, "my-csi-driver", metav1.GetOptions{})
+	if !*driver.Spec.AttachRequired {
+		t.Errorf("expected attachRequired in attach mode, got %+v", driver.Spec)
+	}
+
+	// Inline ephemeral volumes add their lifecycle mode
+	if err := RegisterCSIDriver(ctx, clientset, "my-csi-driver", true, true); err != nil {
+		t.Fatalf("RegisterCSIDriver failed: %v", err)
+	}
+	driver, _ = clientset.StorageV1().CSIDrivers().Get(ctx, "my-csi-driver", metav1.GetOptions{})
+	if want := []storagev1.VolumeLifecycleMode{storagev1.VolumeLifecyclePersistent, storagev1.VolumeLifecycleEphemeral}; !reflect.DeepEqual(driver.Spec.VolumeLifecycleModes, want) {
+		t.Errorf("expected %v lifecycle modes, got %v", want, driver.Spec.VolumeLifecycleModes)
+	}
+
+	if err := RegisterCSIDriver(ctx, clientset, "Not_Valid", false, false); err == nil {
+		t.Errorf("expected an invalid driver name to be rejected")
+	}
+	// Standalone mode has nothing to register with
+	if err := RegisterCSIDriver(ctx, nil, "my-csi-driver", false, false); err != nil {
+		t.Errorf("expected no-op without a clientset, got %v", err)
+	}
+}
+
+func TestCSIDriverSpec_FSGroupPolicy(t *testing.T) {
+	if policy := csiDriverSpec(false, false).FSGroupPolicy; policy == nil || *policy != storagev1.FileFSGroupPolicy {
+		t.Fatalf("expected fsGroupPolicy File so kubelet applies fsGroup, got %v", policy)
+	}
+	// The chart ships the same policy when the driver doesn't register itself
+	chart, err := os.ReadFile(filepath.Join("..", "..", "charts", "my-csi-driver", "templates", "csidriver.yaml"))
+	if err != nil {
+		t.Fatalf("failed to read chart CSIDriver: %v", err)
+	}
+	if !strings.Contains(string(chart), "fsGroupPolicy: "+string(fsGroupPolicy)) {
+		t.Errorf("chart CSIDriver does not declare fsGroupPolicy %s", fsGroupPolicy)
+	}
+}
@@ -0,0 +1,130 @@
+package rawfile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	klog "k8s.io/klog/v2"
+)
+
+// encryptedParam is the storage class parameter, also recorded in the volume
+// context, that turns on LUKS encryption of a volume's backing file
+const encryptedParam = "encrypted"
+
+// Storage class parameters naming the Secret kubelet passes to
+// NodeStageVolume. The external-provisioner consumes them; the node plugin
+// never reads Secrets from the API itself.
+const (
+	nodeStageSecretNameParam      = "csi.storage.k8s.io/node-stage-secret-name"
+	nodeStageSecretNamespaceParam = "csi.storage.k8s.io/node-stage-secret-namespace"
+)
+
+// Former storage class parameters naming the key Secret, which the node
+// plugin fetched with cluster-wide read access to Secrets
+const (
+	encryptionSecretNameParam      = "encryptionKeySecretName"
+	encryptionSecretNamespaceParam = "encryptionKeySecretNamespace"
+)
+
+// encryptionSecretKey is the entry of the node-stage secret holding the LUKS passphrase
+const encryptionSecretKey = "key"
+
+// luksMapperDir is where cryptsetup exposes opened LUKS devices
+const luksMapperDir = "/dev/mapper"
+
+// encryptionVolumeContext validates the encryption parameters of a storage
+// class and returns the entries to record in the volume context. Volumes that
+// don't ask for encryption get none.
+func encryptionVolumeContext(params map[string]string) (map[string]string, error) {
+	if params[encryptionSecretNameParam] != "" || params[encryptionSecretNamespaceParam] != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "the %s and %s parameters are not supported: reference the key Secret with %s and %s", encryptionSecretNameParam, encryptionSecretNamespaceParam, nodeStageSecretNameParam, nodeStageSecretNamespaceParam)
+	}
+	value, ok := params[encryptedParam]
+	if !ok {
+		return nil, nil
+	}
+	encrypted, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q: must be true or false", encryptedParam, value)
+	}
+	if !encrypted {
+		return nil, nil
+	}
+	return map[string]string{encryptedParam: "true"}, nil
+}
+
+// isEncrypted reports whether a volume's backing file is LUKS-encrypted
+func isEncrypted(volumeContext map[string]string) bool {
+	return volumeContext[encryptedParam] == "true"
+}
+
+// hasBlockCapability reports whether any capability asks for a raw block volume
+func hasBlockCapability(capabilities []*csi.VolumeCapability) bool {
+	for _, capability := range capabilities {
+		if capability.GetBlock() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// luksMapperName is the device-mapper name a volume's LUKS device is opened as
+func luksMapperName(volumeID string) string {
+	return "rawfile-" + volumeID
+}
+
+// encryptionKey returns the LUKS passphrase from the node-stage secret
+// kubelet passed with the request
+func encryptionKey(secrets map[string]string) ([]byte, error) {
+	key := secrets[encryptionSecretKey]
+	if key == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "encrypted volumes need the LUKS passphrase in the %q entry of the node-stage secret; set the %s and %s storage class parameters", encryptionSecretKey, nodeStageSecretNameParam, nodeStageSecretNamespaceParam)
+	}
+	return []byte(key), nil
+}
+
+// openLUKS opens loopDev as the volume's LUKS device and returns the mapper
+// device to format and mount. A blank device is LUKS-formatted first unless
+// the volume is read-only.
+func (ns *NodeServer) openLUKS(ctx context.Context, loopDev, volumeID string, key []byte, readOnly bool) (string, error) {
+	name := luksMapperName(volumeID)
+	device := luksMapperDir + "/" + name
+	if _, err := os.Stat(device); err == nil {
+		return device, nil // Already open
+	}
+
+	if _, err := ns.runner.Run(ctx, "cryptsetup", "isLuks", loopDev); err != nil {
+		if readOnly {
+			return "", fmt.Errorf("%s is not a LUKS device and read-only volumes are never formatted", loopDev)
+		}
+		klog.Infof("openLUKS: formatting %s as LUKS", loopDev)
+		if out, err := ns.runner.RunWithInput(ctx, key, "cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", loopDev); err != nil {
+			return "", fmt.Errorf("cryptsetup luksFormat failed on %s: %v: %s", loopDev, err, string(out))
+		}
+	}
+
+	args := []string{"luksOpen", "--key-file", "-"}
+	if readOnly {
+		args = append(args, "--readonly")
+	}
+	args = append(args, loopDev, name)
+	if out, err := ns.runner.RunWithInput(ctx, key, "cryptsetup", args...); err != nil {
+		return "", fmt.Errorf("cryptsetup luksOpen failed on %s: %v: %s", loopDev, err, string(out))
+	}
+	return device, nil
+}
+
+// closeLUKS closes the volume's LUKS device if it is open
+func (ns *NodeServer) closeLUKS(ctx context.Context, volumeID string) error {
+	name := luksMapperName(volumeID)
+	if _, err := os.Stat(luksMapperDir + "/" + name); os.IsNotExist(err) {
+		return nil
+	}
+	klog.Infof("Closing LUKS device %s", name)
+	return ns.runCommand(ctx, "cryptsetup", "luksClose", name)
+}
@@ -0,0 +1,163 @@
+package rawfile
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEncryptionVolumeContext(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		wantCode codes.Code
+		wantCtx  bool
+	}{
+		{"NotRequested", nil, codes.OK, false},
+		{"Disabled", map[string]string{encryptedParam: "false"}, codes.OK, false},
+		{"Enabled", map[string]string{encryptedParam: "true"}, codes.OK, true},
+		{"Invalid", map[string]string{encryptedParam: "yes please"}, codes.InvalidArgument, false},
+		// The node plugin no longer reads Secrets from the API
+		{"SecretReference", map[string]string{encryptedParam: "true", encryptionSecretNameParam: "luks-key", encryptionSecretNamespaceParam: "default"}, codes.InvalidArgument, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encryptionVolumeContext(tt.params)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("expected %v, got %v", tt.wantCode, err)
+			}
+			if tt.wantCtx != isEncrypted(got) {
+				t.Errorf("expected encrypted=%v, got volume context %v", tt.wantCtx, got)
+			}
+		})
+	}
+}
+
+func TestController_CreateVolume_Encrypted(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test.csi", "0.1.0", "/tmp/my-csi-driver", nil)
+	params := map[string]string{encryptedParam: "true"}
+
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "testvol-encrypted",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		Parameters:    params,
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if !isEncrypted(resp.Volume.VolumeContext) {
+		t.Errorf("expected encrypted volume context, got %v", resp.Volume.VolumeContext)
+	}
+
+	// Raw block volumes have no filesystem to put on a LUKS device
+	_, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "testvol-encrypted-block",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		Parameters:    params,
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for an encrypted block volume, got %v", err)
+	}
+}
+
+func TestNode_StageVolume_Encrypted(t *testing.T) {
+	// kubelet passes the node-stage secret named by the storage class
+	secrets := map[string]string{encryptionSecretKey: "s3cret"}
+	stageReq := func(testDir string, secrets map[string]string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-enc",
+			StagingTargetPath: filepath.Join(testDir, "staging"),
+			VolumeContext: map[string]string{
+				"backingFile":  filepath.Join(testDir, "vol-enc.img"),
+				"size":         "1048576",
+				encryptedParam: "true",
+			},
+			Secrets: secrets,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		}
+	}
+
+	t.Run("FormatsAndMountsMapper", func(t *testing.T) {
+		testDir := t.TempDir()
+		// Neither a LUKS header nor a filesystem exists yet
+		runner := &fakeRunner{
+			fail:   map[string]bool{"cryptsetup isLuks": true, "blkid": true},
+			output: map[string]string{"losetup": "/dev/loop7\n"},
+		}
+		ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+		ns.runner = runner
+
+		if _, err := ns.NodeStageVolume(context.Background(), stageReq(testDir, secrets)); err != nil {
+			t.Fatalf("NodeStageVolume failed: %v", err)
+		}
+		want := []string{
+			"losetup -f --show " + testDir + "/vol-enc.img",
+			"cryptsetup isLuks /dev/loop7",
+			"cryptsetup luksFormat --batch-mode --type luks2 --key-file - /dev/loop7",
+			"cryptsetup luksOpen --key-file - /dev/loop7 rawfile-vol-enc",
+			"blkid -p -s TYPE -o value /dev/mapper/rawfile-vol-enc",
+			"mkfs.ext4 /dev/mapper/rawfile-vol-enc",
+			"mount -t ext4 /dev/mapper/rawfile-vol-enc " + testDir + "/staging",
+		}
+		if strings.Join(runner.calls, "\n") != strings.Join(want, "\n") {
+			t.Errorf("expected commands:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(runner.calls, "\n"))
+		}
+		// The key only ever travels over stdin
+		for _, input := range runner.inputs {
+			if input != "s3cret" {
+				t.Errorf("expected the secret key on stdin, got %q", input)
+			}
+		}
+		for _, call := range runner.calls {
+			if strings.Contains(call, "s3cret") {
+				t.Errorf("key leaked onto the command line: %s", call)
+			}
+		}
+	})
+
+	t.Run("MountFailureClosesBeforeDetach", func(t *testing.T) {
+		testDir := t.TempDir()
+		runner := &fakeRunner{
+			fail:   map[string]bool{"mount": true},
+			output: map[string]string{"losetup": "/dev/loop7\n", "blkid": "ext4\n"},
+		}
+		ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+		ns.runner = runner
+
+		if _, err := ns.NodeStageVolume(context.Background(), stageReq(testDir, secrets)); err == nil {
+			t.Fatalf("expected NodeStageVolume to fail when mount fails")
+		}
+		n := len(runner.calls)
+		if n < 2 || runner.calls[n-2] != "cryptsetup luksClose rawfile-vol-enc" || runner.calls[n-1] != "losetup -d /dev/loop7" {
+			t.Errorf("expected LUKS close then loop detach, got %v", runner.calls)
+		}
+	})
+
+	t.Run("MissingSecret", func(t *testing.T) {
+		testDir := t.TempDir()
+		runner := &fakeRunner{}
+		ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+		ns.runner = runner
+
+		if _, err := ns.NodeStageVolume(context.Background(), stageReq(testDir, nil)); status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("expected FailedPrecondition without the node-stage secret, got %v", err)
+		}
+		if len(runner.calls) != 0 {
+			t.Errorf("expected no commands before the key is resolved, got %v", runner.calls)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2"
+)
+
+// ephemeralContextKey is set by kubelet, with podInfoOnMount, in the volume
+// context of CSI ephemeral inline volumes. Those are published straight from
+// the pod spec, without CreateVolume or NodeStageVolume.
+const ephemeralContextKey = "csi.storage.k8s.io/ephemeral"
+
+// ephemeralPrefix names the backing files of inline ephemeral volumes. They
+// have no PersistentVolume: NodeUnpublishVolume deletes them, and the garbage
+// collector only reclaims those it left behind, once no loop device is
+// attached to them.
+const ephemeralPrefix = "ephemeral-"
+
+// isEphemeral reports whether kubelet is publishing an inline ephemeral volume
+func isEphemeral(volumeContext map[string]string) bool {
+	ephemeral, _ := strconv.ParseBool(volumeContext[ephemeralContextKey])
+	return ephemeral
+}
+
+// ephemeralBackingFile returns the backing file of an inline ephemeral
+// volume, and whether it exists on the node
+func (ns *NodeServer) ephemeralBackingFile(volumeID string) (string, bool) {
+	return ns.findBackingFile(filepath.Join(ns.backingDir, ephemeralPrefix+volumeID+".img"))
+}
+
+// ephemeralVolumeContext builds the volume context CreateVolume would have
+// recorded from the attributes of an inline volume: its size, as a quantity
+// such as 1Gi, and fsType. The size is bounded like CreateVolume bounds
+// provisioned volumes. The pod information kubelet adds is kept for events;
+// other attributes are ignored.
+func (ns *NodeServer) ephemeralVolumeContext(volumeID string, attributes map[string]string) (map[string]string, error) {
+	backingFile, _ := ns.ephemeralBackingFile(volumeID)
+	volumeContext := map[string]string{"backingFile": backingFile}
+	size, err := ns.ephemeralVolumeSize(attributes["size"])
+	if err != nil {
+		return nil, err
+	}
+	volumeContext["size"] = strconv.FormatInt(size, 10)
+	if fsType := attributes["fsType"]; fsType != "" {
+		volumeContext["fsType"] = fsType
+	}
+	for key, value := range attributes {
+		if strings.HasPrefix(key, "csi.storage.k8s.io/") {
+			volumeContext[key] = value
+		}
+	}
+	return volumeContext, nil
+}
+
+// ephemeralVolumeSize parses the size attribute of an inline volume and
+// applies the minimum and maximum volume size: a size above the maximum is
+// rejected, one below the minimum is raised to it, and without a size the
+// default is used within the bounds
+func (ns *NodeServer) ephemeralVolumeSize(value string) (int64, error) {
+	size := defaultVolumeSize
+	if value != "" {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil || quantity.Value() <= 0 {
+			return 0, status.Errorf(codes.InvalidArgument, "invalid size %q for ephemeral volume", value)
+		}
+		size = quantity.Value()
+		if ns.maxVolumeSize > 0 && size > ns.maxVolumeSize {
+			return 0, status.Errorf(codes.OutOfRange, "size %d of ephemeral volume exceeds maximum volume size %d", size, ns.maxVolumeSize)
+		}
+	} else if ns.maxVolumeSize > 0 && size > ns.maxVolumeSize {
+		size = ns.maxVolumeSize
+	}
+	if size < ns.minVolumeSize {
+		size = ns.minVolumeSize
+	}
+	return size, nil
+}
+
+// checkEphemeralCapacity refuses an inline volume larger than the space
+// available in dir, less the reserved capacity. No controller checked its size
+// against the node's capacity, and without --max-volume-size nothing else
+// bounds it.
+func (ns *NodeServer) checkEphemeralCapacity(dir string, size int64) error {
+	available, err := availableCapacity(dir)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get capacity of %s: %v", dir, err)
+	}
+	if available = withoutReserve(available, ns.reservedCapacity); size > available {
+		return status.Errorf(codes.ResourceExhausted, "size %d of ephemeral volume exceeds the %d bytes available in %s", size, available, dir)
+	}
+	return nil
+}
+
+// publishEphemeral creates the backing file of an inline ephemeral volume
+// and mounts its filesystem directly at the target path, since kubelet
+// doesn't stage these volumes
+func (ns *NodeServer) publishEphemeral(ctx context.Context, req *csi.NodePublishVolumeRequest) (_ *csi.NodePublishVolumeResponse, err error) {
+	if req.VolumeCapability.GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "ephemeral volumes are only supported as filesystem volumes")
+	}
+	volumeContext, err := ns.ephemeralVolumeContext(req.VolumeId, req.VolumeContext)
+	if err != nil {
+		return nil, err
+	}
+	volCtx, err := ParseVolumeContext(volumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := ns.volumeLocks.Acquire(ctx, req.VolumeId); err != nil {
+		return nil, status.Errorf(codes.Aborted, "timed out waiting for another operation on volume %s: %v", req.VolumeId, err)
+	}
+	defer ns.volumeLocks.Release(req.VolumeId)
+
+	reqCtx := ctx
+	ctx, cancel := ns.withPublishTimeout(ctx)
+	defer cancel()
+
+	// Tell the pod's owner why the volume could not be mounted
+	defer func() {
+		err = deadlineExceeded(ctx, err)
+		if err != nil {
+			ns.recordVolumeEvent(reqCtx, req.VolumeId, volumeContext, corev1.EventTypeWarning, eventReasonPublishFailed, "Failed to publish ephemeral volume %s on node %s: %v", req.VolumeId, ns.nodeID, err)
+		}
+	}()
+
+	// A failed first attempt doesn't leave its backing file behind
+	backingFile, existed := ns.ephemeralBackingFile(req.VolumeId)
+	if !existed {
+		if err := ns.checkEphemeralCapacity(filepath.Dir(backingFile), volCtx.Size); err != nil {
+			return nil, err
+		}
+	}
+	stageReq := &csi.NodeStageVolumeRequest{
+		VolumeId:          req.VolumeId,
+		StagingTargetPath: req.TargetPath,
+		VolumeCapability:  req.VolumeCapability,
+		VolumeContext:     volumeContext,
+	}
+	if err = ns.backends[backingModeFile].Stage(ctx, stageReq, volCtx); err != nil {
+		if backingFile, ok := ns.ephemeralBackingFile(req.VolumeId); ok && !existed {
+			if rerr := os.Remove(backingFile); rerr != nil {
+				klog.Errorf("Failed to remove backing file %s of ephemeral volume %s: %v", backingFile, req.VolumeId, rerr)
+			}
+		}
+		return nil, err
+	}
+	if propagation := publishPropagation(req.VolumeCapability, nil); propagation != "" {
+		if err := ns.setMountPropagation(ctx, req.TargetPath, propagation); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set %s mount propagation: %v", propagation, err)
+		}
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// unpublishEphemeral unmounts an inline ephemeral volume, detaches its loop
+// device and deletes its backing file. The caller holds the volume lock.
+func (ns *NodeServer) unpublishEphemeral(ctx context.Context, req *csi.NodeUnpublishVolumeRequest, backingFile string) (*csi.NodeUnpublishVolumeResponse, error) {
+	unstageReq := &csi.NodeUnstageVolumeRequest{VolumeId: req.VolumeId, StagingTargetPath: req.TargetPath}
+	if err := ns.backends[backingModeFile].Unstage(ctx, unstageReq); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(backingFile); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "failed to remove backing file %s: %v", backingFile, err)
+	}
+	klog.Infof("NodeUnpublishVolume: removed ephemeral volume %s (%s)", req.VolumeId, backingFile)
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
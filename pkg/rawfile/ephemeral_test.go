@@ -0,0 +1,171 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNode_PublishVolume_Ephemeral(t *testing.T) {
+	testDir := t.TempDir()
+	target := filepath.Join(testDir, "pod", "mount")
+	backingFile := filepath.Join(testDir, ephemeralPrefix+"csi-inline.img")
+	// blkid reports no filesystem by failing, as it does on a blank device
+	runner := &fakeRunner{fail: map[string]bool{"blkid": true}, output: map[string]string{"losetup": "/dev/loop7\n"}}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+	publish := func(volumeContext map[string]string, capability *csi.VolumeCapability) error {
+		volumeContext[ephemeralContextKey] = "true"
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         "csi-inline",
+			TargetPath:       target,
+			VolumeContext:    volumeContext,
+			VolumeCapability: capability,
+		})
+		return err
+	}
+	mount := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	// No staging path and no backingFile: the node makes up both
+	if err := publish(map[string]string{"size": "1Mi", "fsType": "xfs"}, mount); err != nil {
+		t.Fatalf("NodePublishVolume failed: %v", err)
+	}
+	fi, err := os.Stat(backingFile)
+	if err != nil {
+		t.Fatalf("expected backing file %s: %v", backingFile, err)
+	}
+	if fi.Size() != 1<<20 {
+		t.Errorf("expected a 1Mi backing file, got %d bytes", fi.Size())
+	}
+	calls := make([]string, len(runner.calls))
+	for i, call := range runner.calls {
+		calls[i] = strings.ReplaceAll(call, testDir, "$DIR")
+	}
+	if want := "mount -t xfs /dev/loop7 $DIR/pod/mount"; calls[len(calls)-1] != want {
+		t.Errorf("expected the filesystem mounted at the target path with %q, got %v", want, calls)
+	}
+
+	// The garbage collector has no PersistentVolume for it but leaves it alone
+	reclaimed, err := ns.garbageCollectVolumes(context.Background(), true)
+	if err != nil {
+		t.Fatalf("garbageCollectVolumes failed: %v", err)
+	}
+	if len(reclaimed) != 0 {
+		t.Errorf("expected the ephemeral backing file to be kept, got %v reclaimed", reclaimed)
+	}
+
+	// Unpublishing tears the volume down and deletes its backing file
+	runner.calls = nil
+	runner.output["losetup"] = "/dev/loop7: [64769]:1234 (" + backingFile + ")\n"
+	if _, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-inline", TargetPath: target}); err != nil {
+		t.Fatalf("NodeUnpublishVolume failed: %v", err)
+	}
+	if _, err := os.Stat(backingFile); !os.IsNotExist(err) {
+		t.Errorf("expected backing file %s removed, got %v", backingFile, err)
+	}
+	if want := []string{"losetup -j " + backingFile, "losetup -d /dev/loop7"}; !reflect.DeepEqual(runner.calls, want) {
+		t.Errorf("expected %v, got %v", want, runner.calls)
+	}
+
+	if err := publish(map[string]string{"size": "lots"}, mount); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for an invalid size, got %v", err)
+	}
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	if err := publish(map[string]string{}, block); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a block ephemeral volume, got %v", err)
+	}
+}
+
+func TestNode_PublishVolume_EphemeralMountFailure(t *testing.T) {
+	testDir := t.TempDir()
+	runner := &fakeRunner{fail: map[string]bool{"blkid": true, "mount": true}, output: map[string]string{"losetup": "/dev/loop7\n"}}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:      "csi-inline",
+		TargetPath:    filepath.Join(testDir, "pod", "mount"),
+		VolumeContext: map[string]string{ephemeralContextKey: "true", "size": "1Mi"},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if err == nil {
+		t.Fatal("expected NodePublishVolume to fail")
+	}
+	if _, ok := ns.ephemeralBackingFile("csi-inline"); ok {
+		t.Error("expected the backing file of the failed attempt removed")
+	}
+}
+
+func TestNode_PublishVolume_EphemeralCapacity(t *testing.T) {
+	testDir := t.TempDir()
+	runner := &fakeRunner{fail: map[string]bool{"blkid": true}, output: map[string]string{"losetup": "/dev/loop7\n"}}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+
+	// Without --max-volume-size the size is still bounded by the free space
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:      "csi-inline",
+		TargetPath:    filepath.Join(testDir, "pod", "mount"),
+		VolumeContext: map[string]string{ephemeralContextKey: "true", "size": "1Ei"},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted for a volume larger than the free space, got %v", err)
+	}
+	if len(runner.calls) != 0 {
+		t.Errorf("expected no commands, got %v", runner.calls)
+	}
+	if _, ok := ns.ephemeralBackingFile("csi-inline"); ok {
+		t.Error("expected no backing file created")
+	}
+}
+
+func TestNode_EphemeralVolumeSize(t *testing.T) {
+	ns := NewNodeServer("test-node", "test-driver", t.TempDir(), nil)
+	ns.minVolumeSize = 10 << 20
+	ns.maxVolumeSize = 2 << 30
+
+	tests := []struct {
+		value    string
+		wantSize int64
+		wantCode codes.Code
+	}{
+		{"", defaultVolumeSize, codes.OK},
+		{"1Mi", 10 << 20, codes.OK},
+		{"2Gi", 2 << 30, codes.OK},
+		{"3Gi", 0, codes.OutOfRange},
+		{"lots", 0, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		size, err := ns.ephemeralVolumeSize(tt.value)
+		if status.Code(err) != tt.wantCode || size != tt.wantSize {
+			t.Errorf("ephemeralVolumeSize(%q) = %d, %v, want %d, %v", tt.value, size, err, tt.wantSize, tt.wantCode)
+		}
+	}
+
+	// Without a size the default stays within the maximum
+	ns.maxVolumeSize = 512 << 20
+	if size, err := ns.ephemeralVolumeSize(""); err != nil || size != 512<<20 {
+		t.Errorf("expected the default size capped at the maximum, got %d, %v", size, err)
+	}
+}
@@ -0,0 +1,101 @@
+package rawfile
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// Reasons of the Events the node plugin records against pods and PVCs
+const (
+	eventReasonBackingFileCreated = "BackingFileCreated"
+	eventReasonStageFailed        = "VolumeStageFailed"
+	eventReasonPublishFailed      = "VolumePublishFailed"
+	eventReasonLoopDeviceLeaked   = "LoopDeviceLeaked"
+)
+
+// Volume context keys set by the kubelet because the CSIDriver has podInfoOnMount
+const (
+	podNameContextKey      = "csi.storage.k8s.io/pod.name"
+	podNamespaceContextKey = "csi.storage.k8s.io/pod.namespace"
+	podUIDContextKey       = "csi.storage.k8s.io/pod.uid"
+)
+
+// newEventRecorder returns a recorder that publishes Events through clientset
+// as component running on host. Events are sent asynchronously; failures are
+// only logged.
+func newEventRecorder(clientset kubernetes.Interface, component, host string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartStructuredLogging(4)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component, Host: host})
+}
+
+// recordVolumeEvent records an Event about a volume on the pod using it, or
+// on its PVC when the pod is unknown. It is best-effort: without a recorder
+// or an object to attach the Event to, nothing is recorded.
+func (ns *NodeServer) recordVolumeEvent(ctx context.Context, volumeID string, volumeContext map[string]string, eventType, reason, messageFmt string, args ...interface{}) {
+	if ns.recorder == nil {
+		return
+	}
+	target := ns.volumeEventTarget(ctx, volumeID, volumeContext)
+	if target == nil {
+		klog.V(4).Infof("No pod or PVC to record %s event for volume %s", reason, volumeID)
+		return
+	}
+	ns.recorder.Eventf(target, eventType, reason, messageFmt, args...)
+}
+
+// recordNodeEvent records an Event about the node itself, for problems that
+// belong to no single volume. Without a recorder nothing is recorded.
+func (ns *NodeServer) recordNodeEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if ns.recorder == nil {
+		return
+	}
+	// Node Events use the node name as UID, like the kubelet's
+	target := &corev1.ObjectReference{Kind: "Node", APIVersion: "v1", Name: ns.nodeID, UID: types.UID(ns.nodeID)}
+	ns.recorder.Eventf(target, eventType, reason, messageFmt, args...)
+}
+
+// volumeEventTarget resolves the pod from the volume context, falling back to
+// the claim of the volume's PersistentVolume
+func (ns *NodeServer) volumeEventTarget(ctx context.Context, volumeID string, volumeContext map[string]string) *corev1.ObjectReference {
+	if name, namespace := volumeContext[podNameContextKey], volumeContext[podNamespaceContextKey]; name != "" && namespace != "" {
+		return &corev1.ObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Name:       name,
+			Namespace:  namespace,
+			UID:        types.UID(volumeContext[podUIDContextKey]),
+		}
+	}
+	if ns.clientset == nil {
+		return nil
+	}
+	// The volume handle is the name of the PersistentVolume
+	pv, err := ns.clientset.CoreV1().PersistentVolumes().Get(ctx, volumeID, metav1.GetOptions{})
+	if err != nil {
+		klog.V(4).Infof("Failed to get PersistentVolume for volume %s event: %v", volumeID, err)
+		return nil
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != ns.driverName || pv.Spec.CSI.VolumeHandle != volumeID {
+		return nil
+	}
+	if claim := pv.Spec.ClaimRef; claim != nil {
+		return &corev1.ObjectReference{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+			Name:       claim.Name,
+			Namespace:  claim.Namespace,
+			UID:        claim.UID,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// drainEvents returns the events recorded so far
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case e := <-recorder.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestNode_StageVolume_Events(t *testing.T) {
+	stageReq := func(testDir string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-events",
+			StagingTargetPath: filepath.Join(testDir, "staging"),
+			VolumeContext: map[string]string{
+				"backingFile": filepath.Join(testDir, "vol-events.img"),
+				"size":        "1048576",
+			},
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		}
+	}
+	newServer := func(testDir string, fail map[string]bool) (*NodeServer, *record.FakeRecorder) {
+		pv := newTestPV("vol-events", "test-driver", "1Mi")
+		pv.Spec.ClaimRef = &corev1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "default", Name: "data"}
+		ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset(pv))
+		ns.runner = &fakeRunner{fail: fail, output: map[string]string{"losetup": "/dev/loop7\n"}}
+		recorder := record.NewFakeRecorder(10)
+		recorder.IncludeObject = true
+		ns.recorder = recorder
+		return ns, recorder
+	}
+
+	t.Run("Created", func(t *testing.T) {
+		testDir := t.TempDir()
+		ns, recorder := newServer(testDir, map[string]bool{"blkid": true})
+		if _, err := ns.NodeStageVolume(context.Background(), stageReq(testDir)); err != nil {
+			t.Fatalf("NodeStageVolume failed: %v", err)
+		}
+		events := drainEvents(recorder)
+		if len(events) != 1 || !strings.HasPrefix(events[0], "Normal "+eventReasonBackingFileCreated) || !strings.Contains(events[0], "kind=PersistentVolumeClaim") {
+			t.Errorf("expected one BackingFileCreated event on the PVC, got %v", events)
+		}
+		if target := ns.volumeEventTarget(context.Background(), "vol-events", nil); target == nil || target.Namespace != "default" || target.Name != "data" {
+			t.Errorf("expected events to target PVC default/data, got %v", target)
+		}
+		if target := ns.volumeEventTarget(context.Background(), "vol-missing", nil); target != nil {
+			t.Errorf("expected no target for a volume without a PersistentVolume, got %v", target)
+		}
+
+		// Staging again reuses the backing file and records nothing
+		if _, err := ns.NodeStageVolume(context.Background(), stageReq(testDir)); err != nil {
+			t.Fatalf("NodeStageVolume failed: %v", err)
+		}
+		if events := drainEvents(recorder); len(events) != 0 {
+			t.Errorf("expected no events for an existing backing file, got %v", events)
+		}
+	})
+
+	t.Run("MkfsFails", func(t *testing.T) {
+		testDir := t.TempDir()
+		ns, recorder := newServer(testDir, map[string]bool{"blkid": true, "mkfs.ext4": true})
+		if _, err := ns.NodeStageVolume(context.Background(), stageReq(testDir)); err == nil {
+			t.Fatalf("expected NodeStageVolume to fail")
+		}
+		events := drainEvents(recorder)
+		if len(events) != 2 || !strings.HasPrefix(events[1], "Warning "+eventReasonStageFailed) || !strings.Contains(events[1], "mkfs.ext4") {
+			t.Errorf("expected a VolumeStageFailed event naming mkfs, got %v", events)
+		}
+	})
+
+	t.Run("NoRecorder", func(t *testing.T) {
+		testDir := t.TempDir()
+		ns, _ := newServer(testDir, map[string]bool{"losetup": true})
+		ns.recorder = nil
+		if _, err := ns.NodeStageVolume(context.Background(), stageReq(testDir)); err == nil {
+			t.Fatalf("expected NodeStageVolume to fail")
+		}
+	})
+}
+
+func TestNode_PublishVolume_FailureEvent(t *testing.T) {
+	testDir := t.TempDir()
+	// A regular file where the target directory's parent should be makes publishing fail
+	blocker := filepath.Join(testDir, "blocker")
+	if err := os.WriteFile(blocker, nil, 0600); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	ns := NewNodeServer("test-node", "test-driver", testDir, nil)
+	recorder := record.NewFakeRecorder(10)
+	recorder.IncludeObject = true
+	ns.recorder = recorder
+
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          "vol-events",
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+		TargetPath:        filepath.Join(blocker, "target"),
+		VolumeContext: map[string]string{
+			podNameContextKey:      "app-0",
+			podNamespaceContextKey: "prod",
+			podUIDContextKey:       "1234",
+		},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected NodePublishVolume to fail")
+	}
+	events := drainEvents(recorder)
+	if len(events) != 1 || !strings.HasPrefix(events[0], "Warning "+eventReasonPublishFailed) || !strings.Contains(events[0], "kind=Pod,") {
+		t.Errorf("expected a VolumePublishFailed event on the pod, got %v", events)
+	}
+}
@@ -1,34 +1,122 @@
 package rawfile
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
 )
 
-// Helper: run command and return error only
-func execCommandSimple(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%v: %s", err, string(out))
+// CommandRunner runs external commands such as losetup, mkfs and mount,
+// returning their combined output. Commands are killed once ctx is done.
+// Tests substitute a fake to assert the invocations and simulate failures
+// without root.
+type CommandRunner interface {
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+	// RunWithInput is Run with input fed to stdin, keeping secrets such as
+	// encryption keys off the command line and out of files
+	RunWithInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error)
+}
+
+// execRunner runs commands on the host
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	klog.InfoS("Running command", "command", name, "args", args)
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+func (execRunner) RunWithInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error) {
+	klog.InfoS("Running command", "command", name, "args", args, "stdin", true)
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	return cmd.CombinedOutput()
+}
+
+// Helper: validate that backingFile is an absolute path cleanly contained
+// within backingDir, rejecting traversal attempts such as "../" components
+func validateBackingFile(backingDir, backingFile string) error {
+	if backingFile == "" {
+		return fmt.Errorf("backing file path is empty")
+	}
+	if !filepath.IsAbs(backingFile) {
+		return fmt.Errorf("backing file %q is not an absolute path", backingFile)
+	}
+	rel, err := filepath.Rel(filepath.Clean(backingDir), filepath.Clean(backingFile))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("backing file %q is outside backing directory %q", backingFile, backingDir)
 	}
 	return nil
 }
 
-// Helper: find loop device for a mount point
-func FindLoopDevice(target string) (string, error) {
-	out, err := exec.Command("mount").CombinedOutput()
+// defaultBackingDirPermissions is the mode of a backing directory the driver
+// creates when no mode is configured
+const defaultBackingDirPermissions os.FileMode = 0750
+
+// Helper: create dir if it is missing and apply mode and ownership to it. A
+// zero mode creates missing directories with defaultBackingDirPermissions and
+// leaves existing ones alone; a uid or gid of -1 keeps the current owner or
+// group. The mode is applied explicitly so the umask does not narrow it.
+func prepareBackingDir(dir string, mode os.FileMode, uid, gid int) error {
+	createMode := mode
+	if createMode == 0 {
+		createMode = defaultBackingDirPermissions
+	}
+	info, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		if err := os.MkdirAll(dir, createMode); err != nil {
+			return fmt.Errorf("failed to create backing directory %s: %v", dir, err)
+		}
+		mode = createMode
+	case err != nil:
+		return fmt.Errorf("failed to stat backing directory %s: %v", dir, err)
+	case !info.IsDir():
+		return fmt.Errorf("backing directory %s is not a directory", dir)
+	}
+	if mode != 0 {
+		if err := os.Chmod(dir, mode); err != nil {
+			return fmt.Errorf("failed to chmod backing directory %s to %#o: %v", dir, mode, err)
+		}
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown backing directory %s to %d:%d: %v", dir, uid, gid, err)
+		}
+	}
+	return nil
+}
+
+// Helper: check that dir exists and files can be created in it
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".probe-*")
 	if err != nil {
-		return "", err
+		return err
 	}
-	lines := SplitLines(string(out))
-	for _, line := range lines {
-		if len(line) > 0 && Contains(line, target) && Contains(line, "/dev/loop") {
-			fields := SplitFields(line)
-			if len(fields) > 0 {
-				return fields[0], nil
-			}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Helper: find the loop device attached to a backing file. Returns an empty
+// string when the file is not attached to any loop device.
+func FindLoopDevice(backingFile string) (string, error) {
+	return findLoopDevice(context.Background(), execRunner{}, backingFile)
+}
+
+func findLoopDevice(ctx context.Context, runner CommandRunner, backingFile string) (string, error) {
+	out, err := runner.Run(ctx, "losetup", "-j", backingFile)
+	if err != nil {
+		return "", fmt.Errorf("losetup -j %s failed: %v: %s", backingFile, err, string(out))
+	}
+	// Each line looks like: /dev/loop0: [64769]:1234 (/var/lib/my-csi-driver/vol-x.img)
+	for _, line := range SplitLines(string(out)) {
+		if i := strings.Index(line, ":"); i > 0 && strings.HasPrefix(line, "/dev/loop") {
+			return line[:i], nil
 		}
 	}
 	return "", nil
@@ -74,10 +162,3 @@ func SplitFields(s string) []string {
 func Contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || (len(s) > len(substr) && (s[0:len(substr)] == substr || Contains(s[1:], substr))))
 }
-
-// Helper: run command and return output
-func execCommand(name string, args ...string) ([]byte, error) {
-	log.Printf("execCommand: %s %v", name, args)
-	cmd := exec.Command(name, args...)
-	return cmd.CombinedOutput()
-}
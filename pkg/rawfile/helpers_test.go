@@ -0,0 +1,129 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestValidateBackingFile(t *testing.T) {
+	backingDir := "/var/lib/my-csi-driver"
+
+	tests := []struct {
+		name        string
+		backingFile string
+		wantErr     bool
+	}{
+		{"Valid", "/var/lib/my-csi-driver/vol-1.img", false},
+		{"ValidUncleanDir", "/var/lib/my-csi-driver/./vol-1.img", false},
+		{"Empty", "", true},
+		{"Relative", "vol-1.img", true},
+		{"BackingDirItself", "/var/lib/my-csi-driver", true},
+		{"ParentTraversal", "/var/lib/my-csi-driver/../../../etc/passwd", true},
+		{"EscapeToSibling", "/var/lib/my-csi-driver/../other/vol-1.img", true},
+		{"SiblingPrefix", "/var/lib/my-csi-driver-evil/vol-1.img", true},
+		{"OutsideAbsolute", "/etc/shadow", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBackingFile(backingDir, tt.backingFile)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateBackingFile(%q) error = %v, wantErr %v", tt.backingFile, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExecRunner_KilledOnDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := (execRunner{}).Run(ctx, "sleep", "10"); err == nil {
+		t.Fatalf("expected the command to be killed")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command ran for %v despite the deadline", elapsed)
+	}
+}
+
+func TestExecRunner_KilledOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	if _, err := (execRunner{}).RunWithInput(ctx, nil, "sleep", "10"); err == nil {
+		t.Fatalf("expected the command to be killed")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command ran for %v despite the cancellation", elapsed)
+	}
+}
+
+func TestPrepareBackingDir(t *testing.T) {
+	// The umask must not narrow the configured mode
+	defer syscall.Umask(syscall.Umask(0077))
+	base := t.TempDir()
+
+	mode := func(dir string) os.FileMode {
+		t.Helper()
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatalf("stat %s: %v", dir, err)
+		}
+		return info.Mode().Perm()
+	}
+
+	// A missing directory is created with the configured mode
+	dir := filepath.Join(base, "data", "volumes")
+	if err := prepareBackingDir(dir, 0770, -1, -1); err != nil {
+		t.Fatalf("prepareBackingDir failed: %v", err)
+	}
+	if got := mode(dir); got != 0770 {
+		t.Errorf("expected mode 0770, got %#o", got)
+	}
+
+	// Without a mode a missing directory gets the default and an existing one is kept
+	dir = filepath.Join(base, "default")
+	if err := prepareBackingDir(dir, 0, -1, -1); err != nil {
+		t.Fatalf("prepareBackingDir failed: %v", err)
+	}
+	if got := mode(dir); got != defaultBackingDirPermissions {
+		t.Errorf("expected default mode %#o, got %#o", defaultBackingDirPermissions, got)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	if err := prepareBackingDir(dir, 0, -1, -1); err != nil {
+		t.Fatalf("prepareBackingDir failed: %v", err)
+	}
+	if got := mode(dir); got != 0700 {
+		t.Errorf("expected existing mode 0700 to be kept, got %#o", got)
+	}
+
+	// A configured mode is applied to an existing directory
+	if err := prepareBackingDir(dir, 0755, -1, -1); err != nil {
+		t.Fatalf("prepareBackingDir failed: %v", err)
+	}
+	if got := mode(dir); got != 0755 {
+		t.Errorf("expected mode 0755, got %#o", got)
+	}
+
+	// Changing to the current owner always succeeds
+	if err := prepareBackingDir(dir, 0, os.Getuid(), os.Getgid()); err != nil {
+		t.Errorf("prepareBackingDir with the current owner failed: %v", err)
+	}
+
+	// A file in the way is an error
+	file := filepath.Join(base, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := prepareBackingDir(file, 0750, -1, -1); err == nil {
+		t.Errorf("expected an error for a file in place of the backing directory")
+	}
+}
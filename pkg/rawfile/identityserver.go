@@ -2,17 +2,33 @@ package rawfile
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
 )
 
 // IdentityServer implements the CSI Identity service endpoints.
 type IdentityServer struct {
 	name    string
 	version string
+	// gitCommit and buildDate, when known, are reported in the plugin manifest
+	gitCommit string
+	buildDate string
+	// backingDirs must be writable for Probe to report ready
+	backingDirs []string
+	// clientset, when set, must reach the API server for Probe to report ready
+	clientset kubernetes.Interface
 	csi.UnimplementedIdentityServer
 }
 
+// probeAPITimeout bounds the API server check of Probe, so a slow API server
+// fails the probe instead of hanging it
+const probeAPITimeout = 5 * time.Second
+
 // Compile-time assertion
 var _ csi.IdentityServer = (*IdentityServer)(nil)
 
@@ -21,9 +37,17 @@ func NewIdentityServer(name, version string) *IdentityServer {
 }
 
 func (is *IdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	manifest := map[string]string{}
+	if is.gitCommit != "" {
+		manifest["gitCommit"] = is.gitCommit
+	}
+	if is.buildDate != "" {
+		manifest["buildDate"] = is.buildDate
+	}
 	return &csi.GetPluginInfoResponse{
 		Name:          is.name,
 		VendorVersion: is.version,
+		Manifest:      manifest,
 	}, nil
 }
 
@@ -48,6 +72,29 @@ func (is *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.Ge
 	return &csi.GetPluginCapabilitiesResponse{Capabilities: caps}, nil
 }
 
+// Probe reports the driver ready only while its backing directories are
+// writable and, outside standalone mode, the API server is reachable.
 func (is *IdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	if err := is.healthy(ctx); err != nil {
+		klog.Warningf("Probe: driver not ready: %v", err)
+		return &csi.ProbeResponse{Ready: wrapperspb.Bool(false)}, nil
+	}
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
+}
+
+// healthy checks the dependencies the driver cannot serve volumes without
+func (is *IdentityServer) healthy(ctx context.Context) error {
+	for _, dir := range is.backingDirs {
+		if err := checkWritable(dir); err != nil {
+			return fmt.Errorf("backing directory %s not writable: %v", dir, err)
+		}
+	}
+	if is.clientset != nil {
+		ctx, cancel := context.WithTimeout(ctx, probeAPITimeout)
+		defer cancel()
+		if err := is.clientset.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error(); err != nil {
+			return fmt.Errorf("kubernetes API unreachable: %v", err)
+		}
+	}
+	return nil
 }
@@ -2,9 +2,16 @@ package rawfile
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 func TestIdentity_GetPluginCapabilities_ControllerService(t *testing.T) {
@@ -42,3 +49,82 @@ func TestIdentity_GetPluginCapabilities_VolumeAccessibilityConstraints(t *testin
 		t.Errorf("Volume accessibility constraints capability not reported")
 	}
 }
+
+func TestIdentity_Probe(t *testing.T) {
+	testDir := t.TempDir()
+	// A regular file in place of a directory can never be written to, even as root
+	notADir := filepath.Join(testDir, "file")
+	if err := os.WriteFile(notADir, nil, 0600); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	// The fake clientset has no REST client, so the API server is served over HTTP
+	apiClient := func(handler http.HandlerFunc) kubernetes.Interface {
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+		return kubernetes.NewForConfigOrDie(&rest.Config{Host: server.URL})
+	}
+	reachable := apiClient(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"major":"1","minor":"30","gitVersion":"v1.30.0"}`))
+	})
+	unreachable := apiClient(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "connection refused", http.StatusServiceUnavailable)
+	})
+	hung := apiClient(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+
+	tests := []struct {
+		name        string
+		backingDirs []string
+		clientset   kubernetes.Interface
+		wantReady   bool
+	}{
+		{name: "Healthy", backingDirs: []string{testDir}, clientset: reachable, wantReady: true},
+		{name: "Standalone", backingDirs: []string{testDir}, wantReady: true},
+		{name: "UnwritableDir", backingDirs: []string{testDir, notADir}, wantReady: false},
+		{name: "MissingDir", backingDirs: []string{filepath.Join(testDir, "missing")}, wantReady: false},
+		{name: "APIUnreachable", backingDirs: []string{testDir}, clientset: unreachable, wantReady: false},
+		{name: "APIHung", backingDirs: []string{testDir}, clientset: hung, wantReady: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is := NewIdentityServer("my-csi-driver", "v1.0.0")
+			is.backingDirs = tt.backingDirs
+			if tt.clientset != nil {
+				is.clientset = tt.clientset
+			}
+			// The probe gives up with its request rather than waiting on the API server
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			resp, err := is.Probe(ctx, &csi.ProbeRequest{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.GetReady() == nil || resp.GetReady().GetValue() != tt.wantReady {
+				t.Errorf("expected ready=%v, got %v", tt.wantReady, resp.GetReady())
+			}
+		})
+	}
+}
+
+func TestIdentity_GetPluginInfo(t *testing.T) {
+	d := NewDriver(&DriverOptions{DriverName: "my-csi-driver", GitCommit: "abc123", BuildDate: "2026-01-02T03:04:05Z"})
+	if d.version != "dev" {
+		t.Errorf("expected version to default to dev, got %q", d.version)
+	}
+
+	is := NewIdentityServer("my-csi-driver", "v1.2.3")
+	is.gitCommit = d.gitCommit
+	is.buildDate = d.buildDate
+	resp, err := is.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.Name != "my-csi-driver" || resp.VendorVersion != "v1.2.3" {
+		t.Errorf("unexpected plugin info %s %s", resp.Name, resp.VendorVersion)
+	}
+	if resp.Manifest["gitCommit"] != "abc123" || resp.Manifest["buildDate"] != "2026-01-02T03:04:05Z" {
+		t.Errorf("expected build information in the manifest, got %v", resp.Manifest)
+	}
+}
@@ -0,0 +1,171 @@
+package rawfile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// DefaultLoopDeviceReconcileInterval is how often the node looks for loop
+// devices left attached to backing files no volume uses.
+const DefaultLoopDeviceReconcileInterval = 10 * time.Minute
+
+// LoopDeviceObserver is told about leaked loop devices, such as for metrics
+type LoopDeviceObserver interface {
+	// ObserveLeakedLoopDevices records the leaks found by one reconcile pass,
+	// each counted once, and how many of them were detached
+	ObserveLeakedLoopDevices(leaked, detached int)
+}
+
+// deletedSuffix marks a backing file that was removed while still attached
+const deletedSuffix = " (deleted)"
+
+// loopDevice is an attached loop device as listed by losetup
+type loopDevice struct {
+	name        string
+	backingFile string
+	deleted     bool
+}
+
+// listLoopDevices lists the attached loop devices and their backing files
+func listLoopDevices(ctx context.Context, runner CommandRunner) ([]loopDevice, error) {
+	out, err := runner.Run(ctx, "losetup", "--list", "--noheadings", "--output", "NAME,BACK-FILE")
+	if err != nil {
+		return nil, fmt.Errorf("losetup --list failed: %v: %s", err, string(out))
+	}
+	// Each line looks like: /dev/loop0 /var/lib/my-csi-driver/vol-x.img (deleted)
+	var devices []loopDevice
+	for _, line := range SplitLines(string(out)) {
+		name, file, ok := strings.Cut(strings.TrimSpace(line), " ")
+		file = strings.TrimSpace(file)
+		if !ok || !strings.HasPrefix(name, "/dev/loop") || file == "" {
+			continue
+		}
+		device := loopDevice{name: name, backingFile: file}
+		if strings.HasSuffix(file, deletedSuffix) {
+			device.backingFile, device.deleted = strings.TrimSuffix(file, deletedSuffix), true
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// reconcileLoopDevices finds loop devices leaked by failed unstages or
+// crashes: devices attached to a file in the backing directories that was
+// deleted, or that nothing mounts or holds while no operation is in flight
+// on its volume. Each leak is logged, recorded as an Event on the Node and
+// reported to the observer the first time it is seen, and with
+// detachLeakedLoopDevices set the device is detached. It returns the leaked
+// devices.
+func (ns *NodeServer) reconcileLoopDevices(ctx context.Context) ([]string, error) {
+	devices, err := listLoopDevices(ctx, ns.runner)
+	if err != nil {
+		return nil, err
+	}
+	mountinfo, err := os.ReadFile(filepath.Join(ns.procDir, "self", "mountinfo"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mountinfo: %v", err)
+	}
+
+	var leaked []string
+	seen := map[string]bool{}
+	newLeaks, detached := 0, 0
+	for _, device := range devices {
+		// Devices of other software on the node are none of our business
+		if ns.validateBackingFile(device.backingFile) != nil {
+			continue
+		}
+		if !device.deleted {
+			if _, err := os.Stat(device.backingFile); os.IsNotExist(err) {
+				device.deleted = true
+			}
+		}
+		if !device.deleted && ns.loopDeviceInUse(device.name, string(mountinfo)) {
+			continue
+		}
+		volumeID := backingFileVolumeID(device.backingFile)
+		if !ns.volumeLocks.TryAcquire(volumeID) {
+			klog.V(4).Infof("Skipping loop device %s: volume %s operation in progress", device.name, volumeID)
+			continue
+		}
+		leaked = append(leaked, device.name)
+		key := device.name + " " + device.backingFile
+		seen[key] = true
+		if !ns.leakedLoopDevices[key] {
+			newLeaks++
+			reason := "is not mounted"
+			if device.deleted {
+				reason = "was deleted"
+			}
+			klog.Warningf("Leaked loop device %s: backing file %s %s", device.name, device.backingFile, reason)
+			ns.recordNodeEvent(corev1.EventTypeWarning, eventReasonLoopDeviceLeaked, "Loop device %s is leaked: backing file %s %s", device.name, device.backingFile, reason)
+		}
+		if ns.detachLeakedLoopDevices {
+			ns.clearIOLimits(device.name)
+			if err := ns.runCommand(ctx, "losetup", "-d", device.name); err != nil {
+				klog.Errorf("Failed to detach leaked loop device %s: %v", device.name, err)
+			} else {
+				klog.Infof("Detached leaked loop device %s", device.name)
+				detached++
+				delete(seen, key)
+			}
+		}
+		ns.volumeLocks.Release(volumeID)
+	}
+	// Remember leaks left attached so later passes don't count them again
+	ns.leakedLoopDevices = seen
+
+	if ns.loopDeviceObserver != nil && (newLeaks > 0 || detached > 0) {
+		ns.loopDeviceObserver.ObserveLeakedLoopDevices(newLeaks, detached)
+	}
+	return leaked, nil
+}
+
+// loopDeviceInUse reports whether a loop device is mounted, bind-mounted as a
+// staged block volume, or held by another device such as a dm-crypt mapping.
+// Devices whose number can't be read count as in use.
+func (ns *NodeServer) loopDeviceInUse(loopDev, mountinfo string) bool {
+	name := filepath.Base(loopDev)
+	if holders, err := os.ReadDir(filepath.Join(ns.sysBlockDir, name, "holders")); err == nil && len(holders) > 0 {
+		return true
+	}
+	data, err := os.ReadFile(filepath.Join(ns.sysBlockDir, name, "dev"))
+	if err != nil {
+		return true
+	}
+	device := strings.TrimSpace(string(data))
+	for _, line := range SplitLines(mountinfo) {
+		// Field 3 is major:minor of mounted filesystems; block volumes bind-mount
+		// the device node, which shows up as /loopN within devtmpfs
+		fields := SplitFields(line)
+		if len(fields) > 4 && (fields[2] == device || unescapeMountInfo(fields[3]) == "/"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunLoopDeviceReconciler looks for leaked loop devices periodically
+func (ns *NodeServer) RunLoopDeviceReconciler(ctx context.Context, interval time.Duration) {
+	klog.Infof("Starting loop device reconciler with interval %v (detach leaked devices: %v)", interval, ns.detachLeakedLoopDevices)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			klog.Infof("Loop device reconciler stopped")
+			return
+		case <-ticker.C:
+			if _, err := ns.reconcileLoopDevices(ctx); err != nil {
+				klog.Errorf("Loop device reconcile failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/record"
+)
+
+type loopDeviceRecorder struct {
+	leaked, detached []int
+}
+
+func (r *loopDeviceRecorder) ObserveLeakedLoopDevices(leaked, detached int) {
+	r.leaked = append(r.leaked, leaked)
+	r.detached = append(r.detached, detached)
+}
+
+func TestListLoopDevices(t *testing.T) {
+	runner := &fakeRunner{output: map[string]string{"losetup": "/dev/loop0 /var/lib/my-csi-driver/vol a.img\n/dev/loop1 /var/lib/my-csi-driver/vol-b.img (deleted)\n/dev/loop2 \n"}}
+	devices, err := listLoopDevices(context.Background(), runner)
+	if err != nil {
+		t.Fatalf("listLoopDevices failed: %v", err)
+	}
+	want := []loopDevice{
+		{name: "/dev/loop0", backingFile: "/var/lib/my-csi-driver/vol a.img"},
+		{name: "/dev/loop1", backingFile: "/var/lib/my-csi-driver/vol-b.img", deleted: true},
+	}
+	if !slices.Equal(devices, want) {
+		t.Errorf("listLoopDevices = %+v, want %+v", devices, want)
+	}
+}
+
+func TestNode_ReconcileLoopDevices(t *testing.T) {
+	testDir := t.TempDir()
+	for _, vol := range []string{"vol-unused", "vol-mounted", "vol-held", "vol-busy"} {
+		createAgedFile(t, filepath.Join(testDir, vol+".img"), 0)
+	}
+	ns := NewNodeServer("test-node", "test-driver", testDir, nil)
+	ns.runner = &fakeRunner{output: map[string]string{"losetup": strings.Join([]string{
+		"/dev/loop0 " + filepath.Join(testDir, "vol-unused.img"),
+		"/dev/loop1 " + filepath.Join(testDir, "vol-mounted.img"),
+		"/dev/loop2 " + filepath.Join(testDir, "vol-deleted.img") + " (deleted)",
+		"/dev/loop3 " + filepath.Join(testDir, "vol-held.img"),
+		"/dev/loop4 " + filepath.Join(testDir, "vol-busy.img"),
+		"/dev/loop5 /var/lib/snapd/snaps/core.snap",
+	}, "\n")}}
+
+	ns.sysBlockDir = t.TempDir()
+	for i, name := range []string{"loop0", "loop1", "loop2", "loop3", "loop4", "loop5"} {
+		if err := os.MkdirAll(filepath.Join(ns.sysBlockDir, name, "holders"), 0755); err != nil {
+			t.Fatalf("failed to create sys block dir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(ns.sysBlockDir, name, "dev"), []byte("7:"+strconv.Itoa(i)+"\n"), 0644); err != nil {
+			t.Fatalf("failed to write device number: %v", err)
+		}
+	}
+	// loop3 backs a dm-crypt mapping
+	if err := os.WriteFile(filepath.Join(ns.sysBlockDir, "loop3", "holders", "dm-0"), nil, 0644); err != nil {
+		t.Fatalf("failed to create holder: %v", err)
+	}
+	ns.procDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(ns.procDir, "self"), 0755); err != nil {
+		t.Fatalf("failed to create proc dir: %v", err)
+	}
+	mountinfo := "36 25 7:1 / /var/lib/kubelet/plugins/staging rw,relatime - ext4 /dev/loop1 rw\n"
+	if err := os.WriteFile(filepath.Join(ns.procDir, "self", "mountinfo"), []byte(mountinfo), 0644); err != nil {
+		t.Fatalf("failed to write mountinfo: %v", err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	ns.recorder = recorder
+	observer := &loopDeviceRecorder{}
+	ns.loopDeviceObserver = observer
+	ns.volumeLocks.TryAcquire("vol-busy")
+
+	// Detect only: the unmounted and deleted devices are reported once
+	for range 2 {
+		leaked, err := ns.reconcileLoopDevices(context.Background())
+		if err != nil {
+			t.Fatalf("reconcileLoopDevices failed: %v", err)
+		}
+		if got, want := strings.Join(leaked, ","), "/dev/loop0,/dev/loop2"; got != want {
+			t.Errorf("expected leaked devices %s, got %s", want, got)
+		}
+	}
+	if !slices.Equal(observer.leaked, []int{2}) {
+		t.Errorf("expected the leaks to be observed once, got %v", observer.leaked)
+	}
+	if len(recorder.Events) != 2 {
+		t.Errorf("expected 2 events, got %d", len(recorder.Events))
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "Warning LoopDeviceLeaked Loop device /dev/loop0") {
+		t.Errorf("unexpected event %q", event)
+	}
+	for _, call := range ns.runner.(*fakeRunner).calls {
+		if strings.HasPrefix(call, "losetup -d") {
+			t.Errorf("expected no detach in detect-only mode, got %s", call)
+		}
+	}
+
+	// Auto-fix detaches them without counting them again
+	ns.detachLeakedLoopDevices = true
+	if _, err := ns.reconcileLoopDevices(context.Background()); err != nil {
+		t.Fatalf("reconcileLoopDevices failed: %v", err)
+	}
+	var detached []string
+	for _, call := range ns.runner.(*fakeRunner).calls {
+		if strings.HasPrefix(call, "losetup -d") {
+			detached = append(detached, call)
+		}
+	}
+	if got, want := strings.Join(detached, ","), "losetup -d /dev/loop0,losetup -d /dev/loop2"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if !slices.Equal(observer.leaked, []int{2, 0}) || !slices.Equal(observer.detached, []int{0, 2}) {
+		t.Errorf("expected 2 detached devices to be observed, got leaked %v detached %v", observer.leaked, observer.detached)
+	}
+	if !ns.volumeLocks.TryAcquire("vol-unused") {
+		t.Errorf("expected the reconciler to release the volume lock")
+	}
+}
+
+func TestNode_ReconcileLoopDevices_EphemeralPublishInFlight(t *testing.T) {
+	testDir := t.TempDir()
+	backingFile := filepath.Join(testDir, ephemeralPrefix+"csi-inline.img")
+	createAgedFile(t, backingFile, 0)
+	ns := NewNodeServer("test-node", "test-driver", testDir, nil)
+	ns.runner = &fakeRunner{output: map[string]string{"losetup": "/dev/loop0 " + backingFile}}
+	ns.sysBlockDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(ns.sysBlockDir, "loop0", "holders"), 0755); err != nil {
+		t.Fatalf("failed to create sys block dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(ns.sysBlockDir, "loop0", "dev"), []byte("7:0\n"), 0644); err != nil {
+		t.Fatalf("failed to write device number: %v", err)
+	}
+	ns.procDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(ns.procDir, "self"), 0755); err != nil {
+		t.Fatalf("failed to create proc dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(ns.procDir, "self", "mountinfo"), nil, 0644); err != nil {
+		t.Fatalf("failed to write mountinfo: %v", err)
+	}
+	ns.detachLeakedLoopDevices = true
+
+	// NodePublishVolume attached the device and has yet to mount it
+	ns.volumeLocks.TryAcquire("csi-inline")
+	leaked, err := ns.reconcileLoopDevices(context.Background())
+	if err != nil {
+		t.Fatalf("reconcileLoopDevices failed: %v", err)
+	}
+	if len(leaked) != 0 {
+		t.Errorf("expected the device of an in-flight publish to be left alone, got %v", leaked)
+	}
+	for _, call := range ns.runner.(*fakeRunner).calls {
+		if strings.HasPrefix(call, "losetup -d") {
+			t.Errorf("expected no detach while the publish holds the volume lock, got %s", call)
+		}
+	}
+
+	// Once the publish gave up, the device is a leak
+	ns.volumeLocks.Release("csi-inline")
+	if leaked, err := ns.reconcileLoopDevices(context.Background()); err != nil || len(leaked) != 1 {
+		t.Errorf("expected the device reported as leaked, got %v, %v", leaked, err)
+	}
+}
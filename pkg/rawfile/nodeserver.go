@@ -2,16 +2,23 @@ package rawfile
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	klog "k8s.io/klog/v2"
 )
 
@@ -23,44 +30,408 @@ type NodeServer struct {
 	nodeID     string
 	driverName string
 	backingDir string
-	clientset  kubernetes.Interface
+	// extraBackingDirs hold backing files alongside backingDir on nodes with
+	// several data disks; new files go wherever there is most free space
+	extraBackingDirs []string
+	clientset        kubernetes.Interface
+	// gcGracePeriod protects recently modified backing files from garbage collection
+	gcGracePeriod time.Duration
+	// gcMaxOrphanRatio aborts a garbage collection pass that finds more than this
+	// fraction of the backing files orphaned; zero means no limit
+	gcMaxOrphanRatio float64
+	// gcObserver is told the outcome of every garbage collection pass; nil disables it
+	gcObserver GCObserver
+	// detachLeakedLoopDevices has the loop device reconciler detach the leaks
+	// it finds rather than only report them
+	detachLeakedLoopDevices bool
+	// loopDeviceObserver is told about leaked loop devices; nil disables it
+	loopDeviceObserver LoopDeviceObserver
+	// leakedLoopDevices are the leaks already reported and still attached,
+	// keyed by device and backing file
+	leakedLoopDevices map[string]bool
+	// onDeletePolicy decides whether orphaned backing files are deleted or archived
+	onDeletePolicy string
+	// removeArchivedVolumePath lets an archived file replace an older archive of the same volume
+	removeArchivedVolumePath bool
+	// mountPermissions is applied to staging/target directories and the mounted
+	// filesystem root; zero keeps the default directory mode
+	mountPermissions os.FileMode
+	// minVolumeSize and maxVolumeSize bound the size of inline ephemeral
+	// volumes in bytes, as the controller bounds provisioned ones; zero disables the bound
+	minVolumeSize int64
+	maxVolumeSize int64
+	// maxVolumesPerNode caps the volumes the scheduler places on this node; zero means no limit
+	maxVolumesPerNode int64
+	// reservedCapacity is the free space just-in-time creation must leave on the backing filesystem
+	reservedCapacity int64
+	// fsckOnMount checks already formatted devices for corruption before mounting them
+	fsckOnMount bool
+	// defaultFsType formats volumes whose capability and storage class name no fsType
+	defaultFsType string
+	// qosCgroup is the cgroup whose io.max applies the I/O limits of volumes
+	// to their loop devices; empty disables volume QoS
+	qosCgroup string
+	// publishTimeout bounds staging and publishing a volume; zero means no limit
+	publishTimeout time.Duration
+	// recorder publishes Events about volumes to their pods and PVCs; nil disables them
+	recorder record.EventRecorder
+	// runner executes losetup, mkfs, mount and friends; tests substitute a fake
+	runner      CommandRunner
+	volumeLocks *VolumeLocks
+	// nbdMu serializes picking a free nbd device for qcow2 backing files
+	nbdMu sync.Mutex
+	// sysBlockDir and procDir locate loop and nbd devices and the qemu-nbd processes serving them
+	sysBlockDir string
+	procDir     string
+	// devDir holds loop-control, checked before any volume is staged
+	devDir string
+	// sysModuleDir holds the loop module parameters, such as its device limit
+	sysModuleDir string
+	// backends provide volumes by backing mode; tests substitute fakes
+	backends map[string]VolumeBackend
 	csi.UnimplementedNodeServer
 }
 
+// DefaultGCGracePeriod is how long a backing file is left alone by the garbage
+// collector after it was last modified.
+const DefaultGCGracePeriod = 10 * time.Minute
+
+// DefaultGCMaxOrphanRatio is the largest fraction of the backing files a
+// garbage collection pass may reclaim. More usually means the PV list came
+// back incomplete, not that the volumes were deleted.
+const DefaultGCMaxOrphanRatio = 0.5
+
+// gcOrphanRatioMinFiles is the fewest backing files a node needs before the
+// orphan ratio is checked. Below it, deleting one or a few volumes would
+// already exceed the ratio.
+const gcOrphanRatioMinFiles = 10
+
+// DefaultNodePublishTimeout bounds staging and publishing a volume, leaving
+// room for formatting large volumes.
+const DefaultNodePublishTimeout = 10 * time.Minute
+
+// DefaultGCInterval is how often the garbage collector scans the backing directory.
+const DefaultGCInterval = 5 * time.Minute
+
+// On-delete policies for orphaned backing files found by the garbage collector.
+const (
+	OnDeletePolicyDelete = "delete"
+	OnDeletePolicyRetain = "retain"
+)
+
+// defaultMountPermissions is the mode of staging and target directories when
+// no mount permissions are configured.
+const defaultMountPermissions os.FileMode = 0750
+
+// archiveDirName is the subdirectory of the backing directory that retained
+// backing files are moved into.
+const archiveDirName = "archived"
+
 func NewNodeServer(nodeID, driverName, backingDir string, clientset kubernetes.Interface) *NodeServer {
-	return &NodeServer{
-		nodeID:     nodeID,
-		driverName: driverName,
-		backingDir: backingDir,
-		clientset:  clientset,
+	ns := &NodeServer{
+		nodeID:         nodeID,
+		driverName:     driverName,
+		backingDir:     backingDir,
+		clientset:      clientset,
+		gcGracePeriod:  DefaultGCGracePeriod,
+		publishTimeout: DefaultNodePublishTimeout,
+		defaultFsType:  defaultFsType,
+		onDeletePolicy: OnDeletePolicyDelete,
+		runner:         execRunner{},
+		volumeLocks:    NewVolumeLocks(),
+		sysBlockDir:    "/sys/block",
+		devDir:         "/dev",
+		procDir:        "/proc",
+		sysModuleDir:   "/sys/module",
 	}
+	ns.backends = newVolumeBackends(ns)
+	return ns
 }
 
-// NodePublishVolume mounts the volume to the target path on the node.
-func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	klog.Infof("NodePublishVolume: %s at %s", req.VolumeId, req.TargetPath)
-	if err := os.MkdirAll(req.TargetPath, 0750); err != nil {
+// NodeStageVolume makes the volume available at the staging path through
+// the backend of its backing mode, by default a loop-mounted backing file.
+func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (_ *csi.NodeStageVolumeResponse, err error) {
+	klog.Infof("NodeStageVolume: %s at %s", req.VolumeId, req.StagingTargetPath)
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
+	}
+
+	// Hold the volume lock so the garbage collector can't remove a backing file being created
+	if !ns.volumeLocks.TryAcquire(req.VolumeId) {
+		return nil, status.Errorf(codes.Aborted, "an operation for volume %s is already in progress", req.VolumeId)
+	}
+	defer ns.volumeLocks.Release(req.VolumeId)
+
+	// Bound the whole operation so a hung losetup, mkfs or mount is killed
+	reqCtx := ctx
+	ctx, cancel := ns.withPublishTimeout(ctx)
+	defer cancel()
+
+	// Tell the user why the volume could not be staged without them having to read node logs
+	defer func() {
+		err = deadlineExceeded(ctx, err)
+		if err != nil {
+			ns.recordVolumeEvent(reqCtx, req.VolumeId, req.VolumeContext, corev1.EventTypeWarning, eventReasonStageFailed, "Failed to stage volume %s on node %s: %v", req.VolumeId, ns.nodeID, err)
+		}
+	}()
+
+	volCtx, err := ParseVolumeContext(req.VolumeContext)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	backend := ns.backend(volCtx)
+	if err = backend.Stage(ctx, req, volCtx); err != nil {
+		return nil, err
+	}
+	ns.markStaged(req.VolumeId)
+	if _, ok := backend.(*loopFileBackend); ok {
+		ns.reconcileIOLimits(ctx, req.VolumeId)
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume tears down what the volume's backend set up at staging.
+func (ns *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	klog.Infof("NodeUnstageVolume: %s at %s", req.VolumeId, req.StagingTargetPath)
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+
+	// Hold the volume lock so the loop device reconciler can't detach the device
+	// between the unmount and the detach
+	if err := ns.volumeLocks.Acquire(ctx, req.VolumeId); err != nil {
+		return nil, status.Errorf(codes.Aborted, "timed out waiting for another operation on volume %s: %v", req.VolumeId, err)
+	}
+	defer ns.volumeLocks.Release(req.VolumeId)
+
+	if err := ns.stagedBackend(req.VolumeId, req.StagingTargetPath).Unstage(ctx, req); err != nil {
 		return nil, err
 	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
 
-	// Get backing file path from volume context
-	backingFile, ok := req.VolumeContext["backingFile"]
-	if !ok {
-		return nil, fmt.Errorf("missing backingFile in volume context")
+// NodePublishVolume bind-mounts the staged volume to the target path on the node.
+func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (_ *csi.NodePublishVolumeResponse, err error) {
+	klog.Infof("NodePublishVolume: %s at %s", req.VolumeId, req.TargetPath)
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if req.TargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "target path is required")
+	}
+	if isEphemeral(req.VolumeContext) {
+		if req.VolumeCapability == nil {
+			return nil, status.Error(codes.InvalidArgument, "volume capability is required")
+		}
+		return ns.publishEphemeral(ctx, req)
+	}
+	if req.StagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path is required")
+	}
+	if req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
 	}
-	klog.Infof("NodePublishVolume backingFile: %s", backingFile)
 
-	// Get size from volume context
-	sizeStr, ok := req.VolumeContext["size"]
-	if !ok {
-		return nil, fmt.Errorf("missing size in volume context")
+	// Serialize publish and unpublish of the volume; kubelet retries can overlap
+	if err := ns.volumeLocks.Acquire(ctx, req.VolumeId); err != nil {
+		return nil, status.Errorf(codes.Aborted, "timed out waiting for another operation on volume %s: %v", req.VolumeId, err)
+	}
+	defer ns.volumeLocks.Release(req.VolumeId)
+
+	reqCtx := ctx
+	ctx, cancel := ns.withPublishTimeout(ctx)
+	defer cancel()
+
+	// Tell the pod's owner why the volume could not be mounted
+	defer func() {
+		err = deadlineExceeded(ctx, err)
+		if err != nil {
+			ns.recordVolumeEvent(reqCtx, req.VolumeId, req.VolumeContext, corev1.EventTypeWarning, eventReasonPublishFailed, "Failed to publish volume %s on node %s: %v", req.VolumeId, ns.nodeID, err)
+		}
+	}()
+
+	// Block volumes are bind-mounted onto a file, filesystem volumes onto a directory
+	block := req.VolumeCapability.GetBlock() != nil
+	source := req.StagingTargetPath
+	if block {
+		source = blockStagingDevice(req.StagingTargetPath)
+		if err := createBlockTarget(req.TargetPath); err != nil {
+			return nil, toStatus(err)
+		}
+	} else if err := ns.makeMountDir(req.TargetPath); err != nil {
+		return nil, toStatus(err)
+	}
+
+	// Already published: nothing to do (idempotent)
+	if mounted, err := ns.isMountPoint(req.TargetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check target path %s: %v", req.TargetPath, err)
+	} else if mounted {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	// ReadWriteOncePod: refuse to expose the volume to a second pod
+	if req.VolumeCapability.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER {
+		if other, err := ns.publishedElsewhere(source, req.TargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check existing mounts of volume %s: %v", req.VolumeId, err)
+		} else if other != "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is single-writer and already published at %s", req.VolumeId, other)
+		}
+	}
+
+	propagation := publishPropagation(req.VolumeCapability, req.VolumeContext)
+	if err := validateMountPropagation(propagation); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var options []string
+	if isReadOnly(req) {
+		options = append(options, "ro")
+	}
+	klog.Infof("NodePublishVolume bind-mounting %s to %s", source, req.TargetPath)
+	if err := ns.bindMount(ctx, source, req.TargetPath, options); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to bind mount staged volume: %v", err)
+	}
+	// The bind mount is private by default; unmount on failure so a retry
+	// doesn't find it published without the requested propagation
+	if err := ns.setMountPropagation(ctx, req.TargetPath, propagation); err != nil {
+		if uerr := ns.runCommand(context.WithoutCancel(ctx), "umount", req.TargetPath); uerr != nil {
+			klog.Errorf("Failed to unmount %s after setting its propagation failed: %v", req.TargetPath, uerr)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to set %s mount propagation: %v", propagation, err)
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// makeMountDir creates a staging or target directory with the configured
+// mount permissions. The mode is set explicitly so the umask can't narrow it.
+func (ns *NodeServer) makeMountDir(path string) error {
+	mode := ns.mountPermissions
+	if mode == 0 {
+		mode = defaultMountPermissions
+	}
+	if err := os.MkdirAll(path, mode); err != nil {
+		return err
+	}
+	if ns.mountPermissions == 0 {
+		return nil
+	}
+	return chmodKeepSetgid(path, mode)
+}
+
+// applyMountPermissions sets the configured mount permissions on the root of
+// a filesystem just mounted at path, so publishing bind mounts expose them to
+// the pod. The mount is undone if that fails.
+func (ns *NodeServer) applyMountPermissions(ctx context.Context, path string) error {
+	if ns.mountPermissions == 0 {
+		return nil
+	}
+	if err := chmodKeepSetgid(path, ns.mountPermissions); err != nil {
+		if uerr := ns.runCommand(context.WithoutCancel(ctx), "umount", path); uerr != nil {
+			klog.Errorf("Failed to unmount %s: %v", path, uerr)
+		}
+		return status.Errorf(codes.Internal, "failed to set permissions on %s: %v", path, err)
 	}
-	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	return nil
+}
+
+// chmodKeepSetgid sets the permission bits of path to mode while keeping its
+// setgid bit. Kubelet sets that bit on the volume root when it applies a pod's
+// fsGroup, so files created later belong to the group; clearing it when the
+// volume is staged again would leave them unwritable for other pod users.
+func chmodKeepSetgid(path string, mode os.FileMode) error {
+	fi, err := os.Stat(path)
 	if err != nil {
-		return nil, fmt.Errorf("invalid size in volume context: %v", err)
+		return err
+	}
+	return os.Chmod(path, mode|fi.Mode()&os.ModeSetgid)
+}
+
+// backingFilePath returns the backing file of a volume: the path CreateVolume
+// records in the volume context, or wherever the file was placed among the
+// extra backing directories, or that of an inline ephemeral volume
+func (ns *NodeServer) backingFilePath(volumeID string) string {
+	file, ok := ns.findBackingFile(filepath.Join(ns.backingDir, volumeID+".img"))
+	if !ok {
+		if ephemeral, ok := ns.ephemeralBackingFile(volumeID); ok {
+			return ephemeral
+		}
+	}
+	return file
+}
+
+// backingDirs returns every backing directory, the primary one first
+func (ns *NodeServer) backingDirs() []string {
+	return append([]string{ns.backingDir}, ns.extraBackingDirs...)
+}
+
+// Helper: validate that backingFile lies within one of the backing directories
+func (ns *NodeServer) validateBackingFile(backingFile string) error {
+	err := validateBackingFile(ns.backingDir, backingFile)
+	if err == nil {
+		return nil
+	}
+	for _, dir := range ns.extraBackingDirs {
+		if validateBackingFile(dir, backingFile) == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Helper: look for a backing file by name in every backing directory. Files
+// are named after their volume, so the directory a file landed in does not
+// need to be recorded anywhere else. Returns backingFile unchanged and false
+// when it exists nowhere.
+func (ns *NodeServer) findBackingFile(backingFile string) (string, bool) {
+	if _, err := os.Stat(backingFile); err == nil {
+		return backingFile, true
+	}
+	name := filepath.Base(backingFile)
+	for _, dir := range ns.backingDirs() {
+		candidate := filepath.Join(dir, name)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, true
+		}
+	}
+	return backingFile, false
+}
+
+// Helper: pick where a new backing file goes: the backing directory with the
+// most free space. With a single directory the path is left untouched.
+func (ns *NodeServer) placeBackingFile(backingFile string) string {
+	if len(ns.extraBackingDirs) == 0 {
+		return backingFile
 	}
+	best, bestAvailable := backingFile, int64(-1)
+	for _, dir := range ns.backingDirs() {
+		available, err := availableCapacity(dir)
+		if err != nil {
+			klog.Warningf("Skipping backing directory %s: %v", dir, err)
+			continue
+		}
+		if available > bestAvailable {
+			best, bestAvailable = filepath.Join(dir, filepath.Base(backingFile)), available
+		}
+	}
+	klog.Infof("Placing backing file %s (%d bytes free)", best, bestAvailable)
+	return best
+}
 
-	// Just-in-time creation: Create backing file if it doesn't exist
+// Helper: create the backing file just-in-time if it doesn't exist yet.
+// When sourceFile is set the new file starts as a copy of it; otherwise it is
+// an empty qcow2 image when qcow2 is set and a sparse raw file if not. Raw
+// files get all their blocks allocated up front when preallocate is set.
+func (ns *NodeServer) ensureBackingFile(ctx context.Context, backingFile string, size int64, sourceFile string, qcow2, preallocate bool) error {
 	if _, statErr := os.Stat(backingFile); statErr != nil {
 		if os.IsNotExist(statErr) {
 			klog.Infof("Backing file %s does not exist, creating just-in-time with size %d", backingFile, size)
@@ -68,22 +439,28 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			// Ensure backing directory exists
 			backingFileDir := filepath.Dir(backingFile)
 			if err := os.MkdirAll(backingFileDir, 0750); err != nil {
-				return nil, fmt.Errorf("failed to create backing directory: %v", err)
+				return fmt.Errorf("failed to create backing directory: %v", err)
+			}
+			if err := ns.checkReservedCapacity(backingFileDir, size); err != nil {
+				return err
 			}
 
-			// Create backing file
-			f, err := os.Create(backingFile)
-			if err != nil {
-				return nil, fmt.Errorf("failed to create backing file: %v", err)
+			// Build the file under a temporary name and rename it into place once
+			// complete, so a failed creation never leaves a half-formed backing
+			// file behind for a retry to mount
+			tmpFile := backingFile + ".tmp"
+			os.Remove(tmpFile)
+			if err := ns.createBackingFile(ctx, tmpFile, size, sourceFile, qcow2, preallocate); err != nil {
+				os.Remove(tmpFile)
+				return err
 			}
-			if err := f.Truncate(size); err != nil {
-				f.Close()
-				return nil, fmt.Errorf("failed to truncate backing file: %v", err)
+			if err := os.Rename(tmpFile, backingFile); err != nil {
+				os.Remove(tmpFile)
+				return fmt.Errorf("failed to rename backing file into place: %v", err)
 			}
-			f.Close()
 			klog.Infof("Created backing file %s with size %d bytes", backingFile, size)
 		} else {
-			return nil, fmt.Errorf("backing file %s not accessible on node: %v", backingFile, statErr)
+			return fmt.Errorf("backing file %s not accessible on node: %v", backingFile, statErr)
 		}
 	} else {
 		klog.Infof("Backing file %s already exists", backingFile)
@@ -91,42 +468,146 @@ func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 
 	// Verify backing file exists and has content
 	if fi, err := os.Stat(backingFile); err != nil {
-		return nil, fmt.Errorf("backing file %s verification failed: %v", backingFile, err)
+		return fmt.Errorf("backing file %s verification failed: %v", backingFile, err)
 	} else if fi.Size() == 0 {
 		klog.Warningf("backing file %s has zero size; losetup may fail", backingFile)
 	}
+	return nil
+}
+
+// Helper: create a backing file of size bytes at file, copied from sourceFile
+// when cloning, in qcow2 format or as a raw file that is optionally preallocated
+func (ns *NodeServer) createBackingFile(ctx context.Context, file string, size int64, sourceFile string, qcow2, preallocate bool) error {
+	if sourceFile != "" {
+		if err := ns.cloneBackingFile(ctx, sourceFile, file, size); err != nil {
+			return err
+		}
+	} else if qcow2 {
+		return ns.createQcow2File(ctx, file, size)
+	} else {
+		f, err := os.Create(file)
+		if err != nil {
+			return backingFileError("create", file, err)
+		}
+		err = f.Truncate(size)
+		f.Close()
+		if err != nil {
+			return backingFileError("truncate", file, err)
+		}
+	}
+	if preallocate && !qcow2 {
+		return preallocateFile(file, size)
+	}
+	return nil
+}
+
+// Helper: report a failure to write a backing file, as ResourceExhausted
+// when the backing filesystem is full, e.g. because other volumes are being
+// created at the same time
+func backingFileError(op, file string, err error) error {
+	if errors.Is(err, unix.ENOSPC) {
+		return status.Errorf(codes.ResourceExhausted, "not enough space to %s backing file %s: %v", op, file, err)
+	}
+	return status.Errorf(codes.Internal, "failed to %s backing file %s: %v", op, file, err)
+}
+
+// Helper: allocate the first size bytes of file so writes to the volume can't
+// fail later for lack of space on the backing filesystem
+func preallocateFile(file string, size int64) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to open backing file %s: %v", file, err)
+	}
+	defer f.Close()
+	if err := unix.Fallocate(int(f.Fd()), 0, 0, size); err != nil {
+		if errors.Is(err, unix.ENOSPC) {
+			return status.Errorf(codes.ResourceExhausted, "not enough space to preallocate %d bytes for %s", size, file)
+		}
+		return status.Errorf(codes.Internal, "failed to preallocate backing file %s: %v", file, err)
+	}
+	return nil
+}
 
-	// Set up loop device
-	loopDev, err := setupLoopDevice(backingFile)
+// Helper: refuse to attach another loop device once maxVolumesPerNode are attached
+func (ns *NodeServer) checkLoopDeviceLimit() error {
+	if ns.maxVolumesPerNode <= 0 {
+		return nil
+	}
+	attached, err := ns.attachedLoopDevices()
 	if err != nil {
-		return nil, fmt.Errorf("failed to set up loop device: %v", err)
+		return status.Errorf(codes.Internal, "failed to count attached loop devices: %v", err)
+	}
+	if int64(attached) >= ns.maxVolumesPerNode {
+		return status.Errorf(codes.ResourceExhausted, "node %s already has %d loop devices attached, the maximum of %d volumes per node", ns.nodeID, attached, ns.maxVolumesPerNode)
 	}
+	return nil
+}
 
-	// Format if needed (only if not already formatted)
-	fsType := req.VolumeCapability.GetMount().GetFsType()
-	if fsType == "" {
-		fsType = "ext4"
+// Helper: count the loop devices bound to a backing file. Detached devices
+// stay listed in sysBlockDir but lose their loop/backing_file attribute.
+func (ns *NodeServer) attachedLoopDevices() (int, error) {
+	entries, err := os.ReadDir(ns.sysBlockDir)
+	if err != nil {
+		return 0, err
+	}
+	attached := 0
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "loop") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(ns.sysBlockDir, entry.Name(), "loop", "backing_file")); err == nil {
+			attached++
+		}
 	}
-	klog.Infof("NodePublishVolume format: %s %s", loopDev, fsType)
+	return attached, nil
+}
 
-	if err := formatIfNeeded(loopDev, fsType); err != nil {
-		return nil, fmt.Errorf("failed to format device: %v", err)
+// loopDeviceLimit returns the number of loop devices the kernel was
+// configured with through the loop module's max_loop parameter, or zero when
+// devices are created on demand without a fixed limit
+func (ns *NodeServer) loopDeviceLimit() int64 {
+	data, err := os.ReadFile(filepath.Join(ns.sysModuleDir, "loop", "parameters", "max_loop"))
+	if err != nil {
+		return 0
 	}
+	limit, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
 
-	// Mount device
-	if err := mountDevice(loopDev, req.TargetPath, fsType); err != nil {
-		return nil, fmt.Errorf("failed to mount device: %v", err)
+// Helper: refuse to create a backing file of size bytes in dir if, once fully
+// allocated, it would leave less than the reserved capacity free
+func (ns *NodeServer) checkReservedCapacity(dir string, size int64) error {
+	if ns.reservedCapacity <= 0 {
+		return nil
+	}
+	available, err := availableCapacity(dir)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get capacity of %s: %v", dir, err)
+	}
+	if available-size < ns.reservedCapacity {
+		return status.Errorf(codes.ResourceExhausted, "creating %d byte backing file would leave %d bytes free in %s, below the reserved %d bytes", size, available-size, dir, ns.reservedCapacity)
 	}
+	return nil
+}
 
-	return &csi.NodePublishVolumeResponse{}, nil
+// Helper: run a command, folding its combined output into the error
+func (ns *NodeServer) runCommand(ctx context.Context, name string, args ...string) error {
+	out, err := ns.runner.Run(ctx, name, args...)
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, string(out))
+	}
+	return nil
 }
 
 // Helper: set up loop device
-func setupLoopDevice(backingFile string) (string, error) {
-	out, err := execCommand("losetup", "-f", "--show", backingFile)
+func (ns *NodeServer) setupLoopDevice(ctx context.Context, backingFile string) (string, error) {
+	out, err := ns.runner.Run(ctx, "losetup", "-f", "--show", backingFile)
 	if err != nil {
 		// Include losetup combined output to aid debugging (e.g., missing /dev/loop-control, permission denied, ENOENT)
-		return "", fmt.Errorf("losetup failed for %s: %v: %s", backingFile, err, string(out))
+		return "", commandError(err, out, "losetup failed for %s", backingFile)
 	}
 	// trim newline
 	if len(out) > 0 && out[len(out)-1] == '\n' {
@@ -135,49 +616,466 @@ func setupLoopDevice(backingFile string) (string, error) {
 	return string(out), nil
 }
 
-// Helper: format device if not already formatted
-func formatIfNeeded(device, fsType string) error {
+// Helper: copy sourceFile to backingFile, preserving sparseness, and grow the
+// copy to size
+func (ns *NodeServer) cloneBackingFile(ctx context.Context, sourceFile, backingFile string, size int64) error {
+	klog.Infof("Cloning backing file %s from %s", backingFile, sourceFile)
+	if _, err := os.Stat(sourceFile); err != nil {
+		return fmt.Errorf("clone source %s not accessible on node: %v", sourceFile, err)
+	}
+	if err := ns.runCommand(ctx, "cp", "--sparse=always", sourceFile, backingFile); err != nil {
+		return fmt.Errorf("failed to copy clone source %s: %v", sourceFile, err)
+	}
+	if fi, err := os.Stat(backingFile); err == nil && fi.Size() < size {
+		if err := os.Truncate(backingFile, size); err != nil {
+			return backingFileError("grow cloned", backingFile, err)
+		}
+	}
+	return nil
+}
+
+// Helper: detach a loop device, logging rather than returning failures
+func (ns *NodeServer) detachLoopDevice(ctx context.Context, loopDev string) {
+	klog.Infof("Detaching loop device %s", loopDev)
+	if err := ns.runCommand(ctx, "losetup", "-d", loopDev); err != nil {
+		klog.Errorf("Failed to detach loop device %s: %v", loopDev, err)
+	}
+}
+
+// Helper: format device if not already formatted, passing mkfsOptions to mkfs
+func (ns *NodeServer) formatIfNeeded(ctx context.Context, device, fsType string, mkfsOptions []string) error {
+	if !supportedFsTypes[fsType] {
+		return status.Errorf(codes.InvalidArgument, "unsupported fsType %q", fsType)
+	}
 	klog.Infof("formatIfNeeded: checking %s", device)
-	out, err := execCommand("blkid", device)
-	if err == nil && len(out) > 0 {
+	// Probe the device directly rather than the blkid cache, which doesn't know
+	// about freshly attached loop devices
+	out, err := ns.runner.Run(ctx, "blkid", "-p", "-s", "TYPE", "-o", "value", device)
+	if existing := strings.TrimSpace(string(out)); err == nil && existing != "" {
+		if existing != fsType {
+			klog.Warningf("formatIfNeeded: %s already holds %s, not reformatting as %s", device, existing, fsType)
+		}
+		if ns.fsckOnMount {
+			return ns.fsckIfNeeded(ctx, device, existing)
+		}
 		return nil // Already formatted
 	}
 	klog.Infof("formatIfNeeded: formatting %s with %s", device, fsType)
-	_, err = execCommand("mkfs."+fsType, device)
+	if out, err := ns.runner.Run(ctx, "mkfs."+fsType, mkfsArgs(device, fsType, mkfsOptions)...); err != nil {
+		return commandError(err, out, "mkfs.%s failed on %s", fsType, device)
+	}
+	return nil
+}
+
+// Helper: check an already formatted device before it is mounted. ext
+// filesystems are repaired with fsck -p where that is safe; xfs and btrfs are
+// only checked, since their repair tools can discard data. Corruption that
+// was not fixed fails the mount.
+func (ns *NodeServer) fsckIfNeeded(ctx context.Context, device, fsType string) error {
+	name, args := fsckCommand(device, fsType)
+	if name == "" {
+		klog.Infof("fsckIfNeeded: no checker for %s on %s, skipping", fsType, device)
+		return nil
+	}
+	klog.Infof("fsckIfNeeded: checking %s (%s)", device, fsType)
+	out, err := ns.runner.Run(ctx, name, args...)
+	if len(out) > 0 {
+		klog.Infof("fsckIfNeeded: %s output for %s: %s", name, device, strings.TrimSpace(string(out)))
+	}
+	if err == nil {
+		return nil
+	}
+	// fsck exits 1 when it corrected errors and 2 when it also wants a reboot;
+	// the filesystem is consistent and safe to mount in both cases
+	var exitErr interface{ ExitCode() int }
+	if name == "fsck" && errors.As(err, &exitErr) && exitErr.ExitCode()&^3 == 0 {
+		klog.Warningf("fsckIfNeeded: %s corrected errors on %s", name, device)
+		return nil
+	}
+	return status.Errorf(codes.Internal, "%s found unrecoverable errors on %s: %v: %s", name, device, err, string(out))
+}
+
+// Helper: build the filesystem check command for a filesystem type; an empty
+// name means there is no checker for it
+func fsckCommand(device, fsType string) (string, []string) {
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		return "fsck", []string{"-p", device}
+	case "xfs":
+		return "xfs_repair", []string{"-n", device}
+	case "btrfs":
+		return "btrfs", []string{"check", "--readonly", device}
+	default:
+		return "", nil
+	}
+}
+
+// Helper: build the mkfs arguments for a filesystem type. xfs and btrfs refuse
+// to overwrite stray signatures left on a reused loop file without -f; blkid
+// has already confirmed there is no filesystem worth keeping. Extra options
+// from the storage class go before the device.
+func mkfsArgs(device, fsType string, options []string) []string {
+	var args []string
+	switch fsType {
+	case "xfs", "btrfs":
+		args = append(args, "-f")
+	}
+	args = append(args, options...)
+	return append(args, device)
+}
+
+// shellMetacharacters are refused in mkfsOptions. mkfs is not run through a
+// shell, but options containing them are far more likely an injection attempt
+// than a real mkfs flag.
+const shellMetacharacters = ";&|$`<>(){}[]*?!~'\"\\\n"
+
+// Helper: split the mkfsOptions volume parameter into mkfs arguments
+func parseMkfsOptions(value string) ([]string, error) {
+	if i := strings.IndexAny(value, shellMetacharacters); i >= 0 {
+		return nil, fmt.Errorf("mkfsOptions must not contain %q", value[i])
+	}
+	return strings.Fields(value), nil
+}
+
+// Helper: check that label can be given to mkfs for fsType as -L
+func validateFsLabel(label, fsType string) error {
+	if limit := maxFsLabelLength[fsType]; len(label) > limit {
+		return fmt.Errorf("%s %q is longer than the %d characters %s allows", fsLabelParam, label, limit, fsType)
+	}
+	if i := strings.IndexAny(label, shellMetacharacters+" \t"); i >= 0 {
+		return fmt.Errorf("%s must not contain %q", fsLabelParam, label[i])
+	}
+	return nil
+}
+
+// Helper: derive the context of a stage or publish operation. It is bounded
+// by the publish timeout instead of the request's deadline: kubelet gives up
+// on a call after about two minutes and retries, while formatting a large
+// volume may legitimately take longer. Cancelling the request, as kubelet does
+// when it abandons the operation, still cancels it and kills running commands.
+func (ns *NodeServer) withPublishTimeout(reqCtx context.Context) (context.Context, context.CancelFunc) {
+	base, cancel := context.WithCancel(context.WithoutCancel(reqCtx))
+	ctx, cancelTimeout := base, context.CancelFunc(func() {})
+	if ns.publishTimeout > 0 {
+		ctx, cancelTimeout = context.WithTimeout(base, ns.publishTimeout)
+	}
+	stop := context.AfterFunc(reqCtx, func() {
+		if errors.Is(reqCtx.Err(), context.Canceled) {
+			cancel()
+		}
+	})
+	return ctx, func() {
+		stop()
+		cancelTimeout()
+		cancel()
+	}
+}
+
+// Helper: report a failure caused by the operation running out of time as
+// DeadlineExceeded, and one caused by the request being cancelled as Canceled
+func deadlineExceeded(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return status.Errorf(codes.DeadlineExceeded, "operation timed out: %v", err)
+	case errors.Is(ctx.Err(), context.Canceled):
+		return status.Errorf(codes.Canceled, "operation cancelled: %v", err)
+	}
 	return err
 }
 
+// Helper: return err as a gRPC status, reporting errors that don't carry a
+// code of their own as internal
+func toStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Helper: prefix the message of err, keeping its gRPC code so kubelet can
+// tell transient failures from permanent ones; errors without a code are
+// reported as internal
+func wrapStatus(err error, format string, args ...interface{}) error {
+	code, message := codes.Internal, err.Error()
+	if st, ok := status.FromError(err); ok {
+		code, message = st.Code(), st.Message()
+	}
+	return status.Errorf(code, "%s: %s", fmt.Sprintf(format, args...), message)
+}
+
+// Helper: return the volume size from the volume context. Without one, the
+// size of an existing backing file is used, or defaultVolumeSize for a new one.
+func volumeSize(volCtx VolumeContext, backingFile string) int64 {
+	if volCtx.Size > 0 {
+		return volCtx.Size
+	}
+	if fi, err := os.Stat(backingFile); err == nil {
+		return fi.Size()
+	}
+	klog.Warningf("No size in volume context for %s, defaulting to %d bytes", backingFile, defaultVolumeSize)
+	return defaultVolumeSize
+}
+
+// Helper: report whether the volume must be published read-only
+func isReadOnly(req *csi.NodePublishVolumeRequest) bool {
+	return req.Readonly || isReadOnlyAccessMode(req.VolumeCapability.GetAccessMode().GetMode())
+}
+
+// Helper: report whether the access mode only allows reading
+func isReadOnlyAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+// conflictingMountOptions maps mount options to their opposite
+var conflictingMountOptions = map[string]string{
+	"ro":         "rw",
+	"rw":         "ro",
+	"atime":      "noatime",
+	"noatime":    "atime",
+	"diratime":   "nodiratime",
+	"nodiratime": "diratime",
+	"discard":    "nodiscard",
+	"nodiscard":  "discard",
+	"exec":       "noexec",
+	"noexec":     "exec",
+	"suid":       "nosuid",
+	"nosuid":     "suid",
+	"dev":        "nodev",
+	"nodev":      "dev",
+}
+
+// Helper: append user mount flags to the driver options, dropping duplicates
+// and flags that conflict with an option already present. Earlier options win,
+// so driver-imposed options such as "ro" cannot be overridden.
+func mergeMountOptions(options []string, flags []string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, flag := range append(append([]string{}, options...), flags...) {
+		for _, opt := range strings.Split(flag, ",") {
+			opt = strings.TrimSpace(opt)
+			if opt == "" || seen[opt] {
+				continue
+			}
+			if opposite, ok := conflictingMountOptions[opt]; ok && seen[opposite] {
+				klog.Warningf("Ignoring mount option %q which conflicts with %q", opt, opposite)
+				continue
+			}
+			seen[opt] = true
+			merged = append(merged, opt)
+		}
+	}
+	return merged
+}
+
 // Helper: mount device
-func mountDevice(device, target, fsType string) error {
-	_, err := execCommand("mount", "-t", fsType, device, target)
-	return err
+func (ns *NodeServer) mountDevice(ctx context.Context, device, target, fsType string, options []string) error {
+	if out, err := ns.runner.Run(ctx, "mount", mountArgs(device, target, fsType, options)...); err != nil {
+		return commandError(err, out, "mount of %s failed", device)
+	}
+	return nil
+}
+
+// Helper: build the mount arguments for device, passing options with -o
+func mountArgs(device, target, fsType string, options []string) []string {
+	args := []string{"-t", fsType}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	return append(args, device, target)
+}
+
+// Helper: create the file a block device is bind-mounted onto
+func createBlockTarget(target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE, 0660)
+	if err != nil {
+		return fmt.Errorf("failed to create block target %s: %v", target, err)
+	}
+	return f.Close()
+}
+
+// Helper: bind mount source (a directory or device node) onto target
+func (ns *NodeServer) bindMount(ctx context.Context, source, target string, options []string) error {
+	return ns.runCommand(ctx, "mount", bindMountArgs(source, target, options)...)
+}
+
+// Helper: build the bind mount arguments, passing options with -o
+func bindMountArgs(source, target string, options []string) []string {
+	return append([]string{"-o", strings.Join(append([]string{"bind"}, options...), ",")}, source, target)
+}
+
+// Helper: path of the file a block volume's loop device is bind-mounted onto while staged
+func blockStagingDevice(stagingPath string) string {
+	return filepath.Join(stagingPath, "device")
+}
+
+// Helper: report whether path is a mount point according to /proc/self/mountinfo
+func (ns *NodeServer) isMountPoint(path string) (bool, error) {
+	data, err := os.ReadFile(filepath.Join(ns.procDir, "self", "mountinfo"))
+	if err != nil {
+		return false, err
+	}
+	path = filepath.Clean(path)
+	for _, line := range SplitLines(string(data)) {
+		// Field 5 is the mount point, with spaces and other characters octal-escaped
+		fields := SplitFields(line)
+		if len(fields) > 4 && unescapeMountInfo(fields[4]) == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Helper: return a mount point other than target that bind-mounts the staged
+// source, or "" if the volume is not published anywhere else
+func (ns *NodeServer) publishedElsewhere(source, target string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(ns.procDir, "self", "mountinfo"))
+	if err != nil {
+		return "", err
+	}
+	source, target = filepath.Clean(source), filepath.Clean(target)
+	for _, mountPoint := range sameSourceMounts(string(data), source) {
+		if mountPoint != source && mountPoint != target {
+			return mountPoint, nil
+		}
+	}
+	return "", nil
+}
+
+// Helper: list the mount points showing the same device and root as the
+// topmost mount at path, i.e. path itself and its bind mounts
+func sameSourceMounts(mountinfo, path string) []string {
+	type entry struct{ device, root, mountPoint string }
+	var entries []entry
+	var origin entry
+	found := false
+	for _, line := range SplitLines(mountinfo) {
+		// Field 3 is major:minor, field 4 the root within the filesystem and
+		// field 5 the mount point
+		fields := SplitFields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		e := entry{fields[2], unescapeMountInfo(fields[3]), unescapeMountInfo(fields[4])}
+		entries = append(entries, e)
+		if e.mountPoint == path {
+			origin, found = e, true
+		}
+	}
+	if !found {
+		return nil
+	}
+	var mounts []string
+	for _, e := range entries {
+		if e.device == origin.device && e.root == origin.root {
+			mounts = append(mounts, e.mountPoint)
+		}
+	}
+	return mounts
+}
+
+// Helper: report whether path is a mount point. A device ID differing from
+// the parent directory's settles it cheaply; bind mounts within a single
+// filesystem share the device, so those fall back to mountinfo.
+func (ns *NodeServer) isVolumeMounted(path string) (bool, error) {
+	var st, parent unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return false, err
+	}
+	if err := unix.Stat(filepath.Dir(filepath.Clean(path)), &parent); err != nil {
+		return false, err
+	}
+	if st.Dev != parent.Dev {
+		return true, nil
+	}
+	return ns.isMountPoint(path)
+}
+
+// Helper: decode the \ooo octal escapes used in /proc/self/mountinfo
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// loopMajor is the block device major number of loop devices
+const loopMajor = 7
+
+// Helper: return the loop device bind-mounted at target for block volumes
+func findBlockLoopDevice(target string) (string, bool) {
+	var st unix.Stat_t
+	if err := unix.Stat(target, &st); err != nil {
+		return "", false
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFBLK || unix.Major(uint64(st.Rdev)) != loopMajor {
+		return "", false
+	}
+	return fmt.Sprintf("/dev/loop%d", unix.Minor(uint64(st.Rdev))), true
 }
 
-// NodeUnpublishVolume unmounts the volume from the target path and detaches loop device.
+// NodeUnpublishVolume unmounts the volume from the target path. The loop device
+// stays attached until NodeUnstageVolume.
 func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	klog.Infof("NodeUnpublishVolume: %s", req.TargetPath)
 
+	if err := ns.volumeLocks.Acquire(ctx, req.VolumeId); err != nil {
+		return nil, status.Errorf(codes.Aborted, "timed out waiting for another operation on volume %s: %v", req.VolumeId, err)
+	}
+	defer ns.volumeLocks.Release(req.VolumeId)
+
+	// Inline ephemeral volumes are mounted directly and go away with their pod
+	if backingFile, ok := ns.ephemeralBackingFile(req.VolumeId); ok {
+		return ns.unpublishEphemeral(ctx, req, backingFile)
+	}
+
 	// Check if target path exists
 	if _, err := os.Stat(req.TargetPath); os.IsNotExist(err) {
 		// Path does not exist, treat as success (idempotent)
 		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
 
-	// Check if it's mounted (by loop device); if not, treat as success
-	loopDev, _ := FindLoopDevice(req.TargetPath)
-	if loopDev == "" {
-		// Not mounted; nothing to do
+	// Raw block volumes: the target file is the bind-mounted loop device
+	if _, ok := findBlockLoopDevice(req.TargetPath); ok {
+		if err := ns.runCommand(ctx, "umount", req.TargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to unmount block device: %v", err)
+		}
+		if err := os.Remove(req.TargetPath); err != nil && !os.IsNotExist(err) {
+			return nil, status.Errorf(codes.Internal, "failed to remove block target: %v", err)
+		}
 		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
 
-	// Unmount the target path
-	if err := execCommandSimple("umount", req.TargetPath); err != nil {
-		return nil, fmt.Errorf("failed to unmount: %v", err)
+	// Check if it's mounted; if not, treat as success
+	mounted, err := ns.isMountPoint(req.TargetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check target path %s: %v", req.TargetPath, err)
+	}
+	if !mounted {
+		// Not mounted; nothing to do
+		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
 
-	// Detach the loop device
-	if err := execCommandSimple("losetup", "-d", loopDev); err != nil {
-		return nil, fmt.Errorf("failed to detach loop device: %v", err)
+	// Unmount the target path
+	if err := ns.runCommand(ctx, "umount", req.TargetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount: %v", err)
 	}
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
@@ -188,10 +1086,11 @@ func (ns *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoReque
 	// Using "kubernetes.io/hostname" avoids attempts by the registrar to set protected
 	// topology.kubernetes.io/* node labels. The label should already exist on the Node.
 	return &csi.NodeGetInfoResponse{
-		NodeId: ns.nodeID,
+		NodeId:            ns.nodeID,
+		MaxVolumesPerNode: ns.maxVolumesPerNode,
 		AccessibleTopology: &csi.Topology{
 			Segments: map[string]string{
-				"kubernetes.io/hostname": ns.nodeID,
+				topologyKey: ns.nodeID,
 			},
 		},
 	}, nil
@@ -199,6 +1098,13 @@ func (ns *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoReque
 
 func (ns *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	caps := []*csi.NodeServiceCapability{
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+				},
+			},
+		},
 		{
 			Type: &csi.NodeServiceCapability_Rpc{
 				Rpc: &csi.NodeServiceCapability_RPC{
@@ -206,6 +1112,20 @@ func (ns *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 				},
 			},
 		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+				},
+			},
+		},
 	}
 	return &csi.NodeGetCapabilitiesResponse{Capabilities: caps}, nil
 }
@@ -215,21 +1135,47 @@ func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 
 	// Validate volume path is provided
 	if req.VolumePath == "" {
-		return nil, fmt.Errorf("volume path is required")
+		return nil, status.Error(codes.InvalidArgument, "volume path is required")
 	}
 
 	// Check if volume path exists
 	if _, err := os.Stat(req.VolumePath); err != nil {
 		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("volume path %s does not exist", req.VolumePath)
+			return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", req.VolumePath)
 		}
-		return nil, fmt.Errorf("failed to stat volume path %s: %v", req.VolumePath, err)
+		return nil, status.Errorf(codes.Internal, "failed to stat volume path %s: %v", req.VolumePath, err)
+	}
+
+	// Once the volume is unmounted, statfs would report the filesystem
+	// underneath the empty target path instead
+	mounted, err := ns.isVolumeMounted(req.VolumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check volume path %s: %v", req.VolumePath, err)
 	}
+	if !mounted {
+		return nil, status.Errorf(codes.NotFound, "volume path %s is not mounted", req.VolumePath)
+	}
+
+	backend := ns.stagedBackend(req.VolumeId, req.VolumePath)
+	resp, err := backend.Stats(ctx, req.VolumeId, req.VolumePath)
+	if err != nil {
+		return nil, err
+	}
+	// Pick up limits changed by ControllerModifyVolume since staging
+	if _, ok := backend.(*loopFileBackend); ok {
+		ns.reconcileIOLimits(ctx, req.VolumeId)
+	}
+	for _, usage := range resp.Usage {
+		klog.Infof("NodeGetVolumeStats: volume=%s, unit=%s, total=%d, available=%d", req.VolumeId, usage.Unit, usage.Total, usage.Available)
+	}
+	return resp, nil
+}
 
-	// Get filesystem statistics using statfs
+// Helper: report the byte and inode usage of the filesystem mounted at path
+func statfsUsage(path string) ([]*csi.VolumeUsage, error) {
 	var stats unix.Statfs_t
-	if err := unix.Statfs(req.VolumePath, &stats); err != nil {
-		return nil, fmt.Errorf("failed to get volume stats for %s: %v", req.VolumePath, err)
+	if err := unix.Statfs(path, &stats); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get volume stats for %s: %v", path, err)
 	}
 
 	// Calculate total capacity and available bytes
@@ -240,58 +1186,135 @@ func (ns *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 	total := int64(stats.Blocks) * int64(stats.Bsize)
 	available := int64(stats.Bavail) * int64(stats.Bsize)
 
-	klog.Infof("NodeGetVolumeStats: volume=%s, total=%d bytes, available=%d bytes", req.VolumeId, total, available)
+	// Inode usage from the same statfs call
+	totalInodes := int64(stats.Files)
+	freeInodes := int64(stats.Ffree)
 
-	return &csi.NodeGetVolumeStatsResponse{
-		Usage: []*csi.VolumeUsage{
-			{
-				Unit:      csi.VolumeUsage_BYTES,
-				Total:     total,
-				Available: available,
-			},
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     total,
+			Available: available,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     totalInodes,
+			Available: freeInodes,
+			Used:      totalInodes - freeInodes,
 		},
 	}, nil
 }
 
-func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return &csi.NodeStageVolumeResponse{}, nil
+// Helper: report whether a published volume is healthy: its backing file
+// exists, is still attached to a device, and its filesystem has not been
+// remounted read-only underneath the mount after errors
+func (ns *NodeServer) volumeCondition(ctx context.Context, volumeID, volumePath string) *csi.VolumeCondition {
+	backingFile := ns.backingFilePath(volumeID)
+	if _, err := os.Stat(backingFile); err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("backing file %s is not accessible: %v", backingFile, err)}
+	}
+	if _, ok := ns.findNBDDevice(backingFile); !ok {
+		loopDev, err := findLoopDevice(ctx, ns.runner, backingFile)
+		if err != nil {
+			// Leave the condition to the next check rather than guess
+			klog.Warningf("NodeGetVolumeStats: failed to look up loop device of %s: %v", backingFile, err)
+		} else if loopDev == "" {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("backing file %s is not attached to a loop device", backingFile)}
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(ns.procDir, "self", "mountinfo")); err == nil && remountedReadOnly(string(data), volumePath) {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("filesystem at %s was remounted read-only, likely after I/O errors", volumePath)}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
 }
 
-func (ns *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return &csi.NodeUnstageVolumeResponse{}, nil
+// Helper: report whether the mount at path is read-write while its
+// filesystem is read-only, as happens when ext4 hits errors=remount-ro.
+// Volumes published read-only have ro mount options and are not flagged.
+func remountedReadOnly(mountinfo, path string) bool {
+	path = filepath.Clean(path)
+	// The last entry for a mount point is the one on top
+	remounted := false
+	for _, line := range SplitLines(mountinfo) {
+		// Field 5 is the mount point and field 6 the per-mount options; the
+		// superblock options follow the fstype and source after the "-" separator
+		fields := SplitFields(line)
+		if len(fields) < 6 || unescapeMountInfo(fields[4]) != path {
+			continue
+		}
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+3 >= len(fields) {
+			continue
+		}
+		remounted = hasMountOption(fields[5], "rw") && hasMountOption(fields[sep+3], "ro")
+	}
+	return remounted
+}
+
+// Helper: report whether a comma separated mount option list contains opt
+func hasMountOption(options, opt string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == opt {
+			return true
+		}
+	}
+	return false
 }
 
 func (ns *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	return &csi.NodeExpandVolumeResponse{}, nil
 }
 
-// garbageCollectVolumes finds and deletes orphaned backing files
-func (ns *NodeServer) garbageCollectVolumes(ctx context.Context) {
-	klog.V(2).Infof("Starting garbage collection of orphaned volumes in %s", ns.backingDir)
+// GCObserver is told the outcome of each garbage collection pass that may
+// reclaim files, such as for metrics. Dry runs are not reported.
+type GCObserver interface {
+	// ObserveGC records a finished pass: the number of orphaned backing files
+	// it deleted or archived, and the error that ended it, if any
+	ObserveGC(reclaimed int, err error)
+}
+
+// garbageCollectVolumes finds orphaned backing files and deletes or archives
+// them according to the on-delete policy. It returns the files it reclaimed;
+// with dryRun set nothing is touched and the files that would be reclaimed are
+// returned instead.
+func (ns *NodeServer) garbageCollectVolumes(ctx context.Context, dryRun bool) (reclaimed []string, err error) {
+	if ns.gcObserver != nil && !dryRun {
+		defer func() { ns.gcObserver.ObserveGC(len(reclaimed), err) }()
+	}
+	klog.V(2).Infof("Starting garbage collection of orphaned volumes in %s", strings.Join(ns.backingDirs(), ", "))
 
 	// Check if clientset is available
 	if ns.clientset == nil {
-		klog.V(2).Infof("Skipping garbage collection: Kubernetes clientset not configured")
-		return
+		return nil, fmt.Errorf("kubernetes clientset not configured")
 	}
 
-	// List all .img files in backing directory
-	files, err := filepath.Glob(filepath.Join(ns.backingDir, "*.img"))
-	if err != nil {
-		klog.Errorf("Failed to list backing files: %v", err)
-		return
+	// List all .img files and subvolumes in the backing directories
+	var files []string
+	for _, dir := range ns.backingDirs() {
+		for _, pattern := range []string{"*.img", "*" + subvolumeSuffix} {
+			matches, err := filepath.Glob(filepath.Join(dir, pattern))
+			if err != nil {
+				return nil, fmt.Errorf("failed to list backing files in %s: %v", dir, err)
+			}
+			files = append(files, matches...)
+		}
 	}
 
 	if len(files) == 0 {
-		klog.V(2).Infof("No backing files found in %s", ns.backingDir)
-		return
+		klog.V(2).Infof("No backing files found in %s", strings.Join(ns.backingDirs(), ", "))
+		return nil, nil
 	}
 
 	// List all PersistentVolumes from Kubernetes
 	pvList, err := ns.clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
 	if err != nil {
-		klog.Errorf("Failed to list PersistentVolumes: %v", err)
-		return
+		return nil, fmt.Errorf("failed to list PersistentVolumes: %v", err)
 	}
 
 	// Build a map of active volume handles for CSI volumes belonging to this driver
@@ -303,31 +1326,200 @@ func (ns *NodeServer) garbageCollectVolumes(ctx context.Context) {
 			if backingFile, ok := pv.Spec.CSI.VolumeAttributes["backingFile"]; ok {
 				activeVolumes[backingFile] = true
 			}
-			// Also track by volume handle/ID
-			volumeFile := filepath.Join(ns.backingDir, pv.Spec.CSI.VolumeHandle+".img")
-			activeVolumes[volumeFile] = true
+			// Also track by volume handle/ID, in whichever directory the file was placed
+			for _, dir := range ns.backingDirs() {
+				activeVolumes[filepath.Join(dir, pv.Spec.CSI.VolumeHandle+".img")] = true
+				activeVolumes[filepath.Join(dir, pv.Spec.CSI.VolumeHandle+subvolumeSuffix)] = true
+			}
 		}
 	}
 
-	// Check each backing file
-	deletedCount := 0
+	// Check each backing file; files within the grace period are not orphans
+	// yet. Inline ephemeral volumes never have a PersistentVolume and are
+	// checked separately.
+	var orphaned, ephemeral []string
 	for _, file := range files {
-		if !activeVolumes[file] {
-			// File is orphaned, delete it
-			klog.Infof("Deleting orphaned backing file: %s", file)
-			if err := os.Remove(file); err != nil {
-				klog.Errorf("Failed to delete orphaned file %s: %v", file, err)
-			} else {
-				deletedCount++
-			}
+		if activeVolumes[file] {
+			continue
+		}
+		if fi, err := os.Stat(file); err != nil || time.Since(fi.ModTime()) < ns.gcGracePeriod {
+			continue
+		}
+		if strings.HasPrefix(filepath.Base(file), ephemeralPrefix) {
+			ephemeral = append(ephemeral, file)
+			continue
+		}
+		orphaned = append(orphaned, file)
+	}
+
+	// An apiserver returning a partial PV list would make live volumes look
+	// orphaned, so refuse to reclaim most of the node at once. Nodes with few
+	// files are exempt: there a single deleted volume is already a large share.
+	if ns.gcMaxOrphanRatio > 0 && len(files) >= gcOrphanRatioMinFiles && float64(len(orphaned)) > ns.gcMaxOrphanRatio*float64(len(files)) {
+		klog.Errorf("Garbage collection aborted: %d of %d backing files have no PersistentVolume, more than the limit of %v; check the PersistentVolumes of driver %s", len(orphaned), len(files), ns.gcMaxOrphanRatio, ns.driverName)
+		return nil, fmt.Errorf("%d of %d backing files look orphaned, more than the limit of %v", len(orphaned), len(files), ns.gcMaxOrphanRatio)
+	}
+
+	for _, file := range orphaned {
+		if ns.removeOrphanedFile(ctx, file, dryRun) {
+			reclaimed = append(reclaimed, file)
 		}
 	}
+	for _, file := range ephemeral {
+		if ns.removeLeakedEphemeralFile(ctx, file, dryRun) {
+			reclaimed = append(reclaimed, file)
+		}
+	}
+
+	klog.V(2).Infof("Garbage collection complete: reclaimed %d orphaned files out of %d total backing files (policy %s, dry run %v)", len(reclaimed), len(files), ns.onDeletePolicy, dryRun)
+	return reclaimed, nil
+}
+
+// backingFileVolumeID returns the ID of the volume a backing file or
+// subvolume belongs to, the key of its volume lock. Inline ephemeral volumes
+// are locked by their ID without the file name prefix.
+func backingFileVolumeID(file string) string {
+	name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(file), ".img"), subvolumeSuffix)
+	return strings.TrimPrefix(name, ephemeralPrefix)
+}
+
+// removeOrphanedFile deletes or archives an orphaned backing file unless it was
+// modified within the grace period or its volume has a node operation in flight.
+// With dryRun set it only reports whether it would.
+func (ns *NodeServer) removeOrphanedFile(ctx context.Context, file string, dryRun bool) (removed bool) {
+	volumeID := backingFileVolumeID(file)
+	if !ns.volumeLocks.TryAcquire(volumeID) {
+		klog.V(2).Infof("Skipping orphaned backing file %s: volume operation in progress", file)
+		return false
+	}
+	defer ns.volumeLocks.Release(volumeID)
+	defer func() {
+		if removed && !dryRun {
+			ns.clearStaged(volumeID)
+		}
+	}()
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Errorf("Failed to stat orphaned file %s: %v", file, err)
+		}
+		return false
+	}
+	if age := time.Since(fi.ModTime()); age < ns.gcGracePeriod {
+		klog.V(2).Infof("Skipping orphaned backing file %s: modified %v ago, within grace period %v", file, age.Round(time.Second), ns.gcGracePeriod)
+		return false
+	}
+
+	if ns.onDeletePolicy == OnDeletePolicyRetain {
+		return ns.archiveOrphanedFile(ctx, file, dryRun)
+	}
+
+	if dryRun {
+		klog.Infof("Would delete orphaned backing file: %s", file)
+		return true
+	}
+
+	// File is orphaned, delete it
+	klog.Infof("Deleting orphaned backing file: %s", file)
+	if err := ns.backendForPath(file).Remove(ctx, file); err != nil {
+		klog.Errorf("Failed to delete orphaned file %s: %v", file, err)
+		return false
+	}
+	return true
+}
+
+// removeLeakedEphemeralFile deletes the backing file of an inline ephemeral
+// volume that NodeUnpublishVolume never removed, after a crash of the plugin
+// or a force-deleted pod. A file whose volume is still published keeps its
+// loop device attached, so only files without one are removed; they are
+// deleted whatever the on-delete policy, as NodeUnpublishVolume would.
+func (ns *NodeServer) removeLeakedEphemeralFile(ctx context.Context, file string, dryRun bool) bool {
+	volumeID := backingFileVolumeID(file)
+	if !ns.volumeLocks.TryAcquire(volumeID) {
+		klog.V(2).Infof("Skipping ephemeral backing file %s: volume operation in progress", file)
+		return false
+	}
+	defer ns.volumeLocks.Release(volumeID)
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Errorf("Failed to stat ephemeral backing file %s: %v", file, err)
+		}
+		return false
+	}
+	if age := time.Since(fi.ModTime()); age < ns.gcGracePeriod {
+		return false
+	}
+	loopDev, err := findLoopDevice(ctx, ns.runner, file)
+	if err != nil {
+		klog.Errorf("Failed to look up the loop device of ephemeral backing file %s: %v", file, err)
+		return false
+	}
+	if loopDev != "" {
+		klog.V(4).Infof("Keeping ephemeral backing file %s: attached to %s", file, loopDev)
+		return false
+	}
+
+	if dryRun {
+		klog.Infof("Would delete leaked ephemeral backing file: %s", file)
+		return true
+	}
+	klog.Infof("Deleting leaked ephemeral backing file: %s", file)
+	if err := os.Remove(file); err != nil {
+		klog.Errorf("Failed to delete ephemeral backing file %s: %v", file, err)
+		return false
+	}
+	return true
+}
+
+// archiveOrphanedFile moves an orphaned backing file into the archive
+// subdirectory. An existing archive of the same volume is only replaced when
+// removeArchivedVolumePath is set; otherwise the orphan is left in place.
+func (ns *NodeServer) archiveOrphanedFile(ctx context.Context, file string, dryRun bool) bool {
+	// Archive next to the file so the move never crosses filesystems
+	archiveDir := filepath.Join(filepath.Dir(file), archiveDirName)
+	archived := filepath.Join(archiveDir, filepath.Base(file))
+	if _, err := os.Stat(archived); err == nil {
+		if !ns.removeArchivedVolumePath {
+			klog.Warningf("Skipping orphaned backing file %s: archive %s already exists", file, archived)
+			return false
+		}
+		if dryRun {
+			klog.Infof("Would archive orphaned backing file %s to %s, replacing the previous archive", file, archived)
+			return true
+		}
+		klog.Infof("Removing previously archived backing file: %s", archived)
+		if err := ns.backendForPath(archived).Remove(ctx, archived); err != nil {
+			klog.Errorf("Failed to remove archived file %s: %v", archived, err)
+			return false
+		}
+	}
+
+	if dryRun {
+		klog.Infof("Would archive orphaned backing file %s to %s", file, archived)
+		return true
+	}
+	if err := os.MkdirAll(archiveDir, 0750); err != nil {
+		klog.Errorf("Failed to create archive directory %s: %v", archiveDir, err)
+		return false
+	}
 
-	klog.V(2).Infof("Garbage collection complete: deleted %d orphaned files out of %d total backing files", deletedCount, len(files))
+	klog.Infof("Archiving orphaned backing file %s to %s", file, archived)
+	if err := os.Rename(file, archived); err != nil {
+		klog.Errorf("Failed to archive orphaned file %s: %v", file, err)
+		return false
+	}
+	return true
 }
 
 // RunGarbageCollector runs the garbage collector periodically
 func (ns *NodeServer) RunGarbageCollector(ctx context.Context, interval time.Duration) {
+	if ns.clientset == nil {
+		klog.Infof("Garbage collector not started: Kubernetes clientset not configured")
+		return
+	}
 	klog.Infof("Starting garbage collector with interval %v", interval)
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -338,7 +1530,9 @@ func (ns *NodeServer) RunGarbageCollector(ctx context.Context, interval time.Dur
 			klog.Infof("Garbage collector stopped")
 			return
 		case <-ticker.C:
-			ns.garbageCollectVolumes(ctx)
+			if _, err := ns.garbageCollectVolumes(ctx, false); err != nil {
+				klog.Errorf("Garbage collection failed: %v", err)
+			}
 		}
 	}
 }
@@ -2,17 +2,27 @@ package rawfile
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
 )
 
-func TestNode_PublishVolume(t *testing.T) {
+func TestNode_StageAndPublishVolume(t *testing.T) {
 	clientset := fake.NewSimpleClientset()
 
 	// In the new architecture, NodeServer creates the backing file just-in-time
@@ -20,19 +30,29 @@ func TestNode_PublishVolume(t *testing.T) {
 
 	volID := "vol-test-publish"
 	backingFile := "/tmp/my-csi-driver/" + volID + ".img"
+	stagingPath := "/tmp/my-csi-driver/test-staging"
+	targetPath := "/tmp/my-csi-driver/test-mount"
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	defer os.Remove(backingFile)
+	defer os.RemoveAll(stagingPath)
+	defer os.RemoveAll(targetPath)
 
-	nodeReq := &csi.NodePublishVolumeRequest{
-		VolumeId:   volID,
-		TargetPath: "/tmp/my-csi-driver/test-mount",
+	stageReq := &csi.NodeStageVolumeRequest{
+		VolumeId:          volID,
+		StagingTargetPath: stagingPath,
 		VolumeContext: map[string]string{
 			"backingFile": backingFile,
 			"size":        "1048576", // 1 MiB
 		},
-		VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}}},
+		VolumeCapability: volCap,
 	}
 
-	if _, err := ns.NodePublishVolume(context.Background(), nodeReq); err != nil {
-		t.Logf("NodePublishVolume returned error (expected if not root): %v", err)
+	_, stageErr := ns.NodeStageVolume(context.Background(), stageReq)
+	if stageErr != nil {
+		t.Logf("NodeStageVolume returned error (expected if not root): %v", stageErr)
 	}
 
 	// Verify the backing file was created just-in-time
@@ -45,11 +65,1081 @@ func TestNode_PublishVolume(t *testing.T) {
 		t.Logf("Backing file check failed (expected if losetup failed): %v", err)
 	}
 
-	if _, err := os.Stat(nodeReq.TargetPath); err != nil {
-		t.Errorf("TargetPath not created: %v", err)
+	if _, err := os.Stat(stagingPath); err != nil {
+		t.Errorf("StagingTargetPath not created: %v", err)
+	}
+	if stageErr != nil {
+		return
+	}
+
+	// Staging again is a no-op
+	if _, err := ns.NodeStageVolume(context.Background(), stageReq); err != nil {
+		t.Errorf("repeated NodeStageVolume failed: %v", err)
+	}
+	if loopDev, err := FindLoopDevice(backingFile); err != nil || loopDev == "" {
+		t.Errorf("expected a loop device attached to %s, got %q (err: %v)", backingFile, loopDev, err)
+	}
+
+	publishReq := &csi.NodePublishVolumeRequest{
+		VolumeId:          volID,
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeContext:     stageReq.VolumeContext,
+		VolumeCapability:  volCap,
+	}
+	if _, err := ns.NodePublishVolume(context.Background(), publishReq); err != nil {
+		t.Errorf("NodePublishVolume failed: %v", err)
+	}
+	if mounted, _ := ns.isMountPoint(targetPath); !mounted {
+		t.Errorf("TargetPath %s should be a mount point", targetPath)
+	}
+
+	if _, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: volID, TargetPath: targetPath}); err != nil {
+		t.Errorf("NodeUnpublishVolume failed: %v", err)
+	}
+	if mounted, _ := ns.isMountPoint(targetPath); mounted {
+		t.Errorf("TargetPath %s should be unmounted", targetPath)
+	}
+
+	if _, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: volID, StagingTargetPath: stagingPath}); err != nil {
+		t.Errorf("NodeUnstageVolume failed: %v", err)
+	}
+	if mounted, _ := ns.isMountPoint(stagingPath); mounted {
+		t.Errorf("StagingTargetPath %s should be unmounted", stagingPath)
+	}
+	if loopDev, _ := FindLoopDevice(backingFile); loopDev != "" {
+		t.Errorf("loop device %s should be detached after unstage", loopDev)
+	}
+}
+
+func TestNode_PublishVolume_RequiresStagingPath(t *testing.T) {
+	ns := NewNodeServer("test-node", "test-driver", "/tmp/my-csi-driver", fake.NewSimpleClientset())
+	_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol-test-nostaging",
+		TargetPath:       filepath.Join(t.TempDir(), "target"),
+		VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument without staging path, got %v", err)
+	}
+}
+
+func TestNode_StageVolume_PathTraversal(t *testing.T) {
+	testDir := t.TempDir()
+	ns := NewNodeServer("test-node", "test-driver", filepath.Join(testDir, "backing"), fake.NewSimpleClientset())
+
+	for _, backingFile := range []string{
+		filepath.Join(testDir, "backing", "..", "escaped.img"),
+		"/etc/passwd",
+		"relative.img",
+	} {
+		_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-test-traversal",
+			StagingTargetPath: filepath.Join(testDir, "staging"),
+			VolumeContext: map[string]string{
+				"backingFile": backingFile,
+				"size":        "1048576",
+			},
+			VolumeCapability: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for backing file %q, got %v", backingFile, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(testDir, "escaped.img")); !os.IsNotExist(err) {
+		t.Errorf("backing file outside the backing directory must not be created")
+	}
+}
+
+func TestNode_StageVolume_DetachOnMountFailure(t *testing.T) {
+	testDir := t.TempDir()
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+
+	volID := "vol-test-mountfail"
+	backingFile := filepath.Join(testDir, volID+".img")
+
+	// A read-only volume is never formatted, so mounting the blank backing file fails
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          volID,
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+		VolumeContext: map[string]string{
+			"backingFile": backingFile,
+			"size":        "1048576",
+		},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY},
+		},
+	})
+	if err == nil {
+		t.Fatalf("expected NodeStageVolume to fail mounting an unformatted read-only volume")
+	}
+	t.Logf("NodeStageVolume failed as expected: %v", err)
+
+	// Whether losetup or mount failed, no loop device may stay attached
+	if loopDev, _ := FindLoopDevice(backingFile); loopDev != "" {
+		t.Errorf("loop device %s leaked after failed NodeStageVolume", loopDev)
+	}
+}
+
+// fakeRunner records commands instead of running them. A command fails when
+// its name, or its name and first argument (e.g. "cryptsetup isLuks"), is in
+// fail; output supplies the combined output of a command.
+type fakeRunner struct {
+	calls  []string
+	inputs []string
+	fail   map[string]bool
+	output map[string]string
+	// exitCode makes a command fail with the given exit status
+	exitCode map[string]int
+	// hang makes a command block until its context is done, like a hung mount
+	hang map[string]bool
+}
+
+// fakeExitError mimics the ExitCode method of *exec.ExitError
+type fakeExitError int
+
+func (e fakeExitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e fakeExitError) ExitCode() int { return int(e) }
+
+func (r *fakeRunner) RunWithInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error) {
+	r.inputs = append(r.inputs, string(input))
+	return r.Run(ctx, name, args...)
+}
+
+func (r *fakeRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	r.calls = append(r.calls, strings.Join(append([]string{name}, args...), " "))
+	if r.hang[name] {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	out := []byte(r.output[name])
+	if code, ok := r.exitCode[name]; ok {
+		return out, fakeExitError(code)
+	}
+	if r.fail[name] || (len(args) > 0 && r.fail[name+" "+args[0]]) {
+		return out, fmt.Errorf("%s: exit status 1", name)
+	}
+	return out, nil
+}
+
+func TestNode_StageVolume_FakeRunner(t *testing.T) {
+	stageReq := func(testDir string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-fake",
+			StagingTargetPath: filepath.Join(testDir, "staging"),
+			VolumeContext: map[string]string{
+				"backingFile": filepath.Join(testDir, "vol-fake.img"),
+				"size":        "1048576",
+				"fsType":      "xfs",
+			},
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		fail    map[string]bool
+		wantErr bool
+		want    []string
+	}{
+		{
+			name: "Success",
+			want: []string{
+				"losetup -f --show $DIR/vol-fake.img",
+				"blkid -p -s TYPE -o value /dev/loop7",
+				"mkfs.xfs -f /dev/loop7",
+				"mount -t xfs /dev/loop7 $DIR/staging",
+			},
+		},
+		{
+			name:    "LosetupFails",
+			fail:    map[string]bool{"losetup": true},
+			wantErr: true,
+			want:    []string{"losetup -f --show $DIR/vol-fake.img"},
+		},
+		{
+			name:    "MkfsFailsDetaches",
+			fail:    map[string]bool{"mkfs.xfs": true},
+			wantErr: true,
+			want: []string{
+				"losetup -f --show $DIR/vol-fake.img",
+				"blkid -p -s TYPE -o value /dev/loop7",
+				"mkfs.xfs -f /dev/loop7",
+				"losetup -d /dev/loop7",
+			},
+		},
+		{
+			name:    "MountFailsDetaches",
+			fail:    map[string]bool{"mount": true},
+			wantErr: true,
+			want: []string{
+				"losetup -f --show $DIR/vol-fake.img",
+				"blkid -p -s TYPE -o value /dev/loop7",
+				"mkfs.xfs -f /dev/loop7",
+				"mount -t xfs /dev/loop7 $DIR/staging",
+				"losetup -d /dev/loop7",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDir := t.TempDir()
+			// blkid reports no filesystem by failing, as it does on a blank device
+			fail := map[string]bool{"blkid": true}
+			for name := range tt.fail {
+				fail[name] = true
+			}
+			runner := &fakeRunner{fail: fail, output: map[string]string{"losetup": "/dev/loop7\n"}}
+			ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+			ns.runner = runner
+
+			_, err := ns.NodeStageVolume(context.Background(), stageReq(testDir))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			var want []string
+			for _, w := range tt.want {
+				want = append(want, strings.ReplaceAll(w, "$DIR", testDir))
+			}
+			if strings.Join(runner.calls, "\n") != strings.Join(want, "\n") {
+				t.Errorf("expected commands:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(runner.calls, "\n"))
+			}
+		})
+	}
+
+	// An existing filesystem is mounted without being reformatted
+	testDir := t.TempDir()
+	runner := &fakeRunner{output: map[string]string{"losetup": "/dev/loop7\n", "blkid": "xfs\n"}}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+	if _, err := ns.NodeStageVolume(context.Background(), stageReq(testDir)); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	for _, call := range runner.calls {
+		if strings.HasPrefix(call, "mkfs") {
+			t.Errorf("formatted device that already holds a filesystem: %s", call)
+		}
+	}
+
+	// The label assigned by the controller is passed to mkfs
+	testDir = t.TempDir()
+	runner = &fakeRunner{fail: map[string]bool{"blkid": true}, output: map[string]string{"losetup": "/dev/loop7\n"}}
+	ns = NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+	req := stageReq(testDir)
+	req.VolumeContext["fsLabel"] = "1b4e28ba2fa1"
+	if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	if !slices.Contains(runner.calls, "mkfs.xfs -f -L 1b4e28ba2fa1 /dev/loop7") {
+		t.Errorf("expected the label in the mkfs call, got %v", runner.calls)
+	}
+	// Labels too long for the filesystem are refused before anything runs
+	req.VolumeContext["fsLabel"] = "label-too-long-for-xfs"
+	if _, err := ns.NodeStageVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a label too long for xfs, got %v", err)
+	}
+
+	// Command output explains a failed mount
+	testDir = t.TempDir()
+	ns = NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = &fakeRunner{
+		fail:   map[string]bool{"mount": true},
+		output: map[string]string{"losetup": "/dev/loop7\n", "blkid": "xfs\n", "mount": "wrong fs type, bad option"},
+	}
+	if _, err := ns.NodeStageVolume(context.Background(), stageReq(testDir)); err == nil || !strings.Contains(err.Error(), "wrong fs type, bad option") {
+		t.Errorf("expected the mount output in the error, got %v", err)
+	}
+}
+
+func TestNode_StageVolume_DefaultFsType(t *testing.T) {
+	testDir := t.TempDir()
+	// blkid reports no filesystem by failing, as it does on a blank device
+	runner := &fakeRunner{fail: map[string]bool{"blkid": true}, output: map[string]string{"losetup": "/dev/loop7\n"}}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+	ns.defaultFsType = "xfs"
+
+	// Neither the capability nor the volume context names an fsType
+	if _, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-default",
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+		VolumeContext:     map[string]string{"backingFile": filepath.Join(testDir, "vol-default.img"), "size": "1048576"},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	if !slices.Contains(runner.calls, "mkfs.xfs -f /dev/loop7") {
+		t.Errorf("expected the volume formatted with the default xfs, got %v", runner.calls)
+	}
+}
+
+func TestNode_StageVolume_Timeout(t *testing.T) {
+	testDir := t.TempDir()
+	runner := &fakeRunner{
+		fail:   map[string]bool{"blkid": true},
+		hang:   map[string]bool{"mkfs.ext4": true},
+		output: map[string]string{"losetup": "/dev/loop7\n"},
+	}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+	ns.publishTimeout = 50 * time.Millisecond
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-slow",
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+		VolumeContext: map[string]string{
+			"backingFile": filepath.Join(testDir, "vol-slow.img"),
+			"size":        "1048576",
+		},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	// The loop device is still detached after the deadline passed
+	if last := runner.calls[len(runner.calls)-1]; last != "losetup -d /dev/loop7" {
+		t.Errorf("expected the loop device to be detached, got %v", runner.calls)
+	}
+
+	// The volume lock is released, so a retry can run
+	if !ns.volumeLocks.TryAcquire("vol-slow") {
+		t.Errorf("volume lock still held after the timeout")
+	}
+}
+
+func TestNode_StageVolume_Cancelled(t *testing.T) {
+	testDir := t.TempDir()
+	runner := &fakeRunner{
+		fail:   map[string]bool{"blkid": true},
+		hang:   map[string]bool{"mkfs.ext4": true},
+		output: map[string]string{"losetup": "/dev/loop7\n"},
+	}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+
+	// kubelet abandons the call while mkfs is running
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-cancelled",
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+		VolumeContext: map[string]string{
+			"backingFile": filepath.Join(testDir, "vol-cancelled.img"),
+			"size":        "1048576",
+		},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	})
+	if status.Code(err) != codes.Canceled {
+		t.Fatalf("expected Canceled, got %v", err)
+	}
+	if last := runner.calls[len(runner.calls)-1]; last != "losetup -d /dev/loop7" {
+		t.Errorf("expected the loop device to be detached, got %v", runner.calls)
+	}
+}
+
+func TestNode_WithPublishTimeout(t *testing.T) {
+	ns := NewNodeServer("test-node", "test-driver", t.TempDir(), nil)
+
+	// kubelet's own RPC deadline does not cut the operation short
+	reqCtx, cancelReq := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelReq()
+	ctx, cancel := ns.withPublishTimeout(reqCtx)
+	<-reqCtx.Done()
+	time.Sleep(10 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Errorf("expected the operation to outlive the request deadline, got %v", ctx.Err())
+	}
+	cancel()
+	if ctx.Err() == nil {
+		t.Errorf("expected the cancel func to end the operation")
+	}
+
+	// ...but cancelling the request does
+	reqCtx, cancelReq = context.WithCancel(context.Background())
+	ctx, cancel = ns.withPublishTimeout(reqCtx)
+	defer cancel()
+	cancelReq()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("operation not cancelled with the request")
+	}
+	if !errors.Is(ctx.Err(), context.Canceled) {
+		t.Errorf("expected Canceled, got %v", ctx.Err())
+	}
+}
+
+func TestNode_UnstageVolume_FakeRunner(t *testing.T) {
+	testDir := t.TempDir()
+	backingFile := filepath.Join(testDir, "vol-fake.img")
+	runner := &fakeRunner{
+		output: map[string]string{"losetup": "/dev/loop7: [64769]:1234 (" + backingFile + ")\n"},
+	}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+
+	// The staging path isn't mounted, so only the loop device is looked up and detached
+	if _, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "vol-fake",
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+	}); err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %v", err)
+	}
+	want := []string{"losetup -j " + backingFile, "losetup -d /dev/loop7"}
+	if strings.Join(runner.calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected commands %v, got %v", want, runner.calls)
+	}
+
+	// A failing detach is reported
+	runner.calls = nil
+	runner.fail = map[string]bool{"losetup": true}
+	if _, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "vol-fake",
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+	}); err == nil {
+		t.Errorf("expected NodeUnstageVolume to fail when losetup fails")
+	}
+}
+
+func TestNode_UnstageVolume_VolumeLocked(t *testing.T) {
+	testDir := t.TempDir()
+	runner := &fakeRunner{}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+
+	// Another operation on the volume holds the lock until the request gives up
+	if !ns.volumeLocks.TryAcquire("vol-busy") {
+		t.Fatalf("failed to acquire volume lock")
+	}
+	defer ns.volumeLocks.Release("vol-busy")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "vol-busy",
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+	})
+	if status.Code(err) != codes.Aborted {
+		t.Errorf("expected Aborted while the volume lock is held, got %v", err)
+	}
+	if len(runner.calls) != 0 {
+		t.Errorf("expected no commands while the volume lock is held, got %v", runner.calls)
+	}
+}
+
+func TestNode_StageVolume_UnsupportedFsType(t *testing.T) {
+	backingDir := t.TempDir()
+	ns := NewNodeServer("test-node", "test-driver", backingDir, fake.NewSimpleClientset())
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-bad-fs",
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{
+			"backingFile": filepath.Join(backingDir, "vol-bad-fs.img"),
+			"size":        "1048576",
+			"fsType":      "ntfs",
+		},
+	}
+	_, err := ns.NodeStageVolume(context.Background(), req)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for unsupported fsType, got %v", err)
+	}
+	// Rejected before anything was created on the node
+	if _, err := os.Stat(req.VolumeContext["backingFile"]); !os.IsNotExist(err) {
+		t.Errorf("backing file should not be created for an unsupported fsType")
+	}
+
+	if err := ns.formatIfNeeded(context.Background(), "/dev/null", "mkfs.ext4 /dev/sda;", nil); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected formatIfNeeded to reject an unsupported fsType, got %v", err)
+	}
+}
+
+func TestNode_StageVolume_VolumeContext(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing is the size of a backing file present before staging, if any
+		existing int64
+		context  map[string]string
+		fail     map[string]bool
+		wantCode codes.Code
+		wantSize int64
+	}{
+		{
+			name:     "MissingBackingFile",
+			context:  map[string]string{"size": "1048576"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "InvalidSize",
+			context:  map[string]string{"backingFile": "vol-ctx.img", "size": "lots"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "MissingSizeDefaults",
+			context:  map[string]string{"backingFile": "vol-ctx.img"},
+			wantCode: codes.OK,
+			wantSize: defaultVolumeSize,
+		},
+		{
+			name:     "MissingSizeExistingFile",
+			existing: 2097152,
+			context:  map[string]string{"backingFile": "vol-ctx.img"},
+			wantCode: codes.OK,
+			wantSize: 2097152,
+		},
+		{
+			name:     "LosetupFailsInternal",
+			context:  map[string]string{"backingFile": "vol-ctx.img", "size": "1048576"},
+			fail:     map[string]bool{"losetup": true},
+			wantCode: codes.Internal,
+			wantSize: 1048576,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDir := t.TempDir()
+			volumeContext := map[string]string{}
+			for k, v := range tt.context {
+				volumeContext[k] = v
+			}
+			if name, ok := volumeContext["backingFile"]; ok {
+				volumeContext["backingFile"] = filepath.Join(testDir, name)
+			}
+			if tt.existing > 0 {
+				if err := os.WriteFile(volumeContext["backingFile"], make([]byte, tt.existing), 0600); err != nil {
+					t.Fatalf("failed to create backing file: %v", err)
+				}
+			}
+			fail := map[string]bool{"blkid": true}
+			for name := range tt.fail {
+				fail[name] = true
+			}
+			ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+			ns.runner = &fakeRunner{fail: fail, output: map[string]string{"losetup": "/dev/loop7\n"}}
+
+			_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-ctx",
+				StagingTargetPath: filepath.Join(testDir, "staging"),
+				VolumeContext:     volumeContext,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				},
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("expected %v, got %v", tt.wantCode, err)
+			}
+			if tt.wantSize == 0 {
+				return
+			}
+			fi, err := os.Stat(volumeContext["backingFile"])
+			if err != nil {
+				t.Fatalf("backing file not created: %v", err)
+			}
+			if fi.Size() != tt.wantSize {
+				t.Errorf("expected backing file of %d bytes, got %d", tt.wantSize, fi.Size())
+			}
+		})
+	}
+}
+
+func TestNode_MkfsArgs(t *testing.T) {
+	tests := []struct {
+		fsType string
+		want   []string
+	}{
+		{"ext3", []string{"/dev/loop0"}},
+		{"ext4", []string{"/dev/loop0"}},
+		{"xfs", []string{"-f", "/dev/loop0"}},
+		{"btrfs", []string{"-f", "/dev/loop0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fsType, func(t *testing.T) {
+			if !supportedFsTypes[tt.fsType] {
+				t.Fatalf("%s should be a supported fsType", tt.fsType)
+			}
+			got := mkfsArgs("/dev/loop0", tt.fsType, nil)
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("expected mkfs args %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNode_FormatIfNeeded_MkfsOptions(t *testing.T) {
+	tests := []struct {
+		fsType  string
+		options string
+		want    string
+	}{
+		{"ext4", "", "mkfs.ext4 /dev/loop0"},
+		{"ext4", "-b 4096  -m 0", "mkfs.ext4 -b 4096 -m 0 /dev/loop0"},
+		{"xfs", "-m reflink=1", "mkfs.xfs -f -m reflink=1 /dev/loop0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fsType+"/"+tt.options, func(t *testing.T) {
+			options, err := parseMkfsOptions(tt.options)
+			if err != nil {
+				t.Fatalf("parseMkfsOptions failed: %v", err)
+			}
+			runner := &fakeRunner{}
+			ns := NewNodeServer("test-node", "test-driver", t.TempDir(), fake.NewSimpleClientset())
+			ns.runner = runner
+
+			if err := ns.formatIfNeeded(context.Background(), "/dev/loop0", tt.fsType, options); err != nil {
+				t.Fatalf("formatIfNeeded failed: %v", err)
+			}
+			if got := runner.calls[len(runner.calls)-1]; got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNode_ParseMkfsOptions_Rejected(t *testing.T) {
+	for _, options := range []string{"-b 4096; rm -rf /", "-L $(hostname)", "-E `id`", "-L a|b", "-L 'x'", "-L a\nb", "-b 4096\n-m 0"} {
+		if _, err := parseMkfsOptions(options); err == nil {
+			t.Errorf("expected mkfsOptions %q to be rejected", options)
+		}
+	}
+}
+
+func TestNode_FsckIfNeeded(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		existing string
+		exitCode map[string]int
+		wantErr  bool
+		want     string
+	}{
+		{name: "Disabled", existing: "ext4", want: "blkid -p -s TYPE -o value /dev/loop0"},
+		{name: "Unformatted", enabled: true, want: "blkid -p -s TYPE -o value /dev/loop0|mkfs.ext4 /dev/loop0"},
+		{name: "Clean", enabled: true, existing: "ext4", want: "blkid -p -s TYPE -o value /dev/loop0|fsck -p /dev/loop0"},
+		{name: "Corrected", enabled: true, existing: "ext4", exitCode: map[string]int{"fsck": 1}, want: "blkid -p -s TYPE -o value /dev/loop0|fsck -p /dev/loop0"},
+		{name: "Unrecoverable", enabled: true, existing: "ext4", exitCode: map[string]int{"fsck": 4}, wantErr: true, want: "blkid -p -s TYPE -o value /dev/loop0|fsck -p /dev/loop0"},
+		{name: "XfsCorrupt", enabled: true, existing: "xfs", exitCode: map[string]int{"xfs_repair": 1}, wantErr: true, want: "blkid -p -s TYPE -o value /dev/loop0|xfs_repair -n /dev/loop0"},
+		{name: "Btrfs", enabled: true, existing: "btrfs", want: "blkid -p -s TYPE -o value /dev/loop0|btrfs check --readonly /dev/loop0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{output: map[string]string{"blkid": tt.existing}, exitCode: tt.exitCode}
+			ns := NewNodeServer("test-node", "test-driver", t.TempDir(), fake.NewSimpleClientset())
+			ns.runner = runner
+			ns.fsckOnMount = tt.enabled
+
+			err := ns.formatIfNeeded(context.Background(), "/dev/loop0", "ext4", nil)
+			if tt.wantErr && err == nil {
+				t.Errorf("expected fsck failure to fail the mount")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("formatIfNeeded failed: %v", err)
+			}
+			if got := strings.Join(runner.calls, "|"); got != tt.want {
+				t.Errorf("unexpected commands:\n got: %s\nwant: %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNode_EnsureBackingFile_Clone(t *testing.T) {
+	testDir := t.TempDir()
+	srcFile := filepath.Join(testDir, "vol-source.img")
+	if err := os.WriteFile(srcFile, []byte("cloned data"), 0600); err != nil {
+		t.Fatalf("failed to write source file: %v", err)
+	}
+
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	dstFile := filepath.Join(testDir, "vol-clone.img")
+	if err := ns.ensureBackingFile(context.Background(), dstFile, 1048576, srcFile, false, false); err != nil {
+		t.Fatalf("ensureBackingFile failed: %v", err)
+	}
+
+	data, err := os.ReadFile(dstFile)
+	if err != nil {
+		t.Fatalf("failed to read clone: %v", err)
+	}
+	if len(data) != 1048576 {
+		t.Errorf("expected clone grown to 1MiB, got %d bytes", len(data))
+	}
+	if !strings.HasPrefix(string(data), "cloned data") {
+		t.Errorf("clone does not contain the source data")
+	}
+	if _, err := os.Stat(dstFile + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary clone file should not remain")
+	}
+}
+
+func TestNode_EnsureBackingFile_Preallocate(t *testing.T) {
+	testDir := t.TempDir()
+	ns := NewNodeServer("test-node", "test-driver", testDir, nil)
+	const size = 8 * 1048576
+
+	allocated := func(file string) int64 {
+		var st unix.Stat_t
+		if err := unix.Stat(file, &st); err != nil {
+			t.Fatalf("failed to stat %s: %v", file, err)
+		}
+		return st.Blocks * 512
+	}
+
+	sparse := filepath.Join(testDir, "vol-sparse.img")
+	if err := ns.ensureBackingFile(context.Background(), sparse, size, "", false, false); err != nil {
+		t.Fatalf("ensureBackingFile failed: %v", err)
+	}
+	preallocated := filepath.Join(testDir, "vol-prealloc.img")
+	if err := ns.ensureBackingFile(context.Background(), preallocated, size, "", false, true); err != nil {
+		if status.Code(err) == codes.Internal && strings.Contains(err.Error(), "operation not supported") {
+			t.Skipf("filesystem of %s does not support fallocate", testDir)
+		}
+		t.Fatalf("ensureBackingFile failed: %v", err)
+	}
+
+	if got := allocated(sparse); got >= size {
+		t.Errorf("expected a sparse file, got %d of %d bytes allocated", got, size)
+	}
+	if got := allocated(preallocated); got < size {
+		t.Errorf("expected all %d bytes allocated, got %d", size, got)
+	}
+	for _, file := range []string{sparse, preallocated} {
+		if fi, err := os.Stat(file); err != nil || fi.Size() != size {
+			t.Errorf("expected %s to be %d bytes, got %v, %v", file, size, fi, err)
+		}
+	}
+}
+
+func TestNode_EnsureBackingFile_FailedCreation(t *testing.T) {
+	testDir := t.TempDir()
+	ns := NewNodeServer("test-node", "test-driver", testDir, nil)
+	backingFile := filepath.Join(testDir, "vol-partial.img")
+
+	// A stale temporary file from a crashed attempt doesn't get in the way
+	if err := os.WriteFile(backingFile+".tmp", []byte("stale"), 0600); err != nil {
+		t.Fatalf("failed to write stale file: %v", err)
+	}
+	// Truncating to a negative size fails after the file has been created
+	if err := ns.ensureBackingFile(context.Background(), backingFile, -1, "", false, false); status.Code(err) != codes.Internal {
+		t.Fatalf("expected the truncate failure to be reported as Internal, got %v", err)
+	}
+	for _, file := range []string{backingFile, backingFile + ".tmp"} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("expected no partial file at %s, got %v", file, err)
+		}
+	}
+
+	// The retry starts from scratch
+	if err := ns.ensureBackingFile(context.Background(), backingFile, 1048576, "", false, false); err != nil {
+		t.Fatalf("ensureBackingFile failed: %v", err)
+	}
+	if fi, err := os.Stat(backingFile); err != nil || fi.Size() != 1048576 {
+		t.Errorf("expected a 1MiB backing file, got %v, %v", fi, err)
+	}
+
+	// A full backing filesystem is worth retrying once space frees up
+	err := backingFileError("truncate", backingFile, &os.PathError{Op: "truncate", Path: backingFile, Err: unix.ENOSPC})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted for ENOSPC, got %v", err)
+	}
+}
+
+func TestNode_EnsureBackingFile_ReservedCapacity(t *testing.T) {
+	testDir := t.TempDir()
+	available, err := availableCapacity(testDir)
+	if err != nil {
+		t.Fatalf("availableCapacity failed: %v", err)
+	}
+
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	// Leave room for a 1MiB file but not for one that eats into the reserve
+	ns.reservedCapacity = available - 4*1048576
+
+	backingFile := filepath.Join(testDir, "vol-reserved.img")
+	err = ns.ensureBackingFile(context.Background(), backingFile, 8*1048576, "", false, false)
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted below the reserve, got %v", err)
+	}
+	if _, statErr := os.Stat(backingFile); !os.IsNotExist(statErr) {
+		t.Errorf("backing file should not be created when the reserve is hit")
+	}
+
+	if err := ns.ensureBackingFile(context.Background(), backingFile, 1048576, "", false, false); err != nil {
+		t.Fatalf("ensureBackingFile within the reserve failed: %v", err)
+	}
+
+	// Existing backing files are reused regardless of the reserve
+	ns.reservedCapacity = available * 2
+	if err := ns.ensureBackingFile(context.Background(), backingFile, 1048576, "", false, false); err != nil {
+		t.Errorf("ensureBackingFile for an existing file failed: %v", err)
+	}
+}
+
+func TestNode_ExtraBackingDirs(t *testing.T) {
+	primary, extra := t.TempDir(), t.TempDir()
+	ns := NewNodeServer("test-node", "test-driver", primary, fake.NewSimpleClientset())
+
+	// A single directory keeps the path CreateVolume recorded
+	if got := ns.placeBackingFile(filepath.Join(primary, "vol-new.img")); got != filepath.Join(primary, "vol-new.img") {
+		t.Errorf("expected single directory placement to keep the path, got %s", got)
+	}
+
+	// Unusable directories are never picked
+	ns.extraBackingDirs = []string{filepath.Join(extra, "missing")}
+	if got := ns.placeBackingFile(filepath.Join(primary, "vol-new.img")); got != filepath.Join(primary, "vol-new.img") {
+		t.Errorf("expected the only usable directory to be picked, got %s", got)
+	}
+
+	ns.extraBackingDirs = []string{extra}
+	if err := ns.validateBackingFile(filepath.Join(extra, "vol-x.img")); err != nil {
+		t.Errorf("expected files in extra directories to be valid: %v", err)
+	}
+	if err := ns.validateBackingFile(filepath.Join(t.TempDir(), "vol-x.img")); err == nil {
+		t.Errorf("expected files outside the backing directories to be rejected")
+	}
+
+	// Files placed in an extra directory are found by volume ID
+	createAgedFile(t, filepath.Join(extra, "vol-placed.img"), time.Hour)
+	if got := ns.backingFilePath("vol-placed"); got != filepath.Join(extra, "vol-placed.img") {
+		t.Errorf("expected backing file in extra directory, got %s", got)
+	}
+	if got := ns.backingFilePath("vol-unknown"); got != filepath.Join(primary, "vol-unknown.img") {
+		t.Errorf("expected unknown volumes to map to the primary directory, got %s", got)
+	}
+
+	// The garbage collector scans every directory and keeps files of live volumes
+	// wherever they were placed
+	createAgedFile(t, filepath.Join(extra, "vol-orphaned.img"), time.Hour)
+	ns.clientset = fake.NewSimpleClientset(newTestPV("vol-placed", "test-driver", "1Mi"))
+	ns.garbageCollectVolumes(context.Background(), false)
+	if _, err := os.Stat(filepath.Join(extra, "vol-placed.img")); err != nil {
+		t.Errorf("live backing file in extra directory should remain: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(extra, "vol-orphaned.img")); !os.IsNotExist(err) {
+		t.Errorf("orphaned backing file in extra directory should be deleted")
+	}
+}
+
+func TestNode_StageAndPublishVolume_Block(t *testing.T) {
+	testDir := t.TempDir()
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+
+	volID := "vol-test-block"
+	backingFile := filepath.Join(testDir, volID+".img")
+	stagingPath := filepath.Join(testDir, "block-staging")
+	targetPath := filepath.Join(testDir, "block-target", volID)
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	_, stageErr := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          volID,
+		StagingTargetPath: stagingPath,
+		VolumeContext: map[string]string{
+			"backingFile": backingFile,
+			"size":        "1048576", // 1 MiB
+		},
+		VolumeCapability: volCap,
+	})
+	if stageErr != nil {
+		t.Logf("NodeStageVolume returned error (expected if not root): %v", stageErr)
+		return
+	}
+	if _, ok := findBlockLoopDevice(blockStagingDevice(stagingPath)); !ok {
+		t.Errorf("expected a loop device bind-mounted in %s", stagingPath)
+	}
+
+	if _, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:          volID,
+		StagingTargetPath: stagingPath,
+		TargetPath:        targetPath,
+		VolumeCapability:  volCap,
+	}); err != nil {
+		t.Fatalf("NodePublishVolume failed: %v", err)
+	}
+
+	// Block targets are files, never directories
+	info, err := os.Stat(targetPath)
+	if err != nil {
+		t.Fatalf("TargetPath not created: %v", err)
+	}
+	if info.IsDir() {
+		t.Errorf("block TargetPath should not be a directory")
+	}
+	if _, ok := findBlockLoopDevice(targetPath); !ok {
+		t.Errorf("expected a loop device bind-mounted at %s", targetPath)
+	}
+
+	if _, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: volID, TargetPath: targetPath}); err != nil {
+		t.Fatalf("NodeUnpublishVolume failed: %v", err)
+	}
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Errorf("block TargetPath should be removed after unpublish")
+	}
+	if _, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: volID, StagingTargetPath: stagingPath}); err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %v", err)
+	}
+	if _, err := os.Stat(blockStagingDevice(stagingPath)); !os.IsNotExist(err) {
+		t.Errorf("block staging device should be removed after unstage")
+	}
+}
+
+func TestNode_ReadOnlyMount(t *testing.T) {
+	mountCap := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+
+	if isReadOnly(&csi.NodePublishVolumeRequest{VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}) {
+		t.Errorf("SINGLE_NODE_WRITER should not be read-only")
+	}
+	if !isReadOnly(&csi.NodePublishVolumeRequest{Readonly: true, VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}) {
+		t.Errorf("Readonly request should be read-only")
+	}
+	if !isReadOnly(&csi.NodePublishVolumeRequest{VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)}) {
+		t.Errorf("SINGLE_NODE_READER_ONLY should be read-only")
+	}
+
+	args := mountArgs("/dev/loop0", "/mnt/target", "ext4", []string{"ro"})
+	want := []string{"-t", "ext4", "-o", "ro", "/dev/loop0", "/mnt/target"}
+	if strings.Join(args, " ") != strings.Join(want, " ") {
+		t.Errorf("expected mount args %v, got %v", want, args)
+	}
+
+	args = mountArgs("/dev/loop0", "/mnt/target", "ext4", nil)
+	want = []string{"-t", "ext4", "/dev/loop0", "/mnt/target"}
+	if strings.Join(args, " ") != strings.Join(want, " ") {
+		t.Errorf("expected mount args %v, got %v", want, args)
+	}
+}
+
+func TestNode_MergeMountOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []string
+		flags   []string
+		want    []string
+	}{
+		{"Empty", nil, nil, nil},
+		{"FlagsOnly", nil, []string{"noatime", "discard"}, []string{"noatime", "discard"}},
+		{"Duplicates", nil, []string{"noatime", "noatime,nodiratime"}, []string{"noatime", "nodiratime"}},
+		{"ReadOnlyWins", []string{"ro"}, []string{"rw", "noatime"}, []string{"ro", "noatime"}},
+		{"FirstConflictWins", nil, []string{"atime", "noatime"}, []string{"atime"}},
+		{"BlankEntries", nil, []string{"", " noatime , "}, []string{"noatime"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeMountOptions(tt.options, tt.flags)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNode_PublishVolume_MountPermissions(t *testing.T) {
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	tests := []struct {
+		name  string
+		perms os.FileMode
+		want  os.FileMode
+	}{
+		{"Default", 0, defaultMountPermissions},
+		{"GroupWritable", 0770, 0770},
+		{"WorldWritable", 0777, 0777},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := NewNodeServer("test-node", "test-driver", t.TempDir(), fake.NewSimpleClientset())
+			ns.mountPermissions = tt.perms
+			target := filepath.Join(t.TempDir(), "target")
+
+			// The staging path doesn't exist so the bind mount fails after the
+			// target directory has been created
+			if _, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          "vol-perms",
+				StagingTargetPath: filepath.Join(t.TempDir(), "missing"),
+				TargetPath:        target,
+				VolumeCapability:  volCap,
+			}); err == nil {
+				t.Fatalf("expected NodePublishVolume to fail for a missing staging path")
+			}
+
+			fi, err := os.Stat(target)
+			if err != nil {
+				t.Fatalf("target directory not created: %v", err)
+			}
+			if fi.Mode().Perm() != tt.want {
+				t.Errorf("expected target mode %o, got %o", tt.want, fi.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestNode_StageVolume_KeepsFsGroupSetgid(t *testing.T) {
+	testDir := t.TempDir()
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = &fakeRunner{output: map[string]string{"losetup": "/dev/loop7\n", "blkid": "ext4\n"}}
+	ns.mountPermissions = 0770
+
+	// Kubelet applied a pod's fsGroup to the volume root when it was first published
+	staging := filepath.Join(testDir, "staging")
+	if err := os.Mkdir(staging, 0750); err != nil {
+		t.Fatalf("failed to create staging dir: %v", err)
+	}
+	if err := os.Chmod(staging, 0770|os.ModeSetgid); err != nil {
+		t.Fatalf("failed to chmod staging dir: %v", err)
+	}
+
+	if _, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-fsgroup",
+		StagingTargetPath: staging,
+		VolumeContext: map[string]string{
+			"backingFile": filepath.Join(testDir, "vol-fsgroup.img"),
+			"size":        "1048576",
+		},
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	fi, err := os.Stat(staging)
+	if err != nil {
+		t.Fatalf("failed to stat staging dir: %v", err)
+	}
+	if fi.Mode().Perm() != 0770 || fi.Mode()&os.ModeSetgid == 0 {
+		t.Errorf("expected mode 0770 with setgid kept, got %v", fi.Mode())
 	}
-	os.RemoveAll(nodeReq.TargetPath)
-	os.Remove(backingFile)
 }
 
 func TestNode_UnpublishVolume(t *testing.T) {
@@ -81,29 +1171,42 @@ func TestNode_GetVolumeStats(t *testing.T) {
 			VolumePath: "",
 		}
 		_, err := ns.NodeGetVolumeStats(context.Background(), req)
-		if err == nil {
-			t.Error("Expected error for missing volume path, got nil")
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected InvalidArgument for missing volume path, got %v", err)
+		}
+	})
+
+	// Test 2: Non-existent path should return error
+	t.Run("NonExistentPath", func(t *testing.T) {
+		// Use a path that doesn't exist within a temp directory
+		nonExistentPath := filepath.Join(t.TempDir(), "nonexistent-subdir")
+		req := &csi.NodeGetVolumeStatsRequest{
+			VolumeId:   "test-vol",
+			VolumePath: nonExistentPath,
+		}
+		_, err := ns.NodeGetVolumeStats(context.Background(), req)
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Expected NotFound for non-existent path, got %v", err)
 		}
 	})
 
-	// Test 2: Non-existent path should return error
-	t.Run("NonExistentPath", func(t *testing.T) {
-		// Use a path that doesn't exist within a temp directory
-		nonExistentPath := filepath.Join(t.TempDir(), "nonexistent-subdir")
+	// Test 3: A path left behind after unmounting must not report the
+	// filesystem underneath it
+	t.Run("NotMounted", func(t *testing.T) {
 		req := &csi.NodeGetVolumeStatsRequest{
 			VolumeId:   "test-vol",
-			VolumePath: nonExistentPath,
+			VolumePath: t.TempDir(),
 		}
 		_, err := ns.NodeGetVolumeStats(context.Background(), req)
-		if err == nil {
-			t.Error("Expected error for non-existent path, got nil")
+		if status.Code(err) != codes.NotFound {
+			t.Errorf("Expected NotFound for a path that is not a mount point, got %v", err)
 		}
 	})
 
-	// Test 3: Valid path should return stats
+	// Test 4: Valid path should return stats
 	t.Run("ValidPath", func(t *testing.T) {
-		// Use t.TempDir() for automatic cleanup and test isolation
-		testPath := t.TempDir()
+		// The root directory is a mount point without needing privileges to mount
+		testPath := "/"
 
 		req := &csi.NodeGetVolumeStatsRequest{
 			VolumeId:   "test-vol",
@@ -118,8 +1221,8 @@ func TestNode_GetVolumeStats(t *testing.T) {
 		if resp == nil {
 			t.Fatal("Expected non-nil response")
 		}
-		if len(resp.Usage) != 1 {
-			t.Fatalf("Expected 1 usage entry, got %d", len(resp.Usage))
+		if len(resp.Usage) != 2 {
+			t.Fatalf("Expected 2 usage entries, got %d", len(resp.Usage))
 		}
 
 		usage := resp.Usage[0]
@@ -136,6 +1239,17 @@ func TestNode_GetVolumeStats(t *testing.T) {
 			t.Errorf("Expected available <= total, got available=%d, total=%d", usage.Available, usage.Total)
 		}
 		t.Logf("Stats: total=%d bytes, available=%d bytes", usage.Total, usage.Available)
+
+		inodes := resp.Usage[1]
+		if inodes.Unit != csi.VolumeUsage_INODES {
+			t.Errorf("Expected unit INODES, got %v", inodes.Unit)
+		}
+		if inodes.Available < 0 || inodes.Available > inodes.Total {
+			t.Errorf("Expected 0 <= available inodes <= total, got available=%d, total=%d", inodes.Available, inodes.Total)
+		}
+		if inodes.Used != inodes.Total-inodes.Available {
+			t.Errorf("Expected used inodes %d, got %d", inodes.Total-inodes.Available, inodes.Used)
+		}
 	})
 }
 
@@ -158,6 +1272,263 @@ func TestNode_GetCapabilities(t *testing.T) {
 	if !found {
 		t.Error("Expected GET_VOLUME_STATS capability to be advertised")
 	}
+
+	found = false
+	for _, cap := range resp.Capabilities {
+		if cap.GetRpc() != nil && cap.GetRpc().Type == csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("Expected STAGE_UNSTAGE_VOLUME capability to be advertised")
+	}
+
+	found = false
+	for _, cap := range resp.Capabilities {
+		if cap.GetRpc() != nil && cap.GetRpc().Type == csi.NodeServiceCapability_RPC_VOLUME_CONDITION {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("Expected VOLUME_CONDITION capability to be advertised")
+	}
+
+	found = false
+	for _, cap := range resp.Capabilities {
+		if cap.GetRpc() != nil && cap.GetRpc().Type == csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("Expected SINGLE_NODE_MULTI_WRITER capability to be advertised")
+	}
+}
+
+func TestNode_GetVolumeStats_VolumeCondition(t *testing.T) {
+	testDir := t.TempDir()
+	runner := &fakeRunner{}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+	ns.sysBlockDir = filepath.Join(testDir, "sys")
+	ns.procDir = filepath.Join(testDir, "proc")
+	if err := os.MkdirAll(filepath.Join(ns.procDir, "self"), 0755); err != nil {
+		t.Fatalf("failed to create proc dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(ns.procDir, "self", "mountinfo"), []byte("1 0 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n"), 0644); err != nil {
+		t.Fatalf("failed to write mountinfo: %v", err)
+	}
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "vol-health", VolumePath: "/"}
+
+	// The backing file is gone, e.g. deleted by hand on the node
+	resp, err := ns.NodeGetVolumeStats(context.Background(), req)
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats failed: %v", err)
+	}
+	if cond := resp.VolumeCondition; cond == nil || !cond.Abnormal || !strings.Contains(cond.Message, "vol-health.img") {
+		t.Errorf("expected abnormal condition for missing backing file, got %v", cond)
+	}
+
+	// The backing file exists but no loop device serves it
+	if err := os.WriteFile(filepath.Join(testDir, "vol-health.img"), nil, 0600); err != nil {
+		t.Fatalf("failed to create backing file: %v", err)
+	}
+	resp, err = ns.NodeGetVolumeStats(context.Background(), req)
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats failed: %v", err)
+	}
+	if cond := resp.VolumeCondition; cond == nil || !cond.Abnormal || !strings.Contains(cond.Message, "loop device") {
+		t.Errorf("expected abnormal condition for detached backing file, got %v", cond)
+	}
+
+	runner.output = map[string]string{"losetup": "/dev/loop7: [64769]:1234 (" + filepath.Join(testDir, "vol-health.img") + ")\n"}
+	resp, err = ns.NodeGetVolumeStats(context.Background(), req)
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats failed: %v", err)
+	}
+	if cond := resp.VolumeCondition; cond == nil || cond.Abnormal {
+		t.Errorf("expected healthy condition, got %v", cond)
+	}
+}
+
+func TestNode_RemountedReadOnly(t *testing.T) {
+	mountinfo := `36 25 7:0 / /mnt/healthy rw,relatime shared:1 - ext4 /dev/loop0 rw
+37 25 7:1 / /mnt/errors rw,relatime shared:2 - ext4 /dev/loop1 ro,errors=remount-ro
+38 25 7:2 / /mnt/readonly ro,relatime shared:3 - ext4 /dev/loop2 ro
+39 25 7:3 / /mnt/with\040space rw,relatime - xfs /dev/loop3 ro
+`
+	tests := map[string]bool{
+		"/mnt/healthy":    false,
+		"/mnt/errors":     true,
+		"/mnt/readonly":   false,
+		"/mnt/with space": true,
+		"/mnt/missing":    false,
+	}
+	for path, want := range tests {
+		if got := remountedReadOnly(mountinfo, path); got != want {
+			t.Errorf("remountedReadOnly(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestNode_SameSourceMounts(t *testing.T) {
+	mountinfo := `36 25 7:0 / /var/lib/kubelet/staging/vol-a rw,relatime - ext4 /dev/loop0 rw
+37 25 7:0 / /var/lib/kubelet/pods/pod-1/vol-a/mount rw,relatime - ext4 /dev/loop0 rw
+38 25 7:1 / /var/lib/kubelet/staging/vol-b rw,relatime - ext4 /dev/loop1 rw
+39 25 0:5 /loop0 /var/lib/kubelet/pods/pod-2/block rw - devtmpfs udev rw
+`
+	got := sameSourceMounts(mountinfo, "/var/lib/kubelet/staging/vol-a")
+	want := []string{"/var/lib/kubelet/staging/vol-a", "/var/lib/kubelet/pods/pod-1/vol-a/mount"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if got := sameSourceMounts(mountinfo, "/not/mounted"); got != nil {
+		t.Errorf("expected no mounts for an unmounted path, got %v", got)
+	}
+}
+
+func TestNode_IsMountPoint(t *testing.T) {
+	ns := NewNodeServer("test-node", "test-driver", t.TempDir(), nil)
+	ns.procDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(ns.procDir, "self"), 0755); err != nil {
+		t.Fatalf("failed to create proc dir: %v", err)
+	}
+	mountinfo := `36 25 7:0 / /var/lib/kubelet/staging/vol\040a rw,relatime - ext4 /dev/loop0 rw
+`
+	if err := os.WriteFile(filepath.Join(ns.procDir, "self", "mountinfo"), []byte(mountinfo), 0644); err != nil {
+		t.Fatalf("failed to write mountinfo: %v", err)
+	}
+
+	if mounted, err := ns.isMountPoint("/var/lib/kubelet/staging/vol a/"); err != nil || !mounted {
+		t.Errorf("expected a mount point, got %v, %v", mounted, err)
+	}
+	if mounted, err := ns.isMountPoint("/var/lib/kubelet/staging"); err != nil || mounted {
+		t.Errorf("expected no mount point, got %v, %v", mounted, err)
+	}
+}
+
+func TestNode_PublishVolume_SingleWriter(t *testing.T) {
+	testDir := t.TempDir()
+	staging := filepath.Join(testDir, "staging")
+	firstTarget := filepath.Join(testDir, "pod-1", "mount")
+	secondTarget := filepath.Join(testDir, "pod-2", "mount")
+
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	runner := &fakeRunner{}
+	ns.runner = runner
+	ns.procDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(ns.procDir, "self"), 0755); err != nil {
+		t.Fatalf("failed to create proc dir: %v", err)
+	}
+	writeMountinfo := func(mountPoints ...string) {
+		var lines []string
+		for i, mp := range mountPoints {
+			lines = append(lines, fmt.Sprintf("%d 25 7:0 / %s rw,relatime - ext4 /dev/loop0 rw", 36+i, mp))
+		}
+		if err := os.WriteFile(filepath.Join(ns.procDir, "self", "mountinfo"), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatalf("failed to write mountinfo: %v", err)
+		}
+	}
+	publish := func(target string, mode csi.VolumeCapability_AccessMode_Mode) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol-rwop",
+			StagingTargetPath: staging,
+			TargetPath:        target,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			},
+		})
+		return err
+	}
+
+	// Only staged: the first pod may publish
+	writeMountinfo(staging)
+	if err := publish(firstTarget, csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER); err != nil {
+		t.Fatalf("first publish failed: %v", err)
+	}
+
+	// Published to the first pod: a second pod is refused
+	writeMountinfo(staging, firstTarget)
+	if err := publish(secondTarget, csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition for a second single-writer publish, got %v", err)
+	}
+	if len(runner.calls) != 1 {
+		t.Errorf("expected only the first publish to bind mount, got %v", runner.calls)
+	}
+
+	// Other access modes may still be shared between pods on the node
+	if err := publish(secondTarget, csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER); err != nil {
+		t.Errorf("multi-writer publish failed: %v", err)
+	}
+}
+
+func TestNode_PublishVolume_MultiWriter(t *testing.T) {
+	testDir := t.TempDir()
+	staging := filepath.Join(testDir, "staging")
+	targets := []string{filepath.Join(testDir, "pod-1", "mount"), filepath.Join(testDir, "pod-2", "mount")}
+
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	runner := &fakeRunner{}
+	ns.runner = runner
+	ns.procDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(ns.procDir, "self"), 0755); err != nil {
+		t.Fatalf("failed to create proc dir: %v", err)
+	}
+	// Staged and already published to the first pod
+	mountinfo := fmt.Sprintf("36 25 7:0 / %s rw,relatime - ext4 /dev/loop0 rw\n37 25 7:0 / %s rw,relatime - ext4 /dev/loop0 rw\n", staging, targets[0])
+	if err := os.WriteFile(filepath.Join(ns.procDir, "self", "mountinfo"), []byte(mountinfo), 0644); err != nil {
+		t.Fatalf("failed to write mountinfo: %v", err)
+	}
+
+	for _, target := range targets {
+		if _, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol-shared",
+			StagingTargetPath: staging,
+			TargetPath:        target,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER},
+			},
+		}); err != nil {
+			t.Fatalf("NodePublishVolume to %s failed: %v", target, err)
+		}
+	}
+	// The first pod keeps its mount and the second shares the staged one; the
+	// loop device is not attached again
+	want := []string{"mount -o bind " + staging + " " + targets[1]}
+	if !slices.Equal(runner.calls, want) {
+		t.Errorf("expected %v, got %v", want, runner.calls)
+	}
+}
+
+func TestNode_GetInfo_Topology(t *testing.T) {
+	ns := NewNodeServer("test-node", "test-driver", "/tmp/my-csi-driver", fake.NewSimpleClientset())
+	resp, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatalf("NodeGetInfo failed: %v", err)
+	}
+	if resp.NodeId != "test-node" {
+		t.Errorf("expected node ID test-node, got %q", resp.NodeId)
+	}
+	// The segment must use the same key CreateVolume pins volumes with
+	if got := resp.GetAccessibleTopology().GetSegments()[topologyKey]; got != "test-node" {
+		t.Errorf("expected topology %s=test-node, got %v", topologyKey, resp.GetAccessibleTopology().GetSegments())
+	}
+	if resp.MaxVolumesPerNode != 0 {
+		t.Errorf("expected no volume limit by default, got %d", resp.MaxVolumesPerNode)
+	}
+
+	ns.maxVolumesPerNode = 16
+	resp, err = ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatalf("NodeGetInfo failed: %v", err)
+	}
+	if resp.MaxVolumesPerNode != 16 {
+		t.Errorf("expected MaxVolumesPerNode 16, got %d", resp.MaxVolumesPerNode)
+	}
 }
 
 func TestNode_GarbageCollectVolumes(t *testing.T) {
@@ -168,13 +1539,9 @@ func TestNode_GarbageCollectVolumes(t *testing.T) {
 	activeVolFile := filepath.Join(testDir, "vol-active.img")
 	orphanedVolFile := filepath.Join(testDir, "vol-orphaned.img")
 
-	// Create the files
+	// Create the files, aged past the GC grace period
 	for _, file := range []string{activeVolFile, orphanedVolFile} {
-		f, err := os.Create(file)
-		if err != nil {
-			t.Fatalf("Failed to create test file %s: %v", file, err)
-		}
-		f.Close()
+		createAgedFile(t, file, time.Hour)
 	}
 
 	// Create a fake PV for the active volume
@@ -207,7 +1574,7 @@ func TestNode_GarbageCollectVolumes(t *testing.T) {
 	}
 
 	// Run garbage collection
-	ns.garbageCollectVolumes(context.Background())
+	ns.garbageCollectVolumes(context.Background(), false)
 
 	// Active volume should still exist
 	if _, err := os.Stat(activeVolFile); err != nil {
@@ -219,3 +1586,474 @@ func TestNode_GarbageCollectVolumes(t *testing.T) {
 		t.Errorf("Orphaned volume file should be deleted after GC")
 	}
 }
+
+// createAgedFile creates an empty file whose modification time is age in the past
+func createAgedFile(t *testing.T, file string, age time.Duration) {
+	t.Helper()
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatalf("Failed to create test file %s: %v", file, err)
+	}
+	f.Close()
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatalf("Failed to set times on %s: %v", file, err)
+	}
+}
+
+func TestNode_GarbageCollectVolumes_DryRun(t *testing.T) {
+	for _, policy := range []string{OnDeletePolicyDelete, OnDeletePolicyRetain} {
+		t.Run(policy, func(t *testing.T) {
+			testDir := t.TempDir()
+			orphaned := filepath.Join(testDir, "vol-orphaned.img")
+			recent := filepath.Join(testDir, "vol-recent.img")
+			createAgedFile(t, orphaned, time.Hour)
+			createAgedFile(t, recent, 0)
+
+			ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+			ns.onDeletePolicy = policy
+			reclaimed, err := ns.garbageCollectVolumes(context.Background(), true)
+			if err != nil {
+				t.Fatalf("garbageCollectVolumes failed: %v", err)
+			}
+			if len(reclaimed) != 1 || reclaimed[0] != orphaned {
+				t.Errorf("expected dry run to report only %s, got %v", orphaned, reclaimed)
+			}
+			if _, err := os.Stat(orphaned); err != nil {
+				t.Errorf("dry run should leave the orphaned file in place: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(testDir, archiveDirName)); !os.IsNotExist(err) {
+				t.Errorf("dry run should not create the archive directory")
+			}
+
+			reclaimed, err = ns.garbageCollectVolumes(context.Background(), false)
+			if err != nil || len(reclaimed) != 1 || reclaimed[0] != orphaned {
+				t.Errorf("expected %s to be reclaimed, got %v, %v", orphaned, reclaimed, err)
+			}
+			if _, err := os.Stat(orphaned); !os.IsNotExist(err) {
+				t.Errorf("orphaned file should be reclaimed")
+			}
+		})
+	}
+
+	// Without the Kubernetes API there is nothing to compare against
+	ns := NewNodeServer("test-node", "test-driver", t.TempDir(), nil)
+	if _, err := ns.garbageCollectVolumes(context.Background(), true); err == nil {
+		t.Errorf("expected an error without a clientset")
+	}
+}
+
+// gcRecorder records the passes reported to a GCObserver
+type gcRecorder struct {
+	reclaimed []int
+	errs      []error
+}
+
+func (r *gcRecorder) ObserveGC(reclaimed int, err error) {
+	r.reclaimed = append(r.reclaimed, reclaimed)
+	r.errs = append(r.errs, err)
+}
+
+func TestNode_GarbageCollectVolumes_Observer(t *testing.T) {
+	testDir := t.TempDir()
+	createAgedFile(t, filepath.Join(testDir, "vol-a.img"), time.Hour)
+	createAgedFile(t, filepath.Join(testDir, "vol-b.img"), time.Hour)
+
+	recorder := &gcRecorder{}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.gcObserver = recorder
+
+	// Dry runs reclaim nothing and are not reported
+	if _, err := ns.garbageCollectVolumes(context.Background(), true); err != nil {
+		t.Fatalf("garbageCollectVolumes failed: %v", err)
+	}
+	if len(recorder.reclaimed) != 0 {
+		t.Errorf("expected no observed passes after a dry run, got %v", recorder.reclaimed)
+	}
+
+	if _, err := ns.garbageCollectVolumes(context.Background(), false); err != nil {
+		t.Fatalf("garbageCollectVolumes failed: %v", err)
+	}
+	if len(recorder.reclaimed) != 1 || recorder.reclaimed[0] != 2 || recorder.errs[0] != nil {
+		t.Errorf("expected one pass reclaiming 2 files, got %v, %v", recorder.reclaimed, recorder.errs)
+	}
+
+	// A pass that can't list PVs is reported with its error
+	ns.clientset = nil
+	if _, err := ns.garbageCollectVolumes(context.Background(), false); err == nil {
+		t.Fatalf("expected an error without a clientset")
+	}
+	if len(recorder.errs) != 2 || recorder.errs[1] == nil {
+		t.Errorf("expected the failed pass to be observed, got %v", recorder.errs)
+	}
+}
+
+func TestNode_GarbageCollectVolumes_MaxOrphanRatio(t *testing.T) {
+	testDir := t.TempDir()
+	var orphaned []string
+	for i := range gcOrphanRatioMinFiles {
+		name := fmt.Sprintf("vol-%d", i)
+		createAgedFile(t, filepath.Join(testDir, name+".img"), time.Hour)
+		if i > 0 {
+			orphaned = append(orphaned, filepath.Join(testDir, name+".img"))
+		}
+	}
+	// Files within the grace period don't count as orphans
+	for i := range 2 * gcOrphanRatioMinFiles {
+		createAgedFile(t, filepath.Join(testDir, fmt.Sprintf("vol-fresh-%d.img", i)), 0)
+	}
+	pv := newTestPV("vol-0", "test-driver", "1Gi")
+
+	recorder := &gcRecorder{}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset(pv))
+	ns.gcObserver = recorder
+	ns.gcMaxOrphanRatio = 0.25
+
+	// Nine of thirty files look orphaned: the pass aborts, dry run or not
+	for _, dryRun := range []bool{true, false} {
+		if reclaimed, err := ns.garbageCollectVolumes(context.Background(), dryRun); err == nil || len(reclaimed) != 0 {
+			t.Errorf("expected the pass to abort (dry run %v), got %v, %v", dryRun, reclaimed, err)
+		}
+	}
+	for _, file := range orphaned {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("aborted pass should leave %s in place: %v", file, err)
+		}
+	}
+	if len(recorder.errs) != 1 || recorder.errs[0] == nil {
+		t.Errorf("expected the aborted pass to be observed as failed, got %v", recorder.errs)
+	}
+
+	ns.gcMaxOrphanRatio = DefaultGCMaxOrphanRatio
+	reclaimed, err := ns.garbageCollectVolumes(context.Background(), false)
+	if err != nil || len(reclaimed) != len(orphaned) {
+		t.Errorf("expected %v to be reclaimed within the limit, got %v, %v", orphaned, reclaimed, err)
+	}
+}
+
+func TestNode_GarbageCollectVolumes_MaxOrphanRatioFewFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		active []string
+		files  []string
+	}{
+		// The only volume on the node was deleted
+		{"SingleFile", nil, []string{"vol-a"}},
+		// Most volumes on a small node were deleted at once
+		{"BulkDelete", []string{"vol-keep"}, []string{"vol-keep", "vol-a", "vol-b", "vol-c", "vol-d"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDir := t.TempDir()
+			for _, name := range tt.files {
+				createAgedFile(t, filepath.Join(testDir, name+".img"), time.Hour)
+			}
+			var pvs []runtime.Object
+			for _, name := range tt.active {
+				pvs = append(pvs, newTestPV(name, "test-driver", "1Gi"))
+			}
+			ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset(pvs...))
+			ns.gcMaxOrphanRatio = DefaultGCMaxOrphanRatio
+
+			reclaimed, err := ns.garbageCollectVolumes(context.Background(), false)
+			if err != nil {
+				t.Fatalf("expected the pass to succeed below %d files, got %v", gcOrphanRatioMinFiles, err)
+			}
+			if want := len(tt.files) - len(tt.active); len(reclaimed) != want {
+				t.Errorf("expected %d files to be reclaimed, got %v", want, reclaimed)
+			}
+		})
+	}
+}
+
+func TestNode_GarbageCollectVolumes_GracePeriod(t *testing.T) {
+	testDir := t.TempDir()
+
+	// A file created just now, e.g. by a NodeStageVolume racing with PV creation
+	freshVolFile := filepath.Join(testDir, "vol-fresh.img")
+	createAgedFile(t, freshVolFile, 0)
+	// An old orphan that should be collected
+	oldVolFile := filepath.Join(testDir, "vol-old.img")
+	createAgedFile(t, oldVolFile, time.Hour)
+
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.garbageCollectVolumes(context.Background(), false)
+
+	if _, err := os.Stat(freshVolFile); err != nil {
+		t.Errorf("Freshly created file should survive GC within the grace period: %v", err)
+	}
+	if _, err := os.Stat(oldVolFile); !os.IsNotExist(err) {
+		t.Errorf("Orphaned file older than the grace period should be deleted")
+	}
+
+	// Without a grace period the fresh file is collected too
+	ns.gcGracePeriod = 0
+	ns.garbageCollectVolumes(context.Background(), false)
+	if _, err := os.Stat(freshVolFile); !os.IsNotExist(err) {
+		t.Errorf("Orphaned file should be deleted once the grace period is disabled")
+	}
+}
+
+func TestNode_GarbageCollectVolumes_Ephemeral(t *testing.T) {
+	testDir := t.TempDir()
+	backingFile := filepath.Join(testDir, ephemeralPrefix+"csi-inline.img")
+	createAgedFile(t, backingFile, time.Hour)
+
+	runner := &fakeRunner{output: map[string]string{"losetup": "/dev/loop7: [64769]:1234 (" + backingFile + ")\n"}}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+	ns.onDeletePolicy = OnDeletePolicyRetain
+
+	// A published inline volume has its loop device attached
+	ns.garbageCollectVolumes(context.Background(), false)
+	if _, err := os.Stat(backingFile); err != nil {
+		t.Errorf("Backing file of a published inline volume should survive GC: %v", err)
+	}
+
+	// One NodeUnpublishVolume never removed is deleted, whatever the policy
+	runner.output["losetup"] = ""
+	reclaimed, err := ns.garbageCollectVolumes(context.Background(), false)
+	if err != nil {
+		t.Fatalf("garbageCollectVolumes failed: %v", err)
+	}
+	if len(reclaimed) != 1 || reclaimed[0] != backingFile {
+		t.Errorf("expected %s reclaimed, got %v", backingFile, reclaimed)
+	}
+	if _, err := os.Stat(backingFile); !os.IsNotExist(err) {
+		t.Errorf("Leaked ephemeral backing file should be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(testDir, archiveDirName)); !os.IsNotExist(err) {
+		t.Errorf("Leaked ephemeral backing file should not be archived")
+	}
+}
+
+func TestNode_GarbageCollectVolumes_VolumeLocked(t *testing.T) {
+	testDir := t.TempDir()
+	volFile := filepath.Join(testDir, "vol-busy.img")
+	createAgedFile(t, volFile, time.Hour)
+
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+
+	// Simulate an in-flight NodeStageVolume holding the volume lock
+	if !ns.volumeLocks.TryAcquire("vol-busy") {
+		t.Fatalf("failed to acquire volume lock")
+	}
+	ns.garbageCollectVolumes(context.Background(), false)
+	if _, err := os.Stat(volFile); err != nil {
+		t.Errorf("File of a locked volume should survive GC: %v", err)
+	}
+
+	ns.volumeLocks.Release("vol-busy")
+	ns.garbageCollectVolumes(context.Background(), false)
+	if _, err := os.Stat(volFile); !os.IsNotExist(err) {
+		t.Errorf("File should be deleted once the volume lock is released")
+	}
+}
+
+// overlapRunner records how many commands run at the same time
+type overlapRunner struct {
+	mu       sync.Mutex
+	inFlight int
+	maxSeen  int
+	calls    int
+}
+
+func (r *overlapRunner) RunWithInput(ctx context.Context, input []byte, name string, args ...string) ([]byte, error) {
+	return r.Run(ctx, name, args...)
+}
+
+func (r *overlapRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	r.mu.Lock()
+	r.inFlight++
+	r.calls++
+	if r.inFlight > r.maxSeen {
+		r.maxSeen = r.inFlight
+	}
+	r.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	r.mu.Lock()
+	r.inFlight--
+	r.mu.Unlock()
+	return nil, nil
+}
+
+func TestNode_PublishVolume_Serialized(t *testing.T) {
+	testDir := t.TempDir()
+	runner := &overlapRunner{}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+
+	const publishes = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, publishes)
+	for i := 0; i < publishes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          "vol-race",
+				StagingTargetPath: filepath.Join(testDir, "staging"),
+				TargetPath:        filepath.Join(testDir, "target"),
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				},
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("NodePublishVolume failed: %v", err)
+		}
+	}
+	if runner.calls != publishes {
+		t.Errorf("expected %d bind mounts, got %d", publishes, runner.calls)
+	}
+	if runner.maxSeen != 1 {
+		t.Errorf("expected publishes of one volume to be serialized, saw %d overlapping", runner.maxSeen)
+	}
+}
+
+func TestNode_VolumeLocks_Acquire(t *testing.T) {
+	vl := NewVolumeLocks()
+	if err := vl.Acquire(context.Background(), "vol-a"); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if vl.TryAcquire("vol-a") {
+		t.Errorf("TryAcquire should fail while vol-a is held")
+	}
+
+	// A waiter gives up when its context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := vl.Acquire(ctx, "vol-a"); err == nil {
+		t.Errorf("expected Acquire to time out while vol-a is held")
+	}
+
+	// and proceeds once the holder releases the lock
+	acquired := make(chan error)
+	go func() { acquired <- vl.Acquire(context.Background(), "vol-a") }()
+	time.Sleep(10 * time.Millisecond)
+	vl.Release("vol-a")
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Errorf("Acquire failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Acquire did not return after Release")
+	}
+	vl.Release("vol-a")
+}
+
+func TestNode_GarbageCollectVolumes_RetainPolicy(t *testing.T) {
+	testDir := t.TempDir()
+	volFile := filepath.Join(testDir, "vol-retained.img")
+	createAgedFile(t, volFile, time.Hour)
+	archived := filepath.Join(testDir, archiveDirName, "vol-retained.img")
+
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.onDeletePolicy = OnDeletePolicyRetain
+	ns.garbageCollectVolumes(context.Background(), false)
+
+	if _, err := os.Stat(volFile); !os.IsNotExist(err) {
+		t.Errorf("Orphaned file should be moved out of the backing directory")
+	}
+	if _, err := os.Stat(archived); err != nil {
+		t.Fatalf("Orphaned file should be archived: %v", err)
+	}
+
+	// A second orphan of the same volume is left alone while an archive exists
+	createAgedFile(t, volFile, time.Hour)
+	ns.garbageCollectVolumes(context.Background(), false)
+	if _, err := os.Stat(volFile); err != nil {
+		t.Errorf("Orphaned file should be kept when its archive already exists: %v", err)
+	}
+
+	// ...unless replacing archived volumes is allowed
+	ns.removeArchivedVolumePath = true
+	ns.garbageCollectVolumes(context.Background(), false)
+	if _, err := os.Stat(volFile); !os.IsNotExist(err) {
+		t.Errorf("Orphaned file should replace the existing archive")
+	}
+	if _, err := os.Stat(archived); err != nil {
+		t.Errorf("Archived file should exist after replacement: %v", err)
+	}
+}
+
+func TestNode_StageVolume_LoopDeviceLimit(t *testing.T) {
+	testDir := t.TempDir()
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = &fakeRunner{fail: map[string]bool{"blkid": true}, output: map[string]string{"losetup": "/dev/loop7\n"}}
+	ns.sysBlockDir = filepath.Join(testDir, "sys")
+	ns.maxVolumesPerNode = 2
+	// loop0 is attached, loop1 was detached and kept by the kernel, sda is not a loop device
+	for _, dir := range []string{"loop0/loop", "loop1", "sda"} {
+		if err := os.MkdirAll(filepath.Join(ns.sysBlockDir, dir), 0750); err != nil {
+			t.Fatalf("failed to create %s: %v", dir, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(ns.sysBlockDir, "loop0", "loop", "backing_file"), []byte("/data/vol-a.img\n"), 0600); err != nil {
+		t.Fatalf("failed to create backing_file: %v", err)
+	}
+
+	stage := func(volumeID string) error {
+		_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: filepath.Join(testDir, volumeID, "staging"),
+			VolumeContext: map[string]string{
+				"backingFile": filepath.Join(testDir, volumeID+".img"),
+				"size":        "1048576",
+			},
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		})
+		return err
+	}
+	if err := stage("vol-b"); err != nil {
+		t.Fatalf("expected staging below the limit to succeed, got %v", err)
+	}
+
+	// The second attached loop device reaches the limit
+	if err := os.MkdirAll(filepath.Join(ns.sysBlockDir, "loop1", "loop"), 0750); err != nil {
+		t.Fatalf("failed to create loop1: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(ns.sysBlockDir, "loop1", "loop", "backing_file"), []byte("/data/vol-b.img\n"), 0600); err != nil {
+		t.Fatalf("failed to create backing_file: %v", err)
+	}
+	if err := stage("vol-c"); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted at the limit, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(testDir, "vol-c.img")); !os.IsNotExist(err) {
+		t.Errorf("backing file should not be created beyond the limit")
+	}
+}
+
+func TestNode_LoopDeviceLimit(t *testing.T) {
+	ns := NewNodeServer("test-node", "test-driver", t.TempDir(), nil)
+	ns.sysModuleDir = t.TempDir()
+	if limit := ns.loopDeviceLimit(); limit != 0 {
+		t.Errorf("expected no limit without the loop module, got %d", limit)
+	}
+
+	params := filepath.Join(ns.sysModuleDir, "loop", "parameters")
+	if err := os.MkdirAll(params, 0750); err != nil {
+		t.Fatalf("failed to create %s: %v", params, err)
+	}
+	for value, want := range map[string]int64{"64\n": 64, "0\n": 0, "bogus": 0} {
+		if err := os.WriteFile(filepath.Join(params, "max_loop"), []byte(value), 0600); err != nil {
+			t.Fatalf("failed to write max_loop: %v", err)
+		}
+		if limit := ns.loopDeviceLimit(); limit != want {
+			t.Errorf("max_loop %q: expected limit %d, got %d", value, want, limit)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package rawfile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// PreflightResult is the outcome of one node prerequisite check
+type PreflightResult struct {
+	Name string
+	// Err is nil when the check passed
+	Err error
+	// Optional checks cover features only some volumes use, such as
+	// encryption or qcow2; their failures are warnings
+	Optional bool
+}
+
+// CheckNode verifies that the node can stage volumes: the tools the node
+// plugin runs are installed, loop devices can be allocated and the backing
+// directories are writable. It catches broken node images before a volume
+// fails deep inside a pod's startup.
+func (d *Driver) CheckNode(ctx context.Context) []PreflightResult {
+	return d.newNodeServer().preflight(ctx)
+}
+
+// PreflightFailed reports whether any required check failed
+func PreflightFailed(results []PreflightResult) bool {
+	return slices.ContainsFunc(results, func(r PreflightResult) bool {
+		return r.Err != nil && !r.Optional
+	})
+}
+
+func (ns *NodeServer) preflight(ctx context.Context) []PreflightResult {
+	var results []PreflightResult
+	check := func(name string, optional bool, err error) {
+		results = append(results, PreflightResult{Name: name, Err: err, Optional: optional})
+	}
+
+	// Tools every volume of the default filesystem needs
+	required := []string{"losetup", "blkid", "mount", "umount", "mkfs." + ns.defaultFsType}
+	if ns.fsckOnMount {
+		if name, _ := fsckCommand("", ns.defaultFsType); name != "" {
+			required = append(required, name)
+		}
+	}
+	for _, tool := range required {
+		check("command "+tool, false, lookPath(tool))
+	}
+	// Tools for storage class parameters some volumes set
+	var optional []string
+	for _, fsType := range []string{"ext3", "ext4", "xfs", "btrfs"} {
+		if tool := "mkfs." + fsType; !slices.Contains(required, tool) {
+			optional = append(optional, tool)
+		}
+	}
+	optional = append(optional, "cryptsetup", "qemu-img", "qemu-nbd", "fallocate")
+	for _, tool := range optional {
+		check("command "+tool, true, lookPath(tool))
+	}
+
+	check("loop devices", false, ns.checkLoopDevices(ctx))
+	for _, dir := range ns.backingDirs() {
+		check("backing directory "+dir, false, checkWritable(dir))
+	}
+	return results
+}
+
+// Helper: find a command on PATH, with an error naming it
+func lookPath(name string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("%s not found in PATH", name)
+	}
+	return nil
+}
+
+// checkLoopDevices verifies that the kernel can hand out a free loop device
+func (ns *NodeServer) checkLoopDevices(ctx context.Context) error {
+	if _, err := os.Stat(filepath.Join(ns.devDir, "loop-control")); err != nil {
+		return fmt.Errorf("%s/loop-control is missing: load the loop module and mount the host /dev: %v", ns.devDir, err)
+	}
+	out, err := ns.runner.Run(ctx, "losetup", "-f")
+	if err != nil {
+		return fmt.Errorf("no free loop device: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	klog.V(4).Infof("Preflight: next free loop device %s", strings.TrimSpace(string(out)))
+	return nil
+}
@@ -0,0 +1,68 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNode_Preflight(t *testing.T) {
+	// A PATH holding only the tools of the default filesystem
+	binDir := t.TempDir()
+	for _, tool := range []string{"losetup", "blkid", "mount", "umount", "mkfs.ext4"} {
+		if err := os.WriteFile(filepath.Join(binDir, tool), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatalf("failed to create %s: %v", tool, err)
+		}
+	}
+	t.Setenv("PATH", binDir)
+
+	ns := NewNodeServer("test-node", "test-driver", t.TempDir(), fake.NewSimpleClientset())
+	runner := &fakeRunner{output: map[string]string{"losetup": "/dev/loop4\n"}}
+	ns.runner = runner
+	ns.devDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(ns.devDir, "loop-control"), nil, 0644); err != nil {
+		t.Fatalf("failed to create loop-control: %v", err)
+	}
+
+	results := ns.preflight(context.Background())
+	if PreflightFailed(results) {
+		t.Errorf("expected the required checks to pass, got %+v", results)
+	}
+	failed := map[string]bool{}
+	for _, r := range results {
+		if r.Err != nil {
+			failed[r.Name] = true
+		}
+	}
+	if !failed["command cryptsetup"] || !failed["command mkfs.xfs"] {
+		t.Errorf("expected missing optional tools to be reported, got %v", failed)
+	}
+	if len(runner.calls) != 1 || runner.calls[0] != "losetup -f" {
+		t.Errorf("expected losetup -f to find a free loop device, got %v", runner.calls)
+	}
+
+	// A missing mkfs for the default filesystem, loop-control and backing directory all fail
+	ns.defaultFsType = "xfs"
+	ns.backingDir = filepath.Join(t.TempDir(), "missing")
+	if err := os.Remove(filepath.Join(ns.devDir, "loop-control")); err != nil {
+		t.Fatalf("failed to remove loop-control: %v", err)
+	}
+	results = ns.preflight(context.Background())
+	if !PreflightFailed(results) {
+		t.Fatalf("expected the preflight to fail")
+	}
+	var required []string
+	for _, r := range results {
+		if r.Err != nil && !r.Optional {
+			required = append(required, r.Name)
+		}
+	}
+	want := "command mkfs.xfs,loop devices,backing directory " + ns.backingDir
+	if got := strings.Join(required, ","); got != want {
+		t.Errorf("expected failed checks %q, got %q", want, got)
+	}
+}
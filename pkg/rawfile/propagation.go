@@ -0,0 +1,93 @@
+package rawfile
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+)
+
+// mountPropagationParam is the storage class parameter, also recorded in the
+// volume context, setting the propagation of a volume's published mounts.
+// Pods mounting the volume with mountPropagation Bidirectional or
+// HostToContainer need shared or slave mounts to see nested mounts.
+const mountPropagationParam = "mountPropagation"
+
+// Mount propagation modes, applied recursively to the target path
+const (
+	mountPropagationShared  = "shared"
+	mountPropagationSlave   = "slave"
+	mountPropagationPrivate = "private"
+)
+
+// propagationMountFlags maps the mount flags of a volume capability that set
+// propagation to the mode they select. mount would apply them to the staged
+// filesystem, so they are kept out of the mount options.
+var propagationMountFlags = map[string]string{
+	"shared":   mountPropagationShared,
+	"rshared":  mountPropagationShared,
+	"slave":    mountPropagationSlave,
+	"rslave":   mountPropagationSlave,
+	"private":  mountPropagationPrivate,
+	"rprivate": mountPropagationPrivate,
+}
+
+// Helper: validate a mountPropagation parameter; empty keeps the default
+func validateMountPropagation(value string) error {
+	switch value {
+	case "", mountPropagationShared, mountPropagationSlave, mountPropagationPrivate:
+		return nil
+	}
+	return fmt.Errorf("invalid %s %q: must be %s, %s or %s", mountPropagationParam, value, mountPropagationShared, mountPropagationSlave, mountPropagationPrivate)
+}
+
+// Helper: separate the propagation flags from the other mount flags. The
+// last propagation flag wins; empty means none was given.
+func splitMountPropagation(flags []string) (string, []string) {
+	var propagation string
+	var rest []string
+	for _, flag := range flags {
+		for _, opt := range strings.Split(flag, ",") {
+			opt = strings.TrimSpace(opt)
+			if mode, ok := propagationMountFlags[opt]; ok {
+				propagation = mode
+				continue
+			}
+			if opt != "" {
+				rest = append(rest, opt)
+			}
+		}
+	}
+	return propagation, rest
+}
+
+// Helper: the mount flags of a capability without the propagation flags
+func capabilityMountFlags(capability *csi.VolumeCapability) []string {
+	_, flags := splitMountPropagation(capability.GetMount().GetMountFlags())
+	return flags
+}
+
+// publishPropagation returns the propagation a published filesystem volume
+// asks for: a propagation mount flag of its capability, or else the
+// mountPropagation of its volume context. Empty leaves the mount as it is.
+func publishPropagation(capability *csi.VolumeCapability, volumeContext map[string]string) string {
+	if capability.GetBlock() != nil {
+		return ""
+	}
+	if propagation, _ := splitMountPropagation(capability.GetMount().GetMountFlags()); propagation != "" {
+		return propagation
+	}
+	return volumeContext[mountPropagationParam]
+}
+
+// setMountPropagation applies propagation to the mount at target and every
+// mount below it
+func (ns *NodeServer) setMountPropagation(ctx context.Context, target, propagation string) error {
+	if propagation == "" {
+		return nil
+	}
+	klog.Infof("Setting %s mount propagation on %s", propagation, target)
+	return ns.runCommand(ctx, "mount", "--make-r"+propagation, target)
+}
@@ -0,0 +1,126 @@
+package rawfile
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSplitMountPropagation(t *testing.T) {
+	tests := []struct {
+		flags           []string
+		wantPropagation string
+		wantRest        []string
+	}{
+		{nil, "", nil},
+		{[]string{"noatime"}, "", []string{"noatime"}},
+		{[]string{"noatime,rshared", "nodev"}, mountPropagationShared, []string{"noatime", "nodev"}},
+		{[]string{"shared", "rslave"}, mountPropagationSlave, nil},
+		{[]string{"private"}, mountPropagationPrivate, nil},
+	}
+	for _, tt := range tests {
+		propagation, rest := splitMountPropagation(tt.flags)
+		if propagation != tt.wantPropagation || !slices.Equal(rest, tt.wantRest) {
+			t.Errorf("splitMountPropagation(%v) = %q, %v, want %q, %v", tt.flags, propagation, rest, tt.wantPropagation, tt.wantRest)
+		}
+	}
+}
+
+func TestNode_PublishVolume_MountPropagation(t *testing.T) {
+	// publish publishes a volume staged at staging to target, both returned
+	publish := func(t *testing.T, runner *fakeRunner, flags []string, volumeContext map[string]string) (string, string, error) {
+		t.Helper()
+		testDir := t.TempDir()
+		ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+		ns.runner = runner
+		staging, target := filepath.Join(testDir, "staging"), filepath.Join(testDir, "target")
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol-propagation",
+			StagingTargetPath: staging,
+			TargetPath:        target,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: flags}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+			VolumeContext: volumeContext,
+		})
+		return staging, target, err
+	}
+
+	tests := []struct {
+		name          string
+		flags         []string
+		volumeContext map[string]string
+		propagation   string
+	}{
+		{"Default", nil, nil, ""},
+		{"Parameter", nil, map[string]string{mountPropagationParam: "shared"}, "--make-rshared"},
+		{"MountFlagOverridesParameter", []string{"rslave"}, map[string]string{mountPropagationParam: "shared"}, "--make-rslave"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &fakeRunner{}
+			staging, target, err := publish(t, runner, tt.flags, tt.volumeContext)
+			if err != nil {
+				t.Fatalf("NodePublishVolume failed: %v", err)
+			}
+			// The propagation flag stays out of the bind mount's options
+			want := []string{"mount -o bind " + staging + " " + target}
+			if tt.propagation != "" {
+				want = append(want, "mount "+tt.propagation+" "+target)
+			}
+			if !slices.Equal(runner.calls, want) {
+				t.Errorf("expected %v, got %v", want, runner.calls)
+			}
+		})
+	}
+
+	t.Run("Failure", func(t *testing.T) {
+		runner := &fakeRunner{fail: map[string]bool{"mount --make-rshared": true}}
+		_, target, err := publish(t, runner, []string{"rshared"}, nil)
+		if status.Code(err) != codes.Internal {
+			t.Fatalf("expected Internal when setting the propagation fails, got %v", err)
+		}
+		if last := runner.calls[len(runner.calls)-1]; last != "umount "+target {
+			t.Errorf("expected the target to be unmounted after the failure, got %v", runner.calls)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		runner := &fakeRunner{}
+		_, _, err := publish(t, runner, nil, map[string]string{mountPropagationParam: "bidirectional"})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument for an unknown propagation, got %v", err)
+		}
+		if len(runner.calls) != 0 {
+			t.Errorf("expected nothing to be mounted, got %v", runner.calls)
+		}
+	})
+}
+
+func TestController_CreateVolume_MountPropagation(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", t.TempDir(), nil)
+	req := &csi.CreateVolumeRequest{
+		Name:          "testvol",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1048576},
+		Parameters:    map[string]string{mountPropagationParam: "slave"},
+	}
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if got := resp.Volume.VolumeContext[mountPropagationParam]; got != "slave" {
+		t.Errorf("expected mountPropagation slave in the volume context, got %q", got)
+	}
+
+	req.Name, req.Parameters = "testvol2", map[string]string{mountPropagationParam: "rshared"}
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for an unknown propagation, got %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package rawfile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	klog "k8s.io/klog/v2"
+)
+
+// backingFormatParam is the storage class parameter, also recorded in the
+// volume context, choosing the backing file format
+const backingFormatParam = "backingFormat"
+
+// Backing file formats. Raw files are attached with losetup, qcow2 files with qemu-nbd.
+const (
+	backingFormatRaw   = "raw"
+	backingFormatQcow2 = "qcow2"
+)
+
+// qcow2Magic starts every qcow2 image
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// backingFormatVolumeContext validates the backingFormat parameter of a
+// storage class and returns the entries to record in the volume context.
+// Raw, the default, records nothing.
+func backingFormatVolumeContext(params map[string]string, capabilities []*csi.VolumeCapability, contentSource *csi.VolumeContentSource) (map[string]string, error) {
+	switch format := params[backingFormatParam]; format {
+	case "", backingFormatRaw:
+		return nil, nil
+	case backingFormatQcow2:
+		if hasBlockCapability(capabilities) {
+			return nil, status.Error(codes.InvalidArgument, "qcow2 backing files are only supported for filesystem volumes")
+		}
+		if contentSource != nil {
+			return nil, status.Error(codes.InvalidArgument, "qcow2 volumes cannot be created from a volume content source")
+		}
+		return map[string]string{backingFormatParam: backingFormatQcow2}, nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported %s %q: must be %q or %q", backingFormatParam, format, backingFormatRaw, backingFormatQcow2)
+	}
+}
+
+// isQcow2 reports whether a volume asked for a qcow2 backing file
+func isQcow2(volumeContext map[string]string) bool {
+	return volumeContext[backingFormatParam] == backingFormatQcow2
+}
+
+// isQcow2File reports whether path holds a qcow2 image
+func isQcow2File(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, len(qcow2Magic))
+	if n, _ := f.Read(header); n < len(header) {
+		return false, nil
+	}
+	return bytes.Equal(header, qcow2Magic), nil
+}
+
+// qcow2Supported reports whether this node can attach qcow2 images: the qemu
+// tools must be installed and the nbd kernel module loaded
+func (ns *NodeServer) qcow2Supported(ctx context.Context) bool {
+	for _, tool := range []string{"qemu-img", "qemu-nbd"} {
+		if _, err := ns.runner.Run(ctx, tool, "--version"); err != nil {
+			klog.V(4).Infof("%s unavailable: %v", tool, err)
+			return false
+		}
+	}
+	if _, err := os.Stat(filepath.Join(ns.sysBlockDir, "nbd0")); err != nil {
+		klog.V(4).Infof("nbd devices unavailable: %v", err)
+		return false
+	}
+	return true
+}
+
+// useQcow2 decides whether a volume asking for qcow2 actually gets it. New
+// backing files fall back to raw when the node can't attach qcow2 images, and
+// existing files keep whatever format they were created with.
+func (ns *NodeServer) useQcow2(ctx context.Context, backingFile string) (bool, error) {
+	existing, err := isQcow2File(backingFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to read backing file %s: %v", backingFile, err)
+	}
+	exists := err == nil
+	if exists && !existing {
+		return false, nil // Created raw by an earlier fallback
+	}
+	if !ns.qcow2Supported(ctx) {
+		if exists {
+			return false, status.Errorf(codes.FailedPrecondition, "backing file %s is qcow2 but qemu-nbd or the nbd module is unavailable on this node", backingFile)
+		}
+		klog.Warningf("qemu tools or nbd module missing; creating %s as a raw backing file", backingFile)
+		return false, nil
+	}
+	return true, nil
+}
+
+// createQcow2File creates an empty qcow2 image with the given virtual size
+func (ns *NodeServer) createQcow2File(ctx context.Context, backingFile string, size int64) error {
+	if err := ns.runCommand(ctx, "qemu-img", "create", "-f", "qcow2", backingFile, fmt.Sprintf("%d", size)); err != nil {
+		return fmt.Errorf("failed to create qcow2 backing file: %v", err)
+	}
+	return nil
+}
+
+// attachNBD connects a qcow2 backing file to the first free nbd device
+func (ns *NodeServer) attachNBD(ctx context.Context, backingFile string) (string, error) {
+	// Serialize picking and connecting a device so concurrent stages don't race for it
+	ns.nbdMu.Lock()
+	defer ns.nbdMu.Unlock()
+
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("nbd%d", i)
+		if _, err := os.Stat(filepath.Join(ns.sysBlockDir, name)); err != nil {
+			return "", fmt.Errorf("no free nbd device for %s", backingFile)
+		}
+		// The pid file only exists while the device is connected
+		if _, err := os.Stat(filepath.Join(ns.sysBlockDir, name, "pid")); err == nil {
+			continue
+		}
+		device := "/dev/" + name
+		if err := ns.runCommand(ctx, "qemu-nbd", "--connect="+device, "--format=qcow2", backingFile); err != nil {
+			return "", fmt.Errorf("qemu-nbd failed for %s: %v", backingFile, err)
+		}
+		return device, nil
+	}
+}
+
+// detachNBD disconnects an nbd device, logging rather than returning failures
+func (ns *NodeServer) detachNBD(ctx context.Context, device string) {
+	klog.Infof("Disconnecting nbd device %s", device)
+	if err := ns.runCommand(ctx, "qemu-nbd", "--disconnect", device); err != nil {
+		klog.Errorf("Failed to disconnect nbd device %s: %v", device, err)
+	}
+}
+
+// findNBDDevice returns the nbd device backingFile is connected to, matching
+// the command line of the qemu-nbd process serving each connected device
+func (ns *NodeServer) findNBDDevice(backingFile string) (string, bool) {
+	entries, err := os.ReadDir(ns.sysBlockDir)
+	if err != nil {
+		return "", false
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "nbd") {
+			continue
+		}
+		pid, err := os.ReadFile(filepath.Join(ns.sysBlockDir, entry.Name(), "pid"))
+		if err != nil {
+			continue // Not connected
+		}
+		cmdline, err := os.ReadFile(filepath.Join(ns.procDir, strings.TrimSpace(string(pid)), "cmdline"))
+		if err != nil {
+			continue
+		}
+		for _, arg := range strings.Split(string(cmdline), "\x00") {
+			if arg == backingFile {
+				return "/dev/" + entry.Name(), true
+			}
+		}
+	}
+	return "", false
+}
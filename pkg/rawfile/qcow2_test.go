@@ -0,0 +1,173 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBackingFormatVolumeContext(t *testing.T) {
+	blockCaps := []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}}
+	clone := &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "vol-src"}}}
+
+	tests := []struct {
+		name     string
+		format   string
+		caps     []*csi.VolumeCapability
+		source   *csi.VolumeContentSource
+		wantCode codes.Code
+		wantQ    bool
+	}{
+		{"Default", "", nil, nil, codes.OK, false},
+		{"Raw", "raw", nil, nil, codes.OK, false},
+		{"Qcow2", "qcow2", nil, nil, codes.OK, true},
+		{"Unknown", "vmdk", nil, nil, codes.InvalidArgument, false},
+		{"Qcow2Block", "qcow2", blockCaps, nil, codes.InvalidArgument, false},
+		{"Qcow2Clone", "qcow2", nil, clone, codes.InvalidArgument, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := backingFormatVolumeContext(map[string]string{backingFormatParam: tt.format}, tt.caps, tt.source)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("expected %v, got %v", tt.wantCode, err)
+			}
+			if isQcow2(got) != tt.wantQ {
+				t.Errorf("expected qcow2=%v, got volume context %v", tt.wantQ, got)
+			}
+		})
+	}
+}
+
+// newQcow2TestNode returns a node server with a fake sysfs holding nbd0
+// (connected to backingFile) and a free nbd1
+func newQcow2TestNode(t *testing.T, testDir, backingFile string, runner *fakeRunner) *NodeServer {
+	t.Helper()
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+	ns.sysBlockDir = filepath.Join(testDir, "sys")
+	ns.procDir = filepath.Join(testDir, "proc")
+	for _, dir := range []string{
+		filepath.Join(ns.sysBlockDir, "nbd0"),
+		filepath.Join(ns.sysBlockDir, "nbd1"),
+		filepath.Join(ns.procDir, "4242"),
+		filepath.Join(ns.procDir, "self"),
+	} {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			t.Fatalf("failed to create %s: %v", dir, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(ns.sysBlockDir, "nbd0", "pid"), []byte("4242\n"), 0600); err != nil {
+		t.Fatalf("failed to write pid: %v", err)
+	}
+	cmdline := strings.Join([]string{"qemu-nbd", "--connect=/dev/nbd0", "--format=qcow2", backingFile}, "\x00") + "\x00"
+	if err := os.WriteFile(filepath.Join(ns.procDir, "4242", "cmdline"), []byte(cmdline), 0600); err != nil {
+		t.Fatalf("failed to write cmdline: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(ns.procDir, "self", "mountinfo"), nil, 0600); err != nil {
+		t.Fatalf("failed to write mountinfo: %v", err)
+	}
+	return ns
+}
+
+func TestNode_StageVolume_Qcow2(t *testing.T) {
+	stageReq := func(testDir string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-q",
+			StagingTargetPath: filepath.Join(testDir, "staging"),
+			VolumeContext: map[string]string{
+				"backingFile":      filepath.Join(testDir, "vol-q.img"),
+				"size":             "1048576",
+				backingFormatParam: backingFormatQcow2,
+			},
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		}
+	}
+	writeQcow2 := func(t *testing.T, path string) {
+		t.Helper()
+		if err := os.WriteFile(path, append(append([]byte{}, qcow2Magic...), make([]byte, 508)...), 0600); err != nil {
+			t.Fatalf("failed to write qcow2 header: %v", err)
+		}
+	}
+
+	t.Run("AttachesFreeNBD", func(t *testing.T) {
+		testDir := t.TempDir()
+		backingFile := filepath.Join(testDir, "vol-q.img")
+		writeQcow2(t, backingFile)
+		runner := &fakeRunner{fail: map[string]bool{"blkid": true, "mount": true}}
+		// nbd0 is busy serving another file
+		ns := newQcow2TestNode(t, testDir, filepath.Join(testDir, "vol-other.img"), runner)
+
+		if _, err := ns.NodeStageVolume(context.Background(), stageReq(testDir)); err == nil {
+			t.Fatalf("expected NodeStageVolume to fail when mount fails")
+		}
+		want := []string{
+			"qemu-img --version",
+			"qemu-nbd --version",
+			"qemu-nbd --connect=/dev/nbd1 --format=qcow2 " + backingFile,
+			"blkid -p -s TYPE -o value /dev/nbd1",
+			"mkfs.ext4 /dev/nbd1",
+			"mount -t ext4 /dev/nbd1 " + testDir + "/staging",
+			"qemu-nbd --disconnect /dev/nbd1",
+		}
+		if strings.Join(runner.calls, "\n") != strings.Join(want, "\n") {
+			t.Errorf("expected commands:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(runner.calls, "\n"))
+		}
+	})
+
+	t.Run("FallsBackToRaw", func(t *testing.T) {
+		testDir := t.TempDir()
+		runner := &fakeRunner{
+			fail:   map[string]bool{"qemu-nbd": true},
+			output: map[string]string{"losetup": "/dev/loop7\n", "blkid": "ext4\n"},
+		}
+		ns := newQcow2TestNode(t, testDir, "", runner)
+
+		if _, err := ns.NodeStageVolume(context.Background(), stageReq(testDir)); err != nil {
+			t.Fatalf("NodeStageVolume failed: %v", err)
+		}
+		if isQ, err := isQcow2File(filepath.Join(testDir, "vol-q.img")); err != nil || isQ {
+			t.Errorf("expected a raw backing file, got qcow2=%v (err: %v)", isQ, err)
+		}
+		if runner.calls[len(runner.calls)-3] != "losetup -f --show "+testDir+"/vol-q.img" {
+			t.Errorf("expected the raw file to be attached with losetup, got %v", runner.calls)
+		}
+	})
+
+	t.Run("ExistingQcow2WithoutTools", func(t *testing.T) {
+		testDir := t.TempDir()
+		writeQcow2(t, filepath.Join(testDir, "vol-q.img"))
+		ns := newQcow2TestNode(t, testDir, "", &fakeRunner{fail: map[string]bool{"qemu-img": true}})
+
+		if _, err := ns.NodeStageVolume(context.Background(), stageReq(testDir)); status.Code(err) != codes.FailedPrecondition {
+			t.Errorf("expected FailedPrecondition, got %v", err)
+		}
+	})
+}
+
+func TestNode_UnstageVolume_Qcow2(t *testing.T) {
+	testDir := t.TempDir()
+	runner := &fakeRunner{}
+	ns := newQcow2TestNode(t, testDir, filepath.Join(testDir, "vol-q.img"), runner)
+
+	if _, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "vol-q",
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+	}); err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %v", err)
+	}
+	want := []string{"qemu-nbd --disconnect /dev/nbd0"}
+	if strings.Join(runner.calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected commands %v, got %v", want, runner.calls)
+	}
+}
@@ -0,0 +1,228 @@
+package rawfile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// Mutable parameters of a VolumeAttributesClass. Both limits apply to reads
+// and writes separately; bandwidthLimit is a quantity of bytes per second.
+const (
+	iopsLimitParam      = "iopsLimit"
+	bandwidthLimitParam = "bandwidthLimit"
+)
+
+// PersistentVolume annotations, prefixed with the driver name, carrying the
+// limits set by ControllerModifyVolume. The volume context is immutable, so
+// limits given at creation live there and these take precedence.
+const (
+	iopsLimitAnnotation      = "/iops-limit"
+	bandwidthLimitAnnotation = "/bandwidth-limit"
+)
+
+// DefaultQoSCgroup is the cgroup v2 parent of the pods on nodes with the
+// systemd cgroup driver. Its io.max throttles the loop devices of volumes for
+// every pod using them.
+const DefaultQoSCgroup = "/sys/fs/cgroup/kubepods.slice"
+
+// ioLimits are the I/O throttles of a volume; zero means unlimited
+type ioLimits struct {
+	iops      int64
+	bandwidth int64
+}
+
+// parseIOLimits validates the mutable parameters of a volume, rejecting
+// anything but positive limits
+func parseIOLimits(params map[string]string) (ioLimits, error) {
+	var limits ioLimits
+	for key, value := range params {
+		switch key {
+		case iopsLimitParam:
+			iops, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || iops <= 0 {
+				return ioLimits{}, fmt.Errorf("invalid %s %q: must be a positive integer", key, value)
+			}
+			limits.iops = iops
+		case bandwidthLimitParam:
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil || quantity.Value() <= 0 {
+				return ioLimits{}, fmt.Errorf("invalid %s %q: must be a positive quantity of bytes per second, e.g. 100Mi", key, value)
+			}
+			limits.bandwidth = quantity.Value()
+		default:
+			return ioLimits{}, fmt.Errorf("unsupported mutable parameter %q (supported: %s, %s)", key, iopsLimitParam, bandwidthLimitParam)
+		}
+	}
+	return limits, nil
+}
+
+// ioMax formats the io.max line limiting device, given as major:minor.
+// Unset limits are written as "max", which also clears earlier ones.
+func (l ioLimits) ioMax(device string) string {
+	value := func(limit int64) string {
+		if limit <= 0 {
+			return "max"
+		}
+		return strconv.FormatInt(limit, 10)
+	}
+	iops, bandwidth := value(l.iops), value(l.bandwidth)
+	return fmt.Sprintf("%s riops=%s wiops=%s rbps=%s wbps=%s", device, iops, iops, bandwidth, bandwidth)
+}
+
+// hasLoopDevice reports whether the node attaches a volume through a loop
+// device, the only kind of volume whose I/O can be limited
+func hasLoopDevice(volumeContext map[string]string) bool {
+	switch volumeContext[backingModeParam] {
+	case backingModeSubvolume, backingModeTmpfs:
+		return false
+	}
+	return !isQcow2(volumeContext)
+}
+
+// modifyVolume records the limits of a VolumeAttributesClass on the volume's
+// PersistentVolume for its node to apply. Limits the class doesn't mention
+// keep their current value.
+func (cs *ControllerServer) modifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) error {
+	if req.VolumeId == "" {
+		return status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	limits, err := parseIOLimits(req.MutableParameters)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if cs.clientset == nil {
+		return status.Errorf(codes.FailedPrecondition, "Kubernetes clientset not configured - cannot record volume limits")
+	}
+
+	pv, err := cs.findPersistentVolume(ctx, req.VolumeId)
+	if err != nil {
+		return err
+	}
+	if !hasLoopDevice(pv.Spec.CSI.VolumeAttributes) {
+		return status.Errorf(codes.InvalidArgument, "volume %s has no loop device to limit", req.VolumeId)
+	}
+	annotations := map[string]string{}
+	if limits.iops > 0 {
+		annotations[cs.name+iopsLimitAnnotation] = strconv.FormatInt(limits.iops, 10)
+	}
+	if limits.bandwidth > 0 {
+		annotations[cs.name+bandwidthLimitAnnotation] = strconv.FormatInt(limits.bandwidth, 10)
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to encode volume limits: %v", err)
+	}
+	if _, err := cs.clientset.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return status.Errorf(codes.Internal, "failed to record limits of volume %s: %v", req.VolumeId, err)
+	}
+	klog.Infof("ControllerModifyVolume: %s limited to %v", req.VolumeId, req.MutableParameters)
+	return nil
+}
+
+// pvIOLimits returns the limits recorded for a volume, from its annotations
+// or else its volume context
+func (ns *NodeServer) pvIOLimits(pv *corev1.PersistentVolume) ioLimits {
+	var limits ioLimits
+	lookup := func(annotation, param string) int64 {
+		value, ok := pv.Annotations[ns.driverName+annotation]
+		if !ok {
+			value = pv.Spec.CSI.VolumeAttributes[param]
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit < 0 {
+			return 0
+		}
+		return limit
+	}
+	limits.iops = lookup(iopsLimitAnnotation, iopsLimitParam)
+	limits.bandwidth = lookup(bandwidthLimitAnnotation, bandwidthLimitParam)
+	return limits
+}
+
+// volumeIOLimits looks up the limits of a volume on its PersistentVolume
+func (ns *NodeServer) volumeIOLimits(ctx context.Context, volumeID string) (ioLimits, error) {
+	if ns.clientset == nil {
+		return ioLimits{}, fmt.Errorf("kubernetes clientset not configured")
+	}
+	// The volume handle is the name of the PersistentVolume
+	pv, err := ns.clientset.CoreV1().PersistentVolumes().Get(ctx, volumeID, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return ioLimits{}, nil
+	}
+	if err != nil {
+		return ioLimits{}, fmt.Errorf("failed to get PersistentVolume %s: %v", volumeID, err)
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != ns.driverName || pv.Spec.CSI.VolumeHandle != volumeID {
+		return ioLimits{}, nil
+	}
+	return ns.pvIOLimits(pv), nil
+}
+
+// reconcileIOLimits applies the current limits of a volume to its loop
+// device. It runs after staging and on every NodeGetVolumeStats, so limits
+// changed by ControllerModifyVolume take effect on kubelet's next stats
+// poll. Failures are logged and retried on the next poll.
+func (ns *NodeServer) reconcileIOLimits(ctx context.Context, volumeID string) {
+	if ns.qosCgroup == "" {
+		return
+	}
+	backingFile := ns.backingFilePath(volumeID)
+	loopDev, err := findLoopDevice(ctx, ns.runner, backingFile)
+	if err != nil || loopDev == "" {
+		klog.V(4).Infof("No loop device to limit for volume %s: %v", volumeID, err)
+		return
+	}
+	limits, err := ns.volumeIOLimits(ctx, volumeID)
+	if err != nil {
+		klog.Warningf("Failed to look up I/O limits of volume %s: %v", volumeID, err)
+		return
+	}
+	if err := ns.setIOLimits(loopDev, limits); err != nil {
+		klog.Warningf("Failed to apply I/O limits to volume %s: %v", volumeID, err)
+	}
+}
+
+// clearIOLimits removes the limits of a loop device before it is detached,
+// so they don't carry over to the next volume that gets the device
+func (ns *NodeServer) clearIOLimits(loopDev string) {
+	if ns.qosCgroup == "" {
+		return
+	}
+	if err := ns.setIOLimits(loopDev, ioLimits{}); err != nil {
+		klog.Warningf("Failed to clear I/O limits of %s: %v", loopDev, err)
+	}
+}
+
+// setIOLimits writes the io.max line of loopDev to the QoS cgroup
+func (ns *NodeServer) setIOLimits(loopDev string, limits ioLimits) error {
+	data, err := os.ReadFile(filepath.Join(ns.sysBlockDir, filepath.Base(loopDev), "dev"))
+	if err != nil {
+		return fmt.Errorf("failed to read device number of %s: %v", loopDev, err)
+	}
+	line := limits.ioMax(strings.TrimSpace(string(data)))
+	if err := os.WriteFile(filepath.Join(ns.qosCgroup, "io.max"), []byte(line), 0644); err != nil {
+		return fmt.Errorf("failed to write io.max of %s: %v", ns.qosCgroup, err)
+	}
+	klog.V(4).Infof("Set I/O limits of %s: %s", loopDev, line)
+	return nil
+}
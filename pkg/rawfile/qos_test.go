@@ -0,0 +1,189 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseIOLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    ioLimits
+		wantErr bool
+	}{
+		{"none", nil, ioLimits{}, false},
+		{"both", map[string]string{iopsLimitParam: "500", bandwidthLimitParam: "10Mi"}, ioLimits{iops: 500, bandwidth: 10 << 20}, false},
+		{"zero iops", map[string]string{iopsLimitParam: "0"}, ioLimits{}, true},
+		{"negative bandwidth", map[string]string{bandwidthLimitParam: "-1Mi"}, ioLimits{}, true},
+		{"fractional iops", map[string]string{iopsLimitParam: "1.5"}, ioLimits{}, true},
+		{"unknown parameter", map[string]string{"throughput": "1"}, ioLimits{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseIOLimits(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseIOLimits(%v) error = %v, wantErr %v", tt.params, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseIOLimits(%v) = %+v, want %+v", tt.params, got, tt.want)
+			}
+		})
+	}
+
+	if got, want := (ioLimits{iops: 100}).ioMax("7:3"), "7:3 riops=100 wiops=100 rbps=max wbps=max"; got != want {
+		t.Errorf("ioMax = %q, want %q", got, want)
+	}
+}
+
+func qosTestPV(volumeID string, annotations, attributes map[string]string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: volumeID, Annotations: annotations},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "test-driver", VolumeHandle: volumeID, VolumeAttributes: attributes},
+			},
+		},
+	}
+}
+
+func TestController_ModifyVolume(t *testing.T) {
+	clientset := fake.NewSimpleClientset(qosTestPV("vol-qos", nil, nil))
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", "/tmp/my-csi-driver", clientset)
+	req := &csi.ControllerModifyVolumeRequest{
+		VolumeId:          "vol-qos",
+		MutableParameters: map[string]string{iopsLimitParam: "200", bandwidthLimitParam: "1Mi"},
+	}
+
+	// Without --enable-volume-qos the RPC stays unimplemented
+	if _, err := cs.ControllerModifyVolume(context.Background(), req); status.Code(err) != codes.Unimplemented {
+		t.Errorf("expected Unimplemented with QoS disabled, got %v", err)
+	}
+
+	cs.qosEnabled = true
+	caps, err := cs.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("ControllerGetCapabilities failed: %v", err)
+	}
+	found := false
+	for _, c := range caps.Capabilities {
+		if c.GetRpc().GetType() == csi.ControllerServiceCapability_RPC_MODIFY_VOLUME {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected MODIFY_VOLUME to be advertised with QoS enabled")
+	}
+
+	if _, err := cs.ControllerModifyVolume(context.Background(), req); err != nil {
+		t.Fatalf("ControllerModifyVolume failed: %v", err)
+	}
+	pv, err := clientset.CoreV1().PersistentVolumes().Get(context.Background(), "vol-qos", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get PV: %v", err)
+	}
+	if pv.Annotations["test-driver"+iopsLimitAnnotation] != "200" || pv.Annotations["test-driver"+bandwidthLimitAnnotation] != "1048576" {
+		t.Errorf("expected the limits to be recorded on the PV, got %v", pv.Annotations)
+	}
+
+	req.MutableParameters = map[string]string{iopsLimitParam: "lots"}
+	if _, err := cs.ControllerModifyVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for an invalid limit, got %v", err)
+	}
+	req.VolumeId, req.MutableParameters = "vol-missing", map[string]string{iopsLimitParam: "10"}
+	if _, err := cs.ControllerModifyVolume(context.Background(), req); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for an unknown volume, got %v", err)
+	}
+}
+
+func TestController_CreateVolume_MutableParameters(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", "/tmp/my-csi-driver", nil)
+	req := &csi.CreateVolumeRequest{
+		Name:              "testvol",
+		CapacityRange:     &csi.CapacityRange{RequiredBytes: 1048576},
+		MutableParameters: map[string]string{iopsLimitParam: "100"},
+	}
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for mutable parameters with QoS disabled, got %v", err)
+	}
+
+	cs.qosEnabled = true
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if got := resp.Volume.VolumeContext[iopsLimitParam]; got != "100" {
+		t.Errorf("expected iopsLimit 100 in the volume context, got %q", got)
+	}
+}
+
+func TestNode_VolumeIOLimits(t *testing.T) {
+	pv := qosTestPV("vol-qos", nil, map[string]string{iopsLimitParam: "100"})
+	ns := NewNodeServer("test-node", "test-driver", t.TempDir(), fake.NewSimpleClientset(pv))
+
+	limits, err := ns.volumeIOLimits(context.Background(), "vol-qos")
+	if err != nil {
+		t.Fatalf("volumeIOLimits failed: %v", err)
+	}
+	if limits.iops != 100 {
+		t.Errorf("expected iops limit 100, got %d", limits.iops)
+	}
+
+	// A volume without a PersistentVolume, such as an inline one, has no limits
+	limits, err = ns.volumeIOLimits(context.Background(), "vol-missing")
+	if err != nil || limits != (ioLimits{}) {
+		t.Errorf("expected no limits for a missing volume, got %+v, %v", limits, err)
+	}
+}
+
+func TestNode_ReconcileIOLimits(t *testing.T) {
+	testDir := t.TempDir()
+	backingFile := filepath.Join(testDir, "vol-qos.img")
+	createAgedFile(t, backingFile, 0)
+
+	// The annotation set by ControllerModifyVolume overrides the creation-time limit
+	pv := qosTestPV("vol-qos",
+		map[string]string{"test-driver" + iopsLimitAnnotation: "300"},
+		map[string]string{"backingFile": backingFile, iopsLimitParam: "100", bandwidthLimitParam: "2048"})
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset(pv))
+	ns.runner = &fakeRunner{output: map[string]string{"losetup": "/dev/loop3: [64769]:1234 (" + backingFile + ")\n"}}
+	ns.sysBlockDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(ns.sysBlockDir, "loop3"), 0755); err != nil {
+		t.Fatalf("failed to create sys block dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(ns.sysBlockDir, "loop3", "dev"), []byte("7:3\n"), 0644); err != nil {
+		t.Fatalf("failed to write device number: %v", err)
+	}
+	ioMax := filepath.Join(t.TempDir(), "io.max")
+
+	// Disabled: nothing is written
+	ns.reconcileIOLimits(context.Background(), "vol-qos")
+	ns.qosCgroup = filepath.Dir(ioMax)
+	if _, err := os.Stat(ioMax); !os.IsNotExist(err) {
+		t.Fatalf("expected no io.max write with QoS disabled")
+	}
+
+	ns.reconcileIOLimits(context.Background(), "vol-qos")
+	data, err := os.ReadFile(ioMax)
+	if err != nil {
+		t.Fatalf("failed to read io.max: %v", err)
+	}
+	if got, want := string(data), "7:3 riops=300 wiops=300 rbps=2048 wbps=2048"; got != want {
+		t.Errorf("io.max = %q, want %q", got, want)
+	}
+
+	ns.clearIOLimits("/dev/loop3")
+	data, _ = os.ReadFile(ioMax)
+	if got, want := string(data), "7:3 riops=max wiops=max rbps=max wbps=max"; got != want {
+		t.Errorf("io.max after clearing = %q, want %q", got, want)
+	}
+}
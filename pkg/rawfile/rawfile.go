@@ -2,50 +2,171 @@ package rawfile
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"os"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 )
 
 // DriverOptions defines driver parameters specified in driver deployment
 type DriverOptions struct {
+	// Version, GitCommit and BuildDate describe the build; Version defaults to "dev"
+	Version                      string
+	GitCommit                    string
+	BuildDate                    string
 	NodeID                       string
 	DriverName                   string
 	Endpoint                     string
 	MountPermissions             uint64
+	MaxVolumesPerNode            int64
 	BackingDir                   string
+	ExtraBackingDirs             []string
+	BackingDirPermissions        uint64
+	BackingDirUID                int
+	BackingDirGID                int
 	Mode                         string
 	DefaultOnDeletePolicy        string
 	VolStatsCacheExpireInMinutes int
 	RemoveArchivedVolumePath     bool
 	UseTarCommandInSnapshot      bool
+	MinVolumeSize                int64
+	MaxVolumeSize                int64
+	SizeRounding                 string
+	AllowedTopologies            []string
+	TopologyPolicy               string
+	ReservedCapacity             int64
+	FsckOnMount                  bool
+	DefaultFsType                string
+	NodePublishTimeout           time.Duration
+	LogOmitVolumeContext         bool
+	GCGracePeriod                time.Duration
+	GCMaxOrphanRatio             float64
+	GCInterval                   time.Duration
+	GCDisabled                   bool
+	LoopDeviceReconcileInterval  time.Duration
+	DetachLeakedLoopDevices      bool
+	CapacityReportInterval       time.Duration
+	EnableCapacityPublishing     bool
+	CapacityNamespace            string
+	EnableAttach                 bool
+	EnableVolumeQoS              bool
+	QoSCgroup                    string
 	Clientset                    kubernetes.Interface
+	Interceptors                 []grpc.UnaryServerInterceptor
+	GCObserver                   GCObserver
+	LoopDeviceObserver           LoopDeviceObserver
 }
 
 type Driver struct {
-	name       string
-	nodeID     string
-	version    string
-	endpoint   string
-	backingDir string
-	mode       string
-	clientset  kubernetes.Interface
+	name          string
+	nodeID        string
+	version       string
+	gitCommit     string
+	buildDate     string
+	endpoint      string
+	backingDir    string
+	extraDirs     []string
+	mode          string
+	minVolumeSize int64
+	maxVolumeSize int64
+	sizeRounding  string
+	gcGracePeriod time.Duration
+	gcMaxOrphans  float64
+	gcInterval    time.Duration
+	gcDisabled    bool
+	enableAttach  bool
+	volumeQoS     bool
+	qosCgroup     string
+	clientset     kubernetes.Interface
+	interceptors  []grpc.UnaryServerInterceptor
+	gcObserver    GCObserver
+
+	onDeletePolicy           string
+	removeArchivedVolumePath bool
+	mountPermissions         uint64
+	backingDirPermissions    uint64
+	backingDirUID            int
+	backingDirGID            int
+	maxVolumesPerNode        int64
+	reservedCapacity         int64
+	capacityReportInterval   time.Duration
+	capacityPublishing       bool
+	capacityNamespace        string
+	fsckOnMount              bool
+	defaultFsType            string
+	loopReconcileInterval    time.Duration
+	detachLeakedLoops        bool
+	loopDeviceObserver       LoopDeviceObserver
+	allowedNodes             []string
+	topologyPolicy           string
+	publishTimeout           time.Duration
+
+	server   NonBlockingGRPCServer
+	gcCtx    context.Context
+	cancelGC context.CancelFunc
 }
 
 func NewDriver(options *DriverOptions) *Driver {
 	klog.V(2).Infof("Driver: rawfile")
 
 	d := &Driver{
-		name:       options.DriverName,
-		version:    "dev",
-		nodeID:     options.NodeID,
-		endpoint:   options.Endpoint,
-		backingDir: options.BackingDir,
-		mode:       options.Mode,
-		clientset:  options.Clientset,
+		name:          options.DriverName,
+		version:       options.Version,
+		gitCommit:     options.GitCommit,
+		buildDate:     options.BuildDate,
+		nodeID:        options.NodeID,
+		endpoint:      options.Endpoint,
+		backingDir:    options.BackingDir,
+		extraDirs:     options.ExtraBackingDirs,
+		mode:          options.Mode,
+		minVolumeSize: options.MinVolumeSize,
+		maxVolumeSize: options.MaxVolumeSize,
+		sizeRounding:  options.SizeRounding,
+		gcGracePeriod: options.GCGracePeriod,
+		gcMaxOrphans:  options.GCMaxOrphanRatio,
+		gcInterval:    options.GCInterval,
+		gcDisabled:    options.GCDisabled,
+		enableAttach:  options.EnableAttach,
+		volumeQoS:     options.EnableVolumeQoS,
+		qosCgroup:     options.QoSCgroup,
+		clientset:     options.Clientset,
+		interceptors:  options.Interceptors,
+		gcObserver:    options.GCObserver,
+
+		onDeletePolicy:           options.DefaultOnDeletePolicy,
+		removeArchivedVolumePath: options.RemoveArchivedVolumePath,
+		mountPermissions:         options.MountPermissions,
+		backingDirPermissions:    options.BackingDirPermissions,
+		backingDirUID:            options.BackingDirUID,
+		backingDirGID:            options.BackingDirGID,
+		maxVolumesPerNode:        options.MaxVolumesPerNode,
+		reservedCapacity:         options.ReservedCapacity,
+		capacityReportInterval:   options.CapacityReportInterval,
+		capacityPublishing:       options.EnableCapacityPublishing,
+		capacityNamespace:        options.CapacityNamespace,
+		fsckOnMount:              options.FsckOnMount,
+		defaultFsType:            options.DefaultFsType,
+		loopReconcileInterval:    options.LoopDeviceReconcileInterval,
+		detachLeakedLoops:        options.DetachLeakedLoopDevices,
+		loopDeviceObserver:       options.LoopDeviceObserver,
+		allowedNodes:             options.AllowedTopologies,
+		topologyPolicy:           options.TopologyPolicy,
+		publishTimeout:           options.NodePublishTimeout,
+	}
+
+	if d.version == "" {
+		d.version = "dev"
+	}
+	if d.gcInterval <= 0 {
+		d.gcInterval = DefaultGCInterval
 	}
+	d.server = newNonBlockingGRPCServer(options.LogOmitVolumeContext, d.interceptors...)
+	d.gcCtx, d.cancelGC = context.WithCancel(context.Background())
 
 	return d
 }
@@ -54,24 +175,174 @@ func (d *Driver) Run(testMode bool) {
 
 	klog.V(2).Infof("Starting CSI driver %s at %s", d.name, d.endpoint)
 
-	s := NewNonBlockingGRPCServer()
+	s := d.server
 
 	// Decide which servers to run based on mode
 	var csServer csi.ControllerServer
 	var nsServer *NodeServer
 	if d.mode == "controller" || d.mode == "both" {
-		csServer = NewControllerServerWithBackingDir(d.name, d.version, d.backingDir, d.clientset)
+		cs := NewControllerServerWithBackingDir(d.name, d.version, d.backingDir, d.clientset)
+		cs.minVolumeSize = d.minVolumeSize
+		cs.maxVolumeSize = d.maxVolumeSize
+		cs.sizeRounding = d.sizeRounding
+		cs.allowedNodes = d.allowedNodes
+		cs.topologyPolicy = d.topologyPolicy
+		cs.reservedCapacity = d.reservedCapacity
+		cs.extraBackingDirs = d.extraDirs
+		cs.attachEnabled = d.enableAttach
+		cs.qosEnabled = d.volumeQoS
+		if d.clientset == nil {
+			cs.volumes = newFileVolumeStore(cs.backingDir)
+		}
+		if d.capacityPublishing {
+			if d.clientset == nil {
+				klog.Warningf("Capacity publishing disabled: Kubernetes clientset not configured")
+			} else {
+				go cs.RunCapacityPublisher(d.gcCtx, d.capacityNamespace, DefaultCapacityPublishInterval)
+			}
+		}
+		csServer = cs
 	}
 	if d.mode == "node" || d.mode == "both" {
-		nsServer = NewNodeServer(d.nodeID, d.name, d.backingDir, d.clientset)
+		nsServer = d.newNodeServer()
 		// Start garbage collector in a goroutine
-		go nsServer.RunGarbageCollector(context.Background(), 5*time.Minute)
+		if d.gcDisabled {
+			klog.Infof("Garbage collector disabled")
+		} else {
+			go nsServer.RunGarbageCollector(d.gcCtx, d.gcInterval)
+		}
+		if d.clientset != nil {
+			nsServer.recorder = newEventRecorder(d.clientset, d.name, d.nodeID)
+			go nsServer.RunVolumeHealthReporter(d.gcCtx, DefaultVolumeHealthInterval)
+			if d.capacityReportInterval > 0 {
+				go nsServer.RunCapacityReporter(d.gcCtx, d.capacityReportInterval)
+			}
+		}
+		if d.loopReconcileInterval > 0 {
+			go nsServer.RunLoopDeviceReconciler(d.gcCtx, d.loopReconcileInterval)
+		} else {
+			klog.Infof("Loop device reconciler disabled")
+		}
 	}
 
+	ids := NewIdentityServer(d.name, d.version)
+	ids.backingDirs = append([]string{d.backingDir}, d.extraDirs...)
+	ids.clientset = d.clientset
+	ids.gitCommit = d.gitCommit
+	ids.buildDate = d.buildDate
+
 	s.Start(d.endpoint,
-		NewIdentityServer(d.name, d.version),
+		ids,
 		csServer,
 		nsServer,
 		testMode)
 	s.Wait()
 }
+
+// newNodeServer returns a node server configured from the driver options
+func (d *Driver) newNodeServer() *NodeServer {
+	ns := NewNodeServer(d.nodeID, d.name, d.backingDir, d.clientset)
+	if d.gcGracePeriod > 0 {
+		ns.gcGracePeriod = d.gcGracePeriod
+	}
+	ns.gcMaxOrphanRatio = d.gcMaxOrphans
+	ns.gcObserver = d.gcObserver
+	ns.detachLeakedLoopDevices = d.detachLeakedLoops
+	ns.loopDeviceObserver = d.loopDeviceObserver
+	if d.onDeletePolicy != "" {
+		ns.onDeletePolicy = d.onDeletePolicy
+	}
+	ns.removeArchivedVolumePath = d.removeArchivedVolumePath
+	ns.mountPermissions = os.FileMode(d.mountPermissions)
+	ns.minVolumeSize = d.minVolumeSize
+	ns.maxVolumeSize = d.maxVolumeSize
+	ns.maxVolumesPerNode = d.maxVolumesPerNode
+	if ns.maxVolumesPerNode == 0 {
+		// Without a configured limit, stop at the kernel's loop device count if it has one
+		ns.maxVolumesPerNode = ns.loopDeviceLimit()
+		if ns.maxVolumesPerNode > 0 {
+			klog.Infof("Limiting volumes per node to the %d loop devices configured by max_loop", ns.maxVolumesPerNode)
+		}
+	}
+	ns.reservedCapacity = d.reservedCapacity
+	ns.extraBackingDirs = d.extraDirs
+	ns.fsckOnMount = d.fsckOnMount
+	if d.defaultFsType != "" {
+		ns.defaultFsType = d.defaultFsType
+	}
+	ns.publishTimeout = d.publishTimeout
+	if d.volumeQoS {
+		ns.qosCgroup = d.qosCgroup
+		if ns.qosCgroup == "" {
+			ns.qosCgroup = DefaultQoSCgroup
+		}
+	}
+	return ns
+}
+
+// GarbageCollectOnce runs a single garbage collection pass over the backing
+// directories with the driver's grace period and on-delete policy, without
+// starting the CSI server. It returns the orphaned backing files that were
+// deleted or archived, or with dryRun set, those that would have been.
+func (d *Driver) GarbageCollectOnce(ctx context.Context, dryRun bool) ([]string, error) {
+	return d.newNodeServer().garbageCollectVolumes(ctx, dryRun)
+}
+
+// PrepareBackingDirs creates missing backing directories, applies the
+// configured mode and ownership and checks that they are writable, so a
+// misconfigured directory stops the driver at startup rather than failing the
+// first volume.
+func (d *Driver) PrepareBackingDirs() error {
+	for _, dir := range append([]string{d.backingDir}, d.extraDirs...) {
+		if err := prepareBackingDir(dir, os.FileMode(d.backingDirPermissions), d.backingDirUID, d.backingDirGID); err != nil {
+			return err
+		}
+		if err := checkWritable(dir); err != nil {
+			return fmt.Errorf("backing directory %s not writable: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// Ready reports an error unless the gRPC endpoint accepts connections and the
+// backing directories are writable. It backs the /readyz endpoint.
+func (d *Driver) Ready() error {
+	proto, addr, err := parseEndpoint(d.endpoint)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout(proto, addr, time.Second)
+	if err != nil {
+		return fmt.Errorf("CSI endpoint %s not listening: %v", d.endpoint, err)
+	}
+	conn.Close()
+
+	for _, dir := range append([]string{d.backingDir}, d.extraDirs...) {
+		if err := checkWritable(dir); err != nil {
+			return fmt.Errorf("backing directory %s not writable: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// Stop cancels the garbage collector and gracefully stops the gRPC server,
+// letting in-flight RPCs finish. If they have not finished within timeout the
+// server is stopped forcefully. Run returns once the server has stopped.
+func (d *Driver) Stop(timeout time.Duration) {
+	klog.Infof("Stopping CSI driver %s", d.name)
+	d.cancelGC()
+
+	stopped := make(chan struct{})
+	go func() {
+		d.server.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		klog.Warningf("In-flight requests did not finish within %v, forcing gRPC server stop", timeout)
+		d.server.ForceStop()
+		<-stopped
+	}
+}
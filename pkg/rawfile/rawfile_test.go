@@ -0,0 +1,111 @@
+package rawfile
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDriver_Stop(t *testing.T) {
+	d := NewDriver(&DriverOptions{
+		NodeID:     "test-node",
+		DriverName: "test-driver",
+		Endpoint:   "unix://" + filepath.Join(t.TempDir(), "csi.sock"),
+		BackingDir: t.TempDir(),
+		Mode:       "controller",
+	})
+
+	done := make(chan struct{})
+	go func() {
+		d.Run(false)
+		close(done)
+	}()
+
+	// Wait for the gRPC server to be created before stopping it
+	deadline := time.Now().Add(5 * time.Second)
+	for d.server.(*nonBlockingGRPCServer).getServer() == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("gRPC server was not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	d.Stop(time.Second)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after Stop")
+	}
+	if d.gcCtx.Err() == nil {
+		t.Errorf("Expected the garbage collector context to be cancelled")
+	}
+}
+
+func TestDriver_Ready(t *testing.T) {
+	// Reserve a free port for the TCP endpoint
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %v", err)
+	}
+	tcpEndpoint := "tcp://" + l.Addr().String()
+	l.Close()
+
+	for name, endpoint := range map[string]string{
+		"unix": "unix://" + filepath.Join(t.TempDir(), "csi.sock"),
+		"tcp":  tcpEndpoint,
+	} {
+		t.Run(name, func(t *testing.T) {
+			backingDir := t.TempDir()
+			d := NewDriver(&DriverOptions{
+				NodeID:     "test-node",
+				DriverName: "test-driver",
+				Endpoint:   endpoint,
+				BackingDir: backingDir,
+				Mode:       "controller",
+			})
+
+			// Not serving yet
+			if err := d.Ready(); err == nil {
+				t.Fatalf("expected Ready to fail before the gRPC server is listening")
+			}
+
+			done := make(chan struct{})
+			go func() {
+				d.Run(false)
+				close(done)
+			}()
+			defer func() {
+				d.Stop(time.Second)
+				<-done
+			}()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for d.Ready() != nil {
+				if time.Now().After(deadline) {
+					t.Fatalf("driver did not become ready: %v", d.Ready())
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			// The probe file is cleaned up
+			entries, err := os.ReadDir(backingDir)
+			if err != nil {
+				t.Fatalf("failed to read backing dir: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("expected empty backing dir after Ready, found %d entries", len(entries))
+			}
+
+			// A missing backing directory makes the driver unready
+			if err := os.RemoveAll(backingDir); err != nil {
+				t.Fatalf("failed to remove backing dir: %v", err)
+			}
+			if err := d.Ready(); err == nil {
+				t.Errorf("expected Ready to fail without a writable backing directory")
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -12,6 +13,8 @@ import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"k8s.io/klog/v2"
 )
 
@@ -27,14 +30,25 @@ type NonBlockingGRPCServer interface {
 	ForceStop()
 }
 
-func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
-	return &nonBlockingGRPCServer{}
+// NewNonBlockingGRPCServer creates a server; interceptors run after request logging.
+func NewNonBlockingGRPCServer(interceptors ...grpc.UnaryServerInterceptor) NonBlockingGRPCServer {
+	return newNonBlockingGRPCServer(false, interceptors...)
+}
+
+// newNonBlockingGRPCServer creates a server whose request logging masks
+// volume context values when omitVolumeContext is set.
+func newNonBlockingGRPCServer(omitVolumeContext bool, interceptors ...grpc.UnaryServerInterceptor) *nonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{interceptors: interceptors, omitVolumeContext: omitVolumeContext}
 }
 
 // NonBlocking server
 type nonBlockingGRPCServer struct {
-	wg     sync.WaitGroup
-	server *grpc.Server
+	wg           sync.WaitGroup
+	mu           sync.Mutex
+	server       *grpc.Server
+	interceptors []grpc.UnaryServerInterceptor
+	// omitVolumeContext masks volume context values in logged requests and responses
+	omitVolumeContext bool
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer, testMode bool) {
@@ -49,11 +63,21 @@ func (s *nonBlockingGRPCServer) Wait() {
 }
 
 func (s *nonBlockingGRPCServer) Stop() {
-	s.server.GracefulStop()
+	if server := s.getServer(); server != nil {
+		server.GracefulStop()
+	}
 }
 
 func (s *nonBlockingGRPCServer) ForceStop() {
-	s.server.Stop()
+	if server := s.getServer(); server != nil {
+		server.Stop()
+	}
+}
+
+func (s *nonBlockingGRPCServer) getServer() *grpc.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server
 }
 
 func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer, testMode bool) {
@@ -63,10 +87,10 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		klog.Fatal(err.Error())
 	}
 
+	// Only unix endpoints need a directory and leave a stale socket file behind
 	if proto == "unix" {
-		addr = "/" + addr
-		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
-			klog.Fatalf("Failed to remove %s, error: %v", addr, err)
+		if err := prepareUnixSocket(addr); err != nil {
+			klog.Fatalf("Failed to prepare socket %s: %v", addr, err)
 		}
 	}
 
@@ -76,10 +100,12 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	}
 
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.ChainUnaryInterceptor(append([]grpc.UnaryServerInterceptor{s.logGRPC}, s.interceptors...)...),
 	}
 	server := grpc.NewServer(opts...)
+	s.mu.Lock()
 	s.server = server
+	s.mu.Unlock()
 
 	if ids != nil {
 		csi.RegisterIdentityServer(server, ids)
@@ -98,8 +124,11 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 			// make sure Serve() is called
 			s.wg.Wait()
 			time.Sleep(time.Millisecond * 1000)
-			s.server.GracefulStop()
+			server.GracefulStop()
 		}()
+	} else {
+		// Release Wait() once the server is stopped
+		defer s.wg.Done()
 	}
 
 	klog.Infof("Listening for connections on address: %#v", listener.Addr())
@@ -108,16 +137,73 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	if err != nil {
 		klog.Fatalf("Failed to serve grpc server: %v", err)
 	}
+	klog.Infof("Stopped serving on address: %#v", listener.Addr())
+}
+
+// parseEndpoint splits a CSI endpoint into the network and address to listen
+// on. unix://path and tcp://host:port are accepted with the scheme in any
+// case; a bare path is a unix socket. Unix socket paths are always absolute,
+// so unix://tmp/csi.sock and unix:///tmp/csi.sock name the same socket.
+// ValidateEndpoint checks that ep is a unix socket path or tcp host:port the
+// server can listen on
+func ValidateEndpoint(ep string) error {
+	proto, addr, err := parseEndpoint(ep)
+	if err != nil {
+		return err
+	}
+	if proto == "unix" && len(addr) > maxUnixSocketPath {
+		return fmt.Errorf("invalid endpoint %q: socket path is %d bytes, more than the %d unix sockets allow", ep, len(addr), maxUnixSocketPath)
+	}
+	return nil
+}
+
+// maxUnixSocketPath is the longest socket path that fits sun_path on Linux
+const maxUnixSocketPath = 107
+
+// prepareUnixSocket creates the directory of a unix socket, e.g. the plugin
+// directory under /var/lib/kubelet/plugins on first boot, and removes a
+// socket left behind by a previous run. Anything else at the path is kept.
+func prepareUnixSocket(addr string) error {
+	if len(addr) > maxUnixSocketPath {
+		return fmt.Errorf("socket path is %d bytes, more than the %d unix sockets allow", len(addr), maxUnixSocketPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(addr), 0750); err != nil {
+		return fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	fi, err := os.Lstat(addr)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", addr)
+	}
+	return os.Remove(addr)
 }
 
 func parseEndpoint(ep string) (string, string, error) {
-	if strings.HasPrefix(strings.ToLower(ep), "unix://") || strings.HasPrefix(strings.ToLower(ep), "tcp://") {
-		s := strings.SplitN(ep, "://", 2)
-		if s[1] != "" {
-			return s[0], s[1], nil
+	scheme, addr, found := strings.Cut(ep, "://")
+	if !found {
+		scheme, addr = "unix", ep
+	}
+	switch strings.ToLower(scheme) {
+	case "unix":
+		if addr == "" || addr == "/" {
+			return "", "", fmt.Errorf("invalid endpoint %q: missing socket path", ep)
+		}
+		if !strings.HasPrefix(addr, "/") {
+			addr = "/" + addr
+		}
+		return "unix", addr, nil
+	case "tcp":
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", "", fmt.Errorf("invalid endpoint %q: %v", ep, err)
 		}
+		return "tcp", addr, nil
 	}
-	return "", "", fmt.Errorf("Invalid endpoint: %v", ep)
+	return "", "", fmt.Errorf("invalid endpoint %q: scheme must be unix or tcp", ep)
 }
 
 func getLogLevel(method string) int32 {
@@ -129,16 +215,61 @@ func getLogLevel(method string) int32 {
 	return 2
 }
 
-func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+func (s *nonBlockingGRPCServer) logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	level := klog.Level(getLogLevel(info.FullMethod))
-	klog.V(level).Infof("GRPC call: %s", info.FullMethod)
-	klog.V(level).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	klog.V(level).InfoS("GRPC call", "method", info.FullMethod)
+	klog.V(level).InfoS("GRPC request", "method", info.FullMethod, "request", s.sanitize(req))
 
 	resp, err := handler(ctx, req)
 	if err != nil {
-		klog.Errorf("GRPC error: %v", err)
+		klog.ErrorS(err, "GRPC error", "method", info.FullMethod)
 	} else {
-		klog.V(level).Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
+		klog.V(level).InfoS("GRPC response", "method", info.FullMethod, "response", s.sanitize(resp))
 	}
 	return resp, err
 }
+
+// sanitize strips secrets from a request or response for logging and, with
+// omitVolumeContext, masks volume context values such as backing file paths
+func (s *nonBlockingGRPCServer) sanitize(msg interface{}) fmt.Stringer {
+	if m, ok := msg.(proto.Message); ok && s.omitVolumeContext {
+		m = proto.Clone(m)
+		maskVolumeContext(m.ProtoReflect())
+		msg = m
+	}
+	return protosanitizer.StripSecrets(msg)
+}
+
+// maskedValue replaces masked volume context values, matching protosanitizer
+const maskedValue = "***stripped***"
+
+// maskVolumeContext replaces the values of every volume_context map in m,
+// including those of nested messages such as CreateVolumeResponse.Volume
+func maskVolumeContext(m protoreflect.Message) {
+	m.Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.Name() == "volume_context" {
+				ctx := m.Mutable(fd).Map()
+				var keys []protoreflect.MapKey
+				ctx.Range(func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+					keys = append(keys, k)
+					return true
+				})
+				for _, k := range keys {
+					ctx.Set(k, protoreflect.ValueOfString(maskedValue))
+				}
+			}
+		case fd.IsList():
+			if fd.Message() != nil {
+				list := m.Mutable(fd).List()
+				for i := 0; i < list.Len(); i++ {
+					maskVolumeContext(list.Get(i).Message())
+				}
+			}
+		case fd.Message() != nil:
+			maskVolumeContext(m.Mutable(fd).Message())
+		}
+		return true
+	})
+}
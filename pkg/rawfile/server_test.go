@@ -0,0 +1,124 @@
+package rawfile
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestServer_SanitizeVolumeContext(t *testing.T) {
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:      "vol-log",
+		Secrets:       map[string]string{"key": "hunter2"},
+		VolumeContext: map[string]string{"backingFile": "/var/lib/my-csi-driver/vol-log.img"},
+	}
+	resp := &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      "vol-log",
+			VolumeContext: map[string]string{"encryptionKeySecretName": "tenant-key"},
+		},
+	}
+
+	plain := newNonBlockingGRPCServer(false)
+	if got := plain.sanitize(req).String(); !strings.Contains(got, "vol-log.img") || strings.Contains(got, "hunter2") {
+		t.Errorf("expected volume context kept and secrets stripped, got %s", got)
+	}
+
+	omit := newNonBlockingGRPCServer(true)
+	for _, msg := range []interface{}{req, resp} {
+		got := omit.sanitize(msg).String()
+		if strings.Contains(got, "vol-log.img") || strings.Contains(got, "tenant-key") || strings.Contains(got, "hunter2") {
+			t.Errorf("expected volume context values masked, got %s", got)
+		}
+		if !strings.Contains(got, "vol-log") || !strings.Contains(got, maskedValue) {
+			t.Errorf("expected volume ID and masked keys to remain, got %s", got)
+		}
+	}
+
+	// Masking works on a copy; the handler still sees the real values
+	if req.VolumeContext["backingFile"] != "/var/lib/my-csi-driver/vol-log.img" {
+		t.Errorf("sanitize modified the request: %v", req.VolumeContext)
+	}
+	if resp.Volume.VolumeContext["encryptionKeySecretName"] != "tenant-key" {
+		t.Errorf("sanitize modified the response: %v", resp.Volume.VolumeContext)
+	}
+}
+
+func TestServer_ParseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint  string
+		wantProto string
+		wantAddr  string
+		wantErr   bool
+	}{
+		{endpoint: "unix:///var/lib/kubelet/plugins/my-csi-driver/csi.sock", wantProto: "unix", wantAddr: "/var/lib/kubelet/plugins/my-csi-driver/csi.sock"},
+		{endpoint: "unix://tmp/csi.sock", wantProto: "unix", wantAddr: "/tmp/csi.sock"},
+		{endpoint: "UNIX:///tmp/csi.sock", wantProto: "unix", wantAddr: "/tmp/csi.sock"},
+		{endpoint: "/tmp/csi.sock", wantProto: "unix", wantAddr: "/tmp/csi.sock"},
+		{endpoint: "tcp://127.0.0.1:10000", wantProto: "tcp", wantAddr: "127.0.0.1:10000"},
+		{endpoint: "TCP://:10000", wantProto: "tcp", wantAddr: ":10000"},
+		{endpoint: "tcp://[::1]:10000", wantProto: "tcp", wantAddr: "[::1]:10000"},
+		{endpoint: "tcp://localhost", wantErr: true},
+		{endpoint: "unix://", wantErr: true},
+		{endpoint: "", wantErr: true},
+		{endpoint: "http://127.0.0.1:10000", wantErr: true},
+	}
+	for _, tt := range tests {
+		proto, addr, err := parseEndpoint(tt.endpoint)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseEndpoint(%q): expected error %v, got %v", tt.endpoint, tt.wantErr, err)
+			continue
+		}
+		if proto != tt.wantProto || addr != tt.wantAddr {
+			t.Errorf("parseEndpoint(%q) = %q, %q; want %q, %q", tt.endpoint, proto, addr, tt.wantProto, tt.wantAddr)
+		}
+	}
+}
+
+func TestServer_PrepareUnixSocket(t *testing.T) {
+	// The plugin directory doesn't exist yet on first boot
+	addr := filepath.Join(t.TempDir(), "plugins", "my-csi-driver", "csi.sock")
+	if err := prepareUnixSocket(addr); err != nil {
+		t.Fatalf("prepareUnixSocket failed: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Dir(addr)); err != nil || !fi.IsDir() {
+		t.Fatalf("expected the socket directory to be created: %v", err)
+	}
+
+	// A socket left behind by a previous run is removed
+	listener, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", addr, err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if err := prepareUnixSocket(addr); err != nil {
+		t.Fatalf("prepareUnixSocket failed: %v", err)
+	}
+	if _, err := os.Lstat(addr); !os.IsNotExist(err) {
+		t.Errorf("expected the stale socket to be removed, got %v", err)
+	}
+
+	// Anything else at the path is left alone
+	if err := os.WriteFile(addr, []byte("data"), 0600); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	if err := prepareUnixSocket(addr); err == nil {
+		t.Errorf("expected an error for a regular file at the socket path")
+	}
+	if _, err := os.Stat(addr); err != nil {
+		t.Errorf("expected the regular file to be kept: %v", err)
+	}
+
+	long := "unix:///" + strings.Repeat("a", maxUnixSocketPath) + ".sock"
+	if err := ValidateEndpoint(long); err == nil {
+		t.Errorf("expected an error for a socket path longer than %d bytes", maxUnixSocketPath)
+	}
+	if err := ValidateEndpoint("unix:///var/lib/kubelet/plugins/my-csi-driver/csi.sock"); err != nil {
+		t.Errorf("ValidateEndpoint failed: %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package rawfile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// backingModeParam is the storage class parameter, also recorded in the volume
+// context, choosing the backend that provides a volume on the node
+const backingModeParam = "backingMode"
+
+// Backing modes. File volumes are loop-mounted backing files, subvolume
+// volumes btrfs subvolumes of the backing directory bind-mounted directly and
+// tmpfs volumes size-limited tmpfs mounts, held in memory.
+const (
+	backingModeFile      = "file"
+	backingModeSubvolume = "subvolume"
+	backingModeTmpfs     = "tmpfs"
+)
+
+// subvolumeSuffix names the subvolume of a volume in its backing directory,
+// next to the .img files of file volumes
+const subvolumeSuffix = ".subvol"
+
+// backingModeVolumeContext validates the backingMode parameter of a storage
+// class and returns the entries to record in the volume context. Subvolumes
+// and tmpfs volumes hold a directory tree, not a device, so they can't be
+// block volumes or use the parameters that shape the backing file or its
+// filesystem.
+func backingModeVolumeContext(params map[string]string, capabilities []*csi.VolumeCapability) (map[string]string, error) {
+	switch mode := params[backingModeParam]; mode {
+	case "", backingModeFile:
+		return nil, nil
+	case backingModeSubvolume, backingModeTmpfs:
+		if hasBlockCapability(capabilities) {
+			return nil, status.Errorf(codes.InvalidArgument, "%s %s is only supported for filesystem volumes", backingModeParam, mode)
+		}
+		for _, param := range []string{"fsType", "mkfsOptions", fsLabelParam, encryptedParam, backingFormatParam, preallocateParam} {
+			if _, ok := params[param]; ok {
+				return nil, status.Errorf(codes.InvalidArgument, "%s is not supported with %s %s", param, backingModeParam, mode)
+			}
+		}
+		return map[string]string{backingModeParam: mode}, nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported %s %q: must be %s, %s or %s", backingModeParam, mode, backingModeFile, backingModeSubvolume, backingModeTmpfs)
+	}
+}
+
+// subvolumePath returns where the subvolume of a volume lives: where the
+// volume context records it, or wherever it was placed among the extra
+// backing directories
+func (ns *NodeServer) subvolumePath(volumeID string) string {
+	subvolume, _ := ns.findBackingFile(filepath.Join(ns.backingDir, volumeID+subvolumeSuffix))
+	return subvolume
+}
+
+// subvolumeBackend keeps each volume in a btrfs subvolume of the backing
+// directory, bind-mounted at the staging path, for nodes whose backing
+// filesystem is btrfs. Space is only limited by a qgroup when quotas are
+// enabled on the filesystem. Clones are snapshots of the source subvolume.
+type subvolumeBackend struct {
+	ns *NodeServer
+}
+
+func (b *subvolumeBackend) Stage(ctx context.Context, req *csi.NodeStageVolumeRequest, volCtx VolumeContext) error {
+	ns := b.ns
+	if req.VolumeCapability.GetBlock() != nil {
+		return status.Errorf(codes.InvalidArgument, "%s %s is only supported for filesystem volumes", backingModeParam, backingModeSubvolume)
+	}
+
+	// Already staged: nothing to do (idempotent)
+	if mounted, err := b.ns.isMountPoint(req.StagingTargetPath); err != nil {
+		return status.Errorf(codes.Internal, "failed to check staging path %s: %v", req.StagingTargetPath, err)
+	} else if mounted {
+		return nil
+	}
+	if err := ns.makeMountDir(req.StagingTargetPath); err != nil {
+		return toStatus(err)
+	}
+
+	subvolume := volCtx.BackingFile
+	if err := ns.validateBackingFile(subvolume); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if existing, ok := ns.findBackingFile(subvolume); ok {
+		subvolume = existing
+	} else {
+		subvolume = ns.placeBackingFile(subvolume)
+		size := volumeSize(volCtx, subvolume)
+		if err := b.create(ctx, subvolume, size, volCtx.CloneSourceFile); err != nil {
+			return err
+		}
+		ns.recordVolumeEvent(ctx, req.VolumeId, req.VolumeContext, corev1.EventTypeNormal, eventReasonBackingFileCreated, "Created subvolume %s (%d bytes) on node %s", subvolume, size, ns.nodeID)
+	}
+	klog.Infof("NodeStageVolume subvolume: %s", subvolume)
+
+	readOnly := isReadOnlyAccessMode(req.VolumeCapability.GetAccessMode().GetMode())
+	var options []string
+	if readOnly {
+		options = append(options, "ro")
+	}
+	options = mergeMountOptions(options, capabilityMountFlags(req.VolumeCapability))
+	if err := ns.bindMount(ctx, subvolume, req.StagingTargetPath, options); err != nil {
+		return status.Errorf(codes.Internal, "failed to bind mount subvolume: %v", err)
+	}
+
+	if !readOnly {
+		return ns.applyMountPermissions(ctx, req.StagingTargetPath)
+	}
+	return nil
+}
+
+// create makes the subvolume of a new volume, as a snapshot of sourceFile for
+// clones, and limits it to size bytes
+func (b *subvolumeBackend) create(ctx context.Context, subvolume string, size int64, sourceFile string) error {
+	ns := b.ns
+	if err := ns.checkReservedCapacity(filepath.Dir(subvolume), size); err != nil {
+		return err
+	}
+	if sourceFile != "" {
+		if err := ns.validateBackingFile(sourceFile); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid clone source: %v", err)
+		}
+		source, ok := ns.findBackingFile(sourceFile)
+		if !ok {
+			return status.Errorf(codes.NotFound, "clone source %s not found on node %s", sourceFile, ns.nodeID)
+		}
+		if err := ns.runCommand(ctx, "btrfs", "subvolume", "snapshot", source, subvolume); err != nil {
+			return status.Errorf(codes.Internal, "failed to snapshot subvolume %s: %v", source, err)
+		}
+	} else if err := ns.runCommand(ctx, "btrfs", "subvolume", "create", subvolume); err != nil {
+		return status.Errorf(codes.Internal, "failed to create subvolume: %v", err)
+	}
+	if err := ns.runCommand(ctx, "btrfs", "qgroup", "limit", strconv.FormatInt(size, 10), subvolume); err != nil {
+		klog.Warningf("Subvolume %s is not limited to %d bytes, are quotas enabled on its filesystem? %v", subvolume, size, err)
+	}
+	return nil
+}
+
+func (b *subvolumeBackend) Unstage(ctx context.Context, req *csi.NodeUnstageVolumeRequest) error {
+	mounted, err := b.ns.isMountPoint(req.StagingTargetPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to check staging path %s: %v", req.StagingTargetPath, err)
+	}
+	if mounted {
+		if err := b.ns.runCommand(ctx, "umount", req.StagingTargetPath); err != nil {
+			return status.Errorf(codes.Internal, "failed to unmount: %v", err)
+		}
+	}
+	return nil
+}
+
+func (b *subvolumeBackend) Remove(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	return b.ns.runCommand(ctx, "btrfs", "subvolume", "delete", path)
+}
+
+// Stats reports the usage of the subvolume from its qgroup: the bytes it
+// references against its limit. statfs would describe the whole btrfs
+// filesystem, so without quotas or a limit the usage is left out as unknown.
+// The subvolume is healthy while it exists and has not been remounted read-only.
+func (b *subvolumeBackend) Stats(ctx context.Context, volumeID, volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	resp := &csi.NodeGetVolumeStatsResponse{VolumeCondition: b.condition(volumeID, volumePath)}
+	used, limit, err := b.qgroupUsage(ctx, volumePath)
+	if err != nil {
+		klog.V(4).Infof("Usage of subvolume volume %s unknown: %v", volumeID, err)
+		return resp, nil
+	}
+	resp.Usage = []*csi.VolumeUsage{{
+		Unit:      csi.VolumeUsage_BYTES,
+		Total:     limit,
+		Used:      used,
+		Available: max(limit-used, 0),
+	}}
+	return resp, nil
+}
+
+// qgroupUsage returns the bytes referenced by the subvolume at path and its
+// qgroup limit, from the level 0 qgroup btrfs keeps for every subvolume
+func (b *subvolumeBackend) qgroupUsage(ctx context.Context, path string) (int64, int64, error) {
+	out, err := b.ns.runner.Run(ctx, "btrfs", "qgroup", "show", "-rF", "--raw", path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("btrfs qgroup show failed, are quotas enabled? %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	// Columns: qgroupid rfer excl max_rfer, where max_rfer is "none" without a limit
+	for _, line := range SplitLines(string(out)) {
+		fields := SplitFields(line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "0/") {
+			continue
+		}
+		used, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid referenced bytes %q of qgroup %s", fields[1], fields[0])
+		}
+		limit, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("qgroup %s has no size limit", fields[0])
+		}
+		return used, limit, nil
+	}
+	return 0, 0, fmt.Errorf("no qgroup found for %s", path)
+}
+
+func (b *subvolumeBackend) condition(volumeID, volumePath string) *csi.VolumeCondition {
+	subvolume := b.ns.subvolumePath(volumeID)
+	if _, err := os.Stat(subvolume); err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("subvolume %s is not accessible: %v", subvolume, err)}
+	}
+	if data, err := os.ReadFile(filepath.Join(b.ns.procDir, "self", "mountinfo")); err == nil && remountedReadOnly(string(data), volumePath) {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("filesystem at %s was remounted read-only, likely after I/O errors", volumePath)}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+}
@@ -0,0 +1,241 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBackingModeVolumeContext(t *testing.T) {
+	mount := []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}}
+	block := []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}}
+	tests := []struct {
+		name         string
+		params       map[string]string
+		capabilities []*csi.VolumeCapability
+		want         map[string]string
+		wantCode     codes.Code
+	}{
+		{name: "Default", params: map[string]string{}, capabilities: mount},
+		{name: "File", params: map[string]string{backingModeParam: "file"}, capabilities: block},
+		{
+			name:         "Subvolume",
+			params:       map[string]string{backingModeParam: "subvolume"},
+			capabilities: mount,
+			want:         map[string]string{backingModeParam: "subvolume"},
+		},
+		{name: "SubvolumeBlock", params: map[string]string{backingModeParam: "subvolume"}, capabilities: block, wantCode: codes.InvalidArgument},
+		{name: "SubvolumeFsType", params: map[string]string{backingModeParam: "subvolume", "fsType": "xfs"}, capabilities: mount, wantCode: codes.InvalidArgument},
+		{name: "SubvolumeEncrypted", params: map[string]string{backingModeParam: "subvolume", encryptedParam: "true"}, capabilities: mount, wantCode: codes.InvalidArgument},
+		{
+			name:         "Tmpfs",
+			params:       map[string]string{backingModeParam: "tmpfs"},
+			capabilities: mount,
+			want:         map[string]string{backingModeParam: "tmpfs"},
+		},
+		{name: "TmpfsPreallocate", params: map[string]string{backingModeParam: "tmpfs", preallocateParam: "true"}, capabilities: mount, wantCode: codes.InvalidArgument},
+		{name: "Unknown", params: map[string]string{backingModeParam: "zvol"}, capabilities: mount, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := backingModeVolumeContext(tt.params, tt.capabilities)
+			if status.Code(err) != tt.wantCode {
+				t.Fatalf("expected %v, got %v", tt.wantCode, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNode_StageVolume_Subvolume(t *testing.T) {
+	testDir := t.TempDir()
+	source := filepath.Join(testDir, "vol-source"+subvolumeSuffix)
+	if err := os.Mkdir(source, 0750); err != nil {
+		t.Fatalf("failed to create source subvolume: %v", err)
+	}
+	stage := func(volumeID string, volumeContext map[string]string, capability *csi.VolumeCapability) ([]string, error) {
+		runner := &fakeRunner{}
+		ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+		ns.runner = runner
+		volumeContext["backingFile"] = filepath.Join(testDir, volumeID+subvolumeSuffix)
+		volumeContext[backingModeParam] = backingModeSubvolume
+		_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: filepath.Join(testDir, "staging-"+volumeID),
+			VolumeContext:     volumeContext,
+			VolumeCapability:  capability,
+		})
+		calls := make([]string, len(runner.calls))
+		for i, call := range runner.calls {
+			calls[i] = strings.ReplaceAll(call, testDir, "$DIR")
+		}
+		return calls, err
+	}
+	mount := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	calls, err := stage("vol-new", map[string]string{"size": "1048576"}, mount)
+	if err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	want := []string{
+		"btrfs subvolume create $DIR/vol-new.subvol",
+		"btrfs qgroup limit 1048576 $DIR/vol-new.subvol",
+		"mount -o bind $DIR/vol-new.subvol $DIR/staging-vol-new",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected %v, got %v", want, calls)
+	}
+
+	// Clones start as a snapshot of the source subvolume
+	calls, err = stage("vol-clone", map[string]string{"size": "1048576", "cloneSourceFile": source}, mount)
+	if err != nil {
+		t.Fatalf("NodeStageVolume of a clone failed: %v", err)
+	}
+	if len(calls) == 0 || calls[0] != "btrfs subvolume snapshot $DIR/vol-source.subvol $DIR/vol-clone.subvol" {
+		t.Errorf("expected the clone snapshotted from its source, got %v", calls)
+	}
+
+	// An existing subvolume is only bind-mounted
+	calls, err = stage("vol-source", map[string]string{"size": "1048576"}, mount)
+	if err != nil {
+		t.Fatalf("NodeStageVolume of an existing subvolume failed: %v", err)
+	}
+	if want := []string{"mount -o bind $DIR/vol-source.subvol $DIR/staging-vol-source"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected %v, got %v", want, calls)
+	}
+
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	if _, err := stage("vol-block", map[string]string{}, block); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a block subvolume, got %v", err)
+	}
+}
+
+func TestNode_UnstageVolume_Subvolume(t *testing.T) {
+	testDir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(testDir, "vol-sub"+subvolumeSuffix), 0750); err != nil {
+		t.Fatalf("failed to create subvolume: %v", err)
+	}
+	runner := &fakeRunner{}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+
+	if _, ok := ns.stagedBackend("vol-sub", filepath.Join(testDir, "staging")).(*subvolumeBackend); !ok {
+		t.Fatalf("expected the subvolume backend for vol-sub")
+	}
+	if _, ok := ns.stagedBackend("vol-file", filepath.Join(testDir, "staging")).(*loopFileBackend); !ok {
+		t.Fatalf("expected the loop file backend for vol-file")
+	}
+	if _, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "vol-sub",
+		StagingTargetPath: filepath.Join(testDir, "staging"),
+	}); err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %v", err)
+	}
+	// Nothing was mounted and there is no device to look for
+	if len(runner.calls) != 0 {
+		t.Errorf("expected no commands, got %v", runner.calls)
+	}
+}
+
+func TestNode_GarbageCollectVolumes_Subvolume(t *testing.T) {
+	testDir := t.TempDir()
+	orphaned := filepath.Join(testDir, "vol-orphaned"+subvolumeSuffix)
+	if err := os.Mkdir(orphaned, 0750); err != nil {
+		t.Fatalf("failed to create subvolume: %v", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(orphaned, old, old); err != nil {
+		t.Fatalf("failed to age subvolume: %v", err)
+	}
+	runner := &fakeRunner{}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+
+	reclaimed, err := ns.garbageCollectVolumes(context.Background(), false)
+	if err != nil {
+		t.Fatalf("garbageCollectVolumes failed: %v", err)
+	}
+	if len(reclaimed) != 1 || reclaimed[0] != orphaned {
+		t.Errorf("expected %s reclaimed, got %v", orphaned, reclaimed)
+	}
+	if want := []string{"btrfs subvolume delete " + orphaned}; !reflect.DeepEqual(runner.calls, want) {
+		t.Errorf("expected %v, got %v", want, runner.calls)
+	}
+}
+
+func TestSubvolumeBackend_Stats(t *testing.T) {
+	testDir := t.TempDir()
+	subvolume := filepath.Join(testDir, "vol-sub"+subvolumeSuffix)
+	if err := os.Mkdir(subvolume, 0750); err != nil {
+		t.Fatalf("failed to create subvolume: %v", err)
+	}
+	header := "qgroupid         rfer         excl     max_rfer \n--------         ----         ----     -------- \n"
+	tests := []struct {
+		name      string
+		runner    *fakeRunner
+		wantUsage []*csi.VolumeUsage
+	}{
+		{
+			name:      "Limited",
+			runner:    &fakeRunner{output: map[string]string{"btrfs": header + "0/257         16384        16384      1048576 \n1/100         16384        16384         none \n"}},
+			wantUsage: []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 1048576, Used: 16384, Available: 1048576 - 16384}},
+		},
+		// The usage of the whole filesystem would be wrong, so it is unknown
+		{name: "NoLimit", runner: &fakeRunner{output: map[string]string{"btrfs": header + "0/257         16384        16384         none \n"}}},
+		{name: "QuotasDisabled", runner: &fakeRunner{fail: map[string]bool{"btrfs": true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns := NewNodeServer("test-node", "test-driver", testDir, nil)
+			ns.runner = tt.runner
+			resp, err := ns.backends[backingModeSubvolume].Stats(context.Background(), "vol-sub", subvolume)
+			if err != nil {
+				t.Fatalf("Stats failed: %v", err)
+			}
+			if !reflect.DeepEqual(resp.Usage, tt.wantUsage) {
+				t.Errorf("expected usage %v, got %v", tt.wantUsage, resp.Usage)
+			}
+			if resp.VolumeCondition.GetAbnormal() {
+				t.Errorf("expected a healthy subvolume, got %v", resp.VolumeCondition)
+			}
+			if want := "btrfs qgroup show -rF --raw " + subvolume; tt.runner.calls[0] != want {
+				t.Errorf("expected %q, got %v", want, tt.runner.calls)
+			}
+		})
+	}
+}
+
+func TestController_CreateVolume_Subvolume(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", "/tmp/my-csi-driver", nil)
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "testvol",
+		Parameters: map[string]string{backingModeParam: backingModeSubvolume},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	volumeContext := resp.Volume.VolumeContext
+	if want := "/tmp/my-csi-driver/" + resp.Volume.VolumeId + subvolumeSuffix; volumeContext["backingFile"] != want {
+		t.Errorf("expected backing file %s, got %s", want, volumeContext["backingFile"])
+	}
+	if volumeContext[backingModeParam] != backingModeSubvolume {
+		t.Errorf("expected %s recorded in the volume context, got %v", backingModeParam, volumeContext)
+	}
+}
@@ -0,0 +1,112 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// tmpfsBackend keeps each volume in a tmpfs mounted at the staging path and
+// limited to the volume size, for CI and cache workloads that want RAM
+// speed. Nothing is written to the backing directory: the data lives only
+// as long as the mount and is lost when the volume is unstaged or the node
+// reboots, and the garbage collector and metrics never see the volume.
+type tmpfsBackend struct {
+	ns *NodeServer
+}
+
+func (b *tmpfsBackend) Stage(ctx context.Context, req *csi.NodeStageVolumeRequest, volCtx VolumeContext) error {
+	ns := b.ns
+	if req.VolumeCapability.GetBlock() != nil {
+		return status.Errorf(codes.InvalidArgument, "%s %s is only supported for filesystem volumes", backingModeParam, backingModeTmpfs)
+	}
+	// Without a limit tmpfs would take half the node's memory
+	if volCtx.Size <= 0 {
+		return status.Errorf(codes.InvalidArgument, "%s %s volume %s has no size in its volume context", backingModeParam, backingModeTmpfs, req.VolumeId)
+	}
+
+	// Already staged: nothing to do (idempotent)
+	if mounted, err := b.ns.isMountPoint(req.StagingTargetPath); err != nil {
+		return status.Errorf(codes.Internal, "failed to check staging path %s: %v", req.StagingTargetPath, err)
+	} else if mounted {
+		return nil
+	}
+	if err := ns.makeMountDir(req.StagingTargetPath); err != nil {
+		return toStatus(err)
+	}
+
+	options := mergeMountOptions([]string{"size=" + strconv.FormatInt(volCtx.Size, 10)}, capabilityMountFlags(req.VolumeCapability))
+	if err := ns.runCommand(ctx, "mount", "-t", "tmpfs", "-o", strings.Join(options, ","), "tmpfs", req.StagingTargetPath); err != nil {
+		return status.Errorf(codes.Internal, "failed to mount tmpfs: %v", err)
+	}
+	klog.Infof("NodeStageVolume tmpfs: %s (%d bytes)", req.StagingTargetPath, volCtx.Size)
+
+	return ns.applyMountPermissions(ctx, req.StagingTargetPath)
+}
+
+func (b *tmpfsBackend) Unstage(ctx context.Context, req *csi.NodeUnstageVolumeRequest) error {
+	mounted, err := b.ns.isMountPoint(req.StagingTargetPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to check staging path %s: %v", req.StagingTargetPath, err)
+	}
+	if mounted {
+		if err := b.ns.runCommand(ctx, "umount", req.StagingTargetPath); err != nil {
+			return status.Errorf(codes.Internal, "failed to unmount: %v", err)
+		}
+	}
+	return nil
+}
+
+// Remove has nothing to delete: tmpfs volumes leave no files behind
+func (b *tmpfsBackend) Remove(ctx context.Context, path string) error {
+	return nil
+}
+
+func (b *tmpfsBackend) Stats(ctx context.Context, volumeID, volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	usage, err := statfsUsage(volumePath)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"},
+	}, nil
+}
+
+// isTmpfsMount reports whether a tmpfs is mounted at path, directly or
+// bind-mounted from the staging path
+func (ns *NodeServer) isTmpfsMount(path string) bool {
+	data, err := os.ReadFile(filepath.Join(ns.procDir, "self", "mountinfo"))
+	if err != nil {
+		return false
+	}
+	return mountFsType(string(data), path) == "tmpfs"
+}
+
+// Helper: return the filesystem type of the mount on top at path, or ""
+// when nothing is mounted there
+func mountFsType(mountinfo, path string) string {
+	path = filepath.Clean(path)
+	fsType := ""
+	for _, line := range SplitLines(mountinfo) {
+		// The fstype follows the "-" separator after the optional fields
+		fields := SplitFields(line)
+		if len(fields) < 6 || unescapeMountInfo(fields[4]) != path {
+			continue
+		}
+		for i := 6; i+1 < len(fields); i++ {
+			if fields[i] == "-" {
+				fsType = fields[i+1]
+				break
+			}
+		}
+	}
+	return fsType
+}
@@ -0,0 +1,119 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNode_StageVolume_Tmpfs(t *testing.T) {
+	testDir := t.TempDir()
+	runner := &fakeRunner{}
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = runner
+	stage := func(volumeContext map[string]string, capability *csi.VolumeCapability) error {
+		volumeContext[backingModeParam] = backingModeTmpfs
+		_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-tmpfs",
+			StagingTargetPath: filepath.Join(testDir, "staging"),
+			VolumeContext:     volumeContext,
+			VolumeCapability:  capability,
+		})
+		return err
+	}
+	mount := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"noexec"}}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	if err := stage(map[string]string{"size": "1048576"}, mount); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	want := []string{"mount -t tmpfs -o size=1048576,noexec tmpfs " + filepath.Join(testDir, "staging")}
+	if !reflect.DeepEqual(runner.calls, want) {
+		t.Errorf("expected %v, got %v", want, runner.calls)
+	}
+	// No backing file is created
+	if entries, _ := filepath.Glob(filepath.Join(testDir, "vol-tmpfs*")); len(entries) != 0 {
+		t.Errorf("expected nothing in the backing directory, got %v", entries)
+	}
+
+	if err := stage(map[string]string{}, mount); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a tmpfs volume without size, got %v", err)
+	}
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	if err := stage(map[string]string{"size": "1048576"}, block); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a block tmpfs volume, got %v", err)
+	}
+}
+
+func TestNode_StagedBackend_Tmpfs(t *testing.T) {
+	testDir := t.TempDir()
+	staging := filepath.Join(testDir, "staging")
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.procDir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(ns.procDir, "self"), 0755); err != nil {
+		t.Fatalf("failed to create proc dir: %v", err)
+	}
+	mountinfo := strings.Join([]string{
+		"36 25 7:0 / " + staging + " rw,relatime - ext4 /dev/loop0 rw",
+		"37 25 0:50 / " + staging + " rw,relatime shared:7 - tmpfs tmpfs rw,size=1024k",
+	}, "\n") + "\n"
+	if err := os.WriteFile(filepath.Join(ns.procDir, "self", "mountinfo"), []byte(mountinfo), 0644); err != nil {
+		t.Fatalf("failed to write mountinfo: %v", err)
+	}
+
+	if _, ok := ns.stagedBackend("vol-tmpfs", staging).(*tmpfsBackend); !ok {
+		t.Errorf("expected the tmpfs backend for a tmpfs mount")
+	}
+	if _, ok := ns.stagedBackend("vol-file", filepath.Join(testDir, "other")).(*loopFileBackend); !ok {
+		t.Errorf("expected the loop file backend for an unmounted path")
+	}
+	if got := mountFsType(mountinfo, staging+"/"); got != "tmpfs" {
+		t.Errorf("expected the top mount tmpfs, got %q", got)
+	}
+}
+
+func TestController_CreateVolume_Tmpfs(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", "/tmp/my-csi-driver", nil)
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "testvol",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1048576},
+		Parameters:    map[string]string{backingModeParam: backingModeTmpfs},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	volumeContext := resp.Volume.VolumeContext
+	if _, ok := volumeContext["backingFile"]; ok {
+		t.Errorf("expected no backing file for a tmpfs volume, got %v", volumeContext)
+	}
+	parsed, err := ParseVolumeContext(volumeContext)
+	if err != nil {
+		t.Fatalf("ParseVolumeContext failed: %v", err)
+	}
+	if parsed.BackingMode != backingModeTmpfs || parsed.Size != 1048576 {
+		t.Errorf("expected a 1048576 byte tmpfs volume, got %+v", parsed)
+	}
+
+	if _, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "testclone",
+		Parameters: map[string]string{backingModeParam: backingModeTmpfs},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "vol-source"}},
+		},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a tmpfs clone, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package rawfile
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	klog "k8s.io/klog/v2"
+)
+
+// Policies choosing the node of a new volume among the topologies its
+// request permits. With WaitForFirstConsumer binding the provisioner puts the
+// node the pod was scheduled to first, so anything but TopologyPolicyFirst
+// only suits StorageClasses with Immediate binding.
+const (
+	// TopologyPolicyFirst takes the first preferred topology, or else the first requisite one
+	TopologyPolicyFirst = "first"
+	// TopologyPolicyRandom spreads volumes by picking any permitted topology
+	TopologyPolicyRandom = "random"
+	// TopologyPolicyLeastLoaded picks the node holding the fewest volumes
+	TopologyPolicyLeastLoaded = "least-loaded"
+)
+
+// selectTopology chooses where a new volume is accessible from its
+// accessibility requirements. Every preferred and requisite topology is a
+// candidate, in the provisioner's order of preference, and those outside the
+// allowed nodes are dropped. It returns nil when the request has no
+// requirements.
+func (cs *ControllerServer) selectTopology(ctx context.Context, req *csi.TopologyRequirement) (*csi.Topology, error) {
+	var candidates []*csi.Topology
+	seen := map[string]bool{}
+	for _, topology := range append(slices.Clone(req.GetPreferred()), req.GetRequisite()...) {
+		node := topology.GetSegments()[topologyKey]
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		if !cs.topologyAllowed(topology) {
+			klog.V(4).Infof("CreateVolume: skipping topology %+v outside the allowed topologies", topology.GetSegments())
+			continue
+		}
+		candidates = append(candidates, topology)
+	}
+	if len(candidates) == 0 {
+		if len(seen) == 0 {
+			return nil, nil
+		}
+		return nil, status.Errorf(codes.ResourceExhausted, "none of the requested topologies is allowed (allowed nodes: %v)", cs.allowedNodes)
+	}
+
+	switch cs.topologyPolicy {
+	case TopologyPolicyRandom:
+		return candidates[rand.IntN(len(candidates))], nil
+	case TopologyPolicyLeastLoaded:
+		return cs.leastLoadedTopology(ctx, candidates), nil
+	default:
+		return candidates[0], nil
+	}
+}
+
+// topologyPolicyName is the policy in effect, for logging
+func (cs *ControllerServer) topologyPolicyName() string {
+	if cs.topologyPolicy == "" {
+		return TopologyPolicyFirst
+	}
+	return cs.topologyPolicy
+}
+
+// topologyAllowed reports whether a volume may be placed in topology; every
+// node is allowed when no allowed nodes are configured
+func (cs *ControllerServer) topologyAllowed(topology *csi.Topology) bool {
+	if len(cs.allowedNodes) == 0 {
+		return true
+	}
+	return slices.Contains(cs.allowedNodes, topology.GetSegments()[topologyKey])
+}
+
+// leastLoadedTopology returns the candidate whose node holds the fewest
+// volumes, preferring earlier candidates on ties. Without a volume store, or
+// when it can't be read, it falls back to the first candidate.
+func (cs *ControllerServer) leastLoadedTopology(ctx context.Context, candidates []*csi.Topology) *csi.Topology {
+	store := cs.volumeStore()
+	if store == nil {
+		return candidates[0]
+	}
+	records, err := store.List(ctx)
+	if err != nil {
+		klog.Warningf("CreateVolume: failed to count volumes per node, using the first topology: %v", err)
+		return candidates[0]
+	}
+	volumes := map[string]int{}
+	for _, record := range records {
+		volumes[record.Node]++
+	}
+	best := candidates[0]
+	for _, topology := range candidates[1:] {
+		if volumes[topology.GetSegments()[topologyKey]] < volumes[best.GetSegments()[topologyKey]] {
+			best = topology
+		}
+	}
+	return best
+}
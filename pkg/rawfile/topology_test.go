@@ -0,0 +1,133 @@
+package rawfile
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func nodeTopology(node string) *csi.Topology {
+	return &csi.Topology{Segments: map[string]string{topologyKey: node}}
+}
+
+func topologyRequest(preferred []string, requisite ...string) *csi.TopologyRequirement {
+	req := &csi.TopologyRequirement{}
+	for _, node := range preferred {
+		req.Preferred = append(req.Preferred, nodeTopology(node))
+	}
+	for _, node := range requisite {
+		req.Requisite = append(req.Requisite, nodeTopology(node))
+	}
+	return req
+}
+
+func TestController_SelectTopology_First(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", t.TempDir(), nil)
+	req := topologyRequest([]string{"node-b"}, "node-a", "node-b", "node-c")
+
+	got, err := cs.selectTopology(context.Background(), req)
+	if err != nil {
+		t.Fatalf("selectTopology failed: %v", err)
+	}
+	if node := got.Segments[topologyKey]; node != "node-b" {
+		t.Errorf("expected the preferred node-b, got %s", node)
+	}
+
+	// A preferred node outside the allowed nodes gives way to the requisite ones
+	cs.allowedNodes = []string{"node-c", "node-a"}
+	got, err = cs.selectTopology(context.Background(), req)
+	if err != nil {
+		t.Fatalf("selectTopology failed: %v", err)
+	}
+	if node := got.Segments[topologyKey]; node != "node-a" {
+		t.Errorf("expected the first allowed requisite node-a, got %s", node)
+	}
+
+	// No requirements: the volume has no topology
+	if got, err := cs.selectTopology(context.Background(), nil); got != nil || err != nil {
+		t.Errorf("expected no topology without requirements, got %+v, %v", got, err)
+	}
+
+	cs.allowedNodes = []string{"node-z"}
+	if _, err := cs.selectTopology(context.Background(), req); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted with no allowed topology, got %v", err)
+	}
+}
+
+func TestController_SelectTopology_Random(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", t.TempDir(), nil)
+	cs.topologyPolicy = TopologyPolicyRandom
+	cs.allowedNodes = []string{"node-a", "node-b", "node-c"}
+	req := topologyRequest(nil, "node-a", "node-b", "node-c", "node-d")
+
+	picked := map[string]bool{}
+	for range 100 {
+		got, err := cs.selectTopology(context.Background(), req)
+		if err != nil {
+			t.Fatalf("selectTopology failed: %v", err)
+		}
+		picked[got.Segments[topologyKey]] = true
+	}
+	if picked["node-d"] {
+		t.Errorf("expected node-d outside the allowed nodes never to be picked")
+	}
+	if len(picked) < 2 {
+		t.Errorf("expected volumes to spread over the allowed nodes, got %v", picked)
+	}
+}
+
+func TestController_SelectTopology_LeastLoaded(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", t.TempDir(), nil)
+	cs.topologyPolicy = TopologyPolicyLeastLoaded
+	cs.volumes = newFileVolumeStore(cs.backingDir)
+	for id, node := range map[string]string{"vol-1": "node-a", "vol-2": "node-a", "vol-3": "node-b", "vol-4": "node-c"} {
+		if err := cs.volumes.Put(context.Background(), volumeRecord{ID: id, Name: id, Node: node}); err != nil {
+			t.Fatalf("failed to record %s: %v", id, err)
+		}
+	}
+	req := topologyRequest([]string{"node-a"}, "node-a", "node-b", "node-c")
+
+	// node-b and node-c tie; the earlier candidate wins
+	got, err := cs.selectTopology(context.Background(), req)
+	if err != nil {
+		t.Fatalf("selectTopology failed: %v", err)
+	}
+	if node := got.Segments[topologyKey]; node != "node-b" {
+		t.Errorf("expected the least loaded node-b, got %s", node)
+	}
+
+	// The policy only picks among allowed nodes
+	cs.allowedNodes = []string{"node-a", "node-c"}
+	got, err = cs.selectTopology(context.Background(), req)
+	if err != nil {
+		t.Fatalf("selectTopology failed: %v", err)
+	}
+	if node := got.Segments[topologyKey]; node != "node-c" {
+		t.Errorf("expected the least loaded allowed node-c, got %s", node)
+	}
+}
+
+func TestController_CreateVolume_AllowedTopologies(t *testing.T) {
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", t.TempDir(), nil)
+	cs.allowedNodes = []string{"node-b"}
+	req := &csi.CreateVolumeRequest{
+		Name:                      "testvol",
+		CapacityRange:             &csi.CapacityRange{RequiredBytes: 1048576},
+		AccessibilityRequirements: topologyRequest([]string{"node-a"}, "node-a", "node-b"),
+	}
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if len(resp.Volume.AccessibleTopology) != 1 || resp.Volume.AccessibleTopology[0].Segments[topologyKey] != "node-b" {
+		t.Errorf("expected the volume on the allowed node-b, got %+v", resp.Volume.AccessibleTopology)
+	}
+
+	req.Name, req.AccessibilityRequirements = "testvol2", topologyRequest(nil, "node-a")
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted for a volume with no allowed topology, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package rawfile
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// VolumeContext is the volume context CreateVolume records for the node
+// plugin, parsed and validated
+type VolumeContext struct {
+	// BackingFile is where the controller placed the volume's backing file;
+	// tmpfs volumes have none
+	BackingFile string
+	// Size of the volume in bytes, or 0 for contexts of older controllers
+	// that don't record it
+	Size int64
+	// FsType from the storage class, when the capability doesn't name one
+	FsType string
+	// MkfsOptions are the extra mkfs arguments from the storage class
+	MkfsOptions []string
+	// FsLabel is the filesystem label; checked against the filesystem's
+	// length limit once the fsType is known
+	FsLabel string
+	// CloneSourceFile is the backing file a clone starts as a copy of
+	CloneSourceFile string
+	// Encrypted volumes are LUKS-formatted with the key from the node-stage secret
+	Encrypted bool
+	// Qcow2 backing files are attached with qemu-nbd instead of losetup
+	Qcow2 bool
+	// Preallocate asks for a fully allocated backing file
+	Preallocate bool
+	// MountPropagation of published mounts: shared, slave, private, or empty
+	// to leave the bind mount's default
+	MountPropagation string
+	// BackingMode selects the backend providing the volume: backing files
+	// unless the storage class asked for subvolumes or tmpfs
+	BackingMode string
+}
+
+// ParseVolumeContext parses and validates the volume context of a volume. The
+// backing file is required except for tmpfs volumes; the other keys are
+// optional. Keys it doesn't know, such as the pod information kubelet adds,
+// are ignored.
+func ParseVolumeContext(volumeContext map[string]string) (VolumeContext, error) {
+	var parsed VolumeContext
+
+	parsed.BackingFile = volumeContext["backingFile"]
+	if parsed.BackingFile == "" && volumeContext[backingModeParam] != backingModeTmpfs {
+		return VolumeContext{}, fmt.Errorf("missing backingFile in volume context")
+	}
+
+	if value, ok := volumeContext["size"]; ok {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size <= 0 {
+			return VolumeContext{}, fmt.Errorf("invalid size %q in volume context", value)
+		}
+		parsed.Size = size
+	}
+
+	parsed.FsType = volumeContext["fsType"]
+	if parsed.FsType != "" && !supportedFsTypes[parsed.FsType] {
+		return VolumeContext{}, fmt.Errorf("unsupported fsType %q", parsed.FsType)
+	}
+
+	mkfsOptions, err := parseMkfsOptions(volumeContext["mkfsOptions"])
+	if err != nil {
+		return VolumeContext{}, err
+	}
+	if len(mkfsOptions) > 0 {
+		parsed.MkfsOptions = mkfsOptions
+	}
+	parsed.FsLabel = volumeContext[fsLabelParam]
+	parsed.CloneSourceFile = volumeContext["cloneSourceFile"]
+	parsed.MountPropagation = volumeContext[mountPropagationParam]
+	if err := validateMountPropagation(parsed.MountPropagation); err != nil {
+		return VolumeContext{}, err
+	}
+
+	for key, field := range map[string]*bool{encryptedParam: &parsed.Encrypted, preallocateParam: &parsed.Preallocate} {
+		value, ok := volumeContext[key]
+		if !ok {
+			continue
+		}
+		if *field, err = strconv.ParseBool(value); err != nil {
+			return VolumeContext{}, fmt.Errorf("invalid %s %q in volume context: must be true or false", key, value)
+		}
+	}
+
+	switch format := volumeContext[backingFormatParam]; format {
+	case "", backingFormatRaw:
+	case backingFormatQcow2:
+		parsed.Qcow2 = true
+	default:
+		return VolumeContext{}, fmt.Errorf("unsupported %s %q in volume context", backingFormatParam, format)
+	}
+
+	switch mode := volumeContext[backingModeParam]; mode {
+	case "", backingModeFile:
+		parsed.BackingMode = backingModeFile
+	case backingModeSubvolume, backingModeTmpfs:
+		if parsed.Encrypted || parsed.Qcow2 || parsed.Preallocate {
+			return VolumeContext{}, fmt.Errorf("%s %s volumes can't be encrypted, qcow2 or preallocated", backingModeParam, mode)
+		}
+		parsed.BackingMode = mode
+	default:
+		return VolumeContext{}, fmt.Errorf("unsupported %s %q in volume context", backingModeParam, mode)
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,125 @@
+package rawfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVolumeContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		context map[string]string
+		want    VolumeContext
+		wantErr bool
+	}{
+		{
+			name:    "Minimal",
+			context: map[string]string{"backingFile": "/data/vol-1.img"},
+			want:    VolumeContext{BackingFile: "/data/vol-1.img", BackingMode: backingModeFile},
+		},
+		{
+			name: "Full",
+			context: map[string]string{
+				"backingFile":      "/data/vol-1.img",
+				"size":             "1048576",
+				"fsType":           "xfs",
+				"mkfsOptions":      "-m crc=1",
+				fsLabelParam:       "data",
+				"cloneSourceFile":  "/data/vol-0.img",
+				encryptedParam:     "true",
+				backingFormatParam: backingFormatQcow2,
+				preallocateParam:   "false",
+				// Added by kubelet with podInfoOnMount
+				"csi.storage.k8s.io/pod.name": "app-0",
+			},
+			want: VolumeContext{
+				BackingFile:     "/data/vol-1.img",
+				Size:            1048576,
+				FsType:          "xfs",
+				MkfsOptions:     []string{"-m", "crc=1"},
+				FsLabel:         "data",
+				CloneSourceFile: "/data/vol-0.img",
+				Encrypted:       true,
+				Qcow2:           true,
+				BackingMode:     backingModeFile,
+			},
+		},
+		{
+			name:    "Tmpfs",
+			context: map[string]string{"size": "1048576", backingModeParam: backingModeTmpfs},
+			want:    VolumeContext{Size: 1048576, BackingMode: backingModeTmpfs},
+		},
+		{name: "MissingBackingFile", context: map[string]string{"size": "1048576"}, wantErr: true},
+		{name: "InvalidSize", context: map[string]string{"backingFile": "f", "size": "lots"}, wantErr: true},
+		{name: "NegativeSize", context: map[string]string{"backingFile": "f", "size": "-1"}, wantErr: true},
+		{name: "UnsupportedFsType", context: map[string]string{"backingFile": "f", "fsType": "ntfs"}, wantErr: true},
+		{name: "UnsafeMkfsOptions", context: map[string]string{"backingFile": "f", "mkfsOptions": "-F; reboot"}, wantErr: true},
+		{name: "InvalidBool", context: map[string]string{"backingFile": "f", preallocateParam: "yes"}, wantErr: true},
+		{name: "UnknownBackingFormat", context: map[string]string{"backingFile": "f", backingFormatParam: "vmdk"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseVolumeContext(tt.context)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func FuzzParseVolumeContext(f *testing.F) {
+	f.Add("/data/vol-1.img", "1048576", "ext4", "-O ^has_journal", "data", "true", "qcow2", "false", "", "")
+	f.Add("", "-1", "ntfs", "-F;", "", "yes", "vmdk", "1", "", "")
+	f.Add("f", "9223372036854775808", "", "", "label with spaces", "", "raw", "", "", "")
+	f.Add("/data/vol-2.subvol", "1048576", "", "", "", "", "", "", "subvolume", "shared")
+	f.Add("", "1048576", "", "", "", "", "", "", "tmpfs", "private")
+	f.Add("/data/vol-3.img", "1048576", "xfs", "", "", "", "", "", "file", "slave")
+	f.Add("/data/vol-4.img", "1048576", "", "", "", "", "", "", "zfs", "")
+	f.Add("/data/vol-5.img", "1048576", "", "", "", "", "", "", "", "rshared")
+	f.Add("/data/vol-6.img", "1048576", "", "", "", "true", "", "", "tmpfs", "Shared")
+	f.Fuzz(func(t *testing.T, backingFile, size, fsType, mkfsOptions, fsLabel, encrypted, backingFormat, preallocate, backingMode, mountPropagation string) {
+		volumeContext := map[string]string{
+			"backingFile":         backingFile,
+			"size":                size,
+			"fsType":              fsType,
+			"mkfsOptions":         mkfsOptions,
+			fsLabelParam:          fsLabel,
+			encryptedParam:        encrypted,
+			backingFormatParam:    backingFormat,
+			preallocateParam:      preallocate,
+			backingModeParam:      backingMode,
+			mountPropagationParam: mountPropagation,
+		}
+		got, err := ParseVolumeContext(volumeContext)
+		if err != nil {
+			if !reflect.DeepEqual(got, VolumeContext{}) {
+				t.Errorf("expected an empty VolumeContext with error %v, got %+v", err, got)
+			}
+			return
+		}
+		if (got.BackingFile == "" && got.BackingMode != backingModeTmpfs) || got.Size <= 0 {
+			t.Errorf("accepted an invalid backing file or size: %+v", got)
+		}
+		switch got.BackingMode {
+		case backingModeFile:
+		case backingModeSubvolume, backingModeTmpfs:
+			if got.Encrypted || got.Qcow2 || got.Preallocate {
+				t.Errorf("accepted a %s volume with backing file options: %+v", got.BackingMode, got)
+			}
+		default:
+			t.Errorf("accepted unsupported backingMode %q", backingMode)
+		}
+		if err := validateMountPropagation(got.MountPropagation); err != nil {
+			t.Errorf("accepted invalid mountPropagation %q", mountPropagation)
+		}
+		if got.FsType != "" && !supportedFsTypes[got.FsType] {
+			t.Errorf("accepted unsupported fsType %q", got.FsType)
+		}
+		if _, err := parseMkfsOptions(mkfsOptions); err != nil {
+			t.Errorf("accepted unsafe mkfsOptions %q", mkfsOptions)
+		}
+	})
+}
@@ -0,0 +1,231 @@
+package rawfile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// DefaultVolumeHealthInterval is how often node plugins publish the health of
+// their volumes on their Node object.
+const DefaultVolumeHealthInterval = time.Minute
+
+// Node annotations, prefixed with the driver name, carrying the volume health
+// report: the comma separated IDs of volumes whose backing file is missing,
+// the volumes whose backing file is not the size of the volume as
+// comma separated <volume id>:<bytes on disk>, and when the report was last
+// published.
+const (
+	abnormalVolumesAnnotation      = "/abnormal-volumes"
+	sizeMismatchedAnnotation       = "/size-mismatched-volumes"
+	volumeHealthReportedAnnotation = "/volume-health-reported-at"
+)
+
+// stagedDirName is the subdirectory of the backing directory holding an
+// empty marker file per volume staged on this node. Backing files are only
+// created at first stage, so a volume without a marker has nothing to lose.
+const stagedDirName = ".staged"
+
+// volumeHealthStaleAfter is how old a node's report may be before the
+// controller stops trusting it, e.g. because the node is down
+const volumeHealthStaleAfter = 3 * DefaultVolumeHealthInterval
+
+// RunVolumeHealthReporter periodically publishes the volumes pinned to this
+// node whose backing file is missing or of the wrong size, so ListVolumes and
+// ControllerGetVolume can report them.
+func (ns *NodeServer) RunVolumeHealthReporter(ctx context.Context, interval time.Duration) {
+	klog.Infof("Starting volume health reporter with interval %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := ns.reportVolumeHealth(ctx); err != nil {
+			klog.Errorf("Failed to report volume health: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			klog.Infof("Volume health reporter stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reportVolumeHealth checks the backing file of every volume of this driver
+// pinned to this node and records the missing ones, and those whose size
+// disagrees with the volume, on the Node object. A missing backing file is
+// only reported for volumes staged on this node before, and volumes younger
+// than the garbage collector grace period are skipped, since backing files
+// are only created when volumes are first staged.
+func (ns *NodeServer) reportVolumeHealth(ctx context.Context) error {
+	if ns.clientset == nil {
+		klog.V(2).Infof("Skipping volume health report: Kubernetes clientset not configured")
+		return nil
+	}
+
+	pvList, err := ns.clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list PersistentVolumes: %v", err)
+	}
+
+	var abnormal, mismatched []string
+	for i := range pvList.Items {
+		pv := &pvList.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != ns.driverName || pv.Spec.CSI.VolumeHandle == "" {
+			continue
+		}
+		if nodeFromAffinity(pv) != ns.nodeID || time.Since(pv.CreationTimestamp.Time) < ns.gcGracePeriod {
+			continue
+		}
+		// tmpfs volumes have no backing file to lose
+		if pv.Spec.CSI.VolumeAttributes[backingModeParam] == backingModeTmpfs {
+			continue
+		}
+		backingFile := pv.Spec.CSI.VolumeAttributes["backingFile"]
+		if ns.validateBackingFile(backingFile) != nil {
+			backingFile = ns.backingFilePath(pv.Spec.CSI.VolumeHandle)
+		}
+		path, found := ns.findBackingFile(backingFile)
+		if !found {
+			if !ns.wasStaged(pv.Spec.CSI.VolumeHandle) {
+				continue
+			}
+			klog.Warningf("Volume %s: backing file %s is missing", pv.Spec.CSI.VolumeHandle, backingFile)
+			abnormal = append(abnormal, pv.Spec.CSI.VolumeHandle)
+			continue
+		}
+		if actual, ok := backingFileSizeMismatch(path, pv.Spec.CSI.VolumeAttributes); ok {
+			klog.Warningf("Volume %s: backing file %s is %d bytes, not the volume size %s", pv.Spec.CSI.VolumeHandle, path, actual, pv.Spec.CSI.VolumeAttributes["size"])
+			mismatched = append(mismatched, pv.Spec.CSI.VolumeHandle+":"+strconv.FormatInt(actual, 10))
+		}
+	}
+	sort.Strings(abnormal)
+	sort.Strings(mismatched)
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				ns.driverName + abnormalVolumesAnnotation:      strings.Join(abnormal, ","),
+				ns.driverName + sizeMismatchedAnnotation:       strings.Join(mismatched, ","),
+				ns.driverName + volumeHealthReportedAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := ns.clientset.CoreV1().Nodes().Patch(ctx, ns.nodeID, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to annotate node %s: %v", ns.nodeID, err)
+	}
+	klog.V(4).Infof("Reported volume health for node %s: %d abnormal volumes", ns.nodeID, len(abnormal)+len(mismatched))
+	return nil
+}
+
+// stagedMarker is the marker file recording that a volume was staged here
+func (ns *NodeServer) stagedMarker(volumeID string) string {
+	return filepath.Join(ns.backingDir, stagedDirName, volumeID)
+}
+
+// markStaged records that a volume was staged on this node. Failing to is
+// only logged: the volume works, its health just goes unreported.
+func (ns *NodeServer) markStaged(volumeID string) {
+	marker := ns.stagedMarker(volumeID)
+	if err := os.MkdirAll(filepath.Dir(marker), 0750); err != nil {
+		klog.Warningf("Failed to create staged marker directory for volume %s: %v", volumeID, err)
+		return
+	}
+	if err := os.WriteFile(marker, nil, 0640); err != nil {
+		klog.Warningf("Failed to mark volume %s as staged: %v", volumeID, err)
+	}
+}
+
+// wasStaged reports whether a volume was staged on this node
+func (ns *NodeServer) wasStaged(volumeID string) bool {
+	_, err := os.Stat(ns.stagedMarker(volumeID))
+	return err == nil
+}
+
+// clearStaged forgets that a volume was staged, once its backing file is gone for good
+func (ns *NodeServer) clearStaged(volumeID string) {
+	if err := os.Remove(ns.stagedMarker(volumeID)); err != nil && !os.IsNotExist(err) {
+		klog.Warningf("Failed to remove staged marker of volume %s: %v", volumeID, err)
+	}
+}
+
+// backingFileSizeMismatch returns the size of a raw backing file when it
+// differs from the size in the volume context, e.g. because creating or
+// cloning it was cut short. Subvolumes and qcow2 images take up no fixed
+// size and are never reported.
+func backingFileSizeMismatch(path string, volumeContext map[string]string) (int64, bool) {
+	if isQcow2(volumeContext) {
+		return 0, false
+	}
+	expected, err := strconv.ParseInt(volumeContext["size"], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0, false
+	}
+	return fi.Size(), fi.Size() != expected
+}
+
+// volumeHealthReports caches the Node objects looked up for one ListVolumes
+// or ControllerGetVolume call so each node is fetched at most once per page
+type volumeHealthReports struct {
+	cs    *ControllerServer
+	now   time.Time
+	nodes map[string]*corev1.Node
+}
+
+// condition returns the health of a volume as last reported by its node, or
+// nil when it is unknown: the volume is not pinned to a node, or the node is
+// gone or has not reported recently
+func (r *volumeHealthReports) condition(ctx context.Context, nodeName, volumeID string) *csi.VolumeCondition {
+	if nodeName == "" || r.cs.clientset == nil {
+		return nil
+	}
+	node, ok := r.nodes[nodeName]
+	if !ok {
+		var err error
+		node, err = r.cs.clientset.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			klog.V(4).Infof("Volume health of node %s unknown: %v", nodeName, err)
+			node = nil
+		}
+		r.nodes[nodeName] = node
+	}
+	if node == nil {
+		return nil
+	}
+
+	reportedAt, err := time.Parse(time.RFC3339, node.Annotations[r.cs.name+volumeHealthReportedAnnotation])
+	if err != nil || r.now.Sub(reportedAt) > volumeHealthStaleAfter {
+		klog.V(4).Infof("Node %s has no recent volume health report", nodeName)
+		return nil
+	}
+	for _, id := range strings.Split(node.Annotations[r.cs.name+abnormalVolumesAnnotation], ",") {
+		if id == volumeID {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("backing file is missing on node %s", nodeName)}
+		}
+	}
+	for _, entry := range strings.Split(node.Annotations[r.cs.name+sizeMismatchedAnnotation], ",") {
+		if id, actual, ok := strings.Cut(entry, ":"); ok && id == volumeID {
+			return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("backing file on node %s is %s bytes, not the size of the volume", nodeName, actual)}
+		}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+}
@@ -0,0 +1,212 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newPinnedTestPV returns a PV of test-driver pinned to node and created age ago
+func newPinnedTestPV(name, backingDir, node string, age time.Duration) *corev1.PersistentVolume {
+	pv := newTestPV(name, "test-driver", "1Mi")
+	pv.CreationTimestamp = metav1.NewTime(time.Now().Add(-age))
+	pv.Spec.CSI.VolumeAttributes["backingFile"] = filepath.Join(backingDir, name+".img")
+	pv.Spec.NodeAffinity = &corev1.VolumeNodeAffinity{
+		Required: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{
+					Key:      topologyKey,
+					Operator: corev1.NodeSelectorOpIn,
+					Values:   []string{node},
+				}},
+			}},
+		},
+	}
+	return pv
+}
+
+func TestNode_ReportVolumeHealth(t *testing.T) {
+	testDir := t.TempDir()
+	for name, size := range map[string]int64{"vol-present": 0, "vol-sized": 1 << 20, "vol-short": 4096} {
+		if err := os.WriteFile(filepath.Join(testDir, name+".img"), make([]byte, size), 0600); err != nil {
+			t.Fatalf("failed to create backing file: %v", err)
+		}
+	}
+	sized := newPinnedTestPV("vol-sized", testDir, "test-node", time.Hour)
+	sized.Spec.CSI.VolumeAttributes["size"] = "1048576"
+	// Creating or cloning the backing file was cut short
+	short := newPinnedTestPV("vol-short", testDir, "test-node", time.Hour)
+	short.Spec.CSI.VolumeAttributes["size"] = "1048576"
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "test-node"}},
+		newPinnedTestPV("vol-present", testDir, "test-node", time.Hour),
+		sized,
+		short,
+		newPinnedTestPV("vol-missing", testDir, "test-node", time.Hour),
+		newPinnedTestPV("vol-lost", testDir, "test-node", time.Hour),
+		// Not staged yet, so no backing file is expected
+		newPinnedTestPV("vol-new", testDir, "test-node", time.Second),
+		newPinnedTestPV("vol-unstaged", testDir, "test-node", time.Hour),
+		// Lives on another node
+		newPinnedTestPV("vol-elsewhere", testDir, "other-node", time.Hour),
+	)
+	ns := NewNodeServer("test-node", "test-driver", testDir, clientset)
+	// Only volumes staged here before can have lost their backing file
+	for _, volumeID := range []string{"vol-missing", "vol-lost"} {
+		ns.markStaged(volumeID)
+	}
+
+	if err := ns.reportVolumeHealth(context.Background()); err != nil {
+		t.Fatalf("reportVolumeHealth failed: %v", err)
+	}
+
+	node, err := clientset.CoreV1().Nodes().Get(context.Background(), "test-node", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get node: %v", err)
+	}
+	if got := node.Annotations["test-driver"+abnormalVolumesAnnotation]; got != "vol-lost,vol-missing" {
+		t.Errorf("expected vol-lost,vol-missing reported abnormal, got %q", got)
+	}
+	if got := node.Annotations["test-driver"+sizeMismatchedAnnotation]; got != "vol-short:4096" {
+		t.Errorf("expected vol-short:4096 reported with the wrong size, got %q", got)
+	}
+	if _, err := time.Parse(time.RFC3339, node.Annotations["test-driver"+volumeHealthReportedAnnotation]); err != nil {
+		t.Errorf("expected report timestamp, got %v", err)
+	}
+}
+
+func TestController_ListVolumes_VolumeCondition(t *testing.T) {
+	testDir := t.TempDir()
+	reported := func(name, abnormal string, at time.Time) *corev1.Node {
+		return &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Annotations: map[string]string{
+				"test-driver" + abnormalVolumesAnnotation:      abnormal,
+				"test-driver" + volumeHealthReportedAnnotation: at.UTC().Format(time.RFC3339),
+			},
+		}}
+	}
+	clientset := fake.NewSimpleClientset(
+		reported("node-a", "vol-a2", time.Now()),
+		reported("node-stale", "vol-stale", time.Now().Add(-time.Hour)),
+		newPinnedTestPV("vol-a1", testDir, "node-a", time.Hour),
+		newPinnedTestPV("vol-a2", testDir, "node-a", time.Hour),
+		newPinnedTestPV("vol-gone", testDir, "node-gone", time.Hour),
+		newPinnedTestPV("vol-stale", testDir, "node-stale", time.Hour),
+		newTestPV("vol-unpinned", "test-driver", "1Mi"),
+	)
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", testDir, clientset)
+
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	conditions := map[string]*csi.VolumeCondition{}
+	for _, entry := range resp.Entries {
+		conditions[entry.Volume.VolumeId] = entry.GetStatus().GetVolumeCondition()
+	}
+
+	if c := conditions["vol-a1"]; c == nil || c.Abnormal {
+		t.Errorf("expected vol-a1 healthy, got %v", c)
+	}
+	if c := conditions["vol-a2"]; c == nil || !c.Abnormal {
+		t.Errorf("expected vol-a2 abnormal, got %v", c)
+	}
+	// Unreachable, stale or unpinned volumes have no known condition
+	for _, id := range []string{"vol-gone", "vol-stale", "vol-unpinned"} {
+		if c, ok := conditions[id]; !ok || c != nil {
+			t.Errorf("expected %s listed without a condition, got %v (listed: %v)", id, c, ok)
+		}
+	}
+}
+
+func TestController_GetVolume_VolumeCondition(t *testing.T) {
+	testDir := t.TempDir()
+	clientset := fake.NewSimpleClientset(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name: "node-a",
+			Annotations: map[string]string{
+				"test-driver" + abnormalVolumesAnnotation:      "vol-missing",
+				"test-driver" + sizeMismatchedAnnotation:       "vol-short:4096",
+				"test-driver" + volumeHealthReportedAnnotation: time.Now().UTC().Format(time.RFC3339),
+			},
+		}},
+		newPinnedTestPV("vol-ok", testDir, "node-a", time.Hour),
+		newPinnedTestPV("vol-missing", testDir, "node-a", time.Hour),
+		newPinnedTestPV("vol-short", testDir, "node-a", time.Hour),
+		newPinnedTestPV("vol-gone", testDir, "node-gone", time.Hour),
+	)
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", testDir, clientset)
+
+	condition := func(volumeID string) *csi.VolumeCondition {
+		t.Helper()
+		resp, err := cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+		if err != nil {
+			t.Fatalf("ControllerGetVolume(%s) failed: %v", volumeID, err)
+		}
+		return resp.GetStatus().GetVolumeCondition()
+	}
+	if c := condition("vol-ok"); c == nil || c.Abnormal {
+		t.Errorf("expected vol-ok healthy, got %v", c)
+	}
+	if c := condition("vol-missing"); c == nil || !c.Abnormal {
+		t.Errorf("expected vol-missing abnormal, got %v", c)
+	}
+	if c := condition("vol-short"); c == nil || !c.Abnormal || !strings.Contains(c.Message, "4096 bytes") {
+		t.Errorf("expected vol-short abnormal with its size, got %v", c)
+	}
+	// Without a report from its node the condition is unknown
+	if c := condition("vol-gone"); c != nil {
+		t.Errorf("expected no condition for vol-gone, got %v", c)
+	}
+}
+
+func TestNode_StagedMarker(t *testing.T) {
+	testDir := t.TempDir()
+	ns := NewNodeServer("test-node", "test-driver", testDir, fake.NewSimpleClientset())
+	ns.runner = &fakeRunner{fail: map[string]bool{}, output: map[string]string{"losetup": "/dev/loop7\n", "blkid": "ext4\n"}}
+	stage := func(volumeID string) error {
+		_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: filepath.Join(testDir, "staging-"+volumeID),
+			VolumeContext:     map[string]string{"backingFile": filepath.Join(testDir, volumeID+".img"), "size": "1048576"},
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			},
+		})
+		return err
+	}
+
+	if err := stage("vol-staged"); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+	if !ns.wasStaged("vol-staged") {
+		t.Errorf("expected a staged volume to be marked")
+	}
+	ns.runner.(*fakeRunner).fail["mount"] = true
+	if err := stage("vol-failed"); err == nil {
+		t.Fatalf("expected NodeStageVolume to fail when mount fails")
+	}
+	if ns.wasStaged("vol-failed") {
+		t.Errorf("expected a failed stage to leave no marker")
+	}
+
+	// Reclaiming the orphaned backing file forgets the volume
+	ns.gcGracePeriod = 0
+	if _, err := ns.garbageCollectVolumes(context.Background(), false); err != nil {
+		t.Fatalf("garbageCollectVolumes failed: %v", err)
+	}
+	if ns.wasStaged("vol-staged") {
+		t.Errorf("expected the marker removed with the backing file")
+	}
+}
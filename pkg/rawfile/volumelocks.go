@@ -0,0 +1,60 @@
+package rawfile
+
+import (
+	"context"
+	"sync"
+)
+
+// VolumeLocks tracks volumes with an operation in flight so that node
+// operations and the garbage collector never act on the same volume at once.
+type VolumeLocks struct {
+	mu sync.Mutex
+	// locks maps a locked volume to a channel closed when it is released
+	locks map[string]chan struct{}
+}
+
+func NewVolumeLocks() *VolumeLocks {
+	return &VolumeLocks{locks: make(map[string]chan struct{})}
+}
+
+// TryAcquire locks volumeID and returns true, or returns false if it is already locked.
+func (vl *VolumeLocks) TryAcquire(volumeID string) bool {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	if _, ok := vl.locks[volumeID]; ok {
+		return false
+	}
+	vl.locks[volumeID] = make(chan struct{})
+	return true
+}
+
+// Acquire locks volumeID, waiting for the current holder to release it. It
+// returns the context's error if ctx is done first.
+func (vl *VolumeLocks) Acquire(ctx context.Context, volumeID string) error {
+	for {
+		vl.mu.Lock()
+		released, ok := vl.locks[volumeID]
+		if !ok {
+			vl.locks[volumeID] = make(chan struct{})
+			vl.mu.Unlock()
+			return nil
+		}
+		vl.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release unlocks volumeID.
+func (vl *VolumeLocks) Release(volumeID string) {
+	vl.mu.Lock()
+	defer vl.mu.Unlock()
+	if released, ok := vl.locks[volumeID]; ok {
+		close(released)
+		delete(vl.locks, volumeID)
+	}
+}
@@ -0,0 +1,228 @@
+package rawfile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// volumeRecord maps the name a volume was requested under to the ID the
+// driver generated for it
+type volumeRecord struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Capacity int64             `json:"capacity"`
+	Context  map[string]string `json:"context,omitempty"`
+	// Node is the node the volume is pinned to, if known
+	Node string `json:"node,omitempty"`
+}
+
+// volumeStore is the controller's record of the volumes it has created,
+// shared by CreateVolume, ListVolumes and DeleteVolume
+type volumeStore interface {
+	// GetByName returns the volume created under name, or nil if there is none
+	GetByName(ctx context.Context, name string) (*volumeRecord, error)
+	Put(ctx context.Context, record volumeRecord) error
+	// Delete forgets the volume with the given ID; unknown IDs are not an error
+	Delete(ctx context.Context, volumeID string) error
+	// List returns all volumes sorted by ID
+	List(ctx context.Context) ([]volumeRecord, error)
+}
+
+// volumeStoreFile is the file holding the volumes of a standalone controller
+const volumeStoreFile = "volumes.json"
+
+// fileVolumeStore keeps volume records in a JSON file in the backing
+// directory, for standalone mode where there are no PersistentVolumes
+type fileVolumeStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func newFileVolumeStore(backingDir string) *fileVolumeStore {
+	return &fileVolumeStore{path: filepath.Join(backingDir, volumeStoreFile)}
+}
+
+// load reads all records keyed by volume ID; a missing file is an empty store
+func (s *fileVolumeStore) load() (map[string]volumeRecord, error) {
+	records := map[string]volumeRecord{}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volume store %s: %v", s.path, err)
+	}
+	var list []volumeRecord
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse volume store %s: %v", s.path, err)
+	}
+	for _, record := range list {
+		records[record.ID] = record
+	}
+	return records, nil
+}
+
+// save replaces the file through a rename so a crash never leaves it half written
+func (s *fileVolumeStore) save(records map[string]volumeRecord) error {
+	data, err := json.MarshalIndent(sortedRecords(records), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write volume store %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace volume store %s: %v", s.path, err)
+	}
+	return nil
+}
+
+func (s *fileVolumeStore) GetByName(ctx context.Context, name string) (*volumeRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if record.Name == name {
+			return &record, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *fileVolumeStore) Put(ctx context.Context, record volumeRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+	records[record.ID] = record
+	return s.save(records)
+}
+
+func (s *fileVolumeStore) Delete(ctx context.Context, volumeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := records[volumeID]; !ok {
+		return nil
+	}
+	delete(records, volumeID)
+	return s.save(records)
+}
+
+func (s *fileVolumeStore) List(ctx context.Context) ([]volumeRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return sortedRecords(records), nil
+}
+
+// findVolumeRecord returns the record of the volume with the given ID, or nil
+func findVolumeRecord(ctx context.Context, store volumeStore, volumeID string) (*volumeRecord, error) {
+	records, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range records {
+		if records[i].ID == volumeID {
+			return &records[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func sortedRecords(records map[string]volumeRecord) []volumeRecord {
+	list := make([]volumeRecord, 0, len(records))
+	for _, record := range records {
+		list = append(list, record)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// pvVolumeStore reads volume records from the PersistentVolumes of the
+// driver. The external-provisioner names each PV after the CreateVolume
+// request and creates or deletes it around the driver's calls, so Put and
+// Delete have nothing to do.
+type pvVolumeStore struct {
+	clientset kubernetes.Interface
+	driver    string
+}
+
+func (s *pvVolumeStore) GetByName(ctx context.Context, name string) (*volumeRecord, error) {
+	pv, err := s.clientset.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !s.owns(pv) {
+		return nil, nil
+	}
+	record := pvVolumeRecord(pv)
+	return &record, nil
+}
+
+func (s *pvVolumeStore) Put(ctx context.Context, record volumeRecord) error {
+	return nil
+}
+
+func (s *pvVolumeStore) Delete(ctx context.Context, volumeID string) error {
+	return nil
+}
+
+func (s *pvVolumeStore) List(ctx context.Context) ([]volumeRecord, error) {
+	pvList, err := s.clientset.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var list []volumeRecord
+	for i := range pvList.Items {
+		if s.owns(&pvList.Items[i]) {
+			list = append(list, pvVolumeRecord(&pvList.Items[i]))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (s *pvVolumeStore) owns(pv *corev1.PersistentVolume) bool {
+	return pv.Spec.CSI != nil && pv.Spec.CSI.Driver == s.driver && pv.Spec.CSI.VolumeHandle != ""
+}
+
+func pvVolumeRecord(pv *corev1.PersistentVolume) volumeRecord {
+	var capacityBytes int64
+	if capacity, ok := pv.Spec.Capacity[corev1.ResourceStorage]; ok {
+		capacityBytes = capacity.Value()
+	}
+	return volumeRecord{
+		ID:       pv.Spec.CSI.VolumeHandle,
+		Name:     pv.Name,
+		Capacity: capacityBytes,
+		Context:  pv.Spec.CSI.VolumeAttributes,
+		Node:     nodeFromAffinity(pv),
+	}
+}
@@ -0,0 +1,147 @@
+package rawfile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFileVolumeStore(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	store := newFileVolumeStore(dir)
+
+	// An empty directory is an empty store
+	if record, err := store.GetByName(ctx, "pvc-a"); err != nil || record != nil {
+		t.Fatalf("expected no record in an empty store, got %v, %v", record, err)
+	}
+	if records, err := store.List(ctx); err != nil || len(records) != 0 {
+		t.Fatalf("expected an empty list, got %v, %v", records, err)
+	}
+
+	for _, record := range []volumeRecord{
+		{ID: "vol-b", Name: "pvc-b", Capacity: 2048, Context: map[string]string{"backingFile": "/data/vol-b.img"}},
+		{ID: "vol-a", Name: "pvc-a", Capacity: 1024, Node: "node-1"},
+	} {
+		if err := store.Put(ctx, record); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	// Records survive a restart of the controller
+	store = newFileVolumeStore(dir)
+	record, err := store.GetByName(ctx, "pvc-b")
+	if err != nil || record == nil {
+		t.Fatalf("expected pvc-b to be found, got %v, %v", record, err)
+	}
+	if record.ID != "vol-b" || record.Capacity != 2048 || record.Context["backingFile"] != "/data/vol-b.img" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	records, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(records) != 2 || records[0].ID != "vol-a" || records[1].ID != "vol-b" || records[0].Node != "node-1" {
+		t.Errorf("expected records sorted by ID, got %+v", records)
+	}
+
+	if err := store.Delete(ctx, "vol-a"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	// Deleting an unknown volume is not an error
+	if err := store.Delete(ctx, "vol-a"); err != nil {
+		t.Fatalf("Delete of a deleted volume failed: %v", err)
+	}
+	if record, _ := store.GetByName(ctx, "pvc-a"); record != nil {
+		t.Errorf("expected pvc-a to be gone, got %+v", record)
+	}
+	if _, err := os.Stat(filepath.Join(dir, volumeStoreFile+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("expected no temporary file left behind, got %v", err)
+	}
+
+	// A corrupt file is reported rather than treated as empty
+	if err := os.WriteFile(filepath.Join(dir, volumeStoreFile), []byte("{"), 0600); err != nil {
+		t.Fatalf("failed to corrupt store: %v", err)
+	}
+	if _, err := store.List(ctx); err == nil {
+		t.Errorf("expected an error for a corrupt store")
+	}
+}
+
+func TestController_VolumeStore_Standalone(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	cs := NewControllerServerWithBackingDir("test-driver", "0.1.0", dir, nil)
+	cs.volumes = newFileVolumeStore(dir)
+
+	req := &csi.CreateVolumeRequest{Name: "pvc-standalone", CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 20}}
+	first, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	// A retry returns the same volume
+	second, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("repeated CreateVolume failed: %v", err)
+	}
+	if second.Volume.VolumeId != first.Volume.VolumeId || second.Volume.VolumeContext["backingFile"] != first.Volume.VolumeContext["backingFile"] {
+		t.Errorf("expected the same volume on retry, got %s and %s", first.Volume.VolumeId, second.Volume.VolumeId)
+	}
+	// The same name with another size is a conflict
+	conflict := &csi.CreateVolumeRequest{Name: "pvc-standalone", CapacityRange: &csi.CapacityRange{RequiredBytes: 2 << 20}}
+	if _, err := cs.CreateVolume(ctx, conflict); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists for a different capacity, got %v", err)
+	}
+
+	list, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	if len(list.Entries) != 1 || list.Entries[0].Volume.VolumeId != first.Volume.VolumeId {
+		t.Fatalf("expected the created volume to be listed, got %+v", list.Entries)
+	}
+
+	got, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: first.Volume.VolumeId})
+	if err != nil {
+		t.Fatalf("ControllerGetVolume failed: %v", err)
+	}
+	if got.Volume.CapacityBytes != 1<<20 || got.Volume.VolumeContext["backingFile"] != first.Volume.VolumeContext["backingFile"] {
+		t.Errorf("expected the recorded volume, got %+v", got.Volume)
+	}
+
+	// The node created the backing file; deleting the volume removes it
+	backingFile := first.Volume.VolumeContext["backingFile"]
+	if err := os.WriteFile(backingFile, nil, 0600); err != nil {
+		t.Fatalf("failed to create backing file: %v", err)
+	}
+	if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: first.Volume.VolumeId}); err != nil {
+		t.Fatalf("DeleteVolume failed: %v", err)
+	}
+	if _, err := os.Stat(backingFile); !os.IsNotExist(err) {
+		t.Errorf("expected backing file %s removed, got %v", backingFile, err)
+	}
+	if _, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: first.Volume.VolumeId}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound after delete, got %v", err)
+	}
+	// Deleting again is not an error
+	if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: first.Volume.VolumeId}); err != nil {
+		t.Errorf("repeated DeleteVolume failed: %v", err)
+	}
+	list, err = cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil || len(list.Entries) != 0 {
+		t.Errorf("expected no volumes after delete, got %v, %v", list, err)
+	}
+	// The name is free again
+	third, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateVolume after delete failed: %v", err)
+	}
+	if third.Volume.VolumeId == first.Volume.VolumeId {
+		t.Errorf("expected a new volume after delete, got %s again", third.Volume.VolumeId)
+	}
+}
@@ -97,7 +97,7 @@ READY:
 	}
 
 	// Note: With the new topology-aware architecture, the controller no longer creates
-	// backing files. Files are only created on nodes during NodePublishVolume.
+	// backing files. Files are only created on nodes during NodeStageVolume.
 	// This test runs in controller-only mode, so we skip the volume file checks.
 	t.Skip("Controller-only mode doesn't create backing files in topology-aware architecture")
 }
@@ -174,7 +174,14 @@ READY:
 		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
 		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
 	}
-	pubReq := &csi.NodePublishVolumeRequest{VolumeId: volID, TargetPath: targetPath, VolumeCapability: capability, VolumeContext: map[string]string{"backingFile": backingFile, "size": strconv.FormatInt(1024*1024, 10)}}
+	stagingPath := filepath.Join(os.TempDir(), fmt.Sprintf("csi-staging-node-%d", time.Now().UnixNano()))
+	volumeContext := map[string]string{"backingFile": backingFile, "size": strconv.FormatInt(1024*1024, 10)}
+	stageReq := &csi.NodeStageVolumeRequest{VolumeId: volID, StagingTargetPath: stagingPath, VolumeCapability: capability, VolumeContext: volumeContext}
+	if _, err := nc.NodeStageVolume(context.Background(), stageReq); err != nil {
+		t.Fatalf("NodeStageVolume failed: %v", err)
+	}
+
+	pubReq := &csi.NodePublishVolumeRequest{VolumeId: volID, StagingTargetPath: stagingPath, TargetPath: targetPath, VolumeCapability: capability, VolumeContext: volumeContext}
 	if _, err := nc.NodePublishVolume(context.Background(), pubReq); err != nil {
 		t.Fatalf("NodePublishVolume failed: %v", err)
 	}
@@ -193,6 +200,15 @@ READY:
 			t.Fatalf("target path still mounted: %s", targetPath)
 		}
 	}
+
+	if _, err := nc.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{VolumeId: volID, StagingTargetPath: stagingPath}); err != nil {
+		t.Fatalf("NodeUnstageVolume failed: %v", err)
+	}
+	if data, err := os.ReadFile("/proc/mounts"); err == nil {
+		if indexOf(string(data), stagingPath) >= 0 {
+			t.Fatalf("staging path still mounted: %s", stagingPath)
+		}
+	}
 }
 
 func indexOf(s, sub string) int {
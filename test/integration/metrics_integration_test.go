@@ -120,7 +120,7 @@ READY:
 	}
 
 	// Note: With the new topology-aware architecture, the controller no longer creates
-	// backing files. Files are only created on nodes during NodePublishVolume.
+	// backing files. Files are only created on nodes during NodeStageVolume.
 	// This test runs in controller-only mode, so we skip the volume file checks.
 	t.Logf("✓ Metrics endpoint is accessible and working")
 	t.Skip("Controller-only mode doesn't create backing files in topology-aware architecture")